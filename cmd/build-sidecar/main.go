@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,15 +13,16 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"github.com/bradleyfalzon/ghinstallation"
 	"github.com/google/go-github/v29/github"
 	"github.com/spf13/pflag"
 	"golang.org/x/xerrors"
@@ -33,23 +35,47 @@ import (
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/agent"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/githost"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/mirror"
 )
 
 const (
 	ActionClone             = "clone"
 	ActionWait              = "wait"
 	ActionDownloadArtifacts = "download-artifacts"
+	ActionInstallAgent      = "install-agent"
+	ActionAgent             = "agent"
+	ActionMirror            = "mirror"
 
 	MainProcessContainerName = "main"
 
 	ContainerImage = "quay.io/f110/k8s-cluster-maintenance-bot-build-sidecar"
 )
 
-func actionClone(appId, installationId int64, privateKeyFile, dir, repo, commit string) error {
+func actionClone(host *githost.Host, appId, installationId int64, privateKeyFile, dir, repo, commit, mirrorURL string) error {
+	// The repositories of the other providers (e.g. Gitea) are cloned without the mirror and the credential of GitHub
+	onGitHub := false
+	if u, err := url.Parse(repo); err == nil && u.Host == host.GitHost() {
+		onGitHub = true
+	}
+
+	if mirrorURL != "" && onGitHub {
+		if err := cloneFromMirror(dir, repo, commit, mirrorURL); err != nil {
+			log.Printf("Failed to clone from the mirror. Fallback to %s: %v", repo, err)
+			if err := cleanDir(dir); err != nil {
+				return xerrors.Errorf(": %v", err)
+			}
+		} else {
+			return nil
+		}
+	}
+
 	var auth *gogitHttp.BasicAuth
 	rt := http.DefaultTransport
-	if _, err := os.Stat(privateKeyFile); !os.IsNotExist(err) {
-		t, err := ghinstallation.NewKeyFromFile(http.DefaultTransport, appId, installationId, privateKeyFile)
+	if _, err := os.Stat(privateKeyFile); onGitHub && !os.IsNotExist(err) {
+		t, err := host.NewTransport(appId, installationId, privateKeyFile)
 		if err != nil {
 			return xerrors.Errorf(": %v", err)
 		}
@@ -64,13 +90,13 @@ func actionClone(appId, installationId int64, privateKeyFile, dir, repo, commit
 	archiveDownload := false
 	u, err := url.Parse(repo)
 	if err == nil {
-		if u.Scheme == "https" && u.Hostname() == "github.com" {
+		if u.Scheme == "https" && u.Host == host.GitHost() {
 			archiveDownload = true
 		}
 	}
 
 	if commit != "" && archiveDownload {
-		return checkoutCommit(dir, repo, commit, rt)
+		return checkoutCommit(host, dir, repo, commit, rt)
 	} else {
 		return cloneByGit(dir, repo, commit, 1, auth)
 	}
@@ -103,7 +129,61 @@ func cloneByGit(dir, repo, commit string, depth int, auth transport.AuthMethod)
 	return nil
 }
 
-func checkoutCommit(dir, u, commit string, rt http.RoundTripper) error {
+func cloneFromMirror(dir, repo, commit, mirrorURL string) error {
+	owner, name, err := splitRepositoryURL(repo)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	c := mirror.NewClient(mirrorURL)
+	// The mirror is updated by the push event. The head of the mirror may be stale if the commit is not specified.
+	if commit != "" {
+		log.Printf("Clone from %s", c.RepositoryURL(owner, name))
+		err := cloneByGit(dir, c.RepositoryURL(owner, name), commit, 0, nil)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Update the mirror because %s may not be fetched yet: %v", commit, err)
+		if err := cleanDir(dir); err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+	}
+	if err := c.Update(owner, name); err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	log.Printf("Clone from %s", c.RepositoryURL(owner, name))
+	return cloneByGit(dir, c.RepositoryURL(owner, name), commit, 0, nil)
+}
+
+func cleanDir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	for _, v := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, v.Name())); err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+	}
+
+	return nil
+}
+
+func splitRepositoryURL(u string) (string, string, error) {
+	parsed, err := url.Parse(strings.TrimSuffix(u, ".git"))
+	if err != nil {
+		return "", "", xerrors.Errorf(": %v", err)
+	}
+	s := strings.SplitN(strings.TrimPrefix(parsed.Path, "/"), "/", 2)
+	if len(s) != 2 {
+		return "", "", xerrors.Errorf("invalid repository url: %s", u)
+	}
+
+	return s[0], s[1], nil
+}
+
+func checkoutCommit(host *githost.Host, dir, u, commit string, rt http.RoundTripper) error {
 	addr := u
 	if strings.HasSuffix(u, ".git") {
 		addr = strings.TrimSuffix(u, ".git")
@@ -114,7 +194,7 @@ func checkoutCommit(dir, u, commit string, rt http.RoundTripper) error {
 	}
 	s := strings.SplitN(parsed.Path, "/", 3)
 
-	ghClient := github.NewClient(&http.Client{Transport: rt})
+	ghClient := host.NewClient(&http.Client{Transport: rt})
 	archiveLink, _, _ := ghClient.Repositories.GetArchiveLink(
 		context.Background(),
 		s[1], // owner
@@ -180,7 +260,7 @@ func checkoutCommit(dir, u, commit string, rt http.RoundTripper) error {
 	return nil
 }
 
-func actionWait(artifactHost, artifactBucket, artifactPath string) error {
+func actionWait(artifactHost, artifactBucket string, artifactPaths []string) error {
 	conf, err := rest.InClusterConfig()
 	if err != nil {
 		return xerrors.Errorf(": %v", err)
@@ -189,110 +269,287 @@ func actionWait(artifactHost, artifactBucket, artifactPath string) error {
 	if err != nil {
 		return xerrors.Errorf(": %v", err)
 	}
+	for {
+		finished, err := watchMainContainer(client)
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		if finished {
+			break
+		}
+		// The builder of the pool may be idle longer than the timeout of the watch
+		log.Print("Watch the pod again")
+	}
+
+	if len(artifactPaths) > 0 {
+		return uploadArtifact(artifactHost, artifactBucket, artifactPaths, fmt.Sprintf("%s-%s.tar", os.Getenv("JOB_NAME"), os.Getenv("JOB_ID")))
+	}
+
+	pod, err := client.CoreV1().Pods(os.Getenv("POD_NAMESPACE")).Get(os.Getenv("POD_NAME"), metav1.GetOptions{})
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	// The job is handed to the builder of the pool after the pod is started. The artifact is taken from the annotations.
+	if p := pod.Annotations[agent.AnnotationArtifactPath]; p != "" {
+		return uploadArtifact(artifactHost, artifactBucket, []string{p}, pod.Annotations[agent.AnnotationArtifactKey])
+	}
+
+	stillRunning := false
+	for _, v := range pod.Status.ContainerStatuses {
+		if v.Name == "main" {
+			continue
+		}
+		if strings.HasPrefix(v.Image, ContainerImage) {
+			continue
+		}
+
+		if v.State.Running != nil {
+			stillRunning = true
+		}
+	}
+	if stillRunning {
+		log.Print("Force shutdown")
+		if err := client.CoreV1().Pods(os.Getenv("POD_NAMESPACE")).Delete(os.Getenv("POD_NAME"), &metav1.DeleteOptions{}); err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+	}
+
+	return nil
+}
+
+// watchMainContainer returns true when the main container is completed. It returns false if the watch is closed.
+func watchMainContainer(client *kubernetes.Clientset) (bool, error) {
 	w, err := client.CoreV1().Pods(os.Getenv("POD_NAMESPACE")).Watch(metav1.ListOptions{
 		FieldSelector: fmt.Sprintf("metadata.name=%s", os.Getenv("POD_NAME")),
 	})
 	if err != nil {
-		return xerrors.Errorf(": %v", err)
+		return false, xerrors.Errorf(": %v", err)
 	}
-Watch:
+	defer w.Stop()
+
 	for e := range w.ResultChan() {
 		switch e.Type {
-		case watch.Modified:
+		case watch.Added, watch.Modified:
 			pod, ok := e.Object.(*corev1.Pod)
 			if !ok {
-				return xerrors.New("failure type assert to corev1.Pod")
+				return false, xerrors.New("failure type assert to corev1.Pod")
 			}
 
 			for _, v := range pod.Status.ContainerStatuses {
 				if v.Name != MainProcessContainerName {
 					continue
 				}
-
-				if v.Ready == true {
-					continue
-				}
 				if v.State.Terminated == nil {
 					continue
 				}
 				if v.State.Terminated.Reason != "Completed" {
-					return xerrors.Errorf("main container is terminated by unexpected reason: %s", v.State.Terminated.Reason)
+					return false, xerrors.Errorf("main container is terminated by unexpected reason: %s", v.State.Terminated.Reason)
 				}
 
-				break Watch
+				return true, nil
 			}
+		case watch.Deleted:
+			return false, xerrors.New("the pod is deleted")
 		case watch.Error:
-			return nil
+			return false, nil
 		}
 	}
-	w.Stop()
 
-	if artifactPath != "" {
-		cfg := &aws.Config{
-			Endpoint:         aws.String(artifactHost),
-			Region:           aws.String("us-east-1"),
-			DisableSSL:       aws.Bool(true),
-			S3ForcePathStyle: aws.Bool(true),
-			Credentials:      credentials.NewEnvCredentials(),
+	return false, nil
+}
+
+// uploadArtifact uploads the files as a tar archive. The directories are ignored.
+func uploadArtifact(artifactHost, artifactBucket string, artifactPaths []string, key string) error {
+	cfg := &aws.Config{
+		Endpoint:         aws.String(artifactHost),
+		Region:           aws.String("us-east-1"),
+		DisableSSL:       aws.Bool(true),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewEnvCredentials(),
+	}
+	sess := session.Must(session.NewSession(cfg))
+	s3Client := s3manager.NewUploaderWithClient(s3.New(sess))
+
+	// The artifacts are archived by the file name. The artifact which has the same name would overwrite the other.
+	names := make(map[string]string)
+	for _, v := range artifactPaths {
+		if other, ok := names[filepath.Base(v)]; ok {
+			return xerrors.Errorf("%s and %s have the same file name", other, v)
 		}
-		sess := session.Must(session.NewSession(cfg))
-		s3Client := s3manager.NewUploaderWithClient(s3.New(sess))
+		names[filepath.Base(v)] = v
+	}
 
-		buf := new(bytes.Buffer)
-		if s, err := os.Stat(artifactPath); os.IsNotExist(err) {
+	buf := new(bytes.Buffer)
+	t := tar.NewWriter(buf)
+	for _, artifactPath := range artifactPaths {
+		s, err := os.Stat(artifactPath)
+		if os.IsNotExist(err) {
 			return xerrors.Errorf(": %v", err)
-		} else if !s.IsDir() {
-			t := tar.NewWriter(buf)
-			hdr := &tar.Header{
-				Name: fmt.Sprintf("./%s", filepath.Base(artifactPath)),
-				Mode: 0644,
-				Size: s.Size(),
-			}
-			if err := t.WriteHeader(hdr); err != nil {
-				return xerrors.Errorf(": %v", err)
-			}
-			f, err := ioutil.ReadFile(artifactPath)
-			if err != nil {
-				return xerrors.Errorf(": %v", err)
-			}
-			if _, err := t.Write(f); err != nil {
-				return xerrors.Errorf(": %v", err)
-			}
-			if err := t.Close(); err != nil {
-				return xerrors.Errorf(": %v", err)
-			}
 		}
-		_, err = s3Client.Upload(&s3manager.UploadInput{
-			Bucket: aws.String(artifactBucket),
-			Key:    aws.String(fmt.Sprintf("%s-%s.tar", os.Getenv("JOB_NAME"), os.Getenv("JOB_ID"))),
-			Body:   buf,
-		})
-
-		return err
+		if s.IsDir() {
+			continue
+		}
+		hdr := &tar.Header{
+			Name: fmt.Sprintf("./%s", filepath.Base(artifactPath)),
+			Mode: 0644,
+			Size: s.Size(),
+		}
+		if err := t.WriteHeader(hdr); err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		f, err := ioutil.ReadFile(artifactPath)
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		if _, err := t.Write(f); err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+	}
+	if err := t.Close(); err != nil {
+		return xerrors.Errorf(": %v", err)
 	}
+	_, err := s3Client.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(artifactBucket),
+		Key:    aws.String(key),
+		Body:   buf,
+	})
 
-	pod, err := client.CoreV1().Pods(os.Getenv("POD_NAMESPACE")).Get(os.Getenv("POD_NAME"), metav1.GetOptions{})
+	return err
+}
+
+func actionInstallAgent(agentDir string) error {
+	self, err := os.Executable()
 	if err != nil {
 		return xerrors.Errorf(": %v", err)
 	}
-	stillRunning := false
-	for _, v := range pod.Status.ContainerStatuses {
-		if v.Name == "main" {
-			continue
+	b, err := ioutil.ReadFile(self)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(agentDir, filepath.Base(self)), b, 0755); err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	return nil
+}
+
+// actionAgent waits for a job from the bot and runs it.
+// The agent accepts only one job which has the token of the builder. After the job finishes, the agent exits with the result of the job.
+// The artifact is uploaded by the uploader container because the agent runs the code of the repository.
+func actionAgent(host *githost.Host, dir string) error {
+	token := os.Getenv(agent.TokenEnv)
+	if token == "" {
+		return xerrors.Errorf("%s is not set", agent.TokenEnv)
+	}
+
+	var accepted int32
+	done := make(chan error, 1)
+
+	m := http.NewServeMux()
+	m.HandleFunc(agent.HealthPath, func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	m.HandleFunc(agent.RunPath, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
 		}
-		if strings.HasPrefix(v.Image, ContainerImage) {
-			continue
+		if !agent.Authorized(req, token) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		job := &agent.Job{}
+		if err := json.NewDecoder(req.Body).Decode(job); err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !atomic.CompareAndSwapInt32(&accepted, 0, 1) {
+			w.WriteHeader(http.StatusConflict)
+			return
 		}
 
-		if v.State.Running != nil {
-			stillRunning = true
+		log.Printf("Accept job: %s-%s", job.JobName, job.JobId)
+		w.WriteHeader(http.StatusAccepted)
+		go func() {
+			done <- runJob(host, dir, job)
+		}()
+	})
+
+	s := &http.Server{Addr: fmt.Sprintf(":%d", agent.Port), Handler: m}
+	go func() {
+		if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			done <- xerrors.Errorf(": %v", err)
 		}
+	}()
+
+	err := <-done
+	if err := s.Shutdown(context.Background()); err != nil {
+		log.Print(err)
 	}
-	if stillRunning {
-		log.Print("Force shutdown")
-		if err := client.CoreV1().Pods(os.Getenv("POD_NAMESPACE")).Delete(os.Getenv("POD_NAME"), &metav1.DeleteOptions{}); err != nil {
+
+	return err
+}
+
+func runJob(host *githost.Host, dir string, job *agent.Job) error {
+	// The job is built at the commit of the event. The default branch may be already changed.
+	if job.Commit == "" {
+		return xerrors.New("the job doesn't have the commit")
+	}
+	if err := actionClone(host, 0, 0, "", dir, job.URL, job.Commit, job.MirrorURL); err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	cmd := exec.Command("bazel", "--output_user_root=/out", "run", job.Target)
+	cmd.Dir = dir
+	cmd.Env = jobEnv(os.Environ())
+	for _, v := range job.Env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", v.Name, v.Value))
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	return nil
+}
+
+// jobEnv returns the environment variables except the credentials which the code of the repository must not read.
+func jobEnv(environ []string) []string {
+	env := make([]string, 0, len(environ))
+	for _, v := range environ {
+		name := strings.SplitN(v, "=", 2)[0]
+		switch {
+		case name == agent.TokenEnv, strings.HasPrefix(name, "AWS_"):
+			continue
+		}
+		env = append(env, v)
+	}
+
+	return env
+}
+
+func actionMirror(host *githost.Host, appId, installationId int64, privateKeyFile, dir, listen string, allowRepositories []string) error {
+	var auth mirror.AuthFunc
+	if _, err := os.Stat(privateKeyFile); !os.IsNotExist(err) {
+		t, err := host.NewTransport(appId, installationId, privateKeyFile)
+		if err != nil {
 			return xerrors.Errorf(": %v", err)
 		}
+		auth = func() (transport.AuthMethod, error) {
+			token, err := t.Token(context.Background())
+			if err != nil {
+				return nil, xerrors.Errorf(": %v", err)
+			}
+			return &gogitHttp.BasicAuth{Username: "octocat", Password: token}, nil
+		}
+	}
+
+	s := mirror.NewServer(listen, dir, host.CloneURLFormat(), allowRepositories, auth)
+	log.Printf("Listen: %s", listen)
+	if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return xerrors.Errorf(": %v", err)
 	}
 
 	return nil
@@ -358,7 +615,14 @@ func buildSidecar(args []string) error {
 	workingDir := ""
 	artifactHost := ""
 	artifactBucket := ""
-	artifactPath := ""
+	artifactPaths := make([]string, 0)
+	agentDir := ""
+	mirrorURL := ""
+	listen := ":8080"
+	allowRepositories := make([]string, 0)
+	apiURL := ""
+	uploadURL := ""
+	gitHost := ""
 	fs := pflag.NewFlagSet("build-sidecar", pflag.ContinueOnError)
 	fs.StringVarP(&action, "action", "a", action, "Action")
 	fs.StringVarP(&workingDir, "work-dir", "w", workingDir, "Working directory")
@@ -369,18 +633,38 @@ func buildSidecar(args []string) error {
 	fs.StringVarP(&commit, "commit", "b", "", "Specify commit")
 	fs.StringVar(&artifactHost, "artifact-host", artifactHost, "Artifact storage endpoint")
 	fs.StringVar(&artifactBucket, "artifact-bucket", artifactBucket, "Artifact storage bucket name")
-	fs.StringVar(&artifactPath, "artifact-path", artifactPath, "File path for storing")
+	fs.StringSliceVar(&artifactPaths, "artifact-path", artifactPaths, "File path for storing. download-artifacts uses the first path as the directory")
+	fs.StringVar(&agentDir, "agent-dir", agentDir, "Directory for installing the agent")
+	fs.StringVar(&mirrorURL, "mirror-url", mirrorURL, "URL of git mirror (e.g. http://git-mirror:8080)")
+	fs.StringVar(&listen, "listen", listen, "Listen address of git mirror")
+	fs.StringSliceVar(&allowRepositories, "allow-repository", allowRepositories, "Repository which is allowed to mirror (e.g. octocat/example)")
+	fs.StringVar(&apiURL, "github-api-url", apiURL, "Base URL of the API of GitHub Enterprise Server (e.g. https://github.example.com/api/v3/)")
+	fs.StringVar(&uploadURL, "github-upload-url", uploadURL, "Upload URL of GitHub Enterprise Server")
+	fs.StringVar(&gitHost, "git-host", gitHost, "Host of git (e.g. github.example.com)")
 	if err := fs.Parse(args); err != nil {
 		return xerrors.Errorf(": %v", err)
 	}
+	host, err := githost.New(apiURL, uploadURL, gitHost)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
 
 	switch action {
 	case ActionClone:
-		return actionClone(appId, installationId, privateKeyFile, workingDir, repo, commit)
+		return actionClone(host, appId, installationId, privateKeyFile, workingDir, repo, commit, mirrorURL)
 	case ActionWait:
-		return actionWait(artifactHost, artifactBucket, artifactPath)
+		return actionWait(artifactHost, artifactBucket, artifactPaths)
 	case ActionDownloadArtifacts:
-		return actionDownloadArtifacts(artifactHost, artifactBucket, artifactPath)
+		if len(artifactPaths) == 0 {
+			return xerrors.New("--artifact-path is required")
+		}
+		return actionDownloadArtifacts(artifactHost, artifactBucket, artifactPaths[0])
+	case ActionInstallAgent:
+		return actionInstallAgent(agentDir)
+	case ActionAgent:
+		return actionAgent(host, workingDir)
+	case ActionMirror:
+		return actionMirror(host, appId, installationId, privateKeyFile, workingDir, listen, allowRepositories)
 	default:
 		return xerrors.Errorf("unknown action: %v", action)
 	}
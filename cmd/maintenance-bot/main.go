@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"net/http"
 	"os"
 
 	"github.com/spf13/pflag"
@@ -30,26 +29,64 @@ func producer(args []string) error {
 		return xerrors.Errorf(": %v", err)
 	}
 
-	webhookListener := webhook.NewListener(conf)
+	eventSource, err := webhook.NewEventSource(conf)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	if conf.GitMirrorURL != "" {
+		gitMirror := consumer.NewGitMirrorConsumer(conf)
+		eventSource.SubscribePushEvent(gitMirror.Dispatch)
+	}
 
 	builder, err := consumer.NewBuildConsumer(conf.BuildNamespace, conf, debug)
 	if err != nil {
 		return xerrors.Errorf(": %v", err)
 	}
-	webhookListener.SubscribePushEvent(builder.Build)
+	if err := builder.FillPool(); err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	eventSource.SubscribePushEvent(builder.Build)
+	eventSource.SubscribePullRequest(builder.Promote)
+	eventSource.SubscribeIssueComment(builder.Promote)
+	eventSource.SubscribeIssueComment(builder.RollbackCommand)
+	if err := builder.ResumePromotions(); err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
 
 	dnsControlBuilder, err := consumer.NewDNSControlConsumer(conf.BuildNamespace, conf, conf.SafeMode, debug)
 	if err != nil {
 		return xerrors.Errorf(": %v", err)
 	}
-	webhookListener.SubscribePushEvent(dnsControlBuilder.Dispatch)
-	webhookListener.SubscribePullRequest(dnsControlBuilder.Dispatch)
+	eventSource.SubscribePushEvent(dnsControlBuilder.Dispatch)
+	eventSource.SubscribePullRequest(dnsControlBuilder.Dispatch)
 
-	if err := webhookListener.ListenAndServe(); err != nil {
-		if err == http.ErrServerClosed {
-			return nil
+	autoMerge, err := consumer.NewAutoMergeConsumer(conf)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	eventSource.SubscribeCheckSuite(autoMerge.Dispatch)
+	eventSource.SubscribeStatus(autoMerge.Dispatch)
+	if err := autoMerge.ResumeSchedules(); err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	if conf.ImageAutomation != nil {
+		imageWatcher, err := consumer.NewImageWatcher(conf.BuildNamespace, conf)
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
 		}
+		go imageWatcher.Run()
+	}
 
+	reaper := consumer.NewReaper(conf.BuildNamespace, conf, builder, dnsControlBuilder)
+	if err := reaper.Run(); err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	// The reconciler starts after the reaper so that the resumed jobs are not started again
+	go consumer.NewReconciler(conf, builder, dnsControlBuilder).Run()
+
+	if err := eventSource.Run(); err != nil {
 		return xerrors.Errorf(": %v", err)
 	}
 
@@ -57,7 +94,13 @@ func producer(args []string) error {
 }
 
 func main() {
-	if err := producer(os.Args); err != nil {
+	var err error
+	if len(os.Args) > 1 && os.Args[1] == "rollback" {
+		err = rollback(os.Args[2:])
+	} else {
+		err = producer(os.Args)
+	}
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/xerrors"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/consumer"
+)
+
+// rollback opens the pull request which restores the image in the manifest repository to the image deployed before.
+// Usage: maintenance-bot rollback --repo <manifest repo> --image <name> [--to <digest|build id>]
+func rollback(args []string) error {
+	confFile := ""
+	repo := ""
+	image := ""
+	environment := ""
+	to := ""
+	autoMerge := false
+	fs := pflag.NewFlagSet("rollback", pflag.ContinueOnError)
+	fs.StringVarP(&confFile, "conf", "c", confFile, "Config file")
+	fs.StringVar(&repo, "repo", repo, "Manifest repository (e.g. f110/k8s-manifests)")
+	fs.StringVar(&image, "image", image, "Name of the image which is built")
+	fs.StringVar(&environment, "environment", environment, "Name of the environment. The first environment of the repository is used by default")
+	fs.StringVar(&to, "to", to, "Digest or build id to roll back to. The image deployed before the current one is used by default")
+	fs.BoolVar(&autoMerge, "auto-merge", autoMerge, "Merge the pull request automatically when all checks are passed")
+	if err := fs.Parse(args); err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	if repo == "" || image == "" {
+		return xerrors.New("--repo and --image are required")
+	}
+
+	conf, err := config.ReadConfig(confFile)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	builder, err := consumer.NewBuildConsumer(conf.BuildNamespace, conf, false)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	pr, err := builder.Rollback(repo, image, environment, to, autoMerge)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	if pr == nil {
+		log.Printf("%s already has the image", repo)
+		return nil
+	}
+	log.Printf("Opened %s", pr.GetHTMLURL())
+
+	return nil
+}
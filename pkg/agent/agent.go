@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	Port       = 8080
+	RunPath    = "/run"
+	HealthPath = "/healthz"
+
+	// TokenEnv is the environment variable which has the token of the agent.
+	// The token is generated for each builder and the agent accepts only the job which has the token.
+	TokenEnv = "AGENT_TOKEN"
+
+	// AnnotationArtifactPath and AnnotationArtifactKey are set to the builder when the job is handed.
+	// The uploader of the builder uploads the artifact after the job because the agent doesn't have the credential of the storage.
+	AnnotationArtifactPath = "k8s-cluster-maintenance-bot.f110.dev/artifact-path"
+	AnnotationArtifactKey  = "k8s-cluster-maintenance-bot.f110.dev/artifact-key"
+)
+
+// Job is a build request which is handed to an idle builder in the pool.
+// The agent runs exactly one job and exits with the result of the job.
+type Job struct {
+	URL string `json:"url"`
+	// Commit is checked out before running the target. Commit is mandatory.
+	Commit    string   `json:"commit"`
+	MirrorURL string   `json:"mirror_url,omitempty"`
+	Target    string   `json:"target"`
+	Env       []EnvVar `json:"env,omitempty"`
+	JobName   string   `json:"job_name"`
+	JobId     string   `json:"job_id"`
+}
+
+type EnvVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Dispatch hands the job to the agent. token is the token of the builder.
+func Dispatch(host, token string, job *Job) error {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	u := fmt.Sprintf("http://%s%s", net.JoinHostPort(host, strconv.Itoa(Port)), RunPath)
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusAccepted {
+		return xerrors.Errorf("agent returns unexpected status: %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// Authorized reports whether the request has the token. The empty token never authorizes the request.
+func Authorized(req *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
@@ -0,0 +1,26 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorized(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, RunPath, nil)
+	if Authorized(req, "token") {
+		t.Error("Expect not to authorize the request without the token")
+	}
+	req.Header.Set("Authorization", "Bearer other")
+	if Authorized(req, "token") {
+		t.Error("Expect not to authorize the request which has the other token")
+	}
+	req.Header.Set("Authorization", "Bearer ")
+	if Authorized(req, "") {
+		t.Error("Expect not to authorize any request if the token is empty")
+	}
+	req.Header.Set("Authorization", "Bearer token")
+	if !Authorized(req, "token") {
+		t.Error("Expect to authorize the request")
+	}
+}
@@ -3,30 +3,106 @@ package config
 import (
 	"io/ioutil"
 	"os"
+	"path"
+	"strings"
+	"time"
 
 	"golang.org/x/xerrors"
 	corev1 "k8s.io/api/core/v1"
 	"sigs.k8s.io/yaml"
 )
 
+const (
+	BuildModePod  = "pod"
+	BuildModePool = "pool"
+	BuildModeJob  = "job"
+
+	PromotionImmediate = "immediate"
+	PromotionMerged    = "merged"
+	PromotionSoak      = "soak"
+	PromotionCommand   = "command"
+
+	EventSourceWebhook = "webhook"
+	EventSourcePolling = "polling"
+
+	// DefaultBranch is the keyword of the branch which means the default branch of the repository.
+	DefaultBranch = "$default"
+
+	defaultOrphanGracePeriod       = 1 * time.Hour
+	defaultImageAutomationInterval = 5 * time.Minute
+	defaultReconcileInterval       = 10 * time.Minute
+	defaultPollingInterval         = 1 * time.Minute
+)
+
 type Config struct {
-	WebhookListener         string      `json:"webhook_listener"`
-	BuildNamespace          string      `json:"build_namespace"`
-	GitHubTokenFile         string      `json:"github_token_file"`
-	GitHubAppId             int64       `json:"app_id"`
-	GitHubInstallationId    int64       `json:"installation_id"`
-	GitHubAppPrivateKeyFile string      `json:"app_private_key_file"`
-	PrivateKeySecretName    string      `json:"private_key_secret_name"`
-	StorageHost             string      `json:"storage_host"`
-	StorageTokenSecretName  string      `json:"storage_token_secret_name"`
-	ArtifactBucket          string      `json:"artifact_bucket"`
-	HostAliases             []HostAlias `json:"host_aliases"`
-	CommitAuthor            string      `json:"commit_author"`
-	CommitEmail             string      `json:"commit_email"`
-	AllowRepositories       []string    `json:"allow_repositories"`
-	SafeMode                bool        `json:"safe_mode"`
-
-	GitHubToken string `json:"-"`
+	// EventSource is the source of the events. webhook (default) or polling.
+	// polling is used when the bot can't expose the endpoint of the webhook.
+	EventSource             string `json:"event_source"`
+	PollingInterval         string `json:"polling_interval"`
+	WebhookListener         string `json:"webhook_listener"`
+	BuildNamespace          string `json:"build_namespace"`
+	GitHubTokenFile         string `json:"github_token_file"`
+	GitHubAppId             int64  `json:"app_id"`
+	GitHubInstallationId    int64  `json:"installation_id"`
+	GitHubAppPrivateKeyFile string `json:"app_private_key_file"`
+	// GitHubAPIURL, GitHubUploadURL and GitHost are the endpoints of GitHub Enterprise Server.
+	// If GitHubAPIURL is empty, github.com is used. (e.g. https://github.example.com/api/v3/)
+	// GitHubUploadURL and GitHost are derived from GitHubAPIURL if they are empty.
+	GitHubAPIURL           string      `json:"github_api_url"`
+	GitHubUploadURL        string      `json:"github_upload_url"`
+	GitHost                string      `json:"git_host"`
+	PrivateKeySecretName   string      `json:"private_key_secret_name"`
+	StorageHost            string      `json:"storage_host"`
+	StorageTokenSecretName string      `json:"storage_token_secret_name"`
+	ArtifactBucket         string      `json:"artifact_bucket"`
+	HostAliases            []HostAlias `json:"host_aliases"`
+	CommitAuthor           string      `json:"commit_author"`
+	CommitEmail            string      `json:"commit_email"`
+	// CommitSigningKeySecretName is the name of the secret which has the OpenPGP key to sign the commits of the bot.
+	// The email of the key should be the same as CommitEmail.
+	CommitSigningKeySecretName string `json:"commit_signing_key_secret_name"`
+	// AllowRepositories are the names of the repositories which the bot handles (e.g. infra/dns).
+	// The repository of Gitea or GitLab has the prefix of the provider (e.g. gitea:infra/dns, gitlab:infra/dns).
+	AllowRepositories          []string    `json:"allow_repositories"`
+	SafeMode                   bool        `json:"safe_mode"`
+	BuildMode                  string      `json:"build_mode"`
+	BuilderPool                *PoolConfig `json:"builder_pool"`
+	GitMirrorURL               string      `json:"git_mirror_url"`
+	JobTTLSecondsAfterFinished *int32      `json:"job_ttl_seconds_after_finished"`
+	OrphanGracePeriod          string      `json:"orphan_grace_period"`
+	PodTemplateFile            string      `json:"pod_template_file"`
+	PodTemplateConfigMap       string      `json:"pod_template_config_map"`
+	BuildLogBaseURL            string      `json:"build_log_base_url"`
+	// StoragePublicHost is the endpoint of the storage which is reachable from the users (e.g. https://s3.example.com).
+	// The build log is linked by the url which is presigned against it if BuildLogBaseURL is empty.
+	StoragePublicHost string `json:"storage_public_host"`
+	// InsecureRegistries are the registries which are accessed via plain HTTP
+	InsecureRegistries []string         `json:"insecure_registries"`
+	ImageAutomation    *ImageAutomation `json:"image_automation"`
+	// ReconcileInterval is the interval of finding the pushes and the pull requests which are not processed. The default is 10m.
+	ReconcileInterval string `json:"reconcile_interval"`
+	// Gitea and GitLab are the self-hosted providers. The repositories of them are cloned without credentials.
+	Gitea  *ProviderConfig `json:"gitea"`
+	GitLab *ProviderConfig `json:"gitlab"`
+
+	GitHubToken               string                  `json:"-"`
+	OrphanGracePeriodDuration time.Duration           `json:"-"`
+	ReconcileIntervalDuration time.Duration           `json:"-"`
+	PollingIntervalDuration   time.Duration           `json:"-"`
+	PodTemplate               *corev1.PodTemplateSpec `json:"-"`
+}
+
+// ProviderConfig is the endpoint of Gitea or GitLab.
+type ProviderConfig struct {
+	// URL is the URL of the web page. (e.g. https://gitea.example.com)
+	URL string `json:"url"`
+	// TokenFile has the access token of the API.
+	TokenFile string `json:"token_file"`
+	// WebhookSecretFile has the secret of the webhook. It is mandatory because the payload decides what is built.
+	WebhookSecretFile string `json:"webhook_secret_file"`
+
+	Token         string `json:"-"`
+	WebhookSecret string `json:"-"`
 }
 
 type HostAlias struct {
@@ -34,6 +110,23 @@ type HostAlias struct {
 	IP        string   `json:"ip"`
 }
 
+// ImageAutomation is the configuration of the image watcher.
+// The policy of each image is written in the rule file of the manifest repository.
+type ImageAutomation struct {
+	// Repositories are the manifest repositories. (e.g. f110/k8s-cluster)
+	Repositories []string `json:"repositories"`
+	// Interval is the interval of polling the registries. The default is 5m.
+	Interval string `json:"interval"`
+
+	IntervalDuration time.Duration `json:"-"`
+}
+
+type PoolConfig struct {
+	MinIdle      int    `json:"min_idle"`
+	MaxSize      int    `json:"max_size"`
+	BazelVersion string `json:"bazel_version"`
+}
+
 func ReadConfig(p string) (*Config, error) {
 	b, err := ioutil.ReadFile(p)
 	if err != nil {
@@ -50,6 +143,78 @@ func ReadConfig(p string) (*Config, error) {
 	if conf.BuildNamespace == "" {
 		return nil, xerrors.New("config: build namespace is mandatory")
 	}
+	switch conf.BuildMode {
+	case "":
+		conf.BuildMode = BuildModePod
+	case BuildModePod, BuildModeJob:
+	case BuildModePool:
+		if conf.BuilderPool == nil {
+			return nil, xerrors.New("config: builder_pool is mandatory when build_mode is pool")
+		}
+		if conf.BuilderPool.MinIdle < 1 {
+			conf.BuilderPool.MinIdle = 1
+		}
+		if conf.BuilderPool.MaxSize < conf.BuilderPool.MinIdle {
+			return nil, xerrors.New("config: builder_pool.max_size must be greater than or equal to min_idle")
+		}
+	default:
+		return nil, xerrors.Errorf("config: unknown build mode: %s", conf.BuildMode)
+	}
+	switch conf.EventSource {
+	case "":
+		conf.EventSource = EventSourceWebhook
+	case EventSourceWebhook, EventSourcePolling:
+	default:
+		return nil, xerrors.Errorf("config: unknown event source: %s", conf.EventSource)
+	}
+	conf.PollingIntervalDuration = defaultPollingInterval
+	if conf.PollingInterval != "" {
+		d, err := time.ParseDuration(conf.PollingInterval)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		conf.PollingIntervalDuration = d
+	}
+	conf.OrphanGracePeriodDuration = defaultOrphanGracePeriod
+	if conf.OrphanGracePeriod != "" {
+		d, err := time.ParseDuration(conf.OrphanGracePeriod)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		conf.OrphanGracePeriodDuration = d
+	}
+	conf.ReconcileIntervalDuration = defaultReconcileInterval
+	if conf.ReconcileInterval != "" {
+		d, err := time.ParseDuration(conf.ReconcileInterval)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		conf.ReconcileIntervalDuration = d
+	}
+	if conf.PodTemplateFile != "" && conf.PodTemplateConfigMap != "" {
+		return nil, xerrors.New("config: pod_template_file and pod_template_config_map are exclusive")
+	}
+	if conf.PodTemplateFile != "" {
+		b, err := ioutil.ReadFile(conf.PodTemplateFile)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		t, err := ParsePodTemplate(b)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		conf.PodTemplate = t
+	}
+	if conf.ImageAutomation != nil {
+		conf.ImageAutomation.IntervalDuration = defaultImageAutomationInterval
+		if conf.ImageAutomation.Interval != "" {
+			d, err := time.ParseDuration(conf.ImageAutomation.Interval)
+			if err != nil {
+				return nil, xerrors.Errorf(": %v", err)
+			}
+			conf.ImageAutomation.IntervalDuration = d
+		}
+	}
 	if conf.GitHubTokenFile != "" {
 		b, err := ioutil.ReadFile(conf.GitHubTokenFile)
 		if err != nil {
@@ -57,11 +222,76 @@ func ReadConfig(p string) (*Config, error) {
 		}
 		conf.GitHubToken = string(b)
 	}
+	for _, v := range []*ProviderConfig{conf.Gitea, conf.GitLab} {
+		if err := readProviderConfig(v); err != nil {
+			return nil, err
+		}
+	}
 
 	return conf, nil
 }
 
+func readProviderConfig(p *ProviderConfig) error {
+	if p == nil {
+		return nil
+	}
+	if p.URL == "" {
+		return xerrors.New("config: url of the provider is mandatory")
+	}
+	if p.TokenFile != "" {
+		b, err := ioutil.ReadFile(p.TokenFile)
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		p.Token = strings.TrimSpace(string(b))
+	}
+	if p.WebhookSecretFile == "" {
+		return xerrors.New("config: webhook_secret_file of the provider is mandatory")
+	}
+	b, err := ioutil.ReadFile(p.WebhookSecretFile)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	p.WebhookSecret = strings.TrimSpace(string(b))
+	if p.WebhookSecret == "" {
+		return xerrors.Errorf("config: %s is empty", p.WebhookSecretFile)
+	}
+
+	return nil
+}
+
+// GitHubRepositories returns the repositories of GitHub in AllowRepositories.
+func (c *Config) GitHubRepositories() []string {
+	repos := make([]string, 0, len(c.AllowRepositories))
+	for _, v := range c.AllowRepositories {
+		if strings.Contains(v, ":") {
+			continue
+		}
+		repos = append(repos, v)
+	}
+
+	return repos
+}
+
+// ParsePodTemplate parses the base PodTemplateSpec which is supplied by the operator.
+func ParsePodTemplate(b []byte) (*corev1.PodTemplateSpec, error) {
+	t := &corev1.PodTemplateSpec{}
+	if err := yaml.Unmarshal(b, t); err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	return t, nil
+}
+
 type BuildRule struct {
+	// Name identifies the rule when the repository has multiple rules. Name is mandatory in that case.
+	Name string `json:"name"`
+	// Paths are the globs of the files which trigger the build. (e.g. app/**) The default is all files.
+	Paths []string `json:"paths"`
+	// IgnorePaths are the globs of the files which don't trigger the build even if the file matches Paths.
+	IgnorePaths []string `json:"ignore_paths"`
+	// Branch is the branch to build. All branches are built if empty.
+	// $default is the default branch of the repository.
 	Branch                 string       `json:"branch"`
 	Private                bool         `json:"private"`
 	BazelVersion           string       `json:"bazel_version"`
@@ -70,12 +300,116 @@ type BuildRule struct {
 	Artifacts              []string     `json:"artifacts"`
 	Env                    []Env        `json:"env"`
 	PostProcess            *PostProcess `json:"post_process"`
+	BackoffLimit           *int32       `json:"backoff_limit"`
+	ActiveDeadlineSeconds  *int64       `json:"active_deadline_seconds"`
+	// Release is the rule of the build when a tag is pushed. If Release is nil, the tags are not built.
+	Release *Release `json:"release"`
+}
+
+// Release builds the tag and publishes the artifacts as the assets of GitHub Release.
+// The tag is passed to the build as the stamp variable BUILD_EMBED_LABEL.
+type Release struct {
+	// Target is the target to run. The default is the target of the rule.
+	Target string `json:"target"`
+	// Artifacts are uploaded as the assets of the release. The default is the artifacts of the rule.
+	Artifacts []string `json:"artifacts"`
+	// Draft creates the release as a draft.
+	Draft bool `json:"draft"`
+	// Prerelease marks the release as a pre-release. The tag which has a pre-release version (e.g. v1.0.0-rc.1) is always a pre-release.
+	Prerelease bool `json:"prerelease"`
 }
 
 type PostProcess struct {
 	Repo  string   `json:"repo"`
 	Image string   `json:"image"`
 	Paths []string `json:"paths"`
+	// NewName replaces the name of the image if not empty
+	NewName string `json:"new_name"`
+	// Tag is the tag of the image which is pushed by the build.
+	// If Tag is not empty, the digest of the image is resolved from the registry instead of reading the artifact.
+	Tag string `json:"tag"`
+	// BaseBranch is the base branch of the pull request. The default is the default branch of the repository.
+	BaseBranch    string         `json:"base_branch"`
+	Targets       []UpdateTarget `json:"targets"`
+	Labels        []string       `json:"labels"`
+	Reviewers     []string       `json:"reviewers"`
+	TeamReviewers []string       `json:"team_reviewers"`
+	Assignees     []string       `json:"assignees"`
+	AutoMerge     *AutoMerge     `json:"auto_merge"`
+	// Environments is the ordered list of the environments which the image is promoted to.
+	// If Environments is not empty, Repo, Paths and Targets of PostProcess are ignored.
+	Environments []*Environment `json:"environments"`
+}
+
+// Environment is the stage of the promotion pipeline. (e.g. staging and production)
+// The fields of PostProcess except Environments are available for each environment.
+type Environment struct {
+	Name string `json:"name"`
+	// Promotion is the condition to open the pull request of the environment.
+	// immediate: after the pull request of the previous environment is opened.
+	// merged: after the pull request of the previous environment is merged. (default)
+	// soak: after Soak is elapsed since the pull request of the previous environment is merged.
+	// command: after "/promote" is commented on the pull request of the previous environment.
+	// The first environment is always promoted immediately.
+	Promotion string `json:"promotion"`
+	// Soak is the duration to wait before promoting. (e.g. 24h)
+	Soak string `json:"soak"`
+	PostProcess
+
+	SoakDuration time.Duration `json:"-"`
+}
+
+// Stages returns the environments of the promotion pipeline.
+// If Environments is empty, Stages returns the single environment which has no name.
+// Image and NewName are inherited from PostProcess if an environment doesn't have them.
+func (p *PostProcess) Stages() []*Environment {
+	if len(p.Environments) == 0 {
+		pp := *p
+		return []*Environment{{Promotion: PromotionImmediate, PostProcess: pp}}
+	}
+
+	stages := make([]*Environment, 0, len(p.Environments))
+	for _, v := range p.Environments {
+		env := *v
+		if env.Image == "" {
+			env.Image = p.Image
+		}
+		if env.NewName == "" {
+			env.NewName = p.NewName
+		}
+		stages = append(stages, &env)
+	}
+
+	return stages
+}
+
+// AutoMerge is the policy to merge the pull request of post-process without a human.
+// The pull request is merged when all checks are passed and Delay is elapsed after the pull request is updated.
+type AutoMerge struct {
+	// Delay is the duration to wait before merging. (e.g. 30m)
+	Delay string `json:"delay"`
+	// MergeMethod is merge, squash or rebase. The default is merge.
+	MergeMethod string `json:"merge_method"`
+
+	DelayDuration time.Duration `json:"-"`
+}
+
+// UpdateTarget is the file which has the image.
+// Type is the name of the updater. (kustomize, helm, manifest or jsonnet) The syntax of Locator depends on the updater.
+type UpdateTarget struct {
+	Path    string `json:"path"`
+	Type    string `json:"type"`
+	Locator string `json:"locator"`
+}
+
+// UpdateTargets returns all targets. Paths are treated as the targets of kustomize.
+func (p *PostProcess) UpdateTargets() []UpdateTarget {
+	targets := make([]UpdateTarget, 0, len(p.Paths)+len(p.Targets))
+	for _, v := range p.Paths {
+		targets = append(targets, UpdateTarget{Path: v, Type: "kustomize"})
+	}
+
+	return append(targets, p.Targets...)
 }
 
 type Env struct {
@@ -89,15 +423,218 @@ type SecretSource struct {
 	Key  string `json:"key"`
 }
 
+// Match returns true if the changed files trigger the build.
+// If changed is nil (the changed files are unknown), Match returns true.
+func (r *BuildRule) Match(changed []string) bool {
+	if changed == nil {
+		return true
+	}
+
+	for _, v := range changed {
+		if matchAny(r.IgnorePaths, v) {
+			continue
+		}
+		if len(r.Paths) == 0 || matchAny(r.Paths, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// buildRules is the rule file which has multiple rules.
+type buildRules struct {
+	Rules []*BuildRule `json:"rules"`
+}
+
+// ParseBuildRules parses the rule file of the repository.
+// The rule file has a single rule or the list of the rules under "rules".
+func ParseBuildRules(v string) ([]*BuildRule, error) {
+	multi := &buildRules{}
+	if err := yaml.Unmarshal([]byte(v), multi); err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	if len(multi.Rules) == 0 {
+		rule, err := ParseBuildRule(v)
+		if err != nil {
+			return nil, err
+		}
+		return []*BuildRule{rule}, nil
+	}
+
+	names := make(map[string]struct{})
+	for _, rule := range multi.Rules {
+		if rule.Name == "" {
+			return nil, xerrors.New("config: name of the rule is mandatory when the repository has multiple rules")
+		}
+		if _, ok := names[rule.Name]; ok {
+			return nil, xerrors.Errorf("config: duplicate rule: %s", rule.Name)
+		}
+		names[rule.Name] = struct{}{}
+
+		if err := parseBuildRule(rule); err != nil {
+			return nil, err
+		}
+	}
+
+	return multi.Rules, nil
+}
+
 func ParseBuildRule(v string) (*BuildRule, error) {
 	conf := &BuildRule{}
 	if err := yaml.Unmarshal([]byte(v), conf); err != nil {
 		return nil, xerrors.Errorf(": %v", err)
 	}
+	if err := parseBuildRule(conf); err != nil {
+		return nil, err
+	}
+
+	return conf, nil
+}
+
+func parseBuildRule(conf *BuildRule) error {
+	for _, v := range append(conf.Paths, conf.IgnorePaths...) {
+		if err := validateGlob(v); err != nil {
+			return err
+		}
+	}
+	if conf.Release != nil {
+		if conf.Release.Target == "" {
+			conf.Release.Target = conf.Target
+		}
+		if len(conf.Release.Artifacts) == 0 {
+			conf.Release.Artifacts = conf.Artifacts
+		}
+		// The artifacts are uploaded by the file name
+		names := make(map[string]string)
+		for _, v := range conf.Release.Artifacts {
+			if other, ok := names[path.Base(v)]; ok {
+				return xerrors.Errorf("config: %s and %s have the same file name", other, v)
+			}
+			names[path.Base(v)] = v
+		}
+	}
+	if conf.PostProcess != nil {
+		if err := parseAutoMerge(conf.PostProcess.AutoMerge); err != nil {
+			return err
+		}
+		if err := parseEnvironments(conf.PostProcess.Environments); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ImageAutomationRule is the rule file of the manifest repository.
+type ImageAutomationRule struct {
+	Images []*WatchImage `json:"images"`
+}
+
+// WatchImage is the policy of the image which is not built by the bot.
+// Either Semver, Regex or Tag is required. If Tag is set, the digest of the tag is tracked.
+// The fields of PostProcess except Repo and Environments are available. The files are in the manifest repository.
+type WatchImage struct {
+	// Semver is the range of the version. (e.g. ">=1.2.0 <2.0.0")
+	Semver string `json:"semver"`
+	// Regex selects the tags which match. If the pattern has the submatch, the tags are ordered by the first submatch.
+	Regex string `json:"regex"`
+	// Order is alphabetical or numerical. This is used with Regex.
+	Order                  string `json:"order"`
+	DockerConfigSecretName string `json:"docker_config_secret_name"`
+	PostProcess
+}
+
+func ParseImageAutomationRule(v string) (*ImageAutomationRule, error) {
+	conf := &ImageAutomationRule{}
+	if err := yaml.Unmarshal([]byte(v), conf); err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	for _, img := range conf.Images {
+		if img.Image == "" {
+			return nil, xerrors.New("config: image is mandatory")
+		}
+		n := 0
+		for _, v := range []string{img.Semver, img.Regex, img.Tag} {
+			if v != "" {
+				n++
+			}
+		}
+		if n != 1 {
+			return nil, xerrors.Errorf("config: %s needs exactly one of semver, regex and tag", img.Image)
+		}
+		if err := parseAutoMerge(img.AutoMerge); err != nil {
+			return nil, err
+		}
+	}
 
 	return conf, nil
 }
 
+func parseAutoMerge(autoMerge *AutoMerge) error {
+	if autoMerge == nil {
+		return nil
+	}
+
+	switch autoMerge.MergeMethod {
+	case "", "merge", "squash", "rebase":
+	default:
+		return xerrors.Errorf("config: unknown merge method: %s", autoMerge.MergeMethod)
+	}
+	if autoMerge.Delay != "" {
+		d, err := time.ParseDuration(autoMerge.Delay)
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		autoMerge.DelayDuration = d
+	}
+
+	return nil
+}
+
+func parseEnvironments(environments []*Environment) error {
+	names := make(map[string]struct{})
+	for i, env := range environments {
+		if env.Name == "" {
+			return xerrors.New("config: name of the environment is mandatory")
+		}
+		if _, ok := names[env.Name]; ok {
+			return xerrors.Errorf("config: duplicate environment: %s", env.Name)
+		}
+		names[env.Name] = struct{}{}
+		if env.Repo == "" {
+			return xerrors.Errorf("config: repo of %s is mandatory", env.Name)
+		}
+
+		switch env.Promotion {
+		case "":
+			env.Promotion = PromotionMerged
+		case PromotionImmediate, PromotionMerged, PromotionCommand:
+		case PromotionSoak:
+			if env.Soak == "" {
+				return xerrors.Errorf("config: soak of %s is mandatory", env.Name)
+			}
+		default:
+			return xerrors.Errorf("config: unknown promotion: %s", env.Promotion)
+		}
+		if i == 0 {
+			env.Promotion = PromotionImmediate
+		}
+		if env.Soak != "" {
+			d, err := time.ParseDuration(env.Soak)
+			if err != nil {
+				return xerrors.Errorf(": %v", err)
+			}
+			env.SoakDuration = d
+		}
+		if err := parseAutoMerge(env.AutoMerge); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (e Env) ToEnvVar() corev1.EnvVar {
 	v := corev1.EnvVar{
 		Name:  e.Name,
@@ -118,6 +655,9 @@ func (e Env) ToEnvVar() corev1.EnvVar {
 }
 
 type DNSControlRule struct {
+	// Branch is the branch to apply. The default is the default branch of the repository.
+	Branch string `json:"branch"`
+	// Deprecated: Use Branch instead
 	MasterBranch string          `json:"master_branch"`
 	Image        string          `json:"image"`
 	Dir          string          `json:"dir"`
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"path"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// matchGlob reports whether name matches the glob.
+// The syntax is the same as path.Match except "**" which matches zero or more directories.
+// The glob which ends with "/" matches all files under the directory.
+func matchGlob(glob, name string) bool {
+	if strings.HasSuffix(glob, "/") {
+		glob += "**"
+	}
+
+	return matchSegments(strings.Split(strings.TrimPrefix(glob, "/"), "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(glob, name []string) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(glob[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(glob[0], name[0]); !ok {
+			return false
+		}
+		glob, name = glob[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
+
+func matchAny(globs []string, name string) bool {
+	for _, v := range globs {
+		if matchGlob(v, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func validateGlob(glob string) error {
+	for _, v := range strings.Split(glob, "/") {
+		if v == "**" {
+			continue
+		}
+		if _, err := path.Match(v, ""); err != nil {
+			return xerrors.Errorf("config: invalid glob %s: %v", glob, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	cases := []struct {
+		Glob  string
+		Name  string
+		Match bool
+	}{
+		{Glob: "app/**", Name: "app/main.go", Match: true},
+		{Glob: "app/**", Name: "app/cmd/main.go", Match: true},
+		{Glob: "app/**", Name: "application/main.go"},
+		{Glob: "app/", Name: "app/cmd/main.go", Match: true},
+		{Glob: "/app/*.go", Name: "app/main.go", Match: true},
+		{Glob: "app/*.go", Name: "app/cmd/main.go"},
+		{Glob: "**/*.md", Name: "README.md", Match: true},
+		{Glob: "**/*.md", Name: "docs/design/README.md", Match: true},
+		{Glob: "**/BUILD.bazel", Name: "app/BUILD", Match: false},
+		{Glob: "WORKSPACE", Name: "WORKSPACE", Match: true},
+	}
+
+	for _, c := range cases {
+		if matchGlob(c.Glob, c.Name) != c.Match {
+			t.Errorf("%s %s: expect %v", c.Glob, c.Name, c.Match)
+		}
+	}
+}
+
+func TestBuildRule_Match(t *testing.T) {
+	rule := &BuildRule{Paths: []string{"app/**"}, IgnorePaths: []string{"**/*.md"}}
+	if !rule.Match(nil) {
+		t.Error("Expect to build if the changed files are unknown")
+	}
+	if !rule.Match([]string{"README.md", "app/main.go"}) {
+		t.Error("Expect to build")
+	}
+	if rule.Match([]string{"app/README.md", "lib/lib.go"}) {
+		t.Error("Expect not to build")
+	}
+
+	rule = &BuildRule{IgnorePaths: []string{"docs/"}}
+	if rule.Match([]string{"docs/index.md"}) {
+		t.Error("Expect not to build if only the ignored files are changed")
+	}
+	if !rule.Match([]string{"docs/index.md", "main.go"}) {
+		t.Error("Expect to build")
+	}
+}
+
+func TestParseBuildRules(t *testing.T) {
+	rules, err := ParseBuildRules(`target: //:image
+paths:
+  - app/**
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || rules[0].Target != "//:image" || rules[0].Paths[0] != "app/**" {
+		t.Errorf("unexpected rules: %+v", rules)
+	}
+
+	rules, err = ParseBuildRules(`rules:
+  - name: api
+    target: //api:image
+    paths: ["api/**"]
+  - name: web
+    target: //web:image
+    paths: ["web/**"]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].Name != "api" || rules[1].Target != "//web:image" {
+		t.Errorf("unexpected rules: %+v", rules)
+	}
+
+	if _, err := ParseBuildRules("rules:\n  - target: //api:image\n"); err == nil {
+		t.Error("Expect an error when the name is missing")
+	}
+	if _, err := ParseBuildRules("rules:\n  - name: api\n  - name: api\n"); err == nil {
+		t.Error("Expect an error when the name is duplicated")
+	}
+	if _, err := ParseBuildRules("target: //:release\nrelease:\n  artifacts: [linux/app, darwin/app]\n"); err == nil {
+		t.Error("Expect an error when the file name of the artifacts is duplicated")
+	}
+}
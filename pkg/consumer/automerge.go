@@ -0,0 +1,308 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v29/github"
+	"golang.org/x/xerrors"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/githost"
+)
+
+const (
+	autoMergeMarkerFormat = "<!-- k8s-cluster-maintenance-bot/auto-merge: %s -->"
+)
+
+var autoMergeMarkerRe = regexp.MustCompile(`<!-- k8s-cluster-maintenance-bot/auto-merge: (.+) -->`)
+
+// autoMergeMarker is embedded in the body of the pull request.
+// The policy is kept in the pull request so that the bot can merge it after restarting.
+type autoMergeMarker struct {
+	MergeMethod string    `json:"merge_method,omitempty"`
+	NotBefore   time.Time `json:"not_before"`
+}
+
+func newAutoMergeMarker(autoMerge *config.AutoMerge) string {
+	b, err := json.Marshal(&autoMergeMarker{
+		MergeMethod: autoMerge.MergeMethod,
+		NotBefore:   time.Now().Add(autoMerge.DelayDuration).UTC().Truncate(time.Second),
+	})
+	if err != nil {
+		return ""
+	}
+
+	return fmt.Sprintf(autoMergeMarkerFormat, string(b))
+}
+
+func parseAutoMergeMarker(body string) *autoMergeMarker {
+	m := autoMergeMarkerRe.FindStringSubmatch(body)
+	if m == nil {
+		return nil
+	}
+	marker := &autoMergeMarker{}
+	if err := json.Unmarshal([]byte(m[1]), marker); err != nil {
+		return nil
+	}
+
+	return marker
+}
+
+// AutoMergeConsumer merges the pull requests of post-process which have the auto merge policy.
+// The consumer is triggered by check_suite and status event of the manifest repository.
+// So the manifest repository has to be allowed to send the events.
+type AutoMergeConsumer struct {
+	client *github.Client
+	// repositories are searched for the pull requests which have to be scheduled again at startup
+	repositories []string
+	// botLogin is the login of the bot user of the app. Only the pull requests which are created by the bot are merged.
+	botLogin string
+}
+
+func NewAutoMergeConsumer(conf *config.Config) (*AutoMergeConsumer, error) {
+	host, err := githost.FromConfig(conf)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	t, err := host.NewTransport(conf.GitHubAppId, conf.GitHubInstallationId, conf.GitHubAppPrivateKeyFile)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	botLogin, err := host.BotLogin(conf.GitHubAppId, conf.GitHubAppPrivateKeyFile)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	c := newAutoMergeConsumer(host, t, botLogin)
+	c.repositories = conf.GitHubRepositories()
+	if conf.ImageAutomation != nil {
+		known := make(map[string]struct{})
+		for _, v := range c.repositories {
+			known[v] = struct{}{}
+		}
+		for _, v := range conf.ImageAutomation.Repositories {
+			if _, ok := known[v]; !ok {
+				c.repositories = append(c.repositories, v)
+			}
+		}
+	}
+
+	return c, nil
+}
+
+func newAutoMergeConsumer(host *githost.Host, transport http.RoundTripper, botLogin string) *AutoMergeConsumer {
+	return &AutoMergeConsumer{client: host.NewClient(&http.Client{Transport: transport}), botLogin: botLogin}
+}
+
+func (c *AutoMergeConsumer) Dispatch(e interface{}) {
+	var repo *github.Repository
+	var sha string
+	switch event := e.(type) {
+	case *github.CheckSuiteEvent:
+		if event.GetAction() != "completed" {
+			return
+		}
+		repo, sha = event.GetRepo(), event.GetCheckSuite().GetHeadSHA()
+	case *github.StatusEvent:
+		if event.GetState() != "success" {
+			return
+		}
+		repo, sha = event.GetRepo(), event.GetSHA()
+	default:
+		return
+	}
+
+	pulls, _, err := c.client.PullRequests.List(context.Background(), repo.GetOwner().GetLogin(), repo.GetName(), &github.PullRequestListOptions{
+		State:       "open",
+		ListOptions: github.ListOptions{PerPage: 100},
+	})
+	if err != nil {
+		errorLog(xerrors.Errorf(": %v", err))
+		return
+	}
+	for _, v := range pulls {
+		if v.GetHead().GetSHA() != sha || !isBotPullRequest(v, c.botLogin) {
+			continue
+		}
+
+		if err := c.mergeIfReady(repo.GetOwner().GetLogin(), repo.GetName(), v.GetNumber()); err != nil {
+			errorLog(err)
+		}
+	}
+}
+
+// Schedule checks the pull request again after d.
+// This is needed because any event will not be sent when the delay is elapsed.
+func (c *AutoMergeConsumer) Schedule(owner, repo string, number int, d time.Duration) {
+	time.AfterFunc(d, func() {
+		if err := c.mergeIfReady(owner, repo, number); err != nil {
+			errorLog(err)
+		}
+	})
+}
+
+// ResumeSchedules schedules the pull requests which have the auto merge policy again.
+// The timers of Schedule are lost when the process restarts.
+func (c *AutoMergeConsumer) ResumeSchedules() error {
+	for _, v := range c.repositories {
+		s := strings.SplitN(v, "/", 2)
+		if len(s) != 2 {
+			continue
+		}
+		owner, repo := s[0], s[1]
+
+		opt := &github.PullRequestListOptions{State: "open", ListOptions: github.ListOptions{PerPage: 100}}
+		for {
+			pulls, res, err := c.client.PullRequests.List(context.Background(), owner, repo, opt)
+			if err != nil {
+				return xerrors.Errorf(": %v", err)
+			}
+			for _, pr := range pulls {
+				if !isBotPullRequest(pr, c.botLogin) {
+					continue
+				}
+				marker := parseAutoMergeMarker(pr.GetBody())
+				if marker == nil {
+					continue
+				}
+				d := time.Until(marker.NotBefore)
+				if d < 0 {
+					d = 0
+				}
+				log.Printf("Schedule %s/%s#%d again", owner, repo, pr.GetNumber())
+				c.Schedule(owner, repo, pr.GetNumber(), d)
+			}
+			if res.NextPage == 0 {
+				break
+			}
+			opt.Page = res.NextPage
+		}
+	}
+
+	return nil
+}
+
+func (c *AutoMergeConsumer) mergeIfReady(owner, repo string, number int) error {
+	pr, _, err := c.client.PullRequests.Get(context.Background(), owner, repo, number)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	if pr.GetState() != "open" || !isBotPullRequest(pr, c.botLogin) {
+		return nil
+	}
+	marker := parseAutoMergeMarker(pr.GetBody())
+	if marker == nil {
+		return nil
+	}
+	if time.Now().Before(marker.NotBefore) {
+		log.Printf("%s/%s#%d will be merged after %s", owner, repo, number, marker.NotBefore.Format(time.RFC3339))
+		return nil
+	}
+
+	sha := pr.GetHead().GetSHA()
+	passed, err := c.checksPassed(owner, repo, pr.GetBase().GetRef(), sha)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	if !passed {
+		return nil
+	}
+
+	_, _, err = c.client.PullRequests.Merge(context.Background(), owner, repo, number, "", &github.PullRequestOptions{
+		SHA:         sha,
+		MergeMethod: marker.MergeMethod,
+	})
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	log.Printf("Merged %s/%s#%d", owner, repo, number)
+
+	return nil
+}
+
+// checksPassed reports whether all statuses and check runs of the commit are succeeded.
+// The required status checks of the protected branch have to be succeeded even if they are not reported yet.
+// If the branch is not protected, at least one status or check run has to be reported.
+func (c *AutoMergeConsumer) checksPassed(owner, repo, branch, sha string) (bool, error) {
+	succeeded := make(map[string]bool)
+	statusOpt := &github.ListOptions{PerPage: 100}
+	for {
+		status, res, err := c.client.Repositories.GetCombinedStatus(context.Background(), owner, repo, sha, statusOpt)
+		if err != nil {
+			return false, xerrors.Errorf(": %v", err)
+		}
+		if status.GetTotalCount() > 0 && status.GetState() != "success" {
+			return false, nil
+		}
+		for _, v := range status.Statuses {
+			succeeded[v.GetContext()] = v.GetState() == "success"
+		}
+		if res.NextPage == 0 {
+			break
+		}
+		statusOpt.Page = res.NextPage
+	}
+
+	opt := &github.ListCheckRunsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		checkRuns, res, err := c.client.Checks.ListCheckRunsForRef(context.Background(), owner, repo, sha, opt)
+		if err != nil {
+			return false, xerrors.Errorf(": %v", err)
+		}
+		for _, v := range checkRuns.CheckRuns {
+			if v.GetStatus() != "completed" {
+				return false, nil
+			}
+			switch v.GetConclusion() {
+			case "success", "neutral", "skipped":
+				succeeded[v.GetName()] = true
+			default:
+				return false, nil
+			}
+		}
+		if res.NextPage == 0 {
+			break
+		}
+		opt.Page = res.NextPage
+	}
+
+	required, res, err := c.client.Repositories.GetRequiredStatusChecks(context.Background(), owner, repo, branch)
+	switch {
+	case err == nil:
+	case res != nil && res.StatusCode == http.StatusNotFound:
+		// The branch is not protected. The commit which doesn't have any check is not treated as passed
+		// because the checks may not be started yet.
+		return len(succeeded) > 0, nil
+	default:
+		return false, xerrors.Errorf(": %v", err)
+	}
+	for _, v := range required.Contexts {
+		if !succeeded[v] {
+			log.Printf("%s of %s/%s@%s is not succeeded yet", v, owner, repo, sha)
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// isBotPullRequest reports whether the pull request is created by the bot from the branch of the same repository.
+// The pull request from the fork can have the branch which has the same name as the branch of the bot.
+func isBotPullRequest(pr *github.PullRequest, botLogin string) bool {
+	if !strings.HasPrefix(pr.GetHead().GetRef(), botBranchPrefix) {
+		return false
+	}
+	if pr.GetHead().GetRepo().GetFullName() != pr.GetBase().GetRepo().GetFullName() {
+		return false
+	}
+
+	return botLogin != "" && pr.GetUser().GetLogin() == botLogin
+}
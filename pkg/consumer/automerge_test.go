@@ -0,0 +1,161 @@
+package consumer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v29/github"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+)
+
+func TestAutoMergeMarker(t *testing.T) {
+	body := "Change file(s):\nkustomization.yaml\n\n" + newAutoMergeMarker(&config.AutoMerge{MergeMethod: "squash", DelayDuration: 10 * time.Minute})
+
+	marker := parseAutoMergeMarker(body)
+	if marker == nil {
+		t.Fatal("Expect to parse the marker")
+	}
+	if marker.MergeMethod != "squash" {
+		t.Errorf("unexpected merge method: %s", marker.MergeMethod)
+	}
+	if marker.NotBefore.Before(time.Now().Add(9 * time.Minute)) {
+		t.Errorf("unexpected not before: %v", marker.NotBefore)
+	}
+
+	if parseAutoMergeMarker("Change file(s):\n") != nil {
+		t.Error("Expect nil when the body does not have the marker")
+	}
+}
+
+func TestAutoMergeConsumer_checksPassed(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Status    string
+		CheckRuns []string
+		Required  string
+		Expect    bool
+	}{
+		{
+			Name:      "No checks",
+			Status:    `{"state":"pending","total_count":0}`,
+			CheckRuns: []string{`{"total_count":0,"check_runs":[]}`},
+			Expect:    false,
+		},
+		{
+			Name:      "Passed without the protection",
+			Status:    `{"state":"pending","total_count":0}`,
+			CheckRuns: []string{`{"total_count":1,"check_runs":[{"name":"test","status":"completed","conclusion":"success"}]}`},
+			Expect:    true,
+		},
+		{
+			Name:      "No checks but the branch requires the check",
+			Status:    `{"state":"pending","total_count":0}`,
+			CheckRuns: []string{`{"total_count":0,"check_runs":[]}`},
+			Required:  `{"contexts":["build"]}`,
+			Expect:    false,
+		},
+		{
+			Name:      "All passed",
+			Status:    `{"state":"success","total_count":1,"statuses":[{"context":"build","state":"success"}]}`,
+			CheckRuns: []string{`{"total_count":1,"check_runs":[{"name":"test","status":"completed","conclusion":"success"}]}`},
+			Required:  `{"contexts":["build","test"]}`,
+			Expect:    true,
+		},
+		{
+			Name:      "Status is pending",
+			Status:    `{"state":"pending","total_count":1}`,
+			CheckRuns: []string{`{"total_count":0,"check_runs":[]}`},
+			Expect:    false,
+		},
+		{
+			Name:      "Check run is failed",
+			Status:    `{"state":"success","total_count":1}`,
+			CheckRuns: []string{`{"total_count":1,"check_runs":[{"status":"completed","conclusion":"failure"}]}`},
+			Expect:    false,
+		},
+		{
+			Name:   "Check run of the next page is failed",
+			Status: `{"state":"success","total_count":1}`,
+			CheckRuns: []string{
+				`{"total_count":2,"check_runs":[{"status":"completed","conclusion":"success"}]}`,
+				`{"total_count":2,"check_runs":[{"status":"completed","conclusion":"failure"}]}`,
+			},
+			Expect: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/repos/octocat/manifest/commits/abc/status", func(w http.ResponseWriter, _ *http.Request) {
+				fmt.Fprint(w, c.Status)
+			})
+			mux.HandleFunc("/repos/octocat/manifest/commits/abc/check-runs", func(w http.ResponseWriter, req *http.Request) {
+				page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+				if page == 0 {
+					page = 1
+				}
+				if page < len(c.CheckRuns) {
+					w.Header().Set("Link", fmt.Sprintf(`<%s?page=%d>; rel="next"`, req.URL.Path, page+1))
+				}
+				fmt.Fprint(w, c.CheckRuns[page-1])
+			})
+			mux.HandleFunc("/repos/octocat/manifest/branches/master/protection/required_status_checks", func(w http.ResponseWriter, _ *http.Request) {
+				if c.Required == "" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				fmt.Fprint(w, c.Required)
+			})
+			s := httptest.NewServer(mux)
+			defer s.Close()
+
+			client := github.NewClient(nil)
+			client.BaseURL, _ = url.Parse(s.URL + "/")
+			consumer := &AutoMergeConsumer{client: client}
+
+			passed, err := consumer.checksPassed("octocat", "manifest", "master", "abc")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if passed != c.Expect {
+				t.Errorf("Expect %v: %v", c.Expect, passed)
+			}
+		})
+	}
+}
+
+func TestIsBotPullRequest(t *testing.T) {
+	newPullRequest := func(author, ref, headRepo string) *github.PullRequest {
+		return &github.PullRequest{
+			User: &github.User{Login: github.String(author)},
+			Head: &github.PullRequestBranch{Ref: github.String(ref), Repo: &github.Repository{FullName: github.String(headRepo)}},
+			Base: &github.PullRequestBranch{Ref: github.String("master"), Repo: &github.Repository{FullName: github.String("octocat/manifest")}},
+		}
+	}
+
+	cases := []struct {
+		Name   string
+		PR     *github.PullRequest
+		Expect bool
+	}{
+		{Name: "Bot", PR: newPullRequest("bot[bot]", "update-image/octocat-app/app", "octocat/manifest"), Expect: true},
+		{Name: "Not the branch of the bot", PR: newPullRequest("bot[bot]", "feature", "octocat/manifest"), Expect: false},
+		{Name: "Fork", PR: newPullRequest("bot[bot]", "update-image/octocat-app/app", "someone/manifest"), Expect: false},
+		{Name: "Other user", PR: newPullRequest("someone", "update-image/octocat-app/app", "octocat/manifest"), Expect: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			if v := isBotPullRequest(c.PR, "bot[bot]"); v != c.Expect {
+				t.Errorf("Expect %v: %v", c.Expect, v)
+			}
+		})
+	}
+}
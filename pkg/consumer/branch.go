@@ -0,0 +1,88 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v29/github"
+	"golang.org/x/xerrors"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+)
+
+const (
+	defaultBranchCacheTTL = 1 * time.Hour
+)
+
+var defaultBranches = newDefaultBranchCache(defaultBranchCacheTTL)
+
+type defaultBranchEntry struct {
+	Branch    string
+	ExpiresAt time.Time
+}
+
+// defaultBranchCache has the default branch of the repositories which is got through GitHub API.
+type defaultBranchCache struct {
+	ttl time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*defaultBranchEntry
+}
+
+func newDefaultBranchCache(ttl time.Duration) *defaultBranchCache {
+	return &defaultBranchCache{ttl: ttl, cache: make(map[string]*defaultBranchEntry)}
+}
+
+func (c *defaultBranchCache) Get(client *github.Client, owner, repo string) (string, error) {
+	key := fmt.Sprintf("%s/%s", owner, repo)
+
+	c.mu.Lock()
+	e, ok := c.cache[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(e.ExpiresAt) {
+		return e.Branch, nil
+	}
+
+	r, _, err := client.Repositories.Get(context.Background(), owner, repo)
+	if err != nil {
+		return "", xerrors.Errorf(": %v", err)
+	}
+	if r.GetDefaultBranch() == "" {
+		return "", xerrors.Errorf("could not get the default branch of %s", key)
+	}
+
+	c.mu.Lock()
+	c.cache[key] = &defaultBranchEntry{Branch: r.GetDefaultBranch(), ExpiresAt: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+
+	return r.GetDefaultBranch(), nil
+}
+
+// resolveBranch returns the branch if it is not empty or config.DefaultBranch.
+// Otherwise resolveBranch returns the default branch of the repository.
+func resolveBranch(client *github.Client, owner, repo, branch string) (string, error) {
+	if branch != "" && branch != config.DefaultBranch {
+		return branch, nil
+	}
+
+	return defaultBranches.Get(client, owner, repo)
+}
+
+// resolveTargetBranch returns the branch if it is not empty or config.DefaultBranch.
+// Otherwise resolveTargetBranch returns the default branch of the repository.
+// The default branch of the providers except GitHub is taken from the payload of the event.
+func resolveTargetBranch(client *github.Client, ctx *eventContext, branch string) (string, error) {
+	if branch != "" && branch != config.DefaultBranch {
+		return branch, nil
+	}
+	if !ctx.IsGitHub() {
+		if ctx.DefaultBranch == "" {
+			return "", xerrors.Errorf("the default branch of %s/%s is unknown", ctx.Owner, ctx.Repo)
+		}
+		return ctx.DefaultBranch, nil
+	}
+
+	return resolveBranch(client, ctx.Owner, ctx.Repo, "")
+}
@@ -0,0 +1,65 @@
+package consumer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v29/github"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+)
+
+func TestDefaultBranchCache(t *testing.T) {
+	requests := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/octocat/example", func(w http.ResponseWriter, _ *http.Request) {
+		requests++
+		fmt.Fprint(w, `{"name":"example","default_branch":"main"}`)
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(s.URL + "/")
+
+	cache := newDefaultBranchCache(time.Minute)
+	for i := 0; i < 2; i++ {
+		branch, err := cache.Get(client, "octocat", "example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if branch != "main" {
+			t.Errorf("unexpected branch: %s", branch)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Expect the default branch is cached: %d requests", requests)
+	}
+}
+
+func TestResolveBranch(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/octocat/resolve", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, `{"name":"resolve","default_branch":"main"}`)
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(s.URL + "/")
+
+	cases := map[string]string{"": "main", config.DefaultBranch: "main", "release": "release"}
+	for in, expect := range cases {
+		branch, err := resolveBranch(client, "octocat", "resolve", in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if branch != expect {
+			t.Errorf("Expect %s for %q: %s", expect, in, branch)
+		}
+	}
+}
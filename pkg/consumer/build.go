@@ -15,26 +15,31 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/bradleyfalzon/ghinstallation"
 	"github.com/google/go-github/v29/github"
+	"golang.org/x/crypto/openpgp"
 	"golang.org/x/xerrors"
 	"gopkg.in/src-d/go-git.v4"
 	gitConfig "gopkg.in/src-d/go-git.v4/config"
 	"gopkg.in/src-d/go-git.v4/plumbing"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
 	gogitHttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/agent"
 	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/githost"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/updater"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/webhook"
 )
 
 const (
@@ -44,30 +49,59 @@ const (
 	defaultBazelVersion           = "2.0.0"
 	repositoryBuildConfigFilePath = ".bot/build.yaml"
 
+	botBranchPrefix       = "update-image/"
+	legacyBotBranchPrefix = "update-kustomization-"
+
 	labelKeyJobId  = "k8s-cluster-maintenance-bot.f110.dev/job-id"
 	labelKeyCtrlBy = "k8s-cluster-maintenance-bot.f110.dev/control-by"
+
+	emptyCommit = "0000000000000000000000000000000000000000"
+
+	ctrlByBazelBuild     = "bazel-build"
+	buildStatusContext   = "build"
+	releaseStatusContext = "release"
 )
 
 var (
 	errBuildFailure = xerrors.New("build failed")
 )
 
-var letters = "abcdefghijklmnopqrstuvwxyz1234567890"
+var (
+	letters            = "abcdefghijklmnopqrstuvwxyz1234567890"
+	branchNameEscapeRe = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+)
 
 type BazelBuild struct {
 	Namespace              string
 	AppId                  int64
 	InstallationId         int64
 	StorageHost            string
+	StoragePublicHost      string
 	StorageTokenSecretName string
 	ArtifactBucket         string
-	HostAliases            []config.HostAlias
 	AuthorName             string
 	AuthorEmail            string
+	GitMirrorURL           string
+	BuildMode              string
+	JobTTLSeconds          *int32
+	BuildLogBaseURL        string
+	InsecureRegistries     []string
 
 	transport  *ghinstallation.Transport
+	host       *githost.Host
+	clients    webhook.Clients
+	podBuilder *podBuilder
+	pool       *builderPool
+	autoMerge  *AutoMergeConsumer
+	// botLogin is the login of the bot user of the app
+	botLogin string
+	signKey  *openpgp.Entity
+	// jobs serializes the builds of the same branch and rule
+	jobs       *serialQueue
 	workingDir string
-	debug      bool
+	// promotionMu serializes the updates of the promotion records
+	promotionMu sync.Mutex
+	debug       bool
 }
 
 func errorLog(err error) {
@@ -75,50 +109,162 @@ func errorLog(err error) {
 }
 
 func NewBuildConsumer(namespace string, conf *config.Config, debug bool) (*BazelBuild, error) {
-	t, err := ghinstallation.NewKeyFromFile(http.DefaultTransport, conf.GitHubAppId, conf.GitHubInstallationId, conf.GitHubAppPrivateKeyFile)
+	host, err := githost.FromConfig(conf)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	t, err := host.NewTransport(conf.GitHubAppId, conf.GitHubInstallationId, conf.GitHubAppPrivateKeyFile)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	botLogin, err := host.BotLogin(conf.GitHubAppId, conf.GitHubAppPrivateKeyFile)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	podBuilder, err := newPodBuilder(namespace, conf)
 	if err != nil {
 		return nil, xerrors.Errorf(": %v", err)
 	}
 
+	var signKey *openpgp.Entity
+	if conf.CommitSigningKeySecretName != "" {
+		signKey, err = loadSigningKey(namespace, conf.CommitSigningKeySecretName)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+	}
+
+	var pool *builderPool
+	if conf.BuildMode == config.BuildModePool {
+		pool = newBuilderPool(namespace, conf, podBuilder)
+	}
+
 	return &BazelBuild{
 		Namespace:              namespace,
 		AppId:                  conf.GitHubAppId,
 		InstallationId:         conf.GitHubInstallationId,
 		StorageHost:            conf.StorageHost,
+		StoragePublicHost:      conf.StoragePublicHost,
 		StorageTokenSecretName: conf.StorageTokenSecretName,
 		ArtifactBucket:         conf.ArtifactBucket,
-		HostAliases:            conf.HostAliases,
 		AuthorName:             conf.CommitAuthor,
 		AuthorEmail:            conf.CommitEmail,
+		GitMirrorURL:           conf.GitMirrorURL,
+		BuildMode:              conf.BuildMode,
+		JobTTLSeconds:          conf.JobTTLSecondsAfterFinished,
+		BuildLogBaseURL:        conf.BuildLogBaseURL,
+		InsecureRegistries:     conf.InsecureRegistries,
 		debug:                  debug,
 		transport:              t,
+		host:                   host,
+		clients:                webhook.NewClients(conf, host.NewClient(&http.Client{Transport: t})),
+		podBuilder:             podBuilder,
+		pool:                   pool,
+		autoMerge:              newAutoMergeConsumer(host, t, botLogin),
+		botLogin:               botLogin,
+		signKey:                signKey,
+		jobs:                   newSerialQueue(),
 	}, nil
 }
 
+// FillPool creates idle builders up to the size of the pool.
+// If the pool is not configured, FillPool does nothing.
+func (b *BazelBuild) FillPool() error {
+	if b.pool == nil {
+		return nil
+	}
+
+	client, err := NewKubernetesClient()
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	return b.pool.Fill(client)
+}
+
 func (b *BazelBuild) Build(e interface{}) {
-	event, ok := e.(*github.PushEvent)
+	event, ok := e.(*webhook.PushEvent)
 	if !ok {
 		log.Print("Not push event")
 		return
 	}
-	buildCtx := NewEventContextFromPushEvent(event)
-
-	if contents, err := buildCtx.FetchRuleFile(&http.Client{Transport: b.transport}, repositoryBuildConfigFilePath); err != nil {
+	eventCtx := NewEventContextFromPushEvent(event)
+	rules, err := b.fetchRules(eventCtx)
+	if err != nil {
 		errorLog(err)
 		return
-	} else {
-		rule, err := config.ParseBuildRule(contents)
+	}
+
+	ghClient := b.host.NewClient(&http.Client{Transport: b.transport})
+	changed := event.Changed
+	for _, v := range rules {
+		if changed == nil && eventCtx.Tag() == "" && (len(v.Paths) > 0 || len(v.IgnorePaths) > 0) {
+			changed, err = b.changedFiles(eventCtx, event.Before, event.After)
+			if err != nil {
+				// All rules are built because the changed files are unknown
+				errorLog(err)
+			}
+			break
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, v := range rules {
+		buildCtx := *eventCtx
+		buildCtx.Rule, buildCtx.RuleName = v, v.Name
+		if !b.shouldBuild(ghClient, event, &buildCtx, changed) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(buildCtx *eventContext) {
+			defer wg.Done()
+			key := fmt.Sprintf("%s@%s", ruleName(buildCtx), buildCtx.Ref)
+			b.jobs.Run(key, func() { b.build(buildCtx) })
+		}(&buildCtx)
+	}
+	wg.Wait()
+}
+
+// shouldBuild returns true if the push is the target of the rule.
+func (b *BazelBuild) shouldBuild(ghClient *github.Client, event *webhook.PushEvent, buildCtx *eventContext, changed []string) bool {
+	if tag := buildCtx.Tag(); tag != "" {
+		// The release is published to GitHub Release
+		if event.Deleted || buildCtx.Rule.Release == nil || !buildCtx.IsGitHub() {
+			log.Printf("Skip build because %s is not released", tag)
+			return false
+		}
+		return true
+	}
+
+	// All branches are built if the rule doesn't have the branch
+	if buildCtx.Rule.Branch != "" {
+		targetBranch, err := resolveTargetBranch(ghClient, buildCtx, buildCtx.Rule.Branch)
 		if err != nil {
 			errorLog(err)
-			return
+			return false
+		}
+		branch := strings.TrimPrefix(event.Ref, branchRefPrefix)
+		if targetBranch != branch {
+			log.Printf("Skip build because %s is not target branch", branch)
+			return false
 		}
-		buildCtx.Rule = rule
 	}
+	if !buildCtx.Rule.Match(changed) {
+		log.Printf("Skip build of %s because the files of the rule are not changed", ruleName(buildCtx))
+		return false
+	}
+
+	return true
+}
 
-	s := strings.SplitN(event.GetRef(), "/", 3)
-	branch := s[2]
-	if buildCtx.Rule.Branch != "" && buildCtx.Rule.Branch != branch {
-		log.Printf("Skip build because %s is not target branch", branch)
+func (b *BazelBuild) build(buildCtx *eventContext) {
+	if cached := b.cachedBuild(buildCtx); cached != nil {
+		log.Printf("Skip build of %s@%s because %s already built it", ruleName(buildCtx), buildCtx.Commit, cached.BuildId)
+		description := fmt.Sprintf("Build succeeded (cached: %s)", cached.BuildId)
+		b.setStatus(buildCtx, webhook.StateSuccess, description)
+		b.postBuild(buildCtx, cached.BuildId)
 		return
 	}
 
@@ -136,12 +282,119 @@ func (b *BazelBuild) Build(e interface{}) {
 		}
 	}()
 
-	err = b.buildRepository(buildCtx, client, buildId)
-	if err != nil && err != errBuildFailure {
+	b.setStatus(buildCtx, webhook.StatePending, "Building")
+
+	switch {
+	case b.BuildMode == config.BuildModeJob:
+		err = b.buildRepositoryWithJob(buildCtx, client, buildId)
+	// The builder of the pool can't build the release because the agent doesn't accept the arguments of bazel
+	case b.pool != nil && buildCtx.Tag() == "" && b.pool.Accept(buildCtx.Rule):
+		err = b.buildRepositoryWithPool(buildCtx, client, buildId)
+		if err == errNoIdleBuilder {
+			log.Print("Fallback to build with a new pod because there is no idle builder")
+			err = b.buildRepository(buildCtx, client, buildId)
+		}
+	default:
+		err = b.buildRepository(buildCtx, client, buildId)
+	}
+
+	b.finish(client, buildCtx, buildId, err)
+}
+
+// Resume supervises the build which is left behind by the previous process.
+// The build holds the key of the branch and the rule so that the next build of them waits for it.
+func (b *BazelBuild) Resume(client *kubernetes.Clientset, o *Orphan) {
+	obj := o.Object()
+	buildCtx, err := NewEventContextFromAnnotations(obj.GetAnnotations())
+	if err != nil {
+		errorLog(err)
+		return
+	}
+	buildId := obj.GetLabels()[labelKeyJobId]
+	if err := b.fetchRule(buildCtx); err != nil {
+		errorLog(err)
+		if err := b.cleanup(client, buildId); err != nil {
+			errorLog(err)
+		}
+		return
+	}
+
+	b.jobs.Go(fmt.Sprintf("%s@%s", ruleName(buildCtx), buildCtx.Ref), func() {
+		defer func() {
+			if err := b.cleanup(client, buildId); err != nil {
+				errorLog(err)
+				return
+			}
+		}()
+
+		var failed bool
+		if o.Job != nil {
+			failed, err = WaitForJobFinish(client, b.Namespace, o.Job.Name)
+		} else {
+			failed, err = WaitForFinish(client, b.Namespace, o.Pod.Name)
+		}
+		if err == nil && failed {
+			err = errBuildFailure
+		}
+
+		b.finish(client, buildCtx, buildId, err)
+	})
+}
+
+// Abandon deletes the build which is left behind by the previous process, and reports an error.
+func (b *BazelBuild) Abandon(client *kubernetes.Clientset, o *Orphan) {
+	obj := o.Object()
+	if err := b.cleanup(client, obj.GetLabels()[labelKeyJobId]); err != nil {
+		errorLog(err)
+	}
+
+	buildCtx, err := NewEventContextFromAnnotations(obj.GetAnnotations())
+	if err != nil {
 		errorLog(err)
 		return
 	}
+	b.setStatus(buildCtx, webhook.StateError, "Abandoned")
+}
+
+// finish reports the result of the build and runs the post process if the build succeeded.
+func (b *BazelBuild) finish(client *kubernetes.Clientset, buildCtx *eventContext, buildId string, buildErr error) {
+	if buildErr == nil || buildErr == errBuildFailure {
+		if err := b.saveBuildLog(client, buildCtx, buildId); err != nil {
+			errorLog(err)
+		}
+	}
+
+	status, description := webhook.StateSuccess, "Build succeeded"
+	switch buildErr {
+	case nil:
+	case errBuildFailure:
+		status, description = webhook.StateFailure, "Build failed"
+	default:
+		errorLog(buildErr)
+		status, description = webhook.StateError, "Build error"
+	}
+	b.setStatus(buildCtx, status, description)
+	if buildErr != nil {
+		return
+	}
 
+	if key, err := buildCacheKey(buildCtx); err != nil {
+		errorLog(xerrors.Errorf(": %v", err))
+	} else if err := b.saveBuildCache(key, &buildCache{BuildId: buildId, BuiltAt: time.Now()}); err != nil {
+		errorLog(err)
+	}
+
+	b.postBuild(buildCtx, buildId)
+}
+
+// postBuild publishes the artifacts of the build. The tag is published as the release.
+func (b *BazelBuild) postBuild(buildCtx *eventContext, buildId string) {
+	if buildCtx.Tag() != "" {
+		if err := b.publishRelease(buildCtx, buildId); err != nil {
+			errorLog(err)
+		}
+		return
+	}
 	if buildCtx.Rule.PostProcess != nil {
 		if err := b.postProcess(buildCtx, buildId); err != nil {
 			errorLog(err)
@@ -150,11 +403,157 @@ func (b *BazelBuild) Build(e interface{}) {
 	}
 }
 
+// setStatus reports the status of the build to the provider of the repository.
+func (b *BazelBuild) setStatus(buildCtx *eventContext, status, description string) {
+	client, err := b.clients.Get(buildCtx.Provider)
+	if err != nil {
+		errorLog(xerrors.Errorf(": %v", err))
+		return
+	}
+	if err := buildCtx.SetStatus(client, statusContext(buildCtx), status, description); err != nil {
+		errorLog(err)
+	}
+}
+
+// cachedBuild returns the successful build which has the same content key.
+// If there is no such build, cachedBuild returns nil and the repository is built.
+func (b *BazelBuild) cachedBuild(buildCtx *eventContext) *buildCache {
+	key, err := buildCacheKey(buildCtx)
+	if err != nil {
+		errorLog(xerrors.Errorf(": %v", err))
+		return nil
+	}
+	cached, err := b.findBuildCache(buildCtx, key)
+	if err != nil {
+		errorLog(err)
+		return nil
+	}
+
+	return cached
+}
+
+// statusContext returns the context of the commit status. The build of the tag is reported as the release.
+// If the repository has multiple rules, the name of the rule is appended.
+func statusContext(buildCtx *eventContext) string {
+	c := buildStatusContext
+	if buildCtx.Tag() != "" {
+		c = releaseStatusContext
+	}
+	if buildCtx.RuleName != "" {
+		c += "/" + buildCtx.RuleName
+	}
+
+	return c
+}
+
+// ruleName returns the name of the rule for logging.
+func ruleName(buildCtx *eventContext) string {
+	if buildCtx.RuleName != "" {
+		return fmt.Sprintf("%s/%s:%s", buildCtx.Owner, buildCtx.Repo, buildCtx.RuleName)
+	}
+
+	return fmt.Sprintf("%s/%s", buildCtx.Owner, buildCtx.Repo)
+}
+
+// changedFiles returns the files which are changed between before and after.
+// If the changed files can't be determined (e.g. the branch is created), changedFiles returns nil.
+func changedFiles(client webhook.Client, repo *webhook.Repository, before, after string) ([]string, error) {
+	if before == emptyCommit || after == emptyCommit {
+		return nil, nil
+	}
+
+	files, err := client.CompareFiles(repo, before, after)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	return files, nil
+}
+
+func (b *BazelBuild) changedFiles(eventCtx *eventContext, before, after string) ([]string, error) {
+	client, err := b.clients.Get(eventCtx.Provider)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	return changedFiles(client, eventCtx.Repository(), before, after)
+}
+
+// bazelArgs returns the arguments of bazel. The tag is embedded as the stamp variable when the tag is built.
+func bazelArgs(buildCtx *eventContext) []string {
+	if tag := buildCtx.Tag(); tag != "" && buildCtx.Rule.Release != nil {
+		return []string{"--output_user_root=/out", "run", "--stamp", fmt.Sprintf("--embed_label=%s", tag), buildCtx.Rule.Release.Target}
+	}
+
+	return []string{"--output_user_root=/out", "run", buildCtx.Rule.Target}
+}
+
+// artifactPaths returns the paths of the artifacts which are uploaded after the build.
+func artifactPaths(buildCtx *eventContext) []string {
+	if buildCtx.Tag() != "" && buildCtx.Rule.Release != nil {
+		return buildCtx.Rule.Release.Artifacts
+	}
+	if len(buildCtx.Rule.Artifacts) > 0 {
+		return buildCtx.Rule.Artifacts[:1]
+	}
+
+	return nil
+}
+
+// fetchRules returns all rules of the repository at the commit.
+func (b *BazelBuild) fetchRules(buildCtx *eventContext) ([]*config.BuildRule, error) {
+	client, err := b.clients.Get(buildCtx.Provider)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	contents, err := buildCtx.FetchRuleFile(client, repositoryBuildConfigFilePath)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	rules, err := config.ParseBuildRules(contents)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	return rules, nil
+}
+
+// fetchRule sets the rule of RuleName to the context. If RuleName is empty, the first rule is set.
+func (b *BazelBuild) fetchRule(buildCtx *eventContext) error {
+	rules, err := b.fetchRules(buildCtx)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	for _, v := range rules {
+		if buildCtx.RuleName == "" || v.Name == buildCtx.RuleName {
+			buildCtx.Rule = v
+			return nil
+		}
+	}
+
+	return xerrors.Errorf("%s/%s@%s doesn't have the rule: %s", buildCtx.Owner, buildCtx.Repo, buildCtx.Commit, buildCtx.RuleName)
+}
+
 func (b *BazelBuild) cleanup(client *kubernetes.Clientset, buildId string) error {
 	if b.debug {
 		return nil
 	}
 
+	// Job has to be deleted before pods. Otherwise the job controller creates a new pod.
+	jobList, err := client.BatchV1().Jobs(b.Namespace).List(metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", labelKeyJobId, buildId),
+	})
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	propagation := metav1.DeletePropagationBackground
+	for _, v := range jobList.Items {
+		err := client.BatchV1().Jobs(b.Namespace).Delete(v.Name, &metav1.DeleteOptions{PropagationPolicy: &propagation})
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+	}
+
 	podList, err := client.CoreV1().Pods(b.Namespace).List(metav1.ListOptions{
 		LabelSelector: fmt.Sprintf("%s=%s", labelKeyJobId, buildId),
 	})
@@ -173,57 +572,259 @@ func (b *BazelBuild) cleanup(client *kubernetes.Clientset, buildId string) error
 }
 
 func (b *BazelBuild) buildRepository(buildCtx *eventContext, client *kubernetes.Clientset, buildId string) error {
-	buildPod := b.buildPod(buildCtx, buildId)
-	_, err := client.CoreV1().Pods(b.Namespace).Create(buildPod)
+	buildPod, err := b.buildPod(buildCtx, buildId)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	_, err = client.CoreV1().Pods(b.Namespace).Create(buildPod)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	failed, err := WaitForFinish(client, b.Namespace, buildPod.Name)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	if failed {
+		return errBuildFailure
+	}
+
+	return nil
+}
+
+func (b *BazelBuild) buildRepositoryWithJob(buildCtx *eventContext, client *kubernetes.Clientset, buildId string) error {
+	job, err := b.buildJob(buildCtx, buildId)
 	if err != nil {
 		return xerrors.Errorf(": %v", err)
 	}
-	success, err := WaitForFinish(client, b.Namespace, buildPod.Name)
+	_, err = client.BatchV1().Jobs(b.Namespace).Create(job)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	failed, err := WaitForJobFinish(client, b.Namespace, job.Name)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	if failed {
+		return errBuildFailure
+	}
+
+	return nil
+}
+
+func (b *BazelBuild) buildRepositoryWithPool(buildCtx *eventContext, client *kubernetes.Clientset, buildId string) error {
+	job := b.poolJob(buildCtx, buildId)
+	annotations := buildCtx.Annotations()
+	if len(buildCtx.Rule.Artifacts) > 0 {
+		annotations[agent.AnnotationArtifactPath] = buildCtx.Rule.Artifacts[0]
+		annotations[agent.AnnotationArtifactKey] = artifactKey(buildCtx, buildId)
+	}
+	pod, err := b.pool.Acquire(client, buildId, annotations)
+	if err == errNoIdleBuilder {
+		return err
+	}
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	go func() {
+		if err := b.pool.Fill(client); err != nil {
+			errorLog(err)
+		}
+	}()
+
+	token, err := b.pool.Token(client, pod)
 	if err != nil {
 		return xerrors.Errorf(": %v", err)
 	}
+	if err := agent.Dispatch(pod.Status.PodIP, token, job); err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
 
-	if !success {
+	failed, err := WaitForFinish(client, b.Namespace, pod.Name)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	if failed {
 		return errBuildFailure
 	}
 
 	return nil
 }
 
+// poolJob returns the job which is handed to the builder in the pool.
+func (b *BazelBuild) poolJob(buildCtx *eventContext, buildId string) *agent.Job {
+	job := &agent.Job{
+		URL:       buildCtx.CloneURL(b.host),
+		Commit:    buildCtx.Commit,
+		MirrorURL: b.GitMirrorURL,
+		Target:    buildCtx.Rule.Target,
+		JobName:   fmt.Sprintf("%s-%s", buildCtx.Owner, buildCtx.Repo),
+		JobId:     buildId,
+	}
+	for _, v := range buildCtx.Rule.Env {
+		job.Env = append(job.Env, agent.EnvVar{Name: v.Name, Value: v.Value})
+	}
+
+	return job
+}
+
 func (b *BazelBuild) postProcess(buildCtx *eventContext, buildId string) error {
+	var image updater.Image
+	if buildCtx.Rule.PostProcess.Tag != "" {
+		image = updater.Image{
+			Name:    buildCtx.Rule.PostProcess.Image,
+			NewName: buildCtx.Rule.PostProcess.NewName,
+			Tag:     buildCtx.Rule.PostProcess.Tag,
+		}
+	} else {
+		i, err := b.artifactImage(buildCtx, buildId)
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		image = i
+	}
+	if image.Digest == "" {
+		if err := b.resolveDigest(buildCtx, &image); err != nil {
+			if buildCtx.Rule.PostProcess.Tag != "" {
+				return xerrors.Errorf(": %v", err)
+			}
+			// The tag which is written in the artifact is still available without the digest
+			log.Printf("Failed to resolve the digest of %s:%s: %v", image.Name, image.Tag, err)
+		}
+	}
+
+	h := &buildHistory{
+		Ref:     imageRef(&image),
+		Owner:   buildCtx.Owner,
+		Repo:    buildCtx.Repo,
+		Commit:  buildCtx.Commit,
+		BuildId: buildId,
+		BuiltAt: time.Now(),
+	}
+	if !buildCtx.IsGitHub() {
+		h.Provider, h.CloneURL = buildCtx.Provider, buildCtx.cloneURL
+	}
+	err := b.saveHistory(image.Name, imageRef(&image), h)
+	if err != nil {
+		errorLog(err)
+	}
+
+	if err := b.startPromotion(buildCtx, buildId, image); err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	return nil
+}
+
+// newChangelog returns the description of the pull request.
+// If it failed to fetch the changes of the source repository, the description doesn't have the changes.
+func (b *BazelBuild) newChangelog(buildCtx *eventContext, buildId string, oldImage *updater.Image, newImage updater.Image, editedFiles []string) *changelog {
+	cl := &changelog{
+		Host:        b.host,
+		Owner:       buildCtx.Owner,
+		Repo:        buildCtx.Repo,
+		OldImage:    oldImage,
+		NewImage:    newImage,
+		NewCommit:   buildCtx.Commit,
+		EditedFiles: editedFiles,
+	}
+	b.describeChanges(buildCtx, buildId, cl)
+
+	return cl
+}
+
+// describeChanges fills the build log and the changes of the source repository in the changelog.
+func (b *BazelBuild) describeChanges(buildCtx *eventContext, buildId string, cl *changelog) {
+	if !buildCtx.IsGitHub() {
+		cl.RepositoryURL = strings.TrimSuffix(buildCtx.cloneURL, ".git")
+	}
+	if u, err := b.buildLogURL(buildCtx, buildId); err != nil {
+		errorLog(err)
+	} else {
+		cl.BuildLogURL = u
+	}
+
+	if cl.OldImage == nil {
+		return
+	}
+	h, err := b.findHistory(cl.NewImage.Name, imageRef(cl.OldImage))
+	if err != nil {
+		errorLog(err)
+		return
+	}
+	if h == nil || h.Owner != buildCtx.Owner || h.Repo != buildCtx.Repo {
+		return
+	}
+	cl.OldCommit = h.Commit
+	// The commits and the pull requests are fetched from the API of GitHub
+	if !buildCtx.IsGitHub() {
+		return
+	}
+	if err := cl.fetchChanges(b.host.NewClient(&http.Client{Transport: b.transport})); err != nil {
+		errorLog(err)
+	}
+}
+
+// artifactImage downloads the artifact of the build and reads the image from it.
+func (b *BazelBuild) artifactImage(buildCtx *eventContext, buildId string) (updater.Image, error) {
 	artifactDir, err := b.downloadArtifact(buildCtx, buildId)
 	if artifactDir != "" {
 		defer os.RemoveAll(artifactDir)
 	}
 	if err != nil {
-		return xerrors.Errorf(": %v", err)
+		return updater.Image{}, xerrors.Errorf(": %v", err)
 	}
 
-	s := strings.SplitN(buildCtx.Rule.PostProcess.Repo, "/", 2)
-	r, err := newGitRepo(b.transport, s[0], s[1], buildCtx.Rule.PostProcess.Image, b.AuthorName, b.AuthorEmail)
+	return readArtifactImage(filepath.Join(artifactDir, filepath.Base(buildCtx.Rule.Artifacts[0])), buildCtx.Rule.PostProcess)
+}
+
+// resolveDigest resolves the tag of the image to the digest with the docker config of the build rule.
+func (b *BazelBuild) resolveDigest(buildCtx *eventContext, image *updater.Image) error {
+	c, err := newRegistryClient(b.Namespace, buildCtx.Rule.DockerConfigSecretName, b.podBuilder.hostAliases, b.InsecureRegistries)
 	if err != nil {
 		return xerrors.Errorf(": %v", err)
 	}
-	defer r.Close()
-
-	artifactPath := filepath.Join(artifactDir, filepath.Base(buildCtx.Rule.Artifacts[0]))
-	if err := r.UpdateKustomization(buildCtx, artifactPath, buildCtx.Rule.PostProcess.Paths); err != nil {
+	d, err := c.Digest(fmt.Sprintf("%s:%s", image.Name, image.Tag))
+	if err != nil {
 		return xerrors.Errorf(": %v", err)
 	}
+	log.Printf("Resolve %s:%s to %s", image.Name, image.Tag, d)
+	image.Digest, image.Tag = d, ""
 
 	return nil
 }
 
-func (b *BazelBuild) downloadArtifact(buildCtx *eventContext, buildId string) (string, error) {
-	cfg := &aws.Config{
-		Endpoint:         aws.String(b.StorageHost),
-		Region:           aws.String("us-east-1"),
-		DisableSSL:       aws.Bool(true),
-		S3ForcePathStyle: aws.Bool(true),
-		Credentials:      credentials.NewEnvCredentials(),
+// readArtifactImage reads the image from the artifact.
+// If the artifact is the digest of the image, Digest is set. Otherwise the artifact is treated as the tag of the image.
+func readArtifactImage(artifactPath string, postProcess *config.PostProcess) (updater.Image, error) {
+	buf, err := ioutil.ReadFile(artifactPath)
+	if err != nil {
+		return updater.Image{}, xerrors.Errorf(": %v", err)
+	}
+	v := strings.TrimSpace(string(buf))
+	if v == "" {
+		return updater.Image{}, xerrors.New("artifact file is empty")
+	}
+	image := updater.Image{Name: postProcess.Image, NewName: postProcess.NewName}
+	if strings.HasPrefix(v, "sha256:") {
+		image.Digest = v
+	} else {
+		image.Tag = v
 	}
-	sess := session.Must(session.NewSession(cfg))
-	s3Client := s3manager.NewDownloaderWithClient(s3.New(sess))
+
+	return image, nil
+}
+
+func imageRef(image *updater.Image) string {
+	if image.Digest != "" {
+		return image.Digest
+	}
+
+	return image.Tag
+}
+
+func (b *BazelBuild) downloadArtifact(buildCtx *eventContext, buildId string) (string, error) {
+	s3Client := s3manager.NewDownloaderWithClient(newS3Client(b.StorageHost))
 
 	tmpFile, err := ioutil.TempFile("", "")
 	if err != nil {
@@ -233,7 +834,7 @@ func (b *BazelBuild) downloadArtifact(buildCtx *eventContext, buildId string) (s
 
 	_, err = s3Client.Download(tmpFile, &s3.GetObjectInput{
 		Bucket: aws.String(b.ArtifactBucket),
-		Key:    aws.String(fmt.Sprintf("%s-%s-%s.tar", buildCtx.Owner, buildCtx.Repo, buildId)),
+		Key:    aws.String(artifactKey(buildCtx, buildId)),
 	})
 	if err != nil {
 		return "", xerrors.Errorf(": %v", err)
@@ -266,20 +867,26 @@ func (b *BazelBuild) downloadArtifact(buildCtx *eventContext, buildId string) (s
 	return dir, nil
 }
 
-func (b *BazelBuild) buildPod(buildCtx *eventContext, buildId string) *corev1.Pod {
+func (b *BazelBuild) buildPod(buildCtx *eventContext, buildId string) (*corev1.Pod, error) {
 	mainImage := fmt.Sprintf("%s:%s", bazelImage, defaultBazelVersion)
 	if buildCtx.Rule.BazelVersion != "" {
 		mainImage = fmt.Sprintf("%s:%s", bazelImage, buildCtx.Rule.BazelVersion)
 	}
-	hostAliases := make([]corev1.HostAlias, 0)
-	for _, v := range b.HostAliases {
-		hostAliases = append(hostAliases, corev1.HostAlias{Hostnames: v.Hostnames, IP: v.IP})
-	}
-
 	env := make([]corev1.EnvVar, 0)
 	for _, v := range buildCtx.Rule.Env {
 		env = append(env, v.ToEnvVar())
 	}
+	if tag := buildCtx.Tag(); tag != "" {
+		env = append(env, corev1.EnvVar{Name: "RELEASE_TAG", Value: tag})
+	}
+	sidecarArgs := []string{
+		"--action=wait",
+		fmt.Sprintf("--artifact-host=%s", b.StorageHost),
+		fmt.Sprintf("--artifact-bucket=%s", b.ArtifactBucket),
+	}
+	for _, v := range artifactPaths(buildCtx) {
+		sidecarArgs = append(sidecarArgs, fmt.Sprintf("--artifact-path=%s", v))
+	}
 
 	volumes := []corev1.Volume{
 		{
@@ -315,49 +922,35 @@ func (b *BazelBuild) buildPod(buildCtx *eventContext, buildId string) *corev1.Po
 			SubPath:   ".dockerconfigjson"})
 	}
 
-	return &corev1.Pod{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      fmt.Sprintf("%s-%s-%s", buildCtx.Owner, buildCtx.Repo, buildId),
-			Namespace: b.Namespace,
-			Labels: map[string]string{
-				labelKeyJobId:  buildId,
-				labelKeyCtrlBy: "bazel-build",
-			},
-		},
+	return b.podBuilder.Build(&corev1.Pod{
+		ObjectMeta: b.podBuilder.ObjectMeta(
+			fmt.Sprintf("%s-%s-%s", buildCtx.Owner, buildCtx.Repo, buildId),
+			ctrlByBazelBuild,
+			buildId,
+			buildCtx.Annotations(),
+		),
 		Spec: corev1.PodSpec{
 			ServiceAccountName: builderServiceAccount,
 			RestartPolicy:      corev1.RestartPolicyNever,
 			InitContainers: []corev1.Container{
-				{
-					Name:  "pre-process",
-					Image: buildSidecarImage,
-					Args:  []string{"--action=clone", "--work-dir=/work", fmt.Sprintf("--url=%s", buildCtx.CloneURL())},
-					VolumeMounts: []corev1.VolumeMount{
-						{Name: "workdir", MountPath: "/work"},
-					},
-				},
+				b.podBuilder.CloneContainer(buildCtx.CloneURL(b.host), []string{fmt.Sprintf("--commit=%s", buildCtx.Commit)}),
 			},
-			HostAliases: hostAliases,
+			HostAliases: b.podBuilder.HostAliases(),
 			Containers: []corev1.Container{
 				{
 					Name:         "main",
 					Image:        mainImage,
-					Args:         []string{"--output_user_root=/out", "run", buildCtx.Rule.Target},
+					Args:         bazelArgs(buildCtx),
 					WorkingDir:   "/work",
 					Env:          append(env, corev1.EnvVar{Name: "DOCKER_CONFIG", Value: "/home/bazel/.docker"}),
 					VolumeMounts: volumeMounts,
 				},
 				{
-					Name:  "post-process",
-					Image: buildSidecarImage,
-					Args: []string{
-						"--action=wait",
-						fmt.Sprintf("--artifact-host=%s", b.StorageHost),
-						fmt.Sprintf("--artifact-bucket=%s", b.ArtifactBucket),
-						fmt.Sprintf("--artifact-path=%s", buildCtx.Rule.Artifacts[0]),
-					},
+					Name:       "post-process",
+					Image:      buildSidecarImage,
+					Args:       sidecarArgs,
 					WorkingDir: "/work",
-					Env: []corev1.EnvVar{
+					Env: append([]corev1.EnvVar{
 						{Name: "POD_NAME", ValueFrom: &corev1.EnvVarSource{
 							FieldRef: &corev1.ObjectFieldSelector{
 								FieldPath: "metadata.name",
@@ -368,25 +961,9 @@ func (b *BazelBuild) buildPod(buildCtx *eventContext, buildId string) *corev1.Po
 								FieldPath: "metadata.namespace",
 							},
 						}},
-						{Name: "AWS_ACCESS_KEY_ID", ValueFrom: &corev1.EnvVarSource{
-							SecretKeyRef: &corev1.SecretKeySelector{
-								LocalObjectReference: corev1.LocalObjectReference{
-									Name: b.StorageTokenSecretName,
-								},
-								Key: "accesskey",
-							},
-						}},
-						{Name: "AWS_SECRET_ACCESS_KEY", ValueFrom: &corev1.EnvVarSource{
-							SecretKeyRef: &corev1.SecretKeySelector{
-								LocalObjectReference: corev1.LocalObjectReference{
-									Name: b.StorageTokenSecretName,
-								},
-								Key: "secretkey",
-							},
-						}},
 						{Name: "JOB_NAME", Value: fmt.Sprintf("%s-%s", buildCtx.Owner, buildCtx.Repo)},
 						{Name: "JOB_ID", Value: buildId},
-					},
+					}, storageCredentialEnv(b.StorageTokenSecretName)...),
 					VolumeMounts: []corev1.VolumeMount{
 						{Name: "workdir", MountPath: "/work"},
 						{Name: "outdir", MountPath: "/out"},
@@ -395,6 +972,55 @@ func (b *BazelBuild) buildPod(buildCtx *eventContext, buildId string) *corev1.Po
 			},
 			Volumes: volumes,
 		},
+	})
+}
+
+func (b *BazelBuild) buildJob(buildCtx *eventContext, buildId string) (*batchv1.Job, error) {
+	pod, err := b.buildPod(buildCtx, buildId)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pod.Name,
+			Namespace:   b.Namespace,
+			Labels:      pod.Labels,
+			Annotations: pod.Annotations,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            buildCtx.Rule.BackoffLimit,
+			ActiveDeadlineSeconds:   buildCtx.Rule.ActiveDeadlineSeconds,
+			TTLSecondsAfterFinished: b.JobTTLSeconds,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      pod.Labels,
+					Annotations: pod.Annotations,
+				},
+				Spec: pod.Spec,
+			},
+		},
+	}, nil
+}
+
+func storageCredentialEnv(secretName string) []corev1.EnvVar {
+	return []corev1.EnvVar{
+		{Name: "AWS_ACCESS_KEY_ID", ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: secretName,
+				},
+				Key: "accesskey",
+			},
+		}},
+		{Name: "AWS_SECRET_ACCESS_KEY", ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: secretName,
+				},
+				Key: "secretkey",
+			},
+		}},
 	}
 }
 
@@ -416,12 +1042,21 @@ type gitRepo struct {
 	image       string
 	authorName  string
 	authorEmail string
+	baseBranch  string
+	environment string
+	postProcess *config.PostProcess
+	// markers are appended to the body of the pull request
+	markers []string
+	// signKey signs the commits if not nil
+	signKey *openpgp.Entity
 
 	repo      *git.Repository
+	host      *githost.Host
 	transport *ghinstallation.Transport
 }
 
-func newGitRepo(transport *ghinstallation.Transport, owner, repo, image, authorName, authorEmail string) (*gitRepo, error) {
+// newGitRepo clones the repository. The commits are signed by signKey if it is not nil.
+func newGitRepo(host *githost.Host, transport *ghinstallation.Transport, owner, repo, image, authorName, authorEmail, mirrorURL string, signKey *openpgp.Entity) (*gitRepo, error) {
 	dir, err := ioutil.TempDir("", "")
 	if err != nil {
 		return nil, xerrors.Errorf(": %v", err)
@@ -431,15 +1066,28 @@ func newGitRepo(transport *ghinstallation.Transport, owner, repo, image, authorN
 	if err != nil {
 		return nil, xerrors.Errorf(": %v", err)
 	}
-	u := fmt.Sprintf("https://github.com/%s/%s.git", owner, repo)
-	log.Printf("git clone %s", u)
-	r, err := git.PlainClone(dir, false, &git.CloneOptions{
-		URL:   u,
-		Depth: 1,
-		Auth:  &gogitHttp.BasicAuth{Username: "octocast", Password: t},
-	})
-	if err != nil {
-		return nil, xerrors.Errorf(": %v", err)
+	u := host.CloneURL(owner, repo)
+	auth := &gogitHttp.BasicAuth{Username: "octocast", Password: t}
+	var r *git.Repository
+	if mirrorURL != "" {
+		r, err = cloneFromMirror(dir, mirrorURL, owner, repo, u, auth)
+		if err != nil {
+			log.Printf("Failed to clone from the mirror. Fallback to %s: %v", u, err)
+			if err := os.RemoveAll(dir); err != nil {
+				return nil, xerrors.Errorf(": %v", err)
+			}
+		}
+	}
+	if r == nil {
+		log.Printf("git clone %s", u)
+		r, err = git.PlainClone(dir, false, &git.CloneOptions{
+			URL:   u,
+			Depth: 1,
+			Auth:  auth,
+		})
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
 	}
 
 	log.Printf("New git repo: %s/%s in %s with image name: %s", owner, repo, dir, image)
@@ -450,33 +1098,44 @@ func newGitRepo(transport *ghinstallation.Transport, owner, repo, image, authorN
 		image:       image,
 		authorName:  authorName,
 		authorEmail: authorEmail,
+		signKey:     signKey,
 		repo:        r,
+		host:        host,
 		transport:   transport,
 	}, nil
 }
 
-func (g *gitRepo) switchBranch() (string, *git.Worktree, error) {
-	branchName := fmt.Sprintf("update-kustomization-%d", time.Now().Unix())
+// branchName returns the stable name of the branch for the source repository, the image and the environment.
+// The branch is reused by all builds of the source repository.
+func (g *gitRepo) branchName(buildCtx *eventContext) string {
+	image := branchNameEscapeRe.ReplaceAllString(g.image, "-")
+	if g.environment != "" {
+		image += "_" + branchNameEscapeRe.ReplaceAllString(g.environment, "-")
+	}
+	return fmt.Sprintf("%s%s-%s/%s", botBranchPrefix, buildCtx.Owner, buildCtx.Repo, image)
+}
 
-	masterRef, err := g.repo.Reference("refs/remotes/origin/master", true)
+// switchBranch creates the branch from the head of the base branch. The branch is reset even if it already exists.
+func (g *gitRepo) switchBranch(branchName string) (*git.Worktree, error) {
+	baseRef, err := g.repo.Reference(plumbing.ReferenceName(fmt.Sprintf("refs/remotes/origin/%s", g.baseBranch)), true)
 	if err != nil {
-		return "", nil, err
+		return nil, err
 	}
 
-	ref := plumbing.NewHashReference(plumbing.ReferenceName(fmt.Sprintf("refs/heads/%s", branchName)), masterRef.Hash())
+	ref := plumbing.NewHashReference(plumbing.ReferenceName(fmt.Sprintf("refs/heads/%s", branchName)), baseRef.Hash())
 	if err := g.repo.Storer.SetReference(ref); err != nil {
-		return "", nil, err
+		return nil, err
 	}
 
 	tree, err := g.repo.Worktree()
 	if err != nil {
-		return "", nil, err
+		return nil, err
 	}
 	if err := tree.Checkout(&git.CheckoutOptions{Branch: ref.Name()}); err != nil {
-		return "", nil, err
+		return nil, err
 	}
 
-	return branchName, tree, nil
+	return tree, nil
 }
 
 func (g *gitRepo) commit(tree *git.Worktree, path string) error {
@@ -496,6 +1155,7 @@ func (g *gitRepo) commit(tree *git.Worktree, path string) error {
 			Email: g.authorEmail,
 			When:  time.Now(),
 		},
+		SignKey: g.signKey,
 	})
 	if err != nil {
 		return err
@@ -509,114 +1169,241 @@ func (g *gitRepo) push(branchName string) error {
 	if err != nil {
 		return xerrors.Errorf(": %v", err)
 	}
-	refSpec := fmt.Sprintf("refs/heads/%s:refs/heads/%s", branchName, branchName)
-	log.Printf("git push origin %s with %s", refSpec, token)
-	return g.repo.Push(&git.PushOptions{
+	// The branch is force-pushed because it is recreated from the base branch every time
+	refSpec := fmt.Sprintf("+refs/heads/%s:refs/heads/%s", branchName, branchName)
+	log.Printf("git push origin %s", refSpec)
+	err = g.repo.Push(&git.PushOptions{
 		Auth:       &gogitHttp.BasicAuth{Username: "octocat", Password: token},
 		RemoteName: "origin",
 		RefSpecs:   []gitConfig.RefSpec{gitConfig.RefSpec(refSpec)},
 	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+
+	return nil
 }
 
-func (g *gitRepo) createPullRequest(buildCtx *eventContext, branch string, editedFiles []string) error {
-	client := github.NewClient(&http.Client{Transport: g.transport})
+// openPullRequest updates the title and the body of the open pull request of the branch.
+// If there is no open pull request, openPullRequest creates it.
+func (g *gitRepo) openPullRequest(branch string, cl *changelog) (*github.PullRequest, error) {
+	client := g.host.NewClient(&http.Client{Transport: g.transport})
 
-	desc := "Change file(s):\n"
-	for _, v := range editedFiles {
-		desc += v + "\n"
+	title := cl.Title()
+	desc := cl.String()
+	if g.postProcess.AutoMerge != nil {
+		desc += "\n" + newAutoMergeMarker(g.postProcess.AutoMerge) + "\n"
+	}
+	for _, v := range g.markers {
+		desc += "\n" + v + "\n"
+	}
+
+	pulls, _, err := client.PullRequests.List(context.Background(), g.owner, g.repoName, &github.PullRequestListOptions{
+		State: "open",
+		Head:  fmt.Sprintf("%s:%s", g.owner, branch),
+	})
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	if len(pulls) > 0 {
+		pr, _, err := client.PullRequests.Edit(context.Background(), g.owner, g.repoName, pulls[0].GetNumber(), &github.PullRequest{
+			Title: github.String(title),
+			Body:  github.String(desc),
+		})
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		log.Printf("Update the pull request: #%d", pr.GetNumber())
+
+		if err := g.setPullRequestMetadata(client, g.postProcess, pr); err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		return pr, nil
 	}
-	_, _, err := client.PullRequests.Create(context.Background(), g.owner, g.repoName, &github.NewPullRequest{
-		Title: github.String(fmt.Sprintf("Update %s", buildCtx.Repo)),
+
+	pr, _, err := client.PullRequests.Create(context.Background(), g.owner, g.repoName, &github.NewPullRequest{
+		Title: github.String(title),
 		Body:  github.String(desc),
-		Base:  github.String("master"),
+		Base:  github.String(g.baseBranch),
 		Head:  github.String(branch),
 	})
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	log.Printf("Create the pull request: #%d", pr.GetNumber())
+
+	if err := g.setPullRequestMetadata(client, g.postProcess, pr); err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	return pr, nil
+}
+
+// setPullRequestMetadata adds labels, reviewers and assignees to the pull request.
+func (g *gitRepo) setPullRequestMetadata(client *github.Client, postProcess *config.PostProcess, pr *github.PullRequest) error {
+	if len(postProcess.Labels) > 0 {
+		_, _, err := client.Issues.AddLabelsToIssue(context.Background(), g.owner, g.repoName, pr.GetNumber(), postProcess.Labels)
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+	}
+	if len(postProcess.Reviewers) > 0 || len(postProcess.TeamReviewers) > 0 {
+		_, _, err := client.PullRequests.RequestReviewers(context.Background(), g.owner, g.repoName, pr.GetNumber(), github.ReviewersRequest{
+			Reviewers:     postProcess.Reviewers,
+			TeamReviewers: postProcess.TeamReviewers,
+		})
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+	}
+	if len(postProcess.Assignees) > 0 {
+		_, _, err := client.Issues.AddAssignees(context.Background(), g.owner, g.repoName, pr.GetNumber(), postProcess.Assignees)
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+	}
+
+	return nil
+}
+
+// closeSupersededPullRequests closes the open pull requests which are created by the bot for the same source repository.
+// The pull requests which were created by the old version of the bot (update-kustomization-<unix time>) are also closed.
+func (g *gitRepo) closeSupersededPullRequests(buildCtx *eventContext, pr *github.PullRequest) error {
+	client := g.host.NewClient(&http.Client{Transport: g.transport})
+
+	pulls := make([]*github.PullRequest, 0)
+	opt := &github.PullRequestListOptions{State: "open", ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		p, res, err := client.PullRequests.List(context.Background(), g.owner, g.repoName, opt)
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		pulls = append(pulls, p...)
+		if res.NextPage == 0 {
+			break
+		}
+		opt.Page = res.NextPage
+	}
+
+	legacyTitle := fmt.Sprintf("Update %s", buildCtx.Repo)
+	for _, v := range pulls {
+		if v.GetNumber() == pr.GetNumber() {
+			continue
+		}
+		ref := v.GetHead().GetRef()
+		if v.GetHead().GetRepo().GetFullName() != fmt.Sprintf("%s/%s", g.owner, g.repoName) {
+			continue
+		}
+		if ref != g.branchName(buildCtx) && !(strings.HasPrefix(ref, legacyBotBranchPrefix) && v.GetTitle() == legacyTitle) {
+			continue
+		}
+
+		_, _, err := client.Issues.CreateComment(context.Background(), g.owner, g.repoName, v.GetNumber(), &github.IssueComment{
+			Body: github.String(fmt.Sprintf("Superseded by #%d", pr.GetNumber())),
+		})
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		_, _, err = client.PullRequests.Edit(context.Background(), g.owner, g.repoName, v.GetNumber(), &github.PullRequest{
+			State: github.String("closed"),
+		})
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		log.Printf("Close the pull request: #%d", v.GetNumber())
+	}
 
-	return err
+	return nil
 }
 
-func (g *gitRepo) modifyKustomization(paths []string, newImageHash string) ([]string, error) {
+// modifyFiles updates the image in the files, and returns the edited files and the image before updating.
+func (g *gitRepo) modifyFiles(targets []config.UpdateTarget, image updater.Image) ([]string, *updater.Image, error) {
 	editFiles := make([]string, 0)
-	for _, in := range paths {
-		absPath := filepath.Join(g.dir, in)
+	var oldImage *updater.Image
+	for _, target := range targets {
+		u, err := updater.Get(target.Type)
+		if err != nil {
+			return nil, nil, xerrors.Errorf(": %v", err)
+		}
+
+		absPath := filepath.Join(g.dir, target.Path)
 		log.Printf("Read: %s", absPath)
 		b, err := ioutil.ReadFile(absPath)
 		if err != nil {
-			return nil, xerrors.Errorf(": %v", err)
+			return nil, nil, xerrors.Errorf(": %v", err)
 		}
 		if len(b) == 0 {
-			return nil, errors.New("file is empty")
+			return nil, nil, errors.New("file is empty")
 		}
 
-		lines := strings.Split(string(b), "\n")
-		changed := false
-		for i, v := range lines {
-			if strings.Index(v, "digest") == -1 {
-				continue
-			}
-
-			if strings.Index(v, "# bot:") > 0 {
-				re := regexp.MustCompile(`digest:\s+(sha256:[a-zA-Z0-9]+)\s# bot:` + g.image)
-				m := re.FindStringSubmatch(v)
-				if len(m) == 0 {
-					continue
-				}
-				changed = true
-				lines[i] = strings.Replace(v, m[1], newImageHash, 1)
+		if oldImage == nil {
+			current, err := u.Current(b, target.Locator, image)
+			if err != nil {
+				return nil, nil, xerrors.Errorf("%s: %v", target.Path, err)
 			}
+			oldImage = current
+		}
+		edited, err := u.Update(b, target.Locator, image)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("%s: %v", target.Path, err)
 		}
 
-		if changed {
-			editFiles = append(editFiles, in)
-			if err := ioutil.WriteFile(absPath, []byte(strings.Join(lines, "\n")), 0644); err != nil {
-				return nil, xerrors.Errorf(": %v", err)
+		if !bytes.Equal(b, edited) {
+			editFiles = append(editFiles, target.Path)
+			if err := ioutil.WriteFile(absPath, edited, 0644); err != nil {
+				return nil, nil, xerrors.Errorf(": %v", err)
 			}
 		}
 	}
 
-	return editFiles, nil
+	return editFiles, oldImage, nil
 }
 
-func (g *gitRepo) UpdateKustomization(buildCtx *eventContext, artifactPath string, paths []string) error {
-	buf, err := ioutil.ReadFile(artifactPath)
+// UpdateImage updates the image in the files and creates a pull request.
+// The kustomizations which are affected by the change are rendered and validated before committing.
+// describe returns the description of the pull request.
+func (g *gitRepo) UpdateImage(buildCtx *eventContext, image updater.Image, targets []config.UpdateTarget, describe func(oldImage *updater.Image, editedFiles []string) *changelog) (*github.PullRequest, error) {
+	branchName := g.branchName(buildCtx)
+	tree, err := g.switchBranch(branchName)
 	if err != nil {
-		return xerrors.Errorf(": %v", err)
-	}
-	if !bytes.HasPrefix(buf, []byte("sha256:")) {
-		return xerrors.New("artifact file does not contain an image hash")
+		return nil, err
 	}
-	newImageHash := strings.TrimSuffix(string(buf), "\n")
 
-	branchName, tree, err := g.switchBranch()
+	rendered := renderKustomizations(g.dir)
+	editedFiles, oldImage, err := g.modifyFiles(targets, image)
 	if err != nil {
-		return err
+		return nil, xerrors.Errorf(": %v", err)
 	}
-
-	editedFiles, err := g.modifyKustomization(paths, newImageHash)
+	renderedDiff, err := validateKustomizations(g.dir, rendered, editedFiles)
 	if err != nil {
-		return xerrors.Errorf(": %v", err)
+		return nil, xerrors.Errorf("abort updating the image: %v", err)
 	}
 	for _, v := range editedFiles {
 		if err := g.commit(tree, v); err != nil {
-			return xerrors.Errorf(": %v", err)
+			return nil, xerrors.Errorf(": %v", err)
 		}
 	}
 
 	if len(editedFiles) == 0 {
 		log.Print("Skip creating a pull request because not have any change")
-		return nil
+		return nil, nil
 	}
 
 	if err := g.push(branchName); err != nil {
-		return err
+		return nil, err
 	}
 
-	if err := g.createPullRequest(buildCtx, branchName, editedFiles); err != nil {
-		return err
+	cl := describe(oldImage, editedFiles)
+	cl.RenderedDiff = renderedDiff
+	pr, err := g.openPullRequest(branchName, cl)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.closeSupersededPullRequests(buildCtx, pr); err != nil {
+		return nil, xerrors.Errorf(": %v", err)
 	}
 
 	log.Print("Success create a pull request")
-	return nil
+	return pr, nil
 }
 
 func (g *gitRepo) Close() {
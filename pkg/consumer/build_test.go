@@ -5,9 +5,14 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/updater"
 )
 
-func TestGitRepo_modifyKustomization(t *testing.T) {
+func TestGitRepo_modifyFiles(t *testing.T) {
 	dir, err := ioutil.TempDir("", "")
 	if err != nil {
 		t.Fatal(err)
@@ -25,10 +30,19 @@ images:
 	}
 
 	g := &gitRepo{dir: dir, image: "registry.f110.dev/discord-bot/bot"}
-	editedFiles, err := g.modifyKustomization([]string{"kustomization.yaml"}, "sha256:newhash")
+	editedFiles, oldImage, err := g.modifyFiles(
+		[]config.UpdateTarget{{Path: "kustomization.yaml", Type: updater.TypeKustomize}},
+		updater.Image{Name: g.image, Digest: "sha256:newhash"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if len(editedFiles) == 0 {
 		t.Fatal("Expect edit file but not")
 	}
+	if oldImage.Digest != "sha256:a1dfef369a86d399f7445c8ba3c3dffa1079f731120a886dc26d2e9bf9dcc402" {
+		t.Errorf("unexpected old image: %s", oldImage.Digest)
+	}
 
 	b, err := ioutil.ReadFile(filepath.Join(dir, "kustomization.yaml"))
 	if err != nil {
@@ -47,3 +61,70 @@ images:
 		t.Fatal("unexpected file modification")
 	}
 }
+
+func TestBazelBuild_buildJob(t *testing.T) {
+	ttl := int32(600)
+	backoffLimit := int32(3)
+	deadline := int64(1800)
+	b := &BazelBuild{Namespace: "bot", JobTTLSeconds: &ttl, podBuilder: &podBuilder{Namespace: "bot"}}
+	buildCtx := &eventContext{
+		Owner:  "octocat",
+		Repo:   "example",
+		Commit: "abc123",
+		Ref:    "refs/tags/v1.0.0",
+		Rule: &config.BuildRule{
+			Target:                "//:image",
+			Artifacts:             []string{"bazel-bin/image.digest"},
+			BackoffLimit:          &backoffLimit,
+			ActiveDeadlineSeconds: &deadline,
+		},
+	}
+
+	job, err := b.buildJob(buildCtx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Name != "octocat-example-test" {
+		t.Errorf("unexpected job name: %s", job.Name)
+	}
+	if *job.Spec.BackoffLimit != backoffLimit {
+		t.Errorf("Expect backoffLimit is %d: %d", backoffLimit, *job.Spec.BackoffLimit)
+	}
+	if *job.Spec.ActiveDeadlineSeconds != deadline {
+		t.Errorf("Expect activeDeadlineSeconds is %d: %d", deadline, *job.Spec.ActiveDeadlineSeconds)
+	}
+	if *job.Spec.TTLSecondsAfterFinished != ttl {
+		t.Errorf("Expect ttlSecondsAfterFinished is %d: %d", ttl, *job.Spec.TTLSecondsAfterFinished)
+	}
+	if job.Spec.Template.Labels[labelKeyJobId] != "test" {
+		t.Error("Expect the pod template has the job id label")
+	}
+	if job.Spec.Template.Spec.RestartPolicy != corev1.RestartPolicyNever {
+		t.Errorf("unexpected restart policy: %s", job.Spec.Template.Spec.RestartPolicy)
+	}
+	// The tag is built from the commit of the tag instead of the default branch
+	cloneArgs := job.Spec.Template.Spec.InitContainers[0].Args
+	found := false
+	for _, v := range cloneArgs {
+		if v == "--commit=abc123" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expect the clone args have the commit: %v", cloneArgs)
+	}
+}
+
+func TestGitRepo_branchName(t *testing.T) {
+	g := &gitRepo{image: "registry.f110.dev/discord-bot/bot"}
+	name := g.branchName(&eventContext{Owner: "octocat", Repo: "example"})
+	if name != "update-image/octocat-example/registry.f110.dev-discord-bot-bot" {
+		t.Errorf("unexpected branch name: %s", name)
+	}
+
+	g.environment = "production"
+	name = g.branchName(&eventContext{Owner: "octocat", Repo: "example"})
+	if name != "update-image/octocat-example/registry.f110.dev-discord-bot-bot_production" {
+		t.Errorf("unexpected branch name: %s", name)
+	}
+}
@@ -0,0 +1,45 @@
+package consumer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// buildCache is the record of the successful build.
+// The build which has the same content key is skipped, and the artifact of the record is used instead.
+type buildCache struct {
+	BuildId string    `json:"build_id"`
+	BuiltAt time.Time `json:"built_at"`
+}
+
+// buildCacheKey returns the content key of the build.
+// The key consists of the repository, the commit, the hash of the rule and the version of bazel.
+// The tag is also a part of the key because it is embedded in the artifacts of the release.
+func buildCacheKey(buildCtx *eventContext) (string, error) {
+	rule, err := json.Marshal(buildCtx.Rule)
+	if err != nil {
+		return "", err
+	}
+	ruleHash := sha256.Sum256(rule)
+	bazelVersion := buildCtx.Rule.BazelVersion
+	if bazelVersion == "" {
+		bazelVersion = defaultBazelVersion
+	}
+
+	b, err := json.Marshal([]string{
+		buildCtx.Owner,
+		buildCtx.Repo,
+		buildCtx.Commit,
+		hex.EncodeToString(ruleHash[:]),
+		bazelVersion,
+		buildCtx.Tag(),
+	})
+	if err != nil {
+		return "", err
+	}
+	key := sha256.Sum256(b)
+
+	return hex.EncodeToString(key[:]), nil
+}
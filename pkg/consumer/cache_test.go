@@ -0,0 +1,50 @@
+package consumer
+
+import (
+	"testing"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+)
+
+func TestBuildCacheKey(t *testing.T) {
+	newCtx := func() *eventContext {
+		return &eventContext{
+			Owner:  "f110",
+			Repo:   "bot",
+			Commit: "0123456789abcdef",
+			Ref:    "refs/heads/master",
+			Rule:   &config.BuildRule{Target: "//:image", Artifacts: []string{"bazel-bin/image.digest"}},
+		}
+	}
+
+	base, err := buildCacheKey(newCtx())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The branch is not a part of the key
+	ctx := newCtx()
+	ctx.Ref = "refs/heads/feature"
+	if key, _ := buildCacheKey(ctx); key != base {
+		t.Error("Expect the same key for the same commit")
+	}
+
+	changes := map[string]func(ctx *eventContext){
+		"commit":        func(ctx *eventContext) { ctx.Commit = "fedcba9876543210" },
+		"repository":    func(ctx *eventContext) { ctx.Repo = "bot2" },
+		"target":        func(ctx *eventContext) { ctx.Rule.Target = "//:image2" },
+		"bazel version": func(ctx *eventContext) { ctx.Rule.BazelVersion = "3.0.0" },
+		"tag":           func(ctx *eventContext) { ctx.Ref = "refs/tags/v1.0.0" },
+	}
+	for name, fn := range changes {
+		ctx := newCtx()
+		fn(ctx)
+		key, err := buildCacheKey(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key == base {
+			t.Errorf("Expect the key is changed by %s", name)
+		}
+	}
+}
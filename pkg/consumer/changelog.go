@@ -0,0 +1,207 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-github/v29/github"
+	"golang.org/x/xerrors"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/githost"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/updater"
+)
+
+const (
+	maxChangelogCommits = 50
+	// maxRenderedDiffLength keeps the body of the pull request under the limit of GitHub
+	maxRenderedDiffLength = 30000
+)
+
+var squashedPRNumberRe = regexp.MustCompile(`\(#(\d+)\)$`)
+
+// changelog is the description of the pull request of post-process.
+type changelog struct {
+	// Host is the host of the source repository. nil is github.com
+	Host *githost.Host
+	// RepositoryURL is the web page of the source repository which is not hosted on GitHub.
+	// If RepositoryURL is empty, the URL of Host is used.
+	RepositoryURL string
+	Owner         string
+	Repo          string
+	Environment   string
+	OldImage      *updater.Image
+	NewImage      updater.Image
+	OldCommit     string
+	NewCommit     string
+	BuildLogURL   string
+	EditedFiles   []string
+	// RenderedDiff is the diff of the rendered manifests
+	RenderedDiff string
+	// Rollback is true if NewCommit is older than OldCommit. The changes are the commits which are reverted.
+	Rollback bool
+
+	Commits      []github.RepositoryCommit
+	PullRequests []*github.PullRequest
+}
+
+// fetchChanges fetches the commits and the merged pull requests between OldCommit and NewCommit.
+func (c *changelog) fetchChanges(client *github.Client) error {
+	if c.OldCommit == "" || c.OldCommit == c.NewCommit {
+		return nil
+	}
+
+	base, head := c.compareRange()
+	compare, _, err := client.Repositories.CompareCommits(context.Background(), c.Owner, c.Repo, base, head)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	c.Commits = compare.Commits
+
+	for _, v := range c.Commits {
+		n := pullRequestNumberFromMessage(v.GetCommit().GetMessage())
+		if n == 0 {
+			continue
+		}
+		pr, _, err := client.PullRequests.Get(context.Background(), c.Owner, c.Repo, n)
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		c.PullRequests = append(c.PullRequests, pr)
+	}
+
+	return nil
+}
+
+// compareRange returns the base and the head of the changes.
+func (c *changelog) compareRange() (string, string) {
+	if c.Rollback {
+		return c.NewCommit, c.OldCommit
+	}
+
+	return c.OldCommit, c.NewCommit
+}
+
+// Title returns the title of the pull request.
+// If the image is not built by the bot, the title has the tag or the digest instead of the commit.
+func (c *changelog) Title() string {
+	if c.NewCommit == "" {
+		ref := c.NewImage.Tag
+		if c.NewImage.Digest != "" {
+			ref = shortCommit(strings.TrimPrefix(c.NewImage.Digest, "sha256:"))
+		}
+		return fmt.Sprintf("Update %s to %s", c.NewImage.Repository(), ref)
+	}
+	verb := "Update"
+	if c.Rollback {
+		verb = "Rollback"
+	}
+	if c.Environment != "" {
+		return fmt.Sprintf("%s %s to %s in %s", verb, c.Repo, shortCommit(c.NewCommit), c.Environment)
+	}
+
+	return fmt.Sprintf("%s %s to %s", verb, c.Repo, shortCommit(c.NewCommit))
+}
+
+func (c *changelog) String() string {
+	verb, pullRequests, commits := "Update", "Pull requests", "Commits"
+	if c.Rollback {
+		verb, pullRequests, commits = "Roll back", "Reverted pull requests", "Reverted commits"
+	}
+	buf := new(strings.Builder)
+	if c.Environment != "" {
+		fmt.Fprintf(buf, "%s `%s` in %s\n\n", verb, c.NewImage.Name, c.Environment)
+	} else {
+		fmt.Fprintf(buf, "%s `%s`\n\n", verb, c.NewImage.Name)
+	}
+	fmt.Fprint(buf, "| | Image | Commit |\n| --- | --- | --- |\n")
+	if c.OldImage != nil {
+		fmt.Fprintf(buf, "| Old | `%s` | %s |\n", c.OldImage.Ref(), c.commitLink(c.OldCommit))
+	}
+	fmt.Fprintf(buf, "| New | `%s` | %s |\n", c.NewImage.Ref(), c.commitLink(c.NewCommit))
+
+	if c.OldCommit != "" && c.OldCommit != c.NewCommit {
+		base, head := c.compareRange()
+		fmt.Fprintf(buf, "\nCompare: %s/compare/%s...%s\n", c.repositoryURL(), base, head)
+	}
+
+	if len(c.PullRequests) > 0 {
+		fmt.Fprintf(buf, "\n### %s\n\n", pullRequests)
+		for _, v := range c.PullRequests {
+			fmt.Fprintf(buf, "* %s/%s#%d %s\n", c.Owner, c.Repo, v.GetNumber(), v.GetTitle())
+		}
+	}
+	if len(c.Commits) > 0 {
+		fmt.Fprintf(buf, "\n### %s\n\n", commits)
+		for i, v := range c.Commits {
+			if i == maxChangelogCommits {
+				fmt.Fprintf(buf, "* and %d more commits\n", len(c.Commits)-maxChangelogCommits)
+				break
+			}
+			fmt.Fprintf(buf, "* %s %s\n", c.commitLink(v.GetSHA()), strings.SplitN(v.GetCommit().GetMessage(), "\n", 2)[0])
+		}
+	}
+
+	if c.BuildLogURL != "" {
+		fmt.Fprintf(buf, "\n[Build log](%s)\n", c.BuildLogURL)
+	}
+
+	fmt.Fprint(buf, "\nChange file(s):\n")
+	for _, v := range c.EditedFiles {
+		fmt.Fprintf(buf, "* %s\n", v)
+	}
+
+	if c.RenderedDiff != "" {
+		diff := c.RenderedDiff
+		if len(diff) > maxRenderedDiffLength {
+			diff = diff[:maxRenderedDiffLength] + "\n... (truncated)\n"
+		}
+		fmt.Fprintf(buf, "\n<details>\n<summary>Rendered diff</summary>\n\n```diff\n%s```\n\n</details>\n", diff)
+	}
+
+	return buf.String()
+}
+
+func (c *changelog) commitLink(commit string) string {
+	if commit == "" {
+		return "unknown"
+	}
+
+	return fmt.Sprintf("[%s](%s/commit/%s)", shortCommit(commit), c.repositoryURL(), commit)
+}
+
+func (c *changelog) repositoryURL() string {
+	if c.RepositoryURL != "" {
+		return c.RepositoryURL
+	}
+
+	return c.Host.RepositoryURL(c.Owner, c.Repo)
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 7 {
+		return commit[:7]
+	}
+
+	return commit
+}
+
+// pullRequestNumberFromMessage extracts the number of the pull request from the message of the merge commit or the squashed commit.
+func pullRequestNumberFromMessage(msg string) int {
+	if n := extractPRNumberFromMergedMessage(msg); n != 0 {
+		return n
+	}
+
+	m := squashedPRNumberRe.FindStringSubmatch(strings.SplitN(msg, "\n", 2)[0])
+	if m == nil {
+		return 0
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0
+	}
+
+	return n
+}
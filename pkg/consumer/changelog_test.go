@@ -0,0 +1,102 @@
+package consumer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v29/github"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/githost"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/updater"
+)
+
+func TestChangelog_String(t *testing.T) {
+	cl := &changelog{
+		Owner:       "octocat",
+		Repo:        "example",
+		OldImage:    &updater.Image{Name: "registry.f110.dev/example/app", Digest: "sha256:oldhash"},
+		NewImage:    updater.Image{Name: "registry.f110.dev/example/app", Digest: "sha256:newhash"},
+		OldCommit:   "1111111111111111111111111111111111111111",
+		NewCommit:   "2222222222222222222222222222222222222222",
+		BuildLogURL: "https://storage.example.com/logs/octocat-example-test.log",
+		EditedFiles: []string{"example/kustomization.yaml"},
+		Commits: []github.RepositoryCommit{
+			{SHA: github.String("2222222222222222222222222222222222222222"), Commit: &github.Commit{Message: github.String("Add feature (#12)\n\ndetail")}},
+		},
+		PullRequests: []*github.PullRequest{{Number: github.Int(12), Title: github.String("Add feature")}},
+	}
+
+	if cl.Title() != "Update example to 2222222" {
+		t.Errorf("unexpected title: %s", cl.Title())
+	}
+
+	body := cl.String()
+	for _, v := range []string{
+		"`registry.f110.dev/example/app@sha256:oldhash`",
+		"`registry.f110.dev/example/app@sha256:newhash`",
+		"https://github.com/octocat/example/compare/1111111111111111111111111111111111111111...2222222222222222222222222222222222222222",
+		"* octocat/example#12 Add feature",
+		"[2222222](https://github.com/octocat/example/commit/2222222222222222222222222222222222222222) Add feature (#12)\n",
+		"[Build log](https://storage.example.com/logs/octocat-example-test.log)",
+		"* example/kustomization.yaml",
+	} {
+		if !strings.Contains(body, v) {
+			t.Errorf("Expect the body contains %q", v)
+		}
+	}
+	if strings.Contains(body, "detail") {
+		t.Error("Expect the body has only the first line of the commit message")
+	}
+}
+
+func TestChangelog_TitleWithoutCommit(t *testing.T) {
+	cl := &changelog{NewImage: updater.Image{Name: "nginx", Tag: "1.17.8"}}
+	if cl.Title() != "Update nginx to 1.17.8" {
+		t.Errorf("unexpected title: %s", cl.Title())
+	}
+
+	cl = &changelog{NewImage: updater.Image{Name: "nginx", NewName: "mirror/nginx", Digest: "sha256:0123456789abcdef"}}
+	if cl.Title() != "Update mirror/nginx to 0123456" {
+		t.Errorf("unexpected title: %s", cl.Title())
+	}
+}
+
+func TestChangelog_EnterpriseLinks(t *testing.T) {
+	host, err := githost.New("https://github.example.com/api/v3/", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &changelog{
+		Host:      host,
+		Owner:     "octocat",
+		Repo:      "example",
+		OldImage:  &updater.Image{Name: "nginx", Tag: "1.17.7"},
+		NewImage:  updater.Image{Name: "nginx", Tag: "1.17.8"},
+		OldCommit: "0123456789abcdef",
+		NewCommit: "fedcba9876543210",
+	}
+
+	body := cl.String()
+	for _, v := range []string{
+		"[0123456](https://github.example.com/octocat/example/commit/0123456789abcdef)",
+		"Compare: https://github.example.com/octocat/example/compare/0123456789abcdef...fedcba9876543210",
+	} {
+		if !strings.Contains(body, v) {
+			t.Errorf("Expect the body contains %q", v)
+		}
+	}
+}
+
+func TestPullRequestNumberFromMessage(t *testing.T) {
+	cases := map[string]int{
+		"Merge pull request #3 from octocat/feature\n\nAdd feature": 3,
+		"Add feature (#12)\n\ndetail":                               12,
+		"Fix typo":                                                  0,
+	}
+
+	for msg, expect := range cases {
+		if n := pullRequestNumberFromMessage(msg); n != expect {
+			t.Errorf("Expect %d: %d", expect, n)
+		}
+	}
+}
@@ -1,26 +1,48 @@
 package consumer
 
 import (
-	"context"
-	"encoding/base64"
 	"fmt"
 	"log"
-	"net/http"
+	"strconv"
 	"strings"
 
-	"github.com/google/go-github/v29/github"
 	"golang.org/x/xerrors"
 
 	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/githost"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/webhook"
+)
+
+const (
+	annotationKeyRepository  = "k8s-cluster-maintenance-bot.f110.dev/repository"
+	annotationKeyCommit      = "k8s-cluster-maintenance-bot.f110.dev/commit"
+	annotationKeyRef         = "k8s-cluster-maintenance-bot.f110.dev/ref"
+	annotationKeyPullRequest = "k8s-cluster-maintenance-bot.f110.dev/pull-request"
+	annotationKeyRule        = "k8s-cluster-maintenance-bot.f110.dev/rule"
+	annotationKeyProvider    = "k8s-cluster-maintenance-bot.f110.dev/provider"
+	annotationKeyCloneURL    = "k8s-cluster-maintenance-bot.f110.dev/clone-url"
+
+	branchRefPrefix = "refs/heads/"
+	tagRefPrefix    = "refs/tags/"
 )
 
 type eventContext struct {
-	Owner             string
-	Repo              string
-	Commit            string
+	// Provider is the provider of the repository. The empty is GitHub.
+	Provider string
+	Owner    string
+	Repo     string
+	Commit   string
+	Ref      string
+	// RuleName is the name of the rule when the repository has multiple rules
+	RuleName          string
 	Rule              *config.BuildRule
 	PullRequestNumber int
 	Changed           []string
+	// DefaultBranch is the default branch in the payload of the event. It may be empty.
+	DefaultBranch string
+
+	// cloneURL is the URL in the payload of the event. It is used for the providers except GitHub.
+	cloneURL string
 }
 
 type dnsControlContext struct {
@@ -28,66 +50,138 @@ type dnsControlContext struct {
 	Rule *config.DNSControlRule
 }
 
-func NewEventContextFromPushEvent(event *github.PushEvent) *eventContext {
-	commit := event.GetAfter()
-	if commit == "0000000000000000000000000000000000000000" {
-		commit = event.GetBefore()
+func NewEventContextFromPushEvent(event *webhook.PushEvent) *eventContext {
+	commit := event.After
+	if commit == emptyCommit {
+		commit = event.Before
+	}
+	// After is the object of the tag if the annotated tag is pushed
+	if strings.HasPrefix(event.Ref, tagRefPrefix) && event.HeadCommit != "" {
+		commit = event.HeadCommit
 	}
-	s := strings.SplitN(event.Repo.GetFullName(), "/", 2)
 	ctx := &eventContext{
-		Owner:  s[0],
-		Repo:   s[1],
-		Commit: commit,
+		Provider:      event.Repo.Provider,
+		Owner:         event.Repo.Owner,
+		Repo:          event.Repo.Name,
+		Commit:        commit,
+		Ref:           event.Ref,
+		DefaultBranch: event.Repo.DefaultBranch,
+		cloneURL:      event.Repo.CloneURL,
 	}
 
 	return ctx
 }
 
-func NewEventContextFromPullRequest(event *github.PullRequestEvent) *eventContext {
-	s := strings.SplitN(event.Repo.GetFullName(), "/", 2)
+func NewEventContextFromPullRequest(event *webhook.PullRequestEvent) *eventContext {
 	ctx := &eventContext{
-		Owner:             s[0],
-		Repo:              s[1],
-		Commit:            event.PullRequest.Head.GetSHA(),
-		PullRequestNumber: event.PullRequest.GetNumber(),
+		Provider:          event.Repo.Provider,
+		Owner:             event.Repo.Owner,
+		Repo:              event.Repo.Name,
+		Commit:            event.Head,
+		PullRequestNumber: event.Number,
+		DefaultBranch:     event.Repo.DefaultBranch,
+		cloneURL:          event.Repo.CloneURL,
 	}
 
 	return ctx
 }
 
-func (c *eventContext) FetchRuleFile(hClient *http.Client, path string) (string, error) {
-	log.Printf("Fetch rule file via api: %s/%s %s %s", c.Owner, c.Repo, c.Commit, path)
-	client := github.NewClient(hClient)
-	t, _, err := client.Git.GetTree(context.Background(), c.Owner, c.Repo, c.Commit, true)
-	if err != nil {
-		return "", xerrors.Errorf(": %v", err)
+// NewEventContextFromAnnotations restores the context from annotations of the object which is created by the bot.
+func NewEventContextFromAnnotations(annotations map[string]string) (*eventContext, error) {
+	// The owner of GitLab may have the subgroups. The last element is the name of the repository.
+	repository := annotations[annotationKeyRepository]
+	i := strings.LastIndex(repository, "/")
+	if i == -1 {
+		return nil, xerrors.New("repository annotation is not found")
+	}
+	if annotations[annotationKeyCommit] == "" {
+		return nil, xerrors.New("commit annotation is not found")
 	}
 
-	fileSHA := ""
-	for _, v := range t.Entries {
-		if v.GetPath() != path {
-			continue
+	ctx := &eventContext{
+		Owner:    repository[:i],
+		Repo:     repository[i+1:],
+		Commit:   annotations[annotationKeyCommit],
+		Ref:      annotations[annotationKeyRef],
+		RuleName: annotations[annotationKeyRule],
+		Provider: annotations[annotationKeyProvider],
+		cloneURL: annotations[annotationKeyCloneURL],
+	}
+	if v, ok := annotations[annotationKeyPullRequest]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
 		}
-		fileSHA = v.GetSHA()
-		break
+		ctx.PullRequestNumber = n
 	}
 
-	if fileSHA == "" {
-		return "", xerrors.New("run rule file is not found")
+	return ctx, nil
+}
+
+func (c *eventContext) Annotations() map[string]string {
+	a := map[string]string{
+		annotationKeyRepository: fmt.Sprintf("%s/%s", c.Owner, c.Repo),
+		annotationKeyCommit:     c.Commit,
+	}
+	if c.Ref != "" {
+		a[annotationKeyRef] = c.Ref
+	}
+	if c.PullRequestNumber != 0 {
+		a[annotationKeyPullRequest] = strconv.Itoa(c.PullRequestNumber)
+	}
+	if c.RuleName != "" {
+		a[annotationKeyRule] = c.RuleName
+	}
+	if !c.IsGitHub() {
+		a[annotationKeyProvider] = c.Provider
+		a[annotationKeyCloneURL] = c.cloneURL
 	}
 
-	b, _, err := client.Git.GetBlob(context.Background(), c.Owner, c.Repo, fileSHA)
-	if err != nil {
-		return "", xerrors.Errorf(": %v", err)
+	return a
+}
+
+// Tag returns the name of the tag if the event is the push of the tag. Otherwise Tag returns empty.
+func (c *eventContext) Tag() string {
+	if !strings.HasPrefix(c.Ref, tagRefPrefix) {
+		return ""
 	}
-	buf, err := base64.StdEncoding.DecodeString(b.GetContent())
+
+	return strings.TrimPrefix(c.Ref, tagRefPrefix)
+}
+
+// IsGitHub returns true if the repository is hosted on GitHub.
+// The features which depend on the API of GitHub (e.g. the release and the changelog) are available only for GitHub.
+func (c *eventContext) IsGitHub() bool {
+	return c.Provider == "" || c.Provider == webhook.ProviderGitHub
+}
+
+func (c *eventContext) Repository() *webhook.Repository {
+	return &webhook.Repository{Provider: c.Provider, Owner: c.Owner, Name: c.Repo, CloneURL: c.cloneURL, DefaultBranch: c.DefaultBranch}
+}
+
+func (c *eventContext) SetStatus(client webhook.Client, contextName, status, description string) error {
+	if err := client.SetStatus(c.Repository(), c.Commit, contextName, status, description); err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	return nil
+}
+
+func (c *eventContext) FetchRuleFile(client webhook.Client, path string) (string, error) {
+	log.Printf("Fetch rule file via api: %s/%s %s %s", c.Owner, c.Repo, c.Commit, path)
+	b, err := client.FetchFile(c.Repository(), c.Commit, path)
 	if err != nil {
 		return "", xerrors.Errorf(": %v", err)
 	}
 
-	return string(buf), nil
+	return string(b), nil
 }
 
-func (c *eventContext) CloneURL() string {
-	return fmt.Sprintf("https://github.com/%s/%s.git", c.Owner, c.Repo)
+// CloneURL returns the URL of the repository. The URL of the payload is used for the providers except GitHub.
+func (c *eventContext) CloneURL(host *githost.Host) string {
+	if !c.IsGitHub() && c.cloneURL != "" {
+		return c.cloneURL
+	}
+
+	return host.CloneURL(c.Owner, c.Repo)
 }
@@ -0,0 +1,48 @@
+package consumer
+
+import (
+	"testing"
+)
+
+func TestEventContext_Annotations(t *testing.T) {
+	ctx := &eventContext{Owner: "octocat", Repo: "example", Commit: "0123456789abcdef", Ref: "refs/heads/master", PullRequestNumber: 10, RuleName: "api"}
+
+	restored, err := NewEventContextFromAnnotations(ctx.Annotations())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Owner != ctx.Owner || restored.Repo != ctx.Repo {
+		t.Errorf("unexpected repository: %s/%s", restored.Owner, restored.Repo)
+	}
+	if restored.Commit != ctx.Commit {
+		t.Errorf("unexpected commit: %s", restored.Commit)
+	}
+	if restored.Ref != ctx.Ref {
+		t.Errorf("unexpected ref: %s", restored.Ref)
+	}
+	if restored.PullRequestNumber != ctx.PullRequestNumber {
+		t.Errorf("unexpected pull request number: %d", restored.PullRequestNumber)
+	}
+	if restored.RuleName != ctx.RuleName {
+		t.Errorf("unexpected rule name: %s", restored.RuleName)
+	}
+
+	if _, err := NewEventContextFromAnnotations(map[string]string{}); err == nil {
+		t.Error("Expect error")
+	}
+
+	ctx = &eventContext{Provider: "gitlab", Owner: "infra/dns", Repo: "example", Commit: "0123456789abcdef", cloneURL: "https://gitlab.example.com/infra/dns/example.git"}
+	restored, err = NewEventContextFromAnnotations(ctx.Annotations())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Owner != "infra/dns" || restored.Repo != "example" {
+		t.Errorf("unexpected repository: %s/%s", restored.Owner, restored.Repo)
+	}
+	if restored.IsGitHub() {
+		t.Error("Expect gitlab")
+	}
+	if restored.CloneURL(nil) != ctx.cloneURL {
+		t.Errorf("unexpected clone url: %s", restored.CloneURL(nil))
+	}
+}
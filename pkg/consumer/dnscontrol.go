@@ -11,49 +11,98 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/bradleyfalzon/ghinstallation"
 	"github.com/google/go-github/v29/github"
-	"github.com/sourcegraph/go-diff/diff"
 	"golang.org/x/xerrors"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 
 	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/githost"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/webhook"
 )
 
 const (
 	dnscontrolBuildRule    = ".bot/dnscontrol.yaml"
 	defaultDNSControlImage = "registry.f110.dev/dnscontrol/dnscontrol"
+
+	ctrlByDNSControl = "dnscontrol"
+	// skippedDescription is the prefix of the description of the status which is set without running the command
+	skippedDescription = "Skipped: "
+)
+
+// prMergedMessageRes are the patterns of the merge commit of GitHub, Gitea and GitLab.
+var prMergedMessageRes = []*regexp.Regexp{
+	regexp.MustCompile(`^Merge pull request #(\d+) from`),
+	regexp.MustCompile(`^Merge pull request '.*' \(#(\d+)\) from`),
+	regexp.MustCompile(`See merge request \S+!(\d+)`),
+}
+
+const (
+	annotationKeyCommand = "k8s-cluster-maintenance-bot.f110.dev/command"
 )
 
-var prMergedMessageRe = regexp.MustCompile(`^Merge pull request #(\d+) from`)
+type dnsControlCommand struct {
+	// Name is the sub command of dnscontrol
+	Name string
+	// Context is the context of the commit status
+	Context     string
+	Description string
+	// Heading is the heading of the comment
+	Heading string
+}
+
+var (
+	dnsControlPush    = &dnsControlCommand{Name: "push", Context: "execute", Description: "Applying", Heading: "Applied"}
+	dnsControlPreview = &dnsControlCommand{Name: "preview", Context: "preview", Description: "Run dry-run", Heading: "Preview"}
+
+	dnsControlCommands = map[string]*dnsControlCommand{
+		dnsControlPush.Name:    dnsControlPush,
+		dnsControlPreview.Name: dnsControlPreview,
+	}
+)
 
 type DNSControlConsumer struct {
 	Namespace            string
-	HostAliases          []config.HostAlias
 	AppId                int64
 	InstallationId       int64
 	PrivateKeySecretName string
 
-	client   *http.Client
+	client     *http.Client
+	host       *githost.Host
+	clients    webhook.Clients
+	podBuilder *podBuilder
+	// jobs serializes the applies of the same directory
+	jobs     *serialQueue
 	safeMode bool
 	debug    bool
 }
 
 func NewDNSControlConsumer(namespace string, conf *config.Config, safeMode, debug bool) (*DNSControlConsumer, error) {
-	t, err := ghinstallation.NewKeyFromFile(http.DefaultTransport, conf.GitHubAppId, conf.GitHubInstallationId, conf.GitHubAppPrivateKeyFile)
+	host, err := githost.FromConfig(conf)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	t, err := host.NewTransport(conf.GitHubAppId, conf.GitHubInstallationId, conf.GitHubAppPrivateKeyFile)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	podBuilder, err := newPodBuilder(namespace, conf)
 	if err != nil {
 		return nil, xerrors.Errorf(": %v", err)
 	}
 
 	return &DNSControlConsumer{
 		Namespace:            namespace,
-		HostAliases:          conf.HostAliases,
 		AppId:                conf.GitHubAppId,
 		InstallationId:       conf.GitHubInstallationId,
 		PrivateKeySecretName: conf.PrivateKeySecretName,
 		client:               &http.Client{Transport: t},
+		host:                 host,
+		clients:              webhook.NewClients(conf, host.NewClient(&http.Client{Transport: t})),
+		podBuilder:           podBuilder,
+		jobs:                 newSerialQueue(),
 		safeMode:             safeMode,
 		debug:                debug,
 	}, nil
@@ -67,9 +116,9 @@ func (c *DNSControlConsumer) Dispatch(e interface{}) {
 	}
 
 	switch v := e.(type) {
-	case *github.PushEvent:
+	case *webhook.PushEvent:
 		c.dispatchPushEvent(v, client)
-	case *github.PullRequestEvent:
+	case *webhook.PullRequestEvent:
 		c.dispatchPullRequestEvent(v, client)
 	default:
 		log.Print("Unknown event")
@@ -77,48 +126,65 @@ func (c *DNSControlConsumer) Dispatch(e interface{}) {
 
 }
 
-func (c *DNSControlConsumer) dispatchPushEvent(event *github.PushEvent, client *kubernetes.Clientset) {
+func (c *DNSControlConsumer) dispatchPushEvent(event *webhook.PushEvent, client *kubernetes.Clientset) {
 	ctx := &dnsControlContext{eventContext: NewEventContextFromPushEvent(event)}
 	if err := c.fetchRuleFile(ctx); err != nil {
 		errorLog(err)
 		return
 	}
 
-	s := strings.SplitN(event.GetRef(), "/", 3)
+	ghClient := c.host.NewClient(c.client)
+	targetBranch := ctx.Rule.Branch
+	if targetBranch == "" {
+		targetBranch = ctx.Rule.MasterBranch
+	}
+	targetBranch, err := resolveTargetBranch(ghClient, ctx.eventContext, targetBranch)
+	if err != nil {
+		errorLog(err)
+		return
+	}
+	s := strings.SplitN(event.Ref, "/", 3)
 	branch := s[2]
-	switch branch {
-	case ctx.Rule.MasterBranch:
-	default:
+	if branch != targetBranch {
 		return
 	}
 
-	if event.GetHeadCommit() == nil {
+	if event.HeadCommit == "" {
 		log.Print("HeadCommit is empty")
 		return
 	}
 
-	prNumber := extractPRNumberFromMergedMessage(event.GetHeadCommit().GetMessage())
+	prNumber := extractPRNumberFromMergedMessage(event.HeadCommitMessage)
 	if prNumber == 0 {
-		log.Printf("Failed parse commit message. could not extract pr number: %s", event.GetHeadCommit().GetMessage())
+		log.Printf("Failed parse commit message. could not extract pr number: %s", event.HeadCommitMessage)
 		return
 	}
 
-	ghClient := github.NewClient(c.client)
-	compare, _, err := ghClient.Repositories.CompareCommits(context.Background(), ctx.Owner, ctx.Repo, event.GetBefore(), event.GetAfter())
-	if err != nil {
-		errorLog(err)
-		return
+	changed := event.Changed
+	if changed == nil {
+		providerClient, err := c.clients.Get(ctx.Provider)
+		if err != nil {
+			errorLog(xerrors.Errorf(": %v", err))
+			return
+		}
+		changed, err = changedFiles(providerClient, ctx.Repository(), event.Before, event.After)
+		if err != nil {
+			errorLog(err)
+			return
+		}
 	}
-	ok := false
-	for _, v := range compare.Files {
-		log.Print(v.GetFilename())
-		if strings.HasPrefix("/"+v.GetFilename(), ctx.Rule.Dir) {
+	// The changes are applied if the changed files are unknown
+	ok := changed == nil
+	for _, v := range changed {
+		log.Print(v)
+		if strings.HasPrefix("/"+v, ctx.Rule.Dir) {
 			ok = true
 			break
 		}
 	}
+	// The status is not set because the commit is not applied
 	if !ok {
-		errorLog(xerrors.New("nothing change"))
+		log.Printf("Skip %s of %s/%s@%s: Nothing changed", dnsControlPush.Name, ctx.Owner, ctx.Repo, ctx.Commit)
 		return
 	}
 
@@ -126,43 +192,21 @@ func (c *DNSControlConsumer) dispatchPushEvent(event *github.PushEvent, client *
 		log.Print("Finish dispatchPushEvent. because safe mode is on.")
 		return
 	}
+	ctx.PullRequestNumber = prNumber
 
-	if err := c.setStatus(ghClient, ctx, "execute", "pending", "Applying"); err != nil {
-		errorLog(err)
-		return
-	}
-	success := false
-	defer func() {
-		status := "failure"
-		if success {
-			status = "success"
-		}
-
-		if err := c.setStatus(ghClient, ctx, "execute", status, "Applying"); err != nil {
+	c.jobs.Run(dnsControlKey(ctx), func() {
+		pod, err := c.createPod(ctx, client, dnsControlPush)
+		if err != nil {
 			errorLog(err)
 			return
 		}
-	}()
-
-	result, err := c.runExecute(ctx, client)
-	if err != nil {
-		errorLog(err)
-		return
-	}
-
-	comment := "Applied:\n```\n" + result + "\n```\n"
-	_, _, err = ghClient.Issues.CreateComment(context.Background(), ctx.Owner, ctx.Repo, prNumber, &github.IssueComment{Body: github.String(comment)})
-	if err != nil {
-		errorLog(err)
-		return
-	}
-
-	success = true
+		c.finish(ctx, client, pod, dnsControlPush)
+	})
 }
 
-func (c *DNSControlConsumer) dispatchPullRequestEvent(event *github.PullRequestEvent, client *kubernetes.Clientset) {
-	switch event.GetAction() {
-	case "opened", "synchronized":
+func (c *DNSControlConsumer) dispatchPullRequestEvent(event *webhook.PullRequestEvent, client *kubernetes.Clientset) {
+	switch event.Action {
+	case webhook.ActionOpened, webhook.ActionSynchronize:
 	default:
 		return
 	}
@@ -173,19 +217,19 @@ func (c *DNSControlConsumer) dispatchPullRequestEvent(event *github.PullRequestE
 		return
 	}
 
-	ghClient := github.NewClient(c.client)
-	res, _, err := ghClient.PullRequests.GetRaw(context.Background(), ctx.Owner, ctx.Repo, ctx.PullRequestNumber, github.RawOptions{Type: github.Diff})
+	providerClient, err := c.clients.Get(ctx.Provider)
 	if err != nil {
-		errorLog(err)
+		errorLog(xerrors.Errorf(": %v", err))
 		return
 	}
-
-	changed, err := changedFilesFromDiff(res)
+	changed, err := providerClient.PullRequestFiles(ctx.Repository(), ctx.PullRequestNumber)
 	if err != nil {
 		errorLog(err)
 		return
 	}
-	ctx.Changed = changed
+	for _, v := range changed {
+		ctx.Changed = append(ctx.Changed, "/"+v)
+	}
 
 	ok := false
 	for _, v := range ctx.Changed {
@@ -195,84 +239,140 @@ func (c *DNSControlConsumer) dispatchPullRequestEvent(event *github.PullRequestE
 		}
 	}
 	if !ok {
-		errorLog(xerrors.New("nothing change"))
+		c.skip(ctx, dnsControlPreview, "Nothing changed")
 		return
 	}
 
-	if err := c.setStatus(ghClient, ctx, "preview", "pending", "Run dry-run"); err != nil {
+	pod, err := c.createPod(ctx, client, dnsControlPreview)
+	if err != nil {
 		errorLog(err)
 		return
 	}
-	success := false
-	defer func() {
-		status := "failure"
-		if success {
-			status = "success"
-		}
-
-		if err := c.setStatus(ghClient, ctx, "preview", status, "Run dry-run"); err != nil {
-			errorLog(err)
-			return
-		}
-	}()
+	c.finish(ctx, client, pod, dnsControlPreview)
+}
 
-	result, err := c.runPreview(ctx, client)
+// Resume supervises the pod which is left behind by the previous process.
+func (c *DNSControlConsumer) Resume(client *kubernetes.Clientset, o *Orphan) {
+	if o.Pod == nil {
+		return
+	}
+	command, ok := dnsControlCommands[o.Pod.Annotations[annotationKeyCommand]]
+	if !ok {
+		log.Printf("Unknown command: %s", o.Pod.Annotations[annotationKeyCommand])
+		return
+	}
+	eventCtx, err := NewEventContextFromAnnotations(o.Pod.Annotations)
 	if err != nil {
 		errorLog(err)
 		return
 	}
 
-	comment := "Preview:\n```\n" + result + "\n```\n"
-	_, _, err = ghClient.Issues.CreateComment(context.Background(), ctx.Owner, ctx.Repo, ctx.PullRequestNumber, &github.IssueComment{Body: github.String(comment)})
-	if err != nil {
+	ctx := &dnsControlContext{eventContext: eventCtx}
+
+	log.Printf("Resume %s: %s", command.Name, o.Pod.Name)
+	if command != dnsControlPush {
+		go c.finish(ctx, client, o.Pod, command)
+		return
+	}
+	// The apply which is resumed blocks the next apply of the same directory
+	if err := c.fetchRuleFile(ctx); err != nil {
 		errorLog(err)
+		go c.finish(ctx, client, o.Pod, command)
 		return
 	}
-	success = true
+	c.jobs.Go(dnsControlKey(ctx), func() { c.finish(ctx, client, o.Pod, command) })
+}
+
+// dnsControlKey returns the key which serializes the applies of the same directory.
+func dnsControlKey(ctx *dnsControlContext) string {
+	return fmt.Sprintf("%s/%s:%s", ctx.Owner, ctx.Repo, ctx.Rule.Dir)
 }
 
-func (c *DNSControlConsumer) runExecute(ctx *dnsControlContext, client *kubernetes.Clientset) (string, error) {
-	buildId := newBuildId()
+// Abandon deletes the pod which is left behind by the previous process, and reports an error.
+func (c *DNSControlConsumer) Abandon(client *kubernetes.Clientset, o *Orphan) {
+	if o.Pod == nil {
+		return
+	}
 	defer func() {
-		if err := c.cleanup(client, buildId); err != nil {
+		if err := c.cleanup(client, o.Pod.Labels[labelKeyJobId]); err != nil {
 			errorLog(err)
-			return
 		}
 	}()
 
-	pod := c.runPod(ctx, buildId, "push")
-	_, err := client.CoreV1().Pods(c.Namespace).Create(pod)
-	if err != nil {
-		return "", xerrors.Errorf(": %v", err)
+	command, ok := dnsControlCommands[o.Pod.Annotations[annotationKeyCommand]]
+	if !ok {
+		return
 	}
-	_, err = WaitForFinish(client, pod.Namespace, pod.Name)
+	eventCtx, err := NewEventContextFromAnnotations(o.Pod.Annotations)
 	if err != nil {
-		return "", xerrors.Errorf(": %v", err)
+		errorLog(err)
+		return
 	}
-
-	body, err := client.CoreV1().Pods(c.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{Container: "dnscontrol"}).DoRaw()
-	if err != nil {
-		return "", xerrors.Errorf(": %v", err)
+	if err := c.setStatus(&dnsControlContext{eventContext: eventCtx}, command.Context, webhook.StateError, "Abandoned"); err != nil {
+		errorLog(err)
 	}
-
-	return string(body), nil
 }
 
-func (c *DNSControlConsumer) runPreview(ctx *dnsControlContext, client *kubernetes.Clientset) (string, error) {
-	buildId := newBuildId()
+// finish waits for the pod, and reports the result to the pull request and the commit status.
+func (c *DNSControlConsumer) finish(ctx *dnsControlContext, client *kubernetes.Clientset, pod *corev1.Pod, command *dnsControlCommand) {
 	defer func() {
-		if err := c.cleanup(client, buildId); err != nil {
+		if err := c.cleanup(client, pod.Labels[labelKeyJobId]); err != nil {
 			errorLog(err)
 			return
 		}
 	}()
 
-	pod := c.runPod(ctx, buildId, "preview")
-	_, err := client.CoreV1().Pods(c.Namespace).Create(pod)
+	if err := c.setStatus(ctx, command.Context, webhook.StatePending, command.Description); err != nil {
+		errorLog(err)
+		return
+	}
+	success := false
+	defer func() {
+		status := webhook.StateFailure
+		if success {
+			status = webhook.StateSuccess
+		}
+
+		if err := c.setStatus(ctx, command.Context, status, command.Description); err != nil {
+			errorLog(err)
+			return
+		}
+	}()
+
+	result, err := c.waitForResult(client, pod)
 	if err != nil {
-		return "", xerrors.Errorf(": %v", err)
+		errorLog(err)
+		return
+	}
+
+	comment := command.Heading + ":\n```\n" + result + "\n```\n"
+	providerClient, err := c.clients.Get(ctx.Provider)
+	if err != nil {
+		errorLog(xerrors.Errorf(": %v", err))
+		return
+	}
+	if err := providerClient.CreateComment(ctx.Repository(), ctx.PullRequestNumber, comment); err != nil {
+		errorLog(err)
+		return
+	}
+	success = true
+}
+
+func (c *DNSControlConsumer) createPod(ctx *dnsControlContext, client *kubernetes.Clientset, command *dnsControlCommand) (*corev1.Pod, error) {
+	pod, err := c.runPod(ctx, newBuildId(), command.Name)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
 	}
-	_, err = WaitForFinish(client, pod.Namespace, pod.Name)
+	pod, err = client.CoreV1().Pods(c.Namespace).Create(pod)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	return pod, nil
+}
+
+func (c *DNSControlConsumer) waitForResult(client *kubernetes.Clientset, pod *corev1.Pod) (string, error) {
+	_, err := WaitForFinish(client, pod.Namespace, pod.Name)
 	if err != nil {
 		return "", xerrors.Errorf(": %v", err)
 	}
@@ -285,27 +385,30 @@ func (c *DNSControlConsumer) runPreview(ctx *dnsControlContext, client *kubernet
 	return string(body), nil
 }
 
-func (c *DNSControlConsumer) setStatus(ghClient *github.Client, ctx *dnsControlContext, contextName, status, description string) error {
-	_, _, err := ghClient.Repositories.CreateStatus(
-		context.Background(),
-		ctx.Owner,
-		ctx.Repo,
-		ctx.Commit,
-		&github.RepoStatus{
-			Context:     github.String(contextName),
-			State:       github.String(status),
-			Description: github.String(description),
-		},
-	)
+func (c *DNSControlConsumer) setStatus(ctx *dnsControlContext, contextName, status, description string) error {
+	providerClient, err := c.clients.Get(ctx.Provider)
 	if err != nil {
 		return xerrors.Errorf(": %v", err)
 	}
 
-	return nil
+	return ctx.SetStatus(providerClient, contextName, status, description)
+}
+
+// skip reports that the preview is not needed. The status prevents the reconciler from previewing the pull request again.
+// skip must not be used for the apply because the status means that the commit is applied.
+func (c *DNSControlConsumer) skip(ctx *dnsControlContext, command *dnsControlCommand, reason string) {
+	log.Printf("Skip %s of %s/%s@%s: %s", command.Name, ctx.Owner, ctx.Repo, ctx.Commit, reason)
+	if err := c.setStatus(ctx, command.Context, webhook.StateSuccess, skippedDescription+reason); err != nil {
+		errorLog(err)
+	}
 }
 
 func (c *DNSControlConsumer) fetchRuleFile(ctx *dnsControlContext) error {
-	if contents, err := ctx.FetchRuleFile(c.client, dnscontrolBuildRule); err != nil {
+	providerClient, err := c.clients.Get(ctx.Provider)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	if contents, err := ctx.FetchRuleFile(providerClient, dnscontrolBuildRule); err != nil {
 		return xerrors.Errorf(": %v", err)
 	} else {
 		rule, err := config.ParseDNSControlRule(contents)
@@ -365,48 +468,30 @@ func (c *DNSControlConsumer) cleanup(client *kubernetes.Clientset, buildId strin
 	return nil
 }
 
-func (c *DNSControlConsumer) runPod(ctx *dnsControlContext, buildId, command string) *corev1.Pod {
+func (c *DNSControlConsumer) runPod(ctx *dnsControlContext, buildId, command string) (*corev1.Pod, error) {
 	mainImage := defaultDNSControlImage
 	if ctx.Rule.Image != "" {
 		mainImage = ctx.Rule.Image
 	}
-	hostAliases := make([]corev1.HostAlias, 0)
-	for _, v := range c.HostAliases {
-		hostAliases = append(hostAliases, corev1.HostAlias{Hostnames: v.Hostnames, IP: v.IP})
+	cloneArgs := []string{
+		fmt.Sprintf("--commit=%s", ctx.Commit),
+		fmt.Sprintf("--github-app-id=%d", c.AppId),
+		fmt.Sprintf("--github-installation-id=%d", c.InstallationId),
+		"--private-key-file=/etc/sidecar/privatekey.pem",
 	}
 
-	return &corev1.Pod{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      fmt.Sprintf("%s-%s-%s", ctx.Owner, ctx.Repo, buildId),
-			Namespace: c.Namespace,
-			Labels: map[string]string{
-				labelKeyJobId:  buildId,
-				labelKeyCtrlBy: "dnscontrol",
-			},
-		},
+	annotations := ctx.Annotations()
+	annotations[annotationKeyCommand] = command
+
+	return c.podBuilder.Build(&corev1.Pod{
+		ObjectMeta: c.podBuilder.ObjectMeta(fmt.Sprintf("%s-%s-%s", ctx.Owner, ctx.Repo, buildId), ctrlByDNSControl, buildId, annotations),
 		Spec: corev1.PodSpec{
 			ServiceAccountName: builderServiceAccount,
 			RestartPolicy:      corev1.RestartPolicyNever,
 			InitContainers: []corev1.Container{
-				{
-					Name:  "pre-process",
-					Image: buildSidecarImage,
-					Args: []string{
-						"--action=clone",
-						"--work-dir=/work",
-						fmt.Sprintf("--url=%s", ctx.CloneURL()),
-						fmt.Sprintf("--commit=%s", ctx.Commit),
-						fmt.Sprintf("--github-app-id=%d", c.AppId),
-						fmt.Sprintf("--github-installation-id=%d", c.InstallationId),
-						"--private-key-file=/etc/sidecar/privatekey.pem",
-					},
-					VolumeMounts: []corev1.VolumeMount{
-						{Name: "workdir", MountPath: "/work"},
-						{Name: "private-key", MountPath: "/etc/sidecar"},
-					},
-				},
+				c.podBuilder.CloneContainer(ctx.CloneURL(c.host), cloneArgs, corev1.VolumeMount{Name: "private-key", MountPath: "/etc/sidecar"}),
 			},
-			HostAliases: hostAliases,
+			HostAliases: c.podBuilder.HostAliases(),
 			Containers: []corev1.Container{
 				{
 					Name:            "dnscontrol",
@@ -445,39 +530,22 @@ func (c *DNSControlConsumer) runPod(ctx *dnsControlContext, buildId, command str
 				},
 			},
 		},
-	}
-}
-
-func changedFilesFromDiff(v string) ([]string, error) {
-	diffs, err := diff.ParseMultiFileDiff([]byte(v))
-	if err != nil {
-		return nil, xerrors.Errorf(": %v", err)
-	}
-
-	files := make(map[string]struct{})
-	for _, v := range diffs {
-		s := strings.Split(v.NewName, "/")
-		name := strings.Join(s[1:], "/")
-		files[name] = struct{}{}
-	}
-
-	res := make([]string, 0, len(files))
-	for k := range files {
-		res = append(res, "/"+k)
-	}
-
-	return res, nil
+	})
 }
 
 func extractPRNumberFromMergedMessage(msg string) int {
-	matched := prMergedMessageRe.FindStringSubmatch(msg)
-	if len(matched) != 2 {
-		return 0
-	}
-	num, err := strconv.ParseInt(matched[1], 10, 32)
-	if err != nil {
-		return 0
+	for _, re := range prMergedMessageRes {
+		matched := re.FindStringSubmatch(msg)
+		if len(matched) != 2 {
+			continue
+		}
+		num, err := strconv.ParseInt(matched[1], 10, 32)
+		if err != nil {
+			return 0
+		}
+
+		return int(num)
 	}
 
-	return int(num)
+	return 0
 }
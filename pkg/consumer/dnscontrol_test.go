@@ -1,34 +1,13 @@
 package consumer
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
-)
 
-func TestChangedFiles(t *testing.T) {
-	d := `diff --git a/README.md b/README.md
-index 8b30266..c7dd277 100644
---- a/README.md
-+++ b/README.md
-@@ -1 +1,5 @@
--# bot-staging
-\ No newline at end of file
-+# bot-staging
-+
-+# Author
-+
-+Fumihiro Ito`
-
-	files, err := changedFilesFromDiff(d)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if len(files) != 1 {
-		t.Fatalf("Expect 1 file: %d files", len(files))
-	}
-	if files[0] != "/README.md" {
-		t.Errorf("Expect /README.md: %s", files[0])
-	}
-}
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/webhook"
+)
 
 func TestExtractPRNumberFromMergedMessage(t *testing.T) {
 	num := extractPRNumberFromMergedMessage("Merge pull request #2 from f110/pr-test\n\nPR Test")
@@ -40,4 +19,48 @@ func TestExtractPRNumberFromMergedMessage(t *testing.T) {
 	if num != 10000 {
 		t.Errorf("Expect 10000: %d", num)
 	}
+
+	num = extractPRNumberFromMergedMessage("Merge pull request 'Update records' (#12) from pr-test into master")
+	if num != 12 {
+		t.Errorf("Expect 12: %d", num)
+	}
+
+	num = extractPRNumberFromMergedMessage("Merge branch 'pr-test' into 'master'\n\nUpdate records\n\nSee merge request infra/dns!34")
+	if num != 34 {
+		t.Errorf("Expect 34: %d", num)
+	}
+
+	num = extractPRNumberFromMergedMessage("Update records")
+	if num != 0 {
+		t.Errorf("Expect 0: %d", num)
+	}
+}
+
+func TestDNSControlConsumer_SkipPullRequest(t *testing.T) {
+	var status map[string]string
+	m := http.NewServeMux()
+	m.HandleFunc("/api/v1/repos/infra/dns/raw/.bot/dnscontrol.yaml", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("dir: /zones\n"))
+	})
+	m.HandleFunc("/api/v1/repos/infra/dns/pulls/3.diff", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("diff --git a/README.md b/README.md\n--- a/README.md\n+++ b/README.md\n@@ -1 +1 @@\n-a\n+b\n"))
+	})
+	m.HandleFunc("/api/v1/repos/infra/dns/statuses/b2", func(w http.ResponseWriter, req *http.Request) {
+		json.NewDecoder(req.Body).Decode(&status)
+		w.WriteHeader(http.StatusCreated)
+	})
+	s := httptest.NewServer(m)
+	defer s.Close()
+
+	c := &DNSControlConsumer{clients: webhook.Clients{webhook.ProviderGitea: webhook.NewGiteaClient(s.URL, "")}}
+	c.dispatchPullRequestEvent(&webhook.PullRequestEvent{
+		Repo:   &webhook.Repository{Provider: webhook.ProviderGitea, Owner: "infra", Name: "dns"},
+		Action: webhook.ActionOpened,
+		Number: 3,
+		Head:   "b2",
+	}, nil)
+
+	if status["context"] != dnsControlPreview.Context || status["state"] != webhook.StateSuccess {
+		t.Errorf("Expect the skipped status so that the pull request is not dispatched again: %v", status)
+	}
 }
@@ -0,0 +1,69 @@
+package consumer
+
+import (
+	"log"
+
+	"golang.org/x/xerrors"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/mirror"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/webhook"
+)
+
+// GitMirrorConsumer keeps the git mirror up to date by push events.
+type GitMirrorConsumer struct {
+	client *mirror.Client
+}
+
+func NewGitMirrorConsumer(conf *config.Config) *GitMirrorConsumer {
+	return &GitMirrorConsumer{client: mirror.NewClient(conf.GitMirrorURL)}
+}
+
+func (c *GitMirrorConsumer) Dispatch(e interface{}) {
+	event, ok := e.(*webhook.PushEvent)
+	if !ok {
+		log.Print("Not push event")
+		return
+	}
+	ctx := NewEventContextFromPushEvent(event)
+	// The mirror has only the repositories of GitHub
+	if !ctx.IsGitHub() {
+		return
+	}
+
+	if err := c.client.Update(ctx.Owner, ctx.Repo); err != nil {
+		errorLog(err)
+		return
+	}
+	log.Printf("Update mirror: %s/%s", ctx.Owner, ctx.Repo)
+}
+
+// cloneFromMirror clones the repository from the mirror and points origin to upstream.
+// The mirror is not updated because it is updated by the push event. The new commits are fetched from upstream instead.
+func cloneFromMirror(dir, mirrorURL, owner, repo, upstream string, auth transport.AuthMethod) (*git.Repository, error) {
+	c := mirror.NewClient(mirrorURL)
+	log.Printf("git clone %s", c.RepositoryURL(owner, repo))
+	r, err := git.PlainClone(dir, false, &git.CloneOptions{URL: c.RepositoryURL(owner, repo)})
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	cfg, err := r.Config()
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	cfg.Remotes[git.DefaultRemoteName].URLs = []string{upstream}
+	if err := r.Storer.SetConfig(cfg); err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	log.Printf("git fetch %s", upstream)
+	err = r.Fetch(&git.FetchOptions{RemoteName: git.DefaultRemoteName, Auth: auth})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	return r, nil
+}
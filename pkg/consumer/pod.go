@@ -0,0 +1,135 @@
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"golang.org/x/xerrors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/githost"
+)
+
+const (
+	podTemplateConfigMapKey = "template.yaml"
+)
+
+// podBuilder has the parts of the pod which are common to all consumers.
+// If the operator supplies the base PodTemplateSpec, the pod built by the consumer is merged into it with strategic merge patch.
+type podBuilder struct {
+	Namespace    string
+	GitMirrorURL string
+
+	host        *githost.Host
+	hostAliases []config.HostAlias
+	template    *corev1.PodTemplateSpec
+}
+
+// newPodBuilder returns the podBuilder.
+// If the template is supplied with the ConfigMap, it is read only once at here.
+func newPodBuilder(namespace string, conf *config.Config) (*podBuilder, error) {
+	template := conf.PodTemplate
+	if conf.PodTemplateConfigMap != "" {
+		client, err := NewKubernetesClient()
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		cm, err := client.CoreV1().ConfigMaps(namespace).Get(conf.PodTemplateConfigMap, metav1.GetOptions{})
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		v, ok := cm.Data[podTemplateConfigMapKey]
+		if !ok {
+			return nil, xerrors.Errorf("%s is not found in ConfigMap %s", podTemplateConfigMapKey, cm.Name)
+		}
+		t, err := config.ParsePodTemplate([]byte(v))
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		template = t
+	}
+
+	host, err := githost.FromConfig(conf)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	return &podBuilder{
+		Namespace:    namespace,
+		GitMirrorURL: conf.GitMirrorURL,
+		host:         host,
+		hostAliases:  conf.HostAliases,
+		template:     template,
+	}, nil
+}
+
+func (p *podBuilder) ObjectMeta(name, ctrlBy, buildId string, annotations map[string]string) metav1.ObjectMeta {
+	labels := map[string]string{labelKeyCtrlBy: ctrlBy}
+	if buildId != "" {
+		labels[labelKeyJobId] = buildId
+	}
+
+	return metav1.ObjectMeta{
+		Name:        name,
+		Namespace:   p.Namespace,
+		Labels:      labels,
+		Annotations: annotations,
+	}
+}
+
+func (p *podBuilder) HostAliases() []corev1.HostAlias {
+	hostAliases := make([]corev1.HostAlias, 0)
+	for _, v := range p.hostAliases {
+		hostAliases = append(hostAliases, corev1.HostAlias{Hostnames: v.Hostnames, IP: v.IP})
+	}
+
+	return hostAliases
+}
+
+// CloneContainer returns the init container which clones the repository into /work.
+func (p *podBuilder) CloneContainer(cloneURL string, args []string, volumeMounts ...corev1.VolumeMount) corev1.Container {
+	cloneArgs := []string{"--action=clone", "--work-dir=/work", fmt.Sprintf("--url=%s", cloneURL)}
+	cloneArgs = append(cloneArgs, args...)
+	cloneArgs = append(cloneArgs, p.host.Args()...)
+	if p.GitMirrorURL != "" {
+		cloneArgs = append(cloneArgs, fmt.Sprintf("--mirror-url=%s", p.GitMirrorURL))
+	}
+
+	return corev1.Container{
+		Name:         "pre-process",
+		Image:        buildSidecarImage,
+		Args:         cloneArgs,
+		VolumeMounts: append([]corev1.VolumeMount{{Name: "workdir", MountPath: "/work"}}, volumeMounts...),
+	}
+}
+
+// Build merges the pod into the base template.
+// The fields of the pod take precedence over the template.
+func (p *podBuilder) Build(pod *corev1.Pod) (*corev1.Pod, error) {
+	if p.template == nil {
+		return pod, nil
+	}
+
+	base, err := json.Marshal(p.template)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	patch, err := json.Marshal(&corev1.PodTemplateSpec{ObjectMeta: pod.ObjectMeta, Spec: pod.Spec})
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	merged, err := strategicpatch.StrategicMergePatch(base, patch, corev1.PodTemplateSpec{})
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	t := &corev1.PodTemplateSpec{}
+	if err := json.Unmarshal(merged, t); err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	return &corev1.Pod{ObjectMeta: t.ObjectMeta, Spec: t.Spec}, nil
+}
@@ -0,0 +1,83 @@
+package consumer
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+)
+
+func TestPodBuilder_Build(t *testing.T) {
+	template, err := config.ParsePodTemplate([]byte(`metadata:
+  annotations:
+    sidecar.istio.io/inject: "false"
+spec:
+  imagePullSecrets:
+    - name: registry
+  containers:
+    - name: main
+      resources:
+        limits:
+          memory: 4Gi
+    - name: registry-proxy
+      image: registry.f110.dev/proxy`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &podBuilder{
+		Namespace:    "bot",
+		GitMirrorURL: "http://git-mirror:8080",
+		hostAliases:  []config.HostAlias{{Hostnames: []string{"github.com"}, IP: "127.0.0.1"}},
+		template:     template,
+	}
+	pod, err := p.Build(&corev1.Pod{
+		ObjectMeta: p.ObjectMeta("test", ctrlByBazelBuild, "test", map[string]string{annotationKeyCommit: "abc"}),
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{p.CloneContainer("https://github.com/octocat/example.git", nil)},
+			HostAliases:    p.HostAliases(),
+			Containers: []corev1.Container{
+				{Name: "main", Image: "l.gcr.io/google/bazel:2.0.0"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pod.Name != "test" || pod.Namespace != "bot" {
+		t.Errorf("unexpected name: %s/%s", pod.Namespace, pod.Name)
+	}
+	if pod.Labels[labelKeyJobId] != "test" || pod.Labels[labelKeyCtrlBy] != ctrlByBazelBuild {
+		t.Errorf("unexpected labels: %v", pod.Labels)
+	}
+	if pod.Annotations["sidecar.istio.io/inject"] != "false" || pod.Annotations[annotationKeyCommit] != "abc" {
+		t.Errorf("unexpected annotations: %v", pod.Annotations)
+	}
+	if len(pod.Spec.ImagePullSecrets) != 1 {
+		t.Error("Expect the pod has the image pull secret of the template")
+	}
+	if len(pod.Spec.HostAliases) != 1 {
+		t.Error("Expect the pod has the host alias")
+	}
+	if len(pod.Spec.Containers) != 2 {
+		t.Fatalf("Expect the pod has 2 containers: %d", len(pod.Spec.Containers))
+	}
+	for _, v := range pod.Spec.Containers {
+		if v.Name != "main" {
+			continue
+		}
+		if v.Image != "l.gcr.io/google/bazel:2.0.0" {
+			t.Errorf("unexpected image: %s", v.Image)
+		}
+		if v.Resources.Limits.Memory().String() != "4Gi" {
+			t.Errorf("Expect the resources of the template is merged: %v", v.Resources.Limits)
+		}
+	}
+
+	args := pod.Spec.InitContainers[0].Args
+	if args[len(args)-1] != "--mirror-url=http://git-mirror:8080" {
+		t.Errorf("Expect the mirror url is passed: %v", args)
+	}
+}
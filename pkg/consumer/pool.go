@@ -0,0 +1,331 @@
+package consumer
+
+import (
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+
+	"golang.org/x/xerrors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/agent"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+)
+
+const (
+	labelKeyPoolState = "k8s-cluster-maintenance-bot.f110.dev/pool-state"
+
+	ctrlByBuilderPool = "bazel-build-pool"
+	poolStateIdle     = "idle"
+	poolStateBusy     = "busy"
+
+	agentTokenSecretKey = "token"
+)
+
+var (
+	errNoIdleBuilder = xerrors.New("no idle builder")
+)
+
+// builderPool manages pre-started builder pods.
+// Each builder runs the agent and accepts only one job. The pod is deleted after the job and the pool is refilled.
+type builderPool struct {
+	Namespace              string
+	MinIdle                int
+	MaxSize                int
+	BazelVersion           string
+	StorageHost            string
+	StorageTokenSecretName string
+	ArtifactBucket         string
+
+	podBuilder *podBuilder
+	mu         sync.Mutex
+}
+
+func newBuilderPool(namespace string, conf *config.Config, podBuilder *podBuilder) *builderPool {
+	bazelVersion := defaultBazelVersion
+	if conf.BuilderPool.BazelVersion != "" {
+		bazelVersion = conf.BuilderPool.BazelVersion
+	}
+
+	return &builderPool{
+		Namespace:              namespace,
+		MinIdle:                conf.BuilderPool.MinIdle,
+		MaxSize:                conf.BuilderPool.MaxSize,
+		BazelVersion:           bazelVersion,
+		StorageHost:            conf.StorageHost,
+		StorageTokenSecretName: conf.StorageTokenSecretName,
+		ArtifactBucket:         conf.ArtifactBucket,
+		podBuilder:             podBuilder,
+	}
+}
+
+// Accept reports whether a job of the rule can be handed to the builder in the pool.
+// The builder is started before the job is known, so the rule which needs secrets or other version of bazel is not acceptable.
+func (p *builderPool) Accept(rule *config.BuildRule) bool {
+	if rule.DockerConfigSecretName != "" {
+		return false
+	}
+	for _, v := range rule.Env {
+		if v.Secret != nil {
+			return false
+		}
+	}
+	if rule.BazelVersion != "" && rule.BazelVersion != p.BazelVersion {
+		return false
+	}
+
+	return true
+}
+
+func (p *builderPool) Acquire(client *kubernetes.Clientset, buildId string, annotations map[string]string) (*corev1.Pod, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	podList, err := client.CoreV1().Pods(p.Namespace).List(metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s,%s=%s", labelKeyCtrlBy, ctrlByBuilderPool, labelKeyPoolState, poolStateIdle),
+	})
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	for i := range podList.Items {
+		pod := &podList.Items[i]
+		if !isPodReady(pod) {
+			continue
+		}
+
+		pod.Labels[labelKeyPoolState] = poolStateBusy
+		pod.Labels[labelKeyJobId] = buildId
+		if pod.Annotations == nil {
+			pod.Annotations = make(map[string]string)
+		}
+		for k, v := range annotations {
+			pod.Annotations[k] = v
+		}
+		updated, err := client.CoreV1().Pods(p.Namespace).Update(pod)
+		if apierrors.IsConflict(err) {
+			continue
+		}
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+
+		log.Printf("Acquire builder: %s", updated.Name)
+		return updated, nil
+	}
+
+	return nil, errNoIdleBuilder
+}
+
+func (p *builderPool) Fill(client *kubernetes.Clientset) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	podList, err := client.CoreV1().Pods(p.Namespace).List(metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", labelKeyCtrlBy, ctrlByBuilderPool),
+	})
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	total, idle := 0, 0
+	for _, v := range podList.Items {
+		switch v.Status.Phase {
+		case corev1.PodSucceeded, corev1.PodFailed:
+			continue
+		}
+		total++
+		if v.Labels[labelKeyPoolState] == poolStateIdle {
+			idle++
+		}
+	}
+
+	n := p.MinIdle - idle
+	if total+n > p.MaxSize {
+		n = p.MaxSize - total
+	}
+	for i := 0; i < n; i++ {
+		pod, err := p.builderPod()
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		pod, err = client.CoreV1().Pods(p.Namespace).Create(pod)
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		// The agent doesn't start until the secret of the token is created
+		if err := p.createToken(client, pod); err != nil {
+			if err := client.CoreV1().Pods(p.Namespace).Delete(pod.Name, &metav1.DeleteOptions{}); err != nil {
+				errorLog(err)
+			}
+			return xerrors.Errorf(": %v", err)
+		}
+		log.Printf("Create builder: %s", pod.Name)
+	}
+
+	return nil
+}
+
+// createToken creates the secret which has the token of the agent. The secret is deleted with the builder.
+func (p *builderPool) createToken(client *kubernetes.Clientset, pod *corev1.Pod) error {
+	buf := make([]byte, 32)
+	if _, err := cryptorand.Read(buf); err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	_, err := client.CoreV1().Secrets(p.Namespace).Create(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      agentTokenSecretName(pod.Name),
+			Namespace: p.Namespace,
+			Labels:    map[string]string{labelKeyCtrlBy: ctrlByBuilderPool},
+			OwnerReferences: []metav1.OwnerReference{
+				{APIVersion: "v1", Kind: "Pod", Name: pod.Name, UID: pod.UID},
+			},
+		},
+		StringData: map[string]string{agentTokenSecretKey: hex.EncodeToString(buf)},
+	})
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	return nil
+}
+
+// Token returns the token of the agent of the builder.
+func (p *builderPool) Token(client *kubernetes.Clientset, pod *corev1.Pod) (string, error) {
+	secret, err := client.CoreV1().Secrets(p.Namespace).Get(agentTokenSecretName(pod.Name), metav1.GetOptions{})
+	if err != nil {
+		return "", xerrors.Errorf(": %v", err)
+	}
+
+	return string(secret.Data[agentTokenSecretKey]), nil
+}
+
+func agentTokenSecretName(podName string) string {
+	return podName + "-agent-token"
+}
+
+func (p *builderPool) builderPod() (*corev1.Pod, error) {
+	meta := p.podBuilder.ObjectMeta(fmt.Sprintf("bazel-pool-%s", newBuildId()), ctrlByBuilderPool, "", nil)
+	meta.Labels[labelKeyPoolState] = poolStateIdle
+
+	return p.podBuilder.Build(&corev1.Pod{
+		ObjectMeta: meta,
+		Spec: corev1.PodSpec{
+			ServiceAccountName: builderServiceAccount,
+			RestartPolicy:      corev1.RestartPolicyNever,
+			InitContainers: []corev1.Container{
+				{
+					Name:  "install-agent",
+					Image: buildSidecarImage,
+					Args:  []string{"--action=install-agent", "--agent-dir=/agent"},
+					VolumeMounts: []corev1.VolumeMount{
+						{Name: "agent", MountPath: "/agent"},
+					},
+				},
+			},
+			HostAliases: p.podBuilder.HostAliases(),
+			Containers: []corev1.Container{
+				{
+					Name:    "main",
+					Image:   fmt.Sprintf("%s:%s", bazelImage, p.BazelVersion),
+					Command: []string{"/agent/build-sidecar"},
+					Args: append([]string{
+						"--action=agent",
+						"--work-dir=/work",
+					}, p.podBuilder.host.Args()...),
+					WorkingDir: "/work",
+					// The agent runs the code of the repository. So the agent has only the token and never has the credential of the storage.
+					Env: []corev1.EnvVar{
+						{Name: agent.TokenEnv, ValueFrom: &corev1.EnvVarSource{
+							SecretKeyRef: &corev1.SecretKeySelector{
+								LocalObjectReference: corev1.LocalObjectReference{Name: agentTokenSecretName(meta.Name)},
+								Key:                  agentTokenSecretKey,
+							},
+						}},
+					},
+					Ports: []corev1.ContainerPort{
+						{Name: "agent", ContainerPort: agent.Port},
+					},
+					ReadinessProbe: &corev1.Probe{
+						Handler: corev1.Handler{
+							HTTPGet: &corev1.HTTPGetAction{
+								Path: agent.HealthPath,
+								Port: intstr.FromInt(agent.Port),
+							},
+						},
+					},
+					VolumeMounts: []corev1.VolumeMount{
+						{Name: "workdir", MountPath: "/work"},
+						{Name: "outdir", MountPath: "/out"},
+						{Name: "agent", MountPath: "/agent"},
+					},
+				},
+				{
+					Name:  "post-process",
+					Image: buildSidecarImage,
+					Args: []string{
+						"--action=wait",
+						fmt.Sprintf("--artifact-host=%s", p.StorageHost),
+						fmt.Sprintf("--artifact-bucket=%s", p.ArtifactBucket),
+					},
+					WorkingDir: "/work",
+					Env: append([]corev1.EnvVar{
+						{Name: "POD_NAME", ValueFrom: &corev1.EnvVarSource{
+							FieldRef: &corev1.ObjectFieldSelector{
+								FieldPath: "metadata.name",
+							},
+						}},
+						{Name: "POD_NAMESPACE", ValueFrom: &corev1.EnvVarSource{
+							FieldRef: &corev1.ObjectFieldSelector{
+								FieldPath: "metadata.namespace",
+							},
+						}},
+					}, storageCredentialEnv(p.StorageTokenSecretName)...),
+					VolumeMounts: []corev1.VolumeMount{
+						{Name: "workdir", MountPath: "/work"},
+					},
+				},
+			},
+			Volumes: []corev1.Volume{
+				{
+					Name: "workdir",
+					VolumeSource: corev1.VolumeSource{
+						EmptyDir: &corev1.EmptyDirVolumeSource{},
+					},
+				},
+				{
+					Name: "outdir",
+					VolumeSource: corev1.VolumeSource{
+						EmptyDir: &corev1.EmptyDirVolumeSource{},
+					},
+				},
+				{
+					Name: "agent",
+					VolumeSource: corev1.VolumeSource{
+						EmptyDir: &corev1.EmptyDirVolumeSource{},
+					},
+				},
+			},
+		},
+	})
+}
+
+func isPodReady(pod *corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodRunning {
+		return false
+	}
+	for _, v := range pod.Status.Conditions {
+		if v.Type == corev1.PodReady {
+			return v.Status == corev1.ConditionTrue
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,90 @@
+package consumer
+
+import (
+	"testing"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/agent"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/githost"
+)
+
+func TestBuilderPool_Accept(t *testing.T) {
+	p := &builderPool{BazelVersion: defaultBazelVersion}
+
+	if !p.Accept(&config.BuildRule{Env: []config.Env{{Name: "FOO", Value: "bar"}}}) {
+		t.Error("Expect to accept the rule which has only plain env")
+	}
+	if !p.Accept(&config.BuildRule{BazelVersion: defaultBazelVersion}) {
+		t.Error("Expect to accept the rule which has same version of bazel")
+	}
+	if p.Accept(&config.BuildRule{BazelVersion: "1.2.1"}) {
+		t.Error("Expect not to accept the rule which needs other version of bazel")
+	}
+	if p.Accept(&config.BuildRule{DockerConfigSecretName: "docker-config"}) {
+		t.Error("Expect not to accept the rule which needs docker config")
+	}
+	if p.Accept(&config.BuildRule{Env: []config.Env{{Name: "TOKEN", Secret: &config.SecretSource{Name: "token", Key: "token"}}}}) {
+		t.Error("Expect not to accept the rule which needs secret")
+	}
+}
+
+func TestBazelBuild_poolJob(t *testing.T) {
+	host, err := githost.New("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &BazelBuild{host: host}
+	buildCtx := &eventContext{
+		Owner:  "octocat",
+		Repo:   "example",
+		Commit: "abc123",
+		Ref:    "refs/heads/feature",
+		Rule:   &config.BuildRule{Target: "//:image", Artifacts: []string{"bazel-bin/image.digest"}},
+	}
+
+	job := b.poolJob(buildCtx, "test")
+	if job.Commit != "abc123" {
+		t.Errorf("Expect the job has the commit of the event: %s", job.Commit)
+	}
+	if job.JobName != "octocat-example" || job.JobId != "test" {
+		t.Errorf("Unexpected job: %+v", job)
+	}
+}
+
+func TestBuilderPool_builderPod(t *testing.T) {
+	host, err := githost.New("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &builderPool{Namespace: "bot", BazelVersion: defaultBazelVersion, StorageTokenSecretName: "storage", podBuilder: &podBuilder{Namespace: "bot", host: host}}
+
+	pod, err := p.builderPod()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range pod.Spec.Containers {
+		hasCredential, hasToken := false, false
+		for _, v := range c.Env {
+			switch v.Name {
+			case "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY":
+				hasCredential = true
+			case agent.TokenEnv:
+				hasToken = true
+				if v.ValueFrom.SecretKeyRef.Name != agentTokenSecretName(pod.Name) {
+					t.Errorf("Unexpected secret of the token: %s", v.ValueFrom.SecretKeyRef.Name)
+				}
+			}
+		}
+
+		switch c.Name {
+		case "main":
+			if hasCredential || !hasToken {
+				t.Error("Expect the agent has only the token")
+			}
+		case "post-process":
+			if !hasCredential || hasToken {
+				t.Error("Expect the uploader has only the credential of the storage")
+			}
+		}
+	}
+}
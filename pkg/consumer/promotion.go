@@ -0,0 +1,465 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v29/github"
+	"golang.org/x/xerrors"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/updater"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/webhook"
+)
+
+const (
+	promotionMarkerFormat = "<!-- k8s-cluster-maintenance-bot/promotion: %s -->"
+	promoteCommand        = "/promote"
+
+	stageStateOpened = "opened"
+	stageStateMerged = "merged"
+	stageStateClosed = "closed"
+)
+
+var promotionMarkerRe = regexp.MustCompile(`<!-- k8s-cluster-maintenance-bot/promotion: (.+) -->`)
+
+// promotion is the state of the promotion pipeline of the image.
+// The record is stored in the artifact bucket until the pull requests of all environments are opened.
+type promotion struct {
+	Owner   string `json:"owner"`
+	Repo    string `json:"repo"`
+	Commit  string `json:"commit"`
+	BuildId string `json:"build_id"`
+	// Rule is the name of the rule when the source repository has multiple rules
+	Rule string `json:"rule,omitempty"`
+	// Provider and CloneURL are set if the source repository is not hosted on GitHub
+	Provider string            `json:"provider,omitempty"`
+	CloneURL string            `json:"clone_url,omitempty"`
+	Image    updater.Image     `json:"image"`
+	Stages   []*promotionStage `json:"stages"`
+}
+
+type promotionStage struct {
+	Environment string `json:"environment"`
+	// State is empty, opened, merged or closed
+	State  string `json:"state,omitempty"`
+	Owner  string `json:"owner,omitempty"`
+	Repo   string `json:"repo,omitempty"`
+	Number int    `json:"number,omitempty"`
+	// Branch is the head branch of the pull request
+	Branch   string    `json:"branch,omitempty"`
+	Approved bool      `json:"approved,omitempty"`
+	OpenedAt time.Time `json:"opened_at,omitempty"`
+	MergedAt time.Time `json:"merged_at,omitempty"`
+}
+
+// promotionMarker is embedded in the body of the pull request to find the promotion from the events of the pull request.
+type promotionMarker struct {
+	Image       string `json:"image"`
+	Ref         string `json:"ref"`
+	Environment string `json:"environment"`
+}
+
+func newPromotionMarker(p *promotion, env string) string {
+	b, err := json.Marshal(&promotionMarker{Image: p.Image.Name, Ref: imageRef(&p.Image), Environment: env})
+	if err != nil {
+		return ""
+	}
+
+	return fmt.Sprintf(promotionMarkerFormat, string(b))
+}
+
+func parsePromotionMarker(body string) *promotionMarker {
+	m := promotionMarkerRe.FindStringSubmatch(body)
+	if m == nil {
+		return nil
+	}
+	marker := &promotionMarker{}
+	if err := json.Unmarshal([]byte(m[1]), marker); err != nil {
+		return nil
+	}
+
+	return marker
+}
+
+// stage returns the index of the stage of the environment. If the environment is not found, stage returns -1.
+func (p *promotion) stage(env string) int {
+	for i, v := range p.Stages {
+		if v.Environment == env {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// pullRequestOf returns true if pr is the pull request of the stage.
+func (s *promotionStage) pullRequestOf(owner, repo string, pr *github.PullRequest) bool {
+	if s.Owner != owner || s.Repo != repo || s.Number != pr.GetNumber() {
+		return false
+	}
+	// The record which is saved by the older version doesn't have the branch
+	return s.Branch == "" || s.Branch == pr.GetHead().GetRef()
+}
+
+func (p *promotion) finished() bool {
+	for _, v := range p.Stages {
+		if v.State == "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// stopped returns true if the pull request of any environment is closed without merging.
+func (p *promotion) stopped() bool {
+	for _, v := range p.Stages {
+		if v.State == stageStateClosed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// promotionReady returns true if the condition of the environment is satisfied.
+// If the condition will be satisfied by elapsing the time, promotionReady also returns the duration to wait.
+func promotionReady(env *config.Environment, stage, prev *promotionStage, now time.Time) (bool, time.Duration) {
+	if prev == nil {
+		return true, 0
+	}
+
+	switch env.Promotion {
+	case config.PromotionImmediate:
+		return prev.State == stageStateOpened || prev.State == stageStateMerged, 0
+	case config.PromotionSoak:
+		if prev.State != stageStateMerged {
+			return false, 0
+		}
+		if wait := prev.MergedAt.Add(env.SoakDuration).Sub(now); wait > 0 {
+			return false, wait
+		}
+		return true, 0
+	case config.PromotionCommand:
+		return prev.State == stageStateMerged && stage.Approved, 0
+	default:
+		return prev.State == stageStateMerged, 0
+	}
+}
+
+// startPromotion starts the promotion pipeline of the image. The pipeline of the previous image is discarded.
+func (b *BazelBuild) startPromotion(buildCtx *eventContext, buildId string, image updater.Image) error {
+	p := &promotion{
+		Owner:   buildCtx.Owner,
+		Repo:    buildCtx.Repo,
+		Commit:  buildCtx.Commit,
+		BuildId: buildId,
+		Rule:    buildCtx.RuleName,
+		Image:   image,
+	}
+	if !buildCtx.IsGitHub() {
+		p.Provider, p.CloneURL = buildCtx.Provider, buildCtx.cloneURL
+	}
+	for _, v := range buildCtx.Rule.PostProcess.Stages() {
+		p.Stages = append(p.Stages, &promotionStage{Environment: v.Name})
+	}
+
+	b.promotionMu.Lock()
+	defer b.promotionMu.Unlock()
+
+	if len(p.Stages) > 1 {
+		superseded, err := b.listPromotions(image.Name)
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		for _, v := range superseded {
+			if err := b.deletePromotion(v.Image.Name, imageRef(&v.Image)); err != nil {
+				return xerrors.Errorf(": %v", err)
+			}
+		}
+	}
+
+	return b.advancePromotion(buildCtx, p)
+}
+
+// advancePromotion opens the pull requests of the environments whose condition is satisfied.
+// The caller must hold promotionMu.
+func (b *BazelBuild) advancePromotion(buildCtx *eventContext, p *promotion) error {
+	envs := make(map[string]*config.Environment)
+	for _, v := range buildCtx.Rule.PostProcess.Stages() {
+		envs[v.Name] = v
+	}
+
+	var advanceErr error
+	for i, s := range p.Stages {
+		if s.State != "" {
+			continue
+		}
+		env, ok := envs[s.Environment]
+		if !ok {
+			advanceErr = xerrors.Errorf("environment %s is not found in the rule of %s/%s", s.Environment, p.Owner, p.Repo)
+			break
+		}
+		var prev *promotionStage
+		if i > 0 {
+			prev = p.Stages[i-1]
+		}
+		ready, wait := promotionReady(env, s, prev, time.Now())
+		if !ready {
+			if wait > 0 {
+				log.Printf("Promote %s to %s after %v", imageRef(&p.Image), env.Name, wait)
+				b.schedulePromotion(p.Image.Name, imageRef(&p.Image), wait)
+			}
+			break
+		}
+
+		marker := ""
+		if env.Name != "" {
+			marker = newPromotionMarker(p, env.Name)
+		}
+		pr, err := b.updateEnvironment(buildCtx, p.BuildId, env, p.Image, marker)
+		if err != nil {
+			advanceErr = xerrors.Errorf(": %v", err)
+			break
+		}
+		if pr == nil {
+			// The environment already has the image
+			s.State = stageStateMerged
+			s.MergedAt = time.Now()
+			continue
+		}
+		s.State = stageStateOpened
+		s.Owner, s.Repo = pr.GetBase().GetRepo().GetOwner().GetLogin(), pr.GetBase().GetRepo().GetName()
+		s.Number, s.Branch = pr.GetNumber(), pr.GetHead().GetRef()
+		s.OpenedAt = time.Now()
+	}
+
+	if p.finished() || p.stopped() {
+		if err := b.deletePromotion(p.Image.Name, imageRef(&p.Image)); err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		return advanceErr
+	}
+	if err := b.savePromotion(p); err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	return advanceErr
+}
+
+// updateEnvironment opens the pull request which updates the image of the environment.
+// If the environment already has the image, updateEnvironment returns nil.
+func (b *BazelBuild) updateEnvironment(buildCtx *eventContext, buildId string, env *config.Environment, image updater.Image, marker string) (*github.PullRequest, error) {
+	s := strings.SplitN(env.Repo, "/", 2)
+	if len(s) != 2 {
+		return nil, xerrors.Errorf("invalid repository name: %s", env.Repo)
+	}
+	baseBranch, err := resolveBranch(b.host.NewClient(&http.Client{Transport: b.transport}), s[0], s[1], env.BaseBranch)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	r, err := newGitRepo(b.host, b.transport, s[0], s[1], env.Image, b.AuthorName, b.AuthorEmail, b.GitMirrorURL, b.signKey)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	defer r.Close()
+	r.baseBranch = baseBranch
+	r.environment = env.Name
+	r.postProcess = &env.PostProcess
+	if marker != "" {
+		r.markers = append(r.markers, marker)
+	}
+	r.markers = append(r.markers, newImageMarker(image.Name, env.Name))
+
+	image.Name, image.NewName = env.Image, env.NewName
+	pr, err := r.UpdateImage(buildCtx, image, env.UpdateTargets(), func(oldImage *updater.Image, editedFiles []string) *changelog {
+		cl := b.newChangelog(buildCtx, buildId, oldImage, image, editedFiles)
+		cl.Environment = env.Name
+		return cl
+	})
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	if pr != nil && env.AutoMerge != nil {
+		b.autoMerge.Schedule(r.owner, r.repoName, pr.GetNumber(), env.AutoMerge.DelayDuration)
+	}
+
+	return pr, nil
+}
+
+// Promote advances the promotion pipeline when the pull request of the environment is closed or "/promote" is commented.
+// The manifest repositories have to be allowed to send pull_request and issue_comment event.
+func (b *BazelBuild) Promote(e interface{}) {
+	switch event := e.(type) {
+	case *webhook.PullRequestEvent:
+		// The pull requests of the promotion are opened on GitHub
+		if event.Repo.Provider != webhook.ProviderGitHub || event.Action != webhook.ActionClosed {
+			return
+		}
+		pr, err := b.botPullRequest(event.Repo.Owner, event.Repo.Name, event.Number)
+		if err != nil {
+			errorLog(err)
+			return
+		}
+		if pr == nil {
+			return
+		}
+		marker := parsePromotionMarker(pr.GetBody())
+		if marker == nil {
+			return
+		}
+
+		err = b.updatePromotion(marker, func(p *promotion) bool {
+			i := p.stage(marker.Environment)
+			if i == -1 || !p.Stages[i].pullRequestOf(event.Repo.Owner, event.Repo.Name, pr) {
+				return false
+			}
+			if event.Merged {
+				p.Stages[i].State = stageStateMerged
+				p.Stages[i].MergedAt = event.MergedAt
+			} else {
+				log.Printf("Stop the promotion of %s because #%d is closed", marker.Ref, event.Number)
+				p.Stages[i].State = stageStateClosed
+			}
+			return true
+		})
+		if err != nil {
+			errorLog(err)
+		}
+	case *github.IssueCommentEvent:
+		if event.GetAction() != "created" || !event.GetIssue().IsPullRequest() {
+			return
+		}
+		if strings.TrimSpace(event.GetComment().GetBody()) != promoteCommand {
+			return
+		}
+		if !commandAllowed(event.GetComment()) {
+			log.Printf("%s is not allowed to promote", event.GetComment().GetUser().GetLogin())
+			return
+		}
+		owner, repo := event.GetRepo().GetOwner().GetLogin(), event.GetRepo().GetName()
+		pr, err := b.botPullRequest(owner, repo, event.GetIssue().GetNumber())
+		if err != nil {
+			errorLog(err)
+			return
+		}
+		if pr == nil {
+			return
+		}
+		marker := parsePromotionMarker(pr.GetBody())
+		if marker == nil {
+			return
+		}
+
+		err = b.updatePromotion(marker, func(p *promotion) bool {
+			i := p.stage(marker.Environment)
+			if i == -1 || i+1 >= len(p.Stages) || !p.Stages[i].pullRequestOf(owner, repo, pr) {
+				return false
+			}
+			p.Stages[i+1].Approved = true
+			return true
+		})
+		if err != nil {
+			errorLog(err)
+		}
+	}
+}
+
+// botPullRequest returns the pull request if it is opened by the bot. Otherwise botPullRequest returns nil.
+// The marker in the pull request of the other user is not trusted because anyone can write it.
+func (b *BazelBuild) botPullRequest(owner, repo string, number int) (*github.PullRequest, error) {
+	client := b.host.NewClient(&http.Client{Transport: b.transport})
+	pr, _, err := client.PullRequests.Get(context.Background(), owner, repo, number)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	if !isBotPullRequest(pr, b.botLogin) {
+		return nil, nil
+	}
+
+	return pr, nil
+}
+
+// commandAllowed returns true if the author of the comment has the write access to the repository.
+func commandAllowed(comment *github.IssueComment) bool {
+	switch comment.GetAuthorAssociation() {
+	case "OWNER", "MEMBER", "COLLABORATOR":
+		return true
+	}
+
+	return false
+}
+
+// ResumePromotions advances all promotions in progress. The timers of soak are also restored.
+func (b *BazelBuild) ResumePromotions() error {
+	b.promotionMu.Lock()
+	defer b.promotionMu.Unlock()
+
+	promotions, err := b.listPromotions("")
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	for _, p := range promotions {
+		buildCtx, err := b.promotionContext(p)
+		if err != nil {
+			errorLog(err)
+			continue
+		}
+		if err := b.advancePromotion(buildCtx, p); err != nil {
+			errorLog(err)
+		}
+	}
+
+	return nil
+}
+
+func (b *BazelBuild) schedulePromotion(image, ref string, d time.Duration) {
+	time.AfterFunc(d, func() {
+		err := b.updatePromotion(&promotionMarker{Image: image, Ref: ref}, func(_ *promotion) bool { return true })
+		if err != nil {
+			errorLog(err)
+		}
+	})
+}
+
+// updatePromotion applies fn to the promotion and advances it if fn returns true.
+func (b *BazelBuild) updatePromotion(marker *promotionMarker, fn func(p *promotion) bool) error {
+	b.promotionMu.Lock()
+	defer b.promotionMu.Unlock()
+
+	p, err := b.findPromotion(marker.Image, marker.Ref)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	if p == nil || !fn(p) {
+		return nil
+	}
+
+	buildCtx, err := b.promotionContext(p)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	return b.advancePromotion(buildCtx, p)
+}
+
+// promotionContext restores the context of the build from the promotion.
+// The rule is fetched from the commit which the image is built from.
+func (b *BazelBuild) promotionContext(p *promotion) (*eventContext, error) {
+	buildCtx := &eventContext{Provider: p.Provider, Owner: p.Owner, Repo: p.Repo, Commit: p.Commit, RuleName: p.Rule, cloneURL: p.CloneURL}
+	if err := b.fetchRule(buildCtx); err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	if buildCtx.Rule.PostProcess == nil {
+		return nil, xerrors.Errorf("%s/%s@%s doesn't have post_process", p.Owner, p.Repo, p.Commit)
+	}
+
+	return buildCtx, nil
+}
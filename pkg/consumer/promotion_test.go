@@ -0,0 +1,104 @@
+package consumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v29/github"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/updater"
+)
+
+func TestPromotionMarker(t *testing.T) {
+	p := &promotion{Image: updater.Image{Name: "registry.f110.dev/bot", Digest: "sha256:abcd"}}
+	body := "Update `registry.f110.dev/bot`\n\n" + newPromotionMarker(p, "staging") + "\n"
+
+	marker := parsePromotionMarker(body)
+	if marker == nil {
+		t.Fatal("Expect to find the marker")
+	}
+	if marker.Image != "registry.f110.dev/bot" || marker.Ref != "sha256:abcd" || marker.Environment != "staging" {
+		t.Errorf("unexpected marker: %+v", marker)
+	}
+
+	if parsePromotionMarker("Update `registry.f110.dev/bot`") != nil {
+		t.Error("Expect not to find the marker")
+	}
+}
+
+func TestPromotionReady(t *testing.T) {
+	now := time.Now()
+
+	cases := []struct {
+		Name      string
+		Promotion string
+		Stage     *promotionStage
+		Prev      *promotionStage
+		Ready     bool
+		Wait      time.Duration
+	}{
+		{Name: "first", Promotion: config.PromotionImmediate, Stage: &promotionStage{}, Ready: true},
+		{Name: "immediate", Promotion: config.PromotionImmediate, Stage: &promotionStage{}, Prev: &promotionStage{State: stageStateOpened}, Ready: true},
+		{Name: "immediate not opened", Promotion: config.PromotionImmediate, Stage: &promotionStage{}, Prev: &promotionStage{}},
+		{Name: "merged", Promotion: config.PromotionMerged, Stage: &promotionStage{}, Prev: &promotionStage{State: stageStateMerged}, Ready: true},
+		{Name: "not merged", Promotion: config.PromotionMerged, Stage: &promotionStage{}, Prev: &promotionStage{State: stageStateOpened}},
+		{Name: "closed", Promotion: config.PromotionImmediate, Stage: &promotionStage{}, Prev: &promotionStage{State: stageStateClosed}},
+		{Name: "soak elapsed", Promotion: config.PromotionSoak, Stage: &promotionStage{}, Prev: &promotionStage{State: stageStateMerged, MergedAt: now.Add(-2 * time.Hour)}, Ready: true},
+		{Name: "soaking", Promotion: config.PromotionSoak, Stage: &promotionStage{}, Prev: &promotionStage{State: stageStateMerged, MergedAt: now.Add(-30 * time.Minute)}, Wait: 30 * time.Minute},
+		{Name: "command", Promotion: config.PromotionCommand, Stage: &promotionStage{Approved: true}, Prev: &promotionStage{State: stageStateMerged}, Ready: true},
+		{Name: "command not approved", Promotion: config.PromotionCommand, Stage: &promotionStage{}, Prev: &promotionStage{State: stageStateMerged}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			env := &config.Environment{Promotion: c.Promotion, SoakDuration: time.Hour}
+			ready, wait := promotionReady(env, c.Stage, c.Prev, now)
+			if ready != c.Ready {
+				t.Errorf("Expect ready is %v", c.Ready)
+			}
+			if wait != c.Wait {
+				t.Errorf("unexpected wait: %v", wait)
+			}
+		})
+	}
+}
+
+func TestPromotion_finished(t *testing.T) {
+	p := &promotion{Stages: []*promotionStage{{Environment: "staging", State: stageStateMerged}, {Environment: "production"}}}
+	if p.finished() || p.stopped() {
+		t.Error("Expect the promotion is in progress")
+	}
+	if p.stage("production") != 1 || p.stage("unknown") != -1 {
+		t.Error("unexpected index of the stage")
+	}
+
+	p.Stages[1].State = stageStateOpened
+	if !p.finished() {
+		t.Error("Expect the promotion is finished")
+	}
+
+	p.Stages[1].State = stageStateClosed
+	if !p.stopped() {
+		t.Error("Expect the promotion is stopped")
+	}
+}
+
+func TestPromotionStage_pullRequestOf(t *testing.T) {
+	s := &promotionStage{Owner: "octocat", Repo: "manifest", Number: 2, Branch: "update-image/octocat-app/app"}
+	pr := &github.PullRequest{
+		Number: github.Int(2),
+		Head:   &github.PullRequestBranch{Ref: github.String("update-image/octocat-app/app")},
+	}
+	if !s.pullRequestOf("octocat", "manifest", pr) {
+		t.Error("Expect the pull request of the stage")
+	}
+	if s.pullRequestOf("someone", "manifest", pr) {
+		t.Error("Expect the pull request of the other repository is not the pull request of the stage")
+	}
+
+	pr.Head.Ref = github.String("update-image/octocat-app/other")
+	if s.pullRequestOf("octocat", "manifest", pr) {
+		t.Error("Expect the pull request of the other branch is not the pull request of the stage")
+	}
+}
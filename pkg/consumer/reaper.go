@@ -0,0 +1,120 @@
+package consumer
+
+import (
+	"log"
+	"time"
+
+	"golang.org/x/xerrors"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+)
+
+// Orphan is a pod or a job which is left behind by the previous process of the bot.
+// Either Pod or Job is set.
+type Orphan struct {
+	Pod *corev1.Pod
+	Job *batchv1.Job
+}
+
+func (o *Orphan) Object() metav1.Object {
+	if o.Job != nil {
+		return o.Job
+	}
+
+	return o.Pod
+}
+
+type Resumer interface {
+	// Resume starts to supervise the orphan, and reports the result after it is finished.
+	// Resume returns before the orphan is finished.
+	Resume(client *kubernetes.Clientset, o *Orphan)
+	// Abandon deletes the orphan which is too old to resume.
+	Abandon(client *kubernetes.Clientset, o *Orphan)
+}
+
+// Reaper finds pods and jobs which are created by the previous process at startup.
+// The orphan which is younger than the grace period is resumed. Otherwise it is abandoned.
+type Reaper struct {
+	Namespace   string
+	GracePeriod time.Duration
+
+	resumers map[string]Resumer
+}
+
+func NewReaper(namespace string, conf *config.Config, builder *BazelBuild, dnsControl *DNSControlConsumer) *Reaper {
+	return &Reaper{
+		Namespace:   namespace,
+		GracePeriod: conf.OrphanGracePeriodDuration,
+		resumers: map[string]Resumer{
+			ctrlByBazelBuild:  builder,
+			ctrlByBuilderPool: builder,
+			ctrlByDNSControl:  dnsControl,
+		},
+	}
+}
+
+func (r *Reaper) Run() error {
+	client, err := NewKubernetesClient()
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	jobList, err := client.BatchV1().Jobs(r.Namespace).List(metav1.ListOptions{LabelSelector: labelKeyCtrlBy})
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	for i := range jobList.Items {
+		r.reap(client, &Orphan{Job: &jobList.Items[i]})
+	}
+
+	podList, err := client.CoreV1().Pods(r.Namespace).List(metav1.ListOptions{LabelSelector: labelKeyCtrlBy})
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	for i := range podList.Items {
+		pod := &podList.Items[i]
+		if isOwnedByJob(pod) {
+			continue
+		}
+		// Idle builders are managed by the pool
+		if pod.Labels[labelKeyCtrlBy] == ctrlByBuilderPool && pod.Labels[labelKeyPoolState] == poolStateIdle {
+			continue
+		}
+
+		r.reap(client, &Orphan{Pod: pod})
+	}
+
+	return nil
+}
+
+func (r *Reaper) reap(client *kubernetes.Clientset, o *Orphan) {
+	obj := o.Object()
+	resumer, ok := r.resumers[obj.GetLabels()[labelKeyCtrlBy]]
+	if !ok {
+		log.Printf("Unknown orphan: %s", obj.GetName())
+		return
+	}
+
+	if time.Since(obj.GetCreationTimestamp().Time) > r.GracePeriod {
+		log.Printf("Abandon: %s", obj.GetName())
+		go resumer.Abandon(client, o)
+		return
+	}
+
+	log.Printf("Resume: %s", obj.GetName())
+	resumer.Resume(client, o)
+}
+
+func isOwnedByJob(pod *corev1.Pod) bool {
+	for _, v := range pod.OwnerReferences {
+		if v.Kind == "Job" {
+			return true
+		}
+	}
+
+	return false
+}
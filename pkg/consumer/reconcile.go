@@ -0,0 +1,327 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v29/github"
+	"golang.org/x/xerrors"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/webhook"
+)
+
+// reconcileDepth is the number of the commits which are searched for the last processed commit.
+const reconcileDepth = 30
+
+// Reconciler processes the pushes and the pull requests which were never processed
+// because the bot was down or the delivery of the webhook failed.
+// The commit is processed if it has the commit status of the bot.
+type Reconciler struct {
+	Repositories []string
+	Interval     time.Duration
+
+	builder    *BazelBuild
+	dnsControl *DNSControlConsumer
+}
+
+func NewReconciler(conf *config.Config, builder *BazelBuild, dnsControl *DNSControlConsumer) *Reconciler {
+	return &Reconciler{
+		Repositories: conf.GitHubRepositories(),
+		Interval:     conf.ReconcileIntervalDuration,
+		builder:      builder,
+		dnsControl:   dnsControl,
+	}
+}
+
+// Run reconciles at startup and at the interval. Run never returns.
+func (r *Reconciler) Run() {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		r.Reconcile()
+		<-ticker.C
+	}
+}
+
+// Reconcile checks all allowed repositories once.
+func (r *Reconciler) Reconcile() {
+	for _, v := range r.Repositories {
+		s := strings.SplitN(v, "/", 2)
+		if len(s) != 2 {
+			errorLog(xerrors.Errorf("invalid repository name: %s", v))
+			continue
+		}
+
+		if err := r.builder.reconcile(s[0], s[1]); err != nil {
+			errorLog(err)
+		}
+		if err := r.dnsControl.reconcile(s[0], s[1]); err != nil {
+			errorLog(err)
+		}
+	}
+}
+
+// reconcile builds the head of the target branch of each rule if it is not built since the last build.
+func (b *BazelBuild) reconcile(owner, repo string) error {
+	client := b.host.NewClient(&http.Client{Transport: b.transport})
+	defaultBranch, err := resolveBranch(client, owner, repo, "")
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	head, err := branchHead(client, owner, repo, defaultBranch)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	rules, err := b.fetchRules(&eventContext{Owner: owner, Repo: repo, Commit: head})
+	if err != nil {
+		// The repository doesn't have the build rule
+		return nil
+	}
+
+	for _, v := range rules {
+		// Only the default branch is reconciled if the rule builds all branches
+		branch, err := resolveBranch(client, owner, repo, v.Branch)
+		if err != nil {
+			errorLog(err)
+			continue
+		}
+		buildCtx := &eventContext{Owner: owner, Repo: repo, Ref: branchRefPrefix + branch, RuleName: v.Name}
+		buildCtx.Commit, err = branchHead(client, owner, repo, branch)
+		if err != nil {
+			errorLog(err)
+			continue
+		}
+		// The rule of the other branch may be different from the default branch
+		if err := b.fetchRule(buildCtx); err != nil {
+			errorLog(err)
+			continue
+		}
+
+		last, err := lastProcessedCommit(client, owner, repo, buildCtx.Commit, statusContext(buildCtx))
+		if err != nil {
+			errorLog(err)
+			continue
+		}
+		// The head is built only if the last built commit is known.
+		// Otherwise all of the branches are built when the bot is installed to the repository.
+		if last == "" || last == buildCtx.Commit {
+			continue
+		}
+		changed, err := b.changedFiles(buildCtx, last, buildCtx.Commit)
+		if err != nil {
+			errorLog(err)
+		}
+		if !buildCtx.Rule.Match(changed) {
+			continue
+		}
+
+		log.Printf("Backfill the build of %s@%s", ruleName(buildCtx), buildCtx.Commit)
+		go func(buildCtx *eventContext) {
+			key := fmt.Sprintf("%s@%s", ruleName(buildCtx), buildCtx.Ref)
+			b.jobs.Run(key, func() { b.build(buildCtx) })
+		}(buildCtx)
+	}
+
+	return nil
+}
+
+// reconcile applies the merged changes and previews the open pull requests which are not processed yet.
+func (c *DNSControlConsumer) reconcile(owner, repo string) error {
+	client, err := NewKubernetesClient()
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	ghClient := c.host.NewClient(c.client)
+	defaultBranch, err := resolveBranch(ghClient, owner, repo, "")
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	head, err := branchHead(ghClient, owner, repo, defaultBranch)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	ctx := &dnsControlContext{eventContext: &eventContext{Owner: owner, Repo: repo, Commit: head}}
+	if err := c.fetchRuleFile(ctx); err != nil {
+		// The repository doesn't have the rule of dnscontrol
+		return nil
+	}
+	repository := &webhook.Repository{Provider: webhook.ProviderGitHub, Owner: owner, Name: repo, DefaultBranch: defaultBranch}
+
+	targetBranch := ctx.Rule.Branch
+	if targetBranch == "" {
+		targetBranch = ctx.Rule.MasterBranch
+	}
+	targetBranch, err = resolveBranch(ghClient, owner, repo, targetBranch)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	if targetBranch != defaultBranch {
+		head, err = branchHead(ghClient, owner, repo, targetBranch)
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+	}
+	last, err := lastProcessedCommit(ghClient, owner, repo, head, dnsControlPush.Context)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	// The changes are applied only if the last applied commit is known.
+	// Otherwise all of the history is applied when the bot is installed to the repository.
+	if last != "" && last != head {
+		// The head may not be a merge commit (e.g. the commit which doesn't change the zones is pushed after the merge).
+		// The apply of the whole range is reported to the newest merged pull request.
+		comparison, _, err := ghClient.Repositories.CompareCommits(context.Background(), owner, repo, last, head)
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		message := ""
+		for i := len(comparison.Commits) - 1; i >= 0; i-- {
+			if m := comparison.Commits[i].GetCommit().GetMessage(); extractPRNumberFromMergedMessage(m) != 0 {
+				message = m
+				break
+			}
+		}
+		if message != "" {
+			log.Printf("Backfill the apply of %s/%s@%s...%s", owner, repo, last, head)
+			// The pod applies the zones of the head and the changed files are compared with the last applied commit.
+			// Thus all of the changes after the last applied commit are applied.
+			go c.dispatchPushEvent(&webhook.PushEvent{
+				Repo:              repository,
+				Ref:               branchRefPrefix + targetBranch,
+				Before:            last,
+				After:             head,
+				HeadCommit:        head,
+				HeadCommitMessage: message,
+			}, client)
+		}
+	}
+
+	pulls := make([]*github.PullRequest, 0)
+	opt := &github.PullRequestListOptions{State: "open", ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		p, res, err := ghClient.PullRequests.List(context.Background(), owner, repo, opt)
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		pulls = append(pulls, p...)
+		if res.NextPage == 0 {
+			break
+		}
+		opt.Page = res.NextPage
+	}
+	for _, v := range pulls {
+		ok, err := hasStatus(ghClient, owner, repo, v.GetHead().GetSHA(), dnsControlPreview.Context)
+		if err != nil {
+			errorLog(err)
+			continue
+		}
+		if ok {
+			continue
+		}
+
+		log.Printf("Backfill the preview of %s/%s#%d", owner, repo, v.GetNumber())
+		go c.dispatchPullRequestEvent(&webhook.PullRequestEvent{
+			Repo:    repository,
+			Action:  webhook.ActionOpened,
+			Number:  v.GetNumber(),
+			Head:    v.GetHead().GetSHA(),
+			HeadRef: v.GetHead().GetRef(),
+			BaseRef: v.GetBase().GetRef(),
+			Body:    v.GetBody(),
+		}, client)
+	}
+
+	return nil
+}
+
+func branchHead(client *github.Client, owner, repo, branch string) (string, error) {
+	b, _, err := client.Repositories.GetBranch(context.Background(), owner, repo, branch)
+	if err != nil {
+		return "", xerrors.Errorf(": %v", err)
+	}
+
+	return b.GetCommit().GetSHA(), nil
+}
+
+// lastProcessedCommit returns the newest commit which is processed in the history of head.
+// The commit is processed if the status of statusContext is success or pending.
+// If the commit is not found in the recent commits, lastProcessedCommit returns empty.
+func lastProcessedCommit(client *github.Client, owner, repo, head, statusContext string) (string, error) {
+	commits, _, err := client.Repositories.ListCommits(context.Background(), owner, repo, &github.CommitsListOptions{
+		SHA:         head,
+		ListOptions: github.ListOptions{PerPage: reconcileDepth},
+	})
+	if err != nil {
+		return "", xerrors.Errorf(": %v", err)
+	}
+
+	return findProcessedCommit(commits, func(sha string) (bool, error) {
+		status, _, err := client.Repositories.GetCombinedStatus(context.Background(), owner, repo, sha, &github.ListOptions{PerPage: 100})
+		if err != nil {
+			return false, xerrors.Errorf(": %v", err)
+		}
+
+		return processedStatus(status.Statuses, statusContext), nil
+	})
+}
+
+// findProcessedCommit returns the first commit which is processed. commits must be sorted from newest to oldest.
+func findProcessedCommit(commits []*github.RepositoryCommit, processed func(sha string) (bool, error)) (string, error) {
+	for _, v := range commits {
+		ok, err := processed(v.GetSHA())
+		if err != nil {
+			return "", xerrors.Errorf(": %v", err)
+		}
+		if ok {
+			return v.GetSHA(), nil
+		}
+	}
+
+	return "", nil
+}
+
+// hasStatus returns true if the commit has the status of statusContext regardless of the state.
+func hasStatus(client *github.Client, owner, repo, sha, statusContext string) (bool, error) {
+	status, _, err := client.Repositories.GetCombinedStatus(context.Background(), owner, repo, sha, &github.ListOptions{PerPage: 100})
+	if err != nil {
+		return false, xerrors.Errorf(": %v", err)
+	}
+
+	return containsStatus(status.Statuses, statusContext), nil
+}
+
+func containsStatus(statuses []github.RepoStatus, statusContext string) bool {
+	for _, v := range statuses {
+		if v.GetContext() == statusContext {
+			return true
+		}
+	}
+
+	return false
+}
+
+// processedStatus returns true if the status of statusContext means that the job has been run or is running.
+// The failed job and the skipped job are not counted because they have not been applied.
+func processedStatus(statuses []github.RepoStatus, statusContext string) bool {
+	for _, v := range statuses {
+		if v.GetContext() != statusContext {
+			continue
+		}
+		if strings.HasPrefix(v.GetDescription(), skippedDescription) {
+			return false
+		}
+		switch v.GetState() {
+		case webhook.StateSuccess, webhook.StatePending:
+			return true
+		}
+		return false
+	}
+
+	return false
+}
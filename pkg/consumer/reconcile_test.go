@@ -0,0 +1,89 @@
+package consumer
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-github/v29/github"
+)
+
+func TestFindProcessedCommit(t *testing.T) {
+	commits := []*github.RepositoryCommit{
+		{SHA: github.String("c3")},
+		{SHA: github.String("c2")},
+		{SHA: github.String("c1")},
+	}
+
+	cases := []struct {
+		Name      string
+		Processed map[string]bool
+		Expect    string
+	}{
+		{Name: "head", Processed: map[string]bool{"c3": true, "c1": true}, Expect: "c3"},
+		{Name: "missed", Processed: map[string]bool{"c2": true, "c1": true}, Expect: "c2"},
+		{Name: "never", Processed: map[string]bool{}, Expect: ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			got, err := findProcessedCommit(commits, func(sha string) (bool, error) {
+				return c.Processed[sha], nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.Expect {
+				t.Errorf("Expect %q: %q", c.Expect, got)
+			}
+		})
+	}
+
+	_, err := findProcessedCommit(commits, func(_ string) (bool, error) {
+		return false, errors.New("rate limit")
+	})
+	if err == nil {
+		t.Error("Expect an error")
+	}
+}
+
+func TestContainsStatus(t *testing.T) {
+	statuses := []github.RepoStatus{
+		{Context: github.String("build/api"), State: github.String("failure")},
+		{Context: github.String("execute"), State: github.String("pending")},
+	}
+
+	if !containsStatus(statuses, "build/api") {
+		t.Error("Expect to contain build/api")
+	}
+	if !containsStatus(statuses, "execute") {
+		t.Error("Expect to contain execute")
+	}
+	if containsStatus(statuses, "build") {
+		t.Error("Expect not to contain build")
+	}
+}
+
+func TestProcessedStatus(t *testing.T) {
+	statuses := []github.RepoStatus{
+		{Context: github.String("build/api"), State: github.String("failure")},
+		{Context: github.String("execute"), State: github.String("success")},
+		{Context: github.String("preview"), State: github.String("success"), Description: github.String("Skipped: Nothing changed")},
+		{Context: github.String("build/web"), State: github.String("pending")},
+	}
+
+	if processedStatus(statuses, "build/api") {
+		t.Error("Expect the failed job is not processed")
+	}
+	if !processedStatus(statuses, "execute") {
+		t.Error("Expect execute is processed")
+	}
+	if processedStatus(statuses, "preview") {
+		t.Error("Expect the skipped job is not processed")
+	}
+	if !processedStatus(statuses, "build/web") {
+		t.Error("Expect the running job is processed")
+	}
+	if processedStatus(statuses, "build") {
+		t.Error("Expect the job which doesn't have the status is not processed")
+	}
+}
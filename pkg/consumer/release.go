@@ -0,0 +1,191 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-github/v29/github"
+	"golang.org/x/xerrors"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/imagepolicy"
+)
+
+// publishRelease creates the release of the tag and uploads the artifacts as the assets of the release.
+// If the release already exists (e.g. the tag is built again), the notes and the assets are replaced.
+func (b *BazelBuild) publishRelease(buildCtx *eventContext, buildId string) error {
+	client := b.host.NewClient(&http.Client{Transport: b.transport})
+	tag := buildCtx.Tag()
+	rule := buildCtx.Rule.Release
+
+	tags, err := listTags(client, buildCtx.Owner, buildCtx.Repo)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	cl := &changelog{Host: b.host, Owner: buildCtx.Owner, Repo: buildCtx.Repo, OldCommit: previousTag(tags, tag), NewCommit: tag}
+	if err := cl.fetchChanges(client); err != nil {
+		// The release is published without the changes
+		errorLog(err)
+	}
+	prerelease := rule.Prerelease
+	if v, err := imagepolicy.ParseVersion(tag); err == nil && v.Prerelease != "" {
+		prerelease = true
+	}
+
+	release, res, err := client.Repositories.GetReleaseByTag(context.Background(), buildCtx.Owner, buildCtx.Repo, tag)
+	switch {
+	case err == nil:
+		release, _, err = client.Repositories.EditRelease(context.Background(), buildCtx.Owner, buildCtx.Repo, release.GetID(), &github.RepositoryRelease{
+			Body:       github.String(releaseNotes(cl)),
+			Prerelease: github.Bool(prerelease),
+		})
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		log.Printf("Update the release: %s", tag)
+	case res != nil && res.StatusCode == http.StatusNotFound:
+		release, _, err = client.Repositories.CreateRelease(context.Background(), buildCtx.Owner, buildCtx.Repo, &github.RepositoryRelease{
+			TagName:    github.String(tag),
+			Name:       github.String(tag),
+			Body:       github.String(releaseNotes(cl)),
+			Draft:      github.Bool(rule.Draft),
+			Prerelease: github.Bool(prerelease),
+		})
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		log.Printf("Create the release: %s", tag)
+	default:
+		return xerrors.Errorf(": %v", err)
+	}
+
+	if len(rule.Artifacts) == 0 {
+		return nil
+	}
+	artifactDir, err := b.downloadArtifact(buildCtx, buildId)
+	if artifactDir != "" {
+		defer os.RemoveAll(artifactDir)
+	}
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	return uploadReleaseAssets(client, buildCtx.Owner, buildCtx.Repo, release.GetID(), artifactDir, rule.Artifacts)
+}
+
+// uploadReleaseAssets uploads the artifacts in dir. The asset which has the same name is replaced.
+func uploadReleaseAssets(client *github.Client, owner, repo string, releaseId int64, dir string, artifacts []string) error {
+	assets, _, err := client.Repositories.ListReleaseAssets(context.Background(), owner, repo, releaseId, &github.ListOptions{PerPage: 100})
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	existing := make(map[string]int64)
+	for _, v := range assets {
+		existing[v.GetName()] = v.GetID()
+	}
+
+	for _, v := range artifacts {
+		name := filepath.Base(v)
+		if id, ok := existing[name]; ok {
+			if _, err := client.Repositories.DeleteReleaseAsset(context.Background(), owner, repo, id); err != nil {
+				return xerrors.Errorf(": %v", err)
+			}
+		}
+
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		_, _, err = client.Repositories.UploadReleaseAsset(context.Background(), owner, repo, releaseId, &github.UploadOptions{Name: name}, f)
+		f.Close()
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		log.Printf("Upload the release asset: %s", name)
+	}
+
+	return nil
+}
+
+func listTags(client *github.Client, owner, repo string) ([]string, error) {
+	tags := make([]string, 0)
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		t, res, err := client.Repositories.ListTags(context.Background(), owner, repo, opt)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		for _, v := range t {
+			tags = append(tags, v.GetName())
+		}
+		if res.NextPage == 0 {
+			break
+		}
+		opt.Page = res.NextPage
+	}
+
+	return tags, nil
+}
+
+// previousTag returns the greatest tag which is less than tag in the semantic versioning.
+// The pre-releases are skipped unless tag is also a pre-release.
+// If tag is not a semantic version or there is no previous tag, previousTag returns empty.
+func previousTag(tags []string, tag string) string {
+	current, err := imagepolicy.ParseVersion(tag)
+	if err != nil {
+		return ""
+	}
+
+	prev := ""
+	var prevVersion *imagepolicy.Version
+	for _, v := range tags {
+		ver, err := imagepolicy.ParseVersion(v)
+		if err != nil {
+			continue
+		}
+		if current.Prerelease == "" && ver.Prerelease != "" {
+			continue
+		}
+		if ver.Compare(current) >= 0 {
+			continue
+		}
+		if prevVersion == nil || ver.Compare(prevVersion) > 0 {
+			prev, prevVersion = v, ver
+		}
+	}
+
+	return prev
+}
+
+// releaseNotes returns the notes of the release from the changes between the previous tag and the tag.
+func releaseNotes(cl *changelog) string {
+	buf := new(strings.Builder)
+	if len(cl.PullRequests) > 0 {
+		fmt.Fprint(buf, "### Pull requests\n\n")
+		for _, v := range cl.PullRequests {
+			fmt.Fprintf(buf, "* #%d %s (@%s)\n", v.GetNumber(), v.GetTitle(), v.GetUser().GetLogin())
+		}
+		fmt.Fprint(buf, "\n")
+	}
+	if len(cl.Commits) > 0 {
+		fmt.Fprint(buf, "### Commits\n\n")
+		for i, v := range cl.Commits {
+			if i == maxChangelogCommits {
+				fmt.Fprintf(buf, "* and %d more commits\n", len(cl.Commits)-maxChangelogCommits)
+				break
+			}
+			fmt.Fprintf(buf, "* %s %s\n", cl.commitLink(v.GetSHA()), strings.SplitN(v.GetCommit().GetMessage(), "\n", 2)[0])
+		}
+		fmt.Fprint(buf, "\n")
+	}
+
+	if cl.OldCommit != "" {
+		fmt.Fprintf(buf, "Full changelog: %s/compare/%s...%s\n", cl.Host.RepositoryURL(cl.Owner, cl.Repo), cl.OldCommit, cl.NewCommit)
+	}
+
+	return buf.String()
+}
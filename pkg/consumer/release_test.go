@@ -0,0 +1,97 @@
+package consumer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v29/github"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+)
+
+func TestPreviousTag(t *testing.T) {
+	tags := []string{"v1.2.0", "v1.1.0", "v1.2.0-rc.1", "v1.2.0-rc.2", "v1.0.0", "latest", "v0.9.0"}
+
+	cases := []struct {
+		Tag      string
+		Previous string
+	}{
+		{Tag: "v1.2.0", Previous: "v1.1.0"},
+		{Tag: "v1.2.0-rc.2", Previous: "v1.2.0-rc.1"},
+		{Tag: "v1.2.0-rc.1", Previous: "v1.1.0"},
+		{Tag: "v1.3.0", Previous: "v1.2.0"},
+		{Tag: "v0.9.0", Previous: ""},
+		{Tag: "latest", Previous: ""},
+	}
+
+	for _, c := range cases {
+		if prev := previousTag(tags, c.Tag); prev != c.Previous {
+			t.Errorf("%s: expect %q but got %q", c.Tag, c.Previous, prev)
+		}
+	}
+}
+
+func TestReleaseNotes(t *testing.T) {
+	cl := &changelog{
+		Owner:     "f110",
+		Repo:      "bot",
+		OldCommit: "v1.1.0",
+		NewCommit: "v1.2.0",
+		Commits: []github.RepositoryCommit{
+			{SHA: github.String("0123456789"), Commit: &github.Commit{Message: github.String("Add release (#12)\n\ndetail")}},
+		},
+		PullRequests: []*github.PullRequest{
+			{Number: github.Int(12), Title: github.String("Add release"), User: &github.User{Login: github.String("octocat")}},
+		},
+	}
+
+	notes := releaseNotes(cl)
+	for _, v := range []string{
+		"* #12 Add release (@octocat)\n",
+		"* [0123456](https://github.com/f110/bot/commit/0123456789) Add release (#12)\n",
+		"Full changelog: https://github.com/f110/bot/compare/v1.1.0...v1.2.0\n",
+	} {
+		if !strings.Contains(notes, v) {
+			t.Errorf("Expect the notes contain %q:\n%s", v, notes)
+		}
+	}
+}
+
+func TestBazelArgs_Release(t *testing.T) {
+	rule := &config.BuildRule{
+		Target:    "//:image",
+		Artifacts: []string{"bazel-bin/image.digest"},
+		Release:   &config.Release{Target: "//:release", Artifacts: []string{"bazel-bin/bot_linux_amd64", "bazel-bin/bot_darwin_amd64"}},
+	}
+
+	buildCtx := &eventContext{Ref: "refs/heads/master", Rule: rule}
+	if args := bazelArgs(buildCtx); !reflect.DeepEqual(args, []string{"--output_user_root=/out", "run", "//:image"}) {
+		t.Errorf("unexpected args: %v", args)
+	}
+	if paths := artifactPaths(buildCtx); !reflect.DeepEqual(paths, []string{"bazel-bin/image.digest"}) {
+		t.Errorf("unexpected artifacts: %v", paths)
+	}
+	if statusContext(buildCtx) != buildStatusContext {
+		t.Errorf("unexpected status context: %s", statusContext(buildCtx))
+	}
+
+	buildCtx = &eventContext{Ref: "refs/tags/v1.2.0", Rule: rule}
+	if buildCtx.Tag() != "v1.2.0" {
+		t.Errorf("unexpected tag: %s", buildCtx.Tag())
+	}
+	if args := bazelArgs(buildCtx); !reflect.DeepEqual(args, []string{"--output_user_root=/out", "run", "--stamp", "--embed_label=v1.2.0", "//:release"}) {
+		t.Errorf("unexpected args: %v", args)
+	}
+	if paths := artifactPaths(buildCtx); !reflect.DeepEqual(paths, rule.Release.Artifacts) {
+		t.Errorf("unexpected artifacts: %v", paths)
+	}
+	if statusContext(buildCtx) != releaseStatusContext {
+		t.Errorf("unexpected status context: %s", statusContext(buildCtx))
+	}
+
+	buildCtx.RuleName = "api"
+	if statusContext(buildCtx) != "release/api" {
+		t.Errorf("Expect the status context has the name of the rule: %s", statusContext(buildCtx))
+	}
+}
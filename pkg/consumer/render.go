@@ -0,0 +1,213 @@
+package consumer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+	"golang.org/x/xerrors"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/kustomize"
+)
+
+const (
+	diffContextLines = 3
+)
+
+// renderedKustomizations are the kustomizations in the repository before editing.
+type renderedKustomizations struct {
+	Results map[string]*kustomize.Result
+	// Failed are the kustomizations which can't be rendered (e.g. using the unsupported features or already broken).
+	Failed map[string]error
+}
+
+// renderKustomizations renders all kustomizations in the repository.
+func renderKustomizations(root string) *renderedKustomizations {
+	rendered := &renderedKustomizations{Results: make(map[string]*kustomize.Result), Failed: make(map[string]error)}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if kustomize.FindKustomizationFile(path) == "" {
+			return nil
+		}
+
+		res, err := kustomize.Render(path)
+		if err != nil {
+			log.Printf("Can not render %s: %v", path, err)
+			rendered.Failed[path] = err
+			return nil
+		}
+		rendered.Results[path] = res
+		return nil
+	})
+	if err != nil {
+		errorLog(xerrors.Errorf(": %v", err))
+	}
+
+	return rendered
+}
+
+// validateKustomizations renders the kustomizations which read the edited files again and validates the objects.
+// validateKustomizations returns the diff of the rendered manifests.
+// If the edited file is read by the kustomization which can't be rendered, validateKustomizations returns an error
+// because the change can't be validated.
+func validateKustomizations(root string, before *renderedKustomizations, editedFiles []string) (string, error) {
+	failedDirs := make([]string, 0, len(before.Failed))
+	for dir := range before.Failed {
+		failedDirs = append(failedDirs, dir)
+	}
+	sort.Strings(failedDirs)
+	for _, dir := range failedDirs {
+		deps, err := kustomize.Dependencies(dir)
+		if err != nil {
+			// The files are unknown. The files under the directory are assumed to be read.
+			deps = []string{dir + string(filepath.Separator)}
+		}
+		for _, v := range editedFiles {
+			p := filepath.Join(root, v)
+			for _, d := range deps {
+				if p == d || (strings.HasSuffix(d, string(filepath.Separator)) && strings.HasPrefix(p, d)) {
+					name, _ := filepath.Rel(root, dir)
+					return "", xerrors.Errorf("%s can not be validated because %s can not be rendered: %v", v, name, before.Failed[dir])
+				}
+			}
+		}
+	}
+
+	dirs := make([]string, 0)
+	for dir, res := range before.Results {
+		for _, v := range editedFiles {
+			if res.HasFile(filepath.Join(root, v)) {
+				dirs = append(dirs, dir)
+				break
+			}
+		}
+	}
+	sort.Strings(dirs)
+
+	buf := new(strings.Builder)
+	for _, dir := range dirs {
+		name, err := filepath.Rel(root, dir)
+		if err != nil {
+			return "", xerrors.Errorf(": %v", err)
+		}
+		res, err := kustomize.Render(dir)
+		if err != nil {
+			return "", xerrors.Errorf("%s can not be built after updating: %v", name, err)
+		}
+		if err := kustomize.Validate(res.Objects); err != nil {
+			return "", xerrors.Errorf("%s: %v", name, err)
+		}
+
+		oldManifest, err := before.Results[dir].YAML()
+		if err != nil {
+			return "", xerrors.Errorf(": %v", err)
+		}
+		newManifest, err := res.YAML()
+		if err != nil {
+			return "", xerrors.Errorf(": %v", err)
+		}
+		buf.WriteString(unifiedDiff(name, string(oldManifest), string(newManifest)))
+	}
+
+	return buf.String(), nil
+}
+
+type diffLine struct {
+	op   diffmatchpatch.Operation
+	text string
+}
+
+// unifiedDiff returns the diff of a and b in unified format. If a and b are the same, unifiedDiff returns empty.
+func unifiedDiff(name, a, b string) string {
+	dmp := diffmatchpatch.New()
+	ca, cb, lines := dmp.DiffLinesToChars(a, b)
+	diffs := dmp.DiffCharsToLines(dmp.DiffMain(ca, cb, false), lines)
+
+	all := make([]diffLine, 0)
+	for _, d := range diffs {
+		for _, l := range strings.SplitAfter(d.Text, "\n") {
+			if l == "" {
+				continue
+			}
+			all = append(all, diffLine{op: d.Type, text: strings.TrimSuffix(l, "\n")})
+		}
+	}
+
+	buf := new(strings.Builder)
+	oldLine, newLine := 1, 1
+	for i := 0; i < len(all); {
+		if all[i].op == diffmatchpatch.DiffEqual {
+			oldLine++
+			newLine++
+			i++
+			continue
+		}
+
+		// Find the end of the hunk. The hunk continues while the next change is within the context.
+		start := i - diffContextLines
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(all); j++ {
+			if all[j].op != diffmatchpatch.DiffEqual {
+				end = j
+				continue
+			}
+			if j-end > 2*diffContextLines {
+				break
+			}
+		}
+		end += diffContextLines
+		if end >= len(all) {
+			end = len(all) - 1
+		}
+
+		oldStart, newStart := oldLine-(i-start), newLine-(i-start)
+		oldCount, newCount := 0, 0
+		body := new(strings.Builder)
+		for _, l := range all[start : end+1] {
+			switch l.op {
+			case diffmatchpatch.DiffEqual:
+				oldCount++
+				newCount++
+				fmt.Fprintf(body, " %s\n", l.text)
+			case diffmatchpatch.DiffDelete:
+				oldCount++
+				fmt.Fprintf(body, "-%s\n", l.text)
+			case diffmatchpatch.DiffInsert:
+				newCount++
+				fmt.Fprintf(body, "+%s\n", l.text)
+			}
+		}
+		if buf.Len() == 0 {
+			fmt.Fprintf(buf, "--- a/%s\n+++ b/%s\n", name, name)
+		}
+		fmt.Fprintf(buf, "@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount)
+		buf.WriteString(body.String())
+
+		for _, l := range all[i : end+1] {
+			if l.op != diffmatchpatch.DiffInsert {
+				oldLine++
+			}
+			if l.op != diffmatchpatch.DiffDelete {
+				newLine++
+			}
+		}
+		i = end + 1
+	}
+
+	return buf.String()
+}
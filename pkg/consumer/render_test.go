@@ -0,0 +1,95 @@
+package consumer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateKustomizations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"bot/kustomization.yaml": `resources:
+  - deployment.yaml
+images:
+  - name: registry.f110.dev/bot/bot
+    newTag: v1
+`,
+		"bot/deployment.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: bot
+spec:
+  template:
+    spec:
+      containers:
+        - name: bot
+          image: registry.f110.dev/bot/bot
+`,
+		"other/kustomization.yaml": `configMapGenerator:
+  - name: config
+    files:
+      - config.yaml
+`,
+		"other/config.yaml": "debug: false\n",
+	}
+	for k, v := range files {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(k)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, k), []byte(v), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before := renderKustomizations(dir)
+	if len(before.Results) != 1 || len(before.Failed) != 1 {
+		t.Fatalf("Expect the unsupported kustomization is not rendered: %v %v", before.Results, before.Failed)
+	}
+
+	kustomization := strings.Replace(files["bot/kustomization.yaml"], "newTag: v1", "newTag: v2", 1)
+	if err := ioutil.WriteFile(filepath.Join(dir, "bot/kustomization.yaml"), []byte(kustomization), 0644); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := validateKustomizations(dir, before, []string{"bot/kustomization.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"--- a/bot\n", "-      - image: registry.f110.dev/bot/bot:v1\n", "+      - image: registry.f110.dev/bot/bot:v2\n"} {
+		if !strings.Contains(diff, v) {
+			t.Errorf("Expect the diff contains %q:\n%s", v, diff)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "bot/kustomization.yaml"), []byte(kustomization+"namePrefix: [\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := validateKustomizations(dir, before, []string{"bot/kustomization.yaml"}); err == nil {
+		t.Error("Expect to fail validating the broken kustomization")
+	}
+
+	if _, err := validateKustomizations(dir, before, []string{"other/config.yaml"}); err == nil {
+		t.Error("Expect to fail because the kustomization which reads the edited file can not be rendered")
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n"
+	b := "a\nb\nc\nd\nE\nf\ng\nh\ni\nj\n"
+
+	diff := unifiedDiff("test", a, b)
+	expect := "--- a/test\n+++ b/test\n@@ -2,7 +2,7 @@\n b\n c\n d\n-e\n+E\n f\n g\n h\n"
+	if diff != expect {
+		t.Errorf("unexpected diff:\n%s", diff)
+	}
+
+	if unifiedDiff("test", a, a) != "" {
+		t.Error("Expect the diff is empty")
+	}
+}
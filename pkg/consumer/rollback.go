@@ -0,0 +1,339 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/google/go-github/v29/github"
+	"golang.org/x/xerrors"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/updater"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/webhook"
+)
+
+const (
+	imageMarkerFormat = "<!-- k8s-cluster-maintenance-bot/image: %s -->"
+	rollbackCommand   = "/rollback"
+	// rollbackDepth is the number of the commits of the manifest which are searched for the image deployed before
+	rollbackDepth = 30
+)
+
+var imageMarkerRe = regexp.MustCompile(`<!-- k8s-cluster-maintenance-bot/image: (.+) -->`)
+
+// imageMarker is embedded in the body of the pull request to find the image from the comment of the pull request.
+// Image is the name of the image which is built. It may be different from the name in the manifest.
+type imageMarker struct {
+	Image       string `json:"image"`
+	Environment string `json:"environment,omitempty"`
+}
+
+func newImageMarker(image, env string) string {
+	b, err := json.Marshal(&imageMarker{Image: image, Environment: env})
+	if err != nil {
+		return ""
+	}
+
+	return fmt.Sprintf(imageMarkerFormat, string(b))
+}
+
+func parseImageMarker(body string) *imageMarker {
+	m := imageMarkerRe.FindStringSubmatch(body)
+	if m == nil {
+		return nil
+	}
+	marker := &imageMarker{}
+	if err := json.Unmarshal([]byte(m[1]), marker); err != nil {
+		return nil
+	}
+
+	return marker
+}
+
+// parseRollbackCommand parses "/rollback [<digest|build id>]". If the comment is not the command, parseRollbackCommand returns false.
+func parseRollbackCommand(body string) (string, bool) {
+	f := strings.Fields(body)
+	if len(f) == 0 || f[0] != rollbackCommand || len(f) > 2 {
+		return "", false
+	}
+	if len(f) == 2 {
+		return f[1], true
+	}
+
+	return "", true
+}
+
+// rollbackTarget returns the record of the image to roll back to.
+// If to is empty, rollbackTarget returns the record of previous which is the image deployed before the current image.
+// histories must be sorted from newest to oldest.
+func rollbackTarget(histories []*buildHistory, previous, to string) (*buildHistory, error) {
+	if to == "" {
+		if previous == "" {
+			return nil, xerrors.New("the image deployed before is not found. Specify the digest or the build id to roll back to")
+		}
+		to = previous
+	}
+
+	for _, v := range histories {
+		if v.Ref == to || v.BuildId == to {
+			return v, nil
+		}
+	}
+
+	return nil, xerrors.Errorf("%s is not found in the build history", to)
+}
+
+// findEnvironment returns the environment which deploys the image to the repository.
+// If name is empty, the first environment of the repository is returned.
+func findEnvironment(envs []*config.Environment, repository, name string) *config.Environment {
+	for _, v := range envs {
+		if v.Repo != repository {
+			continue
+		}
+		if name != "" && v.Name != name {
+			continue
+		}
+		return v
+	}
+
+	return nil
+}
+
+// Rollback opens the pull request which restores the image of the manifest repository to the image deployed before.
+// image is the name of the image which is built (post_process.image of the build rule).
+// If to is not empty, the image is restored to the digest or the build id instead of the image deployed before.
+// If autoMerge is true, the pull request is merged automatically even if the rule doesn't have auto_merge.
+// If the manifest repository already has the image, Rollback returns nil.
+func (b *BazelBuild) Rollback(repository, image, environment, to string, autoMerge bool) (*github.PullRequest, error) {
+	s := strings.SplitN(repository, "/", 2)
+	if len(s) != 2 {
+		return nil, xerrors.Errorf("invalid repository name: %s", repository)
+	}
+
+	histories, err := b.listHistory(image)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	if len(histories) == 0 {
+		return nil, xerrors.Errorf("%s doesn't have any build history", image)
+	}
+	latest := histories[0]
+	rules, err := b.fetchRules(latest.eventContext())
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	var rule *config.BuildRule
+	for _, v := range rules {
+		if v.PostProcess != nil && v.PostProcess.Image == image {
+			rule = v
+			break
+		}
+	}
+	if rule == nil {
+		return nil, xerrors.Errorf("%s/%s@%s doesn't have post_process of %s", latest.Owner, latest.Repo, latest.Commit, image)
+	}
+	env := findEnvironment(rule.PostProcess.Stages(), repository, environment)
+	if env == nil {
+		return nil, xerrors.Errorf("%s is not deployed to %s by %s/%s", image, repository, latest.Owner, latest.Repo)
+	}
+
+	baseBranch, err := resolveBranch(b.host.NewClient(&http.Client{Transport: b.transport}), s[0], s[1], env.BaseBranch)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	r, err := newGitRepo(b.host, b.transport, s[0], s[1], env.Image, b.AuthorName, b.AuthorEmail, b.GitMirrorURL, b.signKey)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	defer r.Close()
+	postProcess := env.PostProcess
+	if autoMerge && postProcess.AutoMerge == nil {
+		postProcess.AutoMerge = &config.AutoMerge{}
+	}
+	r.baseBranch = baseBranch
+	r.environment = env.Name
+	r.postProcess = &postProcess
+	r.markers = append(r.markers, newImageMarker(image, env.Name))
+
+	newImage := updater.Image{Name: env.Image, NewName: env.NewName}
+	current, err := r.currentImage(env.UpdateTargets(), newImage)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	previous := ""
+	if to == "" {
+		previous, err = r.previousImage(env.UpdateTargets(), newImage, imageRef(current))
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+	}
+	target, err := rollbackTarget(histories, previous, to)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	if strings.HasPrefix(target.Ref, "sha256:") {
+		newImage.Digest = target.Ref
+	} else {
+		newImage.Tag = target.Ref
+	}
+	log.Printf("Roll back %s in %s from %s to %s (build %s)", image, repository, imageRef(current), target.Ref, target.BuildId)
+
+	buildCtx := target.eventContext()
+	pr, err := r.UpdateImage(buildCtx, newImage, env.UpdateTargets(), func(oldImage *updater.Image, editedFiles []string) *changelog {
+		cl := &changelog{
+			Host:        b.host,
+			Owner:       buildCtx.Owner,
+			Repo:        buildCtx.Repo,
+			Environment: env.Name,
+			OldImage:    oldImage,
+			NewImage:    newImage,
+			NewCommit:   buildCtx.Commit,
+			EditedFiles: editedFiles,
+			Rollback:    true,
+		}
+		b.describeChanges(buildCtx, target.BuildId, cl)
+		return cl
+	})
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	if pr == nil {
+		return nil, nil
+	}
+	if postProcess.AutoMerge != nil {
+		b.autoMerge.Schedule(r.owner, r.repoName, pr.GetNumber(), postProcess.AutoMerge.DelayDuration)
+	}
+
+	// The broken image must not be promoted to the next environment
+	b.promotionMu.Lock()
+	err = b.deletePromotion(image, imageRef(current))
+	b.promotionMu.Unlock()
+	if err != nil {
+		errorLog(err)
+	}
+
+	return pr, nil
+}
+
+// RollbackCommand opens the pull request of Rollback when "/rollback" is commented on the pull request created by the bot.
+// The manifest repositories have to be allowed to send issue_comment event.
+func (b *BazelBuild) RollbackCommand(e interface{}) {
+	event, ok := e.(*github.IssueCommentEvent)
+	if !ok || event.GetAction() != "created" || !event.GetIssue().IsPullRequest() {
+		return
+	}
+	to, ok := parseRollbackCommand(event.GetComment().GetBody())
+	if !ok {
+		return
+	}
+	if !commandAllowed(event.GetComment()) {
+		log.Printf("%s is not allowed to roll back", event.GetComment().GetUser().GetLogin())
+		return
+	}
+	marker := parseImageMarker(event.GetIssue().GetBody())
+	if marker == nil {
+		return
+	}
+
+	var reply string
+	pr, err := b.Rollback(event.GetRepo().GetFullName(), marker.Image, marker.Environment, to, false)
+	switch {
+	case err != nil:
+		errorLog(err)
+		reply = fmt.Sprintf("Failed to roll back `%s`: %v", marker.Image, err)
+	case pr == nil:
+		reply = fmt.Sprintf("`%s` is already rolled back", marker.Image)
+	default:
+		reply = fmt.Sprintf("Opened #%d to roll back `%s`", pr.GetNumber(), marker.Image)
+	}
+
+	client := b.host.NewClient(&http.Client{Transport: b.transport})
+	_, _, err = client.Issues.CreateComment(context.Background(), event.GetRepo().GetOwner().GetLogin(), event.GetRepo().GetName(), event.GetIssue().GetNumber(), &github.IssueComment{
+		Body: github.String(reply),
+	})
+	if err != nil {
+		errorLog(xerrors.Errorf(": %v", err))
+	}
+}
+
+// previousImage returns the ref of the image which was deployed before current in the history of the base branch.
+// The history is read through the API because the manifest repository is cloned shallowly.
+// If the recent history doesn't have the other image, previousImage returns empty.
+func (g *gitRepo) previousImage(targets []config.UpdateTarget, image updater.Image, current string) (string, error) {
+	if len(targets) == 0 {
+		return "", xerrors.Errorf("%s doesn't have any target", g.image)
+	}
+	target := targets[0]
+	u, err := updater.Get(target.Type)
+	if err != nil {
+		return "", xerrors.Errorf(": %v", err)
+	}
+
+	client := g.host.NewClient(&http.Client{Transport: g.transport})
+	commits, _, err := client.Repositories.ListCommits(context.Background(), g.owner, g.repoName, &github.CommitsListOptions{
+		SHA:         g.baseBranch,
+		Path:        target.Path,
+		ListOptions: github.ListOptions{PerPage: rollbackDepth},
+	})
+	if err != nil {
+		return "", xerrors.Errorf(": %v", err)
+	}
+	repo := &webhook.Repository{Provider: webhook.ProviderGitHub, Owner: g.owner, Name: g.repoName}
+	files := webhook.NewGitHubClient(client)
+	for _, v := range commits {
+		b, err := files.FetchFile(repo, v.GetSHA(), target.Path)
+		if err != nil {
+			return "", xerrors.Errorf(": %v", err)
+		}
+		deployed, err := u.Current(b, target.Locator, image)
+		if err != nil {
+			// The image is not deployed before the commit
+			break
+		}
+		if ref := imageRef(deployed); ref != current {
+			return ref, nil
+		}
+	}
+
+	return "", nil
+}
+
+// currentImage returns the image which is written in the targets on the head of the base branch.
+func (g *gitRepo) currentImage(targets []config.UpdateTarget, image updater.Image) (*updater.Image, error) {
+	ref, err := g.repo.Reference(plumbing.ReferenceName(fmt.Sprintf("refs/remotes/origin/%s", g.baseBranch)), true)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	commit, err := g.repo.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	for _, target := range targets {
+		u, err := updater.Get(target.Type)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		f, err := commit.File(target.Path)
+		if err != nil {
+			return nil, xerrors.Errorf("%s: %v", target.Path, err)
+		}
+		contents, err := f.Contents()
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		current, err := u.Current([]byte(contents), target.Locator, image)
+		if err != nil {
+			return nil, xerrors.Errorf("%s: %v", target.Path, err)
+		}
+		return current, nil
+	}
+
+	return nil, xerrors.Errorf("%s doesn't have any target", g.image)
+}
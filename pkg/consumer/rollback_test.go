@@ -0,0 +1,137 @@
+package consumer
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/updater"
+)
+
+func TestImageMarker(t *testing.T) {
+	body := "Update `registry.f110.dev/bot/bot`\n\n" + newImageMarker("registry.f110.dev/bot/bot", "production") + "\n"
+
+	marker := parseImageMarker(body)
+	if marker == nil {
+		t.Fatal("Expect to find the marker")
+	}
+	if marker.Image != "registry.f110.dev/bot/bot" || marker.Environment != "production" {
+		t.Errorf("unexpected marker: %+v", marker)
+	}
+
+	if parseImageMarker("Update `registry.f110.dev/bot/bot`") != nil {
+		t.Error("Expect not to find the marker")
+	}
+}
+
+func TestParseRollbackCommand(t *testing.T) {
+	cases := []struct {
+		Body string
+		To   string
+		Ok   bool
+	}{
+		{Body: "/rollback", Ok: true},
+		{Body: " /rollback sha256:0123456789abcdef\n", To: "sha256:0123456789abcdef", Ok: true},
+		{Body: "/rollback abcd1234", To: "abcd1234", Ok: true},
+		{Body: "/rollback to abcd1234"},
+		{Body: "/promote"},
+		{Body: "Please /rollback"},
+	}
+
+	for _, c := range cases {
+		to, ok := parseRollbackCommand(c.Body)
+		if ok != c.Ok || to != c.To {
+			t.Errorf("%q: expect %q, %v but got %q, %v", c.Body, c.To, c.Ok, to, ok)
+		}
+	}
+}
+
+func TestRollbackTarget(t *testing.T) {
+	now := time.Now()
+	histories := []*buildHistory{
+		{Ref: "sha256:3", BuildId: "build3", BuiltAt: now},
+		{Ref: "sha256:2", BuildId: "build2", BuiltAt: now.Add(-time.Hour)},
+		{Ref: "sha256:2", BuildId: "build2-retry", BuiltAt: now.Add(-2 * time.Hour)},
+		{Ref: "sha256:1", BuildId: "build1", BuiltAt: now.Add(-3 * time.Hour)},
+	}
+
+	cases := []struct {
+		Previous string
+		To       string
+		BuildId  string
+		Err      bool
+	}{
+		{Previous: "sha256:2", BuildId: "build2"},
+		{Previous: "sha256:1", BuildId: "build1"},
+		{Previous: "sha256:2", To: "sha256:1", BuildId: "build1"},
+		{Previous: "sha256:2", To: "build2-retry", BuildId: "build2-retry"},
+		{Previous: "", Err: true},
+		{Previous: "sha256:unknown", Err: true},
+		{Previous: "sha256:2", To: "sha256:unknown", Err: true},
+	}
+
+	for _, c := range cases {
+		h, err := rollbackTarget(histories, c.Previous, c.To)
+		if c.Err {
+			if err == nil {
+				t.Errorf("%s to %q: expect an error", c.Previous, c.To)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s to %q: %v", c.Previous, c.To, err)
+			continue
+		}
+		if h.BuildId != c.BuildId {
+			t.Errorf("%s to %q: expect %s but got %s", c.Previous, c.To, c.BuildId, h.BuildId)
+		}
+	}
+}
+
+func TestFindEnvironment(t *testing.T) {
+	envs := []*config.Environment{
+		{Name: "staging", PostProcess: config.PostProcess{Repo: "f110/k8s-manifests"}},
+		{Name: "production", PostProcess: config.PostProcess{Repo: "f110/k8s-manifests"}},
+		{Name: "dr", PostProcess: config.PostProcess{Repo: "f110/k8s-manifests-dr"}},
+	}
+
+	if env := findEnvironment(envs, "f110/k8s-manifests", ""); env == nil || env.Name != "staging" {
+		t.Errorf("Expect the first environment of the repository: %v", env)
+	}
+	if env := findEnvironment(envs, "f110/k8s-manifests", "production"); env == nil || env.Name != "production" {
+		t.Errorf("Expect production: %v", env)
+	}
+	if env := findEnvironment(envs, "f110/k8s-manifests", "dr"); env != nil {
+		t.Errorf("Expect not to find the environment: %v", env)
+	}
+}
+
+func TestRefFromHistoryKey(t *testing.T) {
+	prefix := "history/registry.f110.dev/bot/bot/"
+	if ref := refFromHistoryKey(prefix, buildHistoryKey("registry.f110.dev/bot/bot", "sha256:0123")); ref != "sha256:0123" {
+		t.Errorf("unexpected ref: %s", ref)
+	}
+	if ref := refFromHistoryKey(prefix, buildHistoryKey("registry.f110.dev/bot/bot", "v1.2.0")); ref != "v1.2.0" {
+		t.Errorf("unexpected ref: %s", ref)
+	}
+}
+
+func TestChangelog_Rollback(t *testing.T) {
+	cl := &changelog{
+		Owner:       "f110",
+		Repo:        "bot",
+		Environment: "production",
+		OldImage:    &updater.Image{Name: "registry.f110.dev/bot/bot", Digest: "sha256:3"},
+		NewImage:    updater.Image{Name: "registry.f110.dev/bot/bot", Digest: "sha256:2"},
+		OldCommit:   "3333333333",
+		NewCommit:   "2222222222",
+		Rollback:    true,
+	}
+	if cl.Title() != "Rollback bot to 2222222 in production" {
+		t.Errorf("unexpected title: %s", cl.Title())
+	}
+	if !strings.Contains(cl.String(), "compare/2222222222...3333333333") {
+		t.Errorf("Expect the compare link of the reverted changes:\n%s", cl.String())
+	}
+}
@@ -0,0 +1,73 @@
+package consumer
+
+import (
+	"log"
+	"sync"
+)
+
+// serialQueue runs the jobs of the same key one by one.
+// While the job of the key is running, only the newest job is queued. The older job in the queue is discarded
+// because the newest job supersedes it (e.g. the newer commit of the same branch).
+type serialQueue struct {
+	mu      sync.Mutex
+	running map[string]bool
+	pending map[string]func()
+}
+
+func newSerialQueue() *serialQueue {
+	return &serialQueue{
+		running: make(map[string]bool),
+		pending: make(map[string]func()),
+	}
+}
+
+// Run runs fn if the job of the key is not running. Otherwise fn is queued and Run returns immediately.
+// The queued job is run by the goroutine of the running job after it finishes.
+func (q *serialQueue) Run(key string, fn func()) {
+	if q.enqueue(key, fn) {
+		return
+	}
+	q.run(key, fn)
+}
+
+// Go is the same as Run, but runs fn in a new goroutine. The key is held by fn when Go returns.
+func (q *serialQueue) Go(key string, fn func()) {
+	if q.enqueue(key, fn) {
+		return
+	}
+	go q.run(key, fn)
+}
+
+// enqueue returns false if the caller has to run the job. Otherwise the job is queued.
+func (q *serialQueue) enqueue(key string, fn func()) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.running[key] {
+		q.running[key] = true
+		return false
+	}
+	if _, ok := q.pending[key]; ok {
+		log.Printf("Discard the queued job of %s because the newer job is queued", key)
+	} else {
+		log.Printf("Queue the job of %s because the previous job is running", key)
+	}
+	q.pending[key] = fn
+	return true
+}
+
+func (q *serialQueue) run(key string, fn func()) {
+	for fn != nil {
+		fn()
+
+		q.mu.Lock()
+		next, ok := q.pending[key]
+		if ok {
+			delete(q.pending, key)
+		} else {
+			delete(q.running, key)
+		}
+		q.mu.Unlock()
+		fn = next
+	}
+}
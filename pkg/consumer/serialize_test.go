@@ -0,0 +1,82 @@
+package consumer
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSerialQueue(t *testing.T) {
+	q := newSerialQueue()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var mu sync.Mutex
+	done := make([]string, 0)
+	record := func(name string) {
+		mu.Lock()
+		done = append(done, name)
+		mu.Unlock()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		q.Run("f110/bot@master", func() {
+			close(started)
+			<-release
+			record("first")
+		})
+		close(finished)
+	}()
+	<-started
+
+	// These jobs are queued while the first job is running. Only the newest job is run.
+	q.Run("f110/bot@master", func() { record("second") })
+	q.Run("f110/bot@master", func() { record("third") })
+	// The job of the other key is not blocked
+	q.Run("f110/bot@feature", func() { record("other") })
+
+	close(release)
+	<-finished
+
+	if !reflect.DeepEqual(done, []string{"other", "first", "third"}) {
+		t.Errorf("unexpected jobs: %v", done)
+	}
+	if len(q.running) != 0 || len(q.pending) != 0 {
+		t.Error("Expect the queue is empty")
+	}
+}
+
+func TestSerialQueue_Go(t *testing.T) {
+	q := newSerialQueue()
+
+	release := make(chan struct{})
+	done := make(chan string, 2)
+	// Go holds the key when it returns
+	q.Go("f110/bot@master", func() {
+		<-release
+		done <- "resumed"
+	})
+
+	// The job is queued even if the commit is not the head of the branch because it may not be applied yet
+	q.Run("f110/bot@master", func() { done <- "queued" })
+	close(release)
+
+	for _, expect := range []string{"resumed", "queued"} {
+		select {
+		case v := <-done:
+			if v != expect {
+				t.Errorf("Expect %s: %s", expect, v)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s is not run", expect)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.running) != 0 || len(q.pending) != 0 {
+		t.Error("Expect the queue is empty")
+	}
+}
@@ -0,0 +1,59 @@
+package consumer
+
+import (
+	"bytes"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/xerrors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	signingKeySecretKey        = "signing.key"
+	signingPassphraseSecretKey = "passphrase"
+)
+
+// loadSigningKey reads the OpenPGP private key from the secret.
+// The secret has the armored private key in signing.key and the passphrase of the key in passphrase. The passphrase is optional.
+func loadSigningKey(namespace, secretName string) (*openpgp.Entity, error) {
+	client, err := NewKubernetesClient()
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	secret, err := client.CoreV1().Secrets(namespace).Get(secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	return parseSigningKey(secret.Data[signingKeySecretKey], secret.Data[signingPassphraseSecretKey])
+}
+
+// parseSigningKey returns the first entity which has the private key. The encrypted key is decrypted by the passphrase.
+func parseSigningKey(armored, passphrase []byte) (*openpgp.Entity, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(armored))
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	for _, e := range entities {
+		if e.PrivateKey == nil {
+			continue
+		}
+		if e.PrivateKey.Encrypted {
+			if err := e.PrivateKey.Decrypt(passphrase); err != nil {
+				return nil, xerrors.Errorf(": %v", err)
+			}
+		}
+		for _, sub := range e.Subkeys {
+			if sub.PrivateKey != nil && sub.PrivateKey.Encrypted {
+				if err := sub.PrivateKey.Decrypt(passphrase); err != nil {
+					return nil, xerrors.Errorf(": %v", err)
+				}
+			}
+		}
+
+		return e, nil
+	}
+
+	return nil, xerrors.New("the private key is not found")
+}
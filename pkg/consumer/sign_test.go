@@ -0,0 +1,80 @@
+package consumer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"gopkg.in/src-d/go-git.v4"
+)
+
+func TestGitRepo_commitWithSignKey(t *testing.T) {
+	entity, err := openpgp.NewEntity("bot", "", "bot@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey := new(bytes.Buffer)
+	w, err := armor.Encode(privateKey, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.SerializePrivate(w, nil); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	publicKey := new(bytes.Buffer)
+	w, err = armor.Encode(publicKey, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	signKey, err := parseSigningKey(privateKey.Bytes(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "kustomization.yaml"), []byte("images: []\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	g := &gitRepo{dir: dir, repo: r, authorName: "bot", authorEmail: "bot@example.com", signKey: signKey}
+	if err := g.commit(tree, "kustomization.yaml"); err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := r.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := r.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit.PGPSignature == "" {
+		t.Fatal("Expect the commit is signed")
+	}
+	if _, err := commit.Verify(publicKey.String()); err != nil {
+		t.Errorf("Failed to verify the signature: %v", err)
+	}
+}
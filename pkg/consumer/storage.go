@@ -0,0 +1,361 @@
+package consumer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/xerrors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// buildLogPresignExpiry is short because the presigned url is written in the pull request
+	buildLogPresignExpiry = 1 * time.Hour
+)
+
+// buildHistory is the record of the image which is built by the bot.
+// The record is used to find the commit from which the image currently deployed is built.
+type buildHistory struct {
+	// Ref is the digest or the tag of the image. The records which are saved by the old version don't have Ref.
+	Ref     string    `json:"ref,omitempty"`
+	Owner   string    `json:"owner"`
+	Repo    string    `json:"repo"`
+	Commit  string    `json:"commit"`
+	BuildId string    `json:"build_id"`
+	BuiltAt time.Time `json:"built_at"`
+	// Provider and CloneURL are set if the source repository is not hosted on GitHub
+	Provider string `json:"provider,omitempty"`
+	CloneURL string `json:"clone_url,omitempty"`
+}
+
+// eventContext returns the context of the commit which the image is built from.
+func (h *buildHistory) eventContext() *eventContext {
+	return &eventContext{Provider: h.Provider, Owner: h.Owner, Repo: h.Repo, Commit: h.Commit, cloneURL: h.CloneURL}
+}
+
+func newS3Client(host string) *s3.S3 {
+	cfg := &aws.Config{
+		Endpoint:         aws.String(host),
+		Region:           aws.String("us-east-1"),
+		DisableSSL:       aws.Bool(true),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewEnvCredentials(),
+	}
+	sess := session.Must(session.NewSession(cfg))
+
+	return s3.New(sess)
+}
+
+func buildHistoryKey(image, ref string) string {
+	return fmt.Sprintf("history/%s/%s.json", image, strings.Replace(ref, ":", "-", -1))
+}
+
+func promotionKey(image, ref string) string {
+	return fmt.Sprintf("promotion/%s/%s.json", image, strings.Replace(ref, ":", "-", -1))
+}
+
+func buildCacheObjectKey(key string) string {
+	return fmt.Sprintf("cache/%s.json", key)
+}
+
+func artifactKey(buildCtx *eventContext, buildId string) string {
+	return fmt.Sprintf("%s-%s-%s.tar", buildCtx.Owner, buildCtx.Repo, buildId)
+}
+
+func buildLogKey(buildCtx *eventContext, buildId string) string {
+	return fmt.Sprintf("logs/%s-%s-%s.log", buildCtx.Owner, buildCtx.Repo, buildId)
+}
+
+// saveHistory records the image which is built from the commit.
+// ref is the digest or the tag of the image.
+func (b *BazelBuild) saveHistory(image, ref string, h *buildHistory) error {
+	return b.putObject(buildHistoryKey(image, ref), h)
+}
+
+// findHistory returns the record of the image. If the image is not built by the bot, findHistory returns nil.
+func (b *BazelBuild) findHistory(image, ref string) (*buildHistory, error) {
+	h := &buildHistory{}
+	found, err := b.getObject(buildHistoryKey(image, ref), h)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return h, nil
+}
+
+// listHistory returns all records of the image in order from newest to oldest.
+func (b *BazelBuild) listHistory(image string) ([]*buildHistory, error) {
+	prefix := fmt.Sprintf("history/%s/", image)
+	// The delimiter excludes the images under the image. (e.g. a/b/c for a/b)
+	keys, err := b.listKeys(prefix, "/")
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	histories := make([]*buildHistory, 0, len(keys))
+	for _, k := range keys {
+		h := &buildHistory{}
+		found, err := b.getObject(k, h)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		if !found {
+			continue
+		}
+		if h.Ref == "" {
+			h.Ref = refFromHistoryKey(prefix, k)
+		}
+		histories = append(histories, h)
+	}
+	sort.SliceStable(histories, func(i, j int) bool {
+		return histories[i].BuiltAt.After(histories[j].BuiltAt)
+	})
+
+	return histories, nil
+}
+
+// refFromHistoryKey restores the ref from the key of the record. The colon of the digest is replaced in the key.
+func refFromHistoryKey(prefix, key string) string {
+	ref := strings.TrimSuffix(strings.TrimPrefix(key, prefix), ".json")
+	if strings.HasPrefix(ref, "sha256-") {
+		return "sha256:" + strings.TrimPrefix(ref, "sha256-")
+	}
+
+	return ref
+}
+
+func (b *BazelBuild) saveBuildCache(key string, c *buildCache) error {
+	return b.putObject(buildCacheObjectKey(key), c)
+}
+
+// findBuildCache returns the record of the build which has the key.
+// If the build doesn't exist or the artifact of the build is already deleted, findBuildCache returns nil.
+func (b *BazelBuild) findBuildCache(buildCtx *eventContext, key string) (*buildCache, error) {
+	c := &buildCache{}
+	found, err := b.getObject(buildCacheObjectKey(key), c)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	if !found {
+		return nil, nil
+	}
+	if len(artifactPaths(buildCtx)) == 0 {
+		return c, nil
+	}
+
+	_, err = newS3Client(b.StorageHost).HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(b.ArtifactBucket),
+		Key:    aws.String(artifactKey(buildCtx, c.BuildId)),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	return c, nil
+}
+
+func (b *BazelBuild) savePromotion(p *promotion) error {
+	return b.putObject(promotionKey(p.Image.Name, imageRef(&p.Image)), p)
+}
+
+// findPromotion returns the promotion of the image. If the promotion is finished or not started, findPromotion returns nil.
+func (b *BazelBuild) findPromotion(image, ref string) (*promotion, error) {
+	p := &promotion{}
+	found, err := b.getObject(promotionKey(image, ref), p)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return p, nil
+}
+
+func (b *BazelBuild) deletePromotion(image, ref string) error {
+	_, err := newS3Client(b.StorageHost).DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(b.ArtifactBucket),
+		Key:    aws.String(promotionKey(image, ref)),
+	})
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	return nil
+}
+
+// listPromotions returns all promotions in progress.
+// If image is not empty, listPromotions returns the promotions of the image only.
+func (b *BazelBuild) listPromotions(image string) ([]*promotion, error) {
+	prefix, delimiter := "promotion/", ""
+	if image != "" {
+		// The delimiter excludes the images under the image. (e.g. a/b/c for a/b)
+		prefix, delimiter = prefix+image+"/", "/"
+	}
+
+	keys, err := b.listKeys(prefix, delimiter)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	promotions := make([]*promotion, 0, len(keys))
+	for _, k := range keys {
+		p := &promotion{}
+		found, err := b.getObject(k, p)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		if found {
+			promotions = append(promotions, p)
+		}
+	}
+
+	return promotions, nil
+}
+
+// listKeys returns the keys which have the prefix.
+// If delimiter is not empty, the keys which have the delimiter after the prefix are not returned.
+func (b *BazelBuild) listKeys(prefix, delimiter string) ([]string, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.ArtifactBucket),
+		Prefix: aws.String(prefix),
+	}
+	if delimiter != "" {
+		input.Delimiter = aws.String(delimiter)
+	}
+	keys := make([]string, 0)
+	err := newS3Client(b.StorageHost).ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, v := range page.Contents {
+			keys = append(keys, aws.StringValue(v.Key))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	return keys, nil
+}
+
+func (b *BazelBuild) putObject(key string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	_, err = newS3Client(b.StorageHost).PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(b.ArtifactBucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(buf),
+	})
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	return nil
+}
+
+// getObject decodes the object into v. If the object doesn't exist, getObject returns false.
+func (b *BazelBuild) getObject(key string, v interface{}) (bool, error) {
+	obj, err := newS3Client(b.StorageHost).GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(b.ArtifactBucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return false, nil
+		}
+		return false, xerrors.Errorf(": %v", err)
+	}
+	defer obj.Body.Close()
+
+	buf, err := ioutil.ReadAll(obj.Body)
+	if err != nil {
+		return false, xerrors.Errorf(": %v", err)
+	}
+	if err := json.Unmarshal(buf, v); err != nil {
+		return false, xerrors.Errorf(": %v", err)
+	}
+
+	return true, nil
+}
+
+// saveBuildLog uploads the log of the main container of the build to the artifact bucket.
+func (b *BazelBuild) saveBuildLog(client *kubernetes.Clientset, buildCtx *eventContext, buildId string) error {
+	podList, err := client.CoreV1().Pods(b.Namespace).List(metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", labelKeyJobId, buildId),
+	})
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	if len(podList.Items) == 0 {
+		return xerrors.Errorf("could not find the pod of %s", buildId)
+	}
+	// The last pod is the result of the build if the job is retried
+	pod := podList.Items[0]
+	for _, v := range podList.Items {
+		if v.CreationTimestamp.After(pod.CreationTimestamp.Time) {
+			pod = v
+		}
+	}
+
+	buf, err := client.CoreV1().Pods(b.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{Container: "main"}).DoRaw()
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	_, err = newS3Client(b.StorageHost).PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(b.ArtifactBucket),
+		Key:         aws.String(buildLogKey(buildCtx, buildId)),
+		Body:        bytes.NewReader(buf),
+		ContentType: aws.String("text/plain"),
+	})
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	return nil
+}
+
+// buildLogURL returns the url of the build log.
+// If the base url is not configured, buildLogURL returns the url which is presigned against the public endpoint.
+// If neither of them is configured, buildLogURL returns empty because StorageHost is not reachable from the users.
+func (b *BazelBuild) buildLogURL(buildCtx *eventContext, buildId string) (string, error) {
+	key := buildLogKey(buildCtx, buildId)
+	if b.BuildLogBaseURL != "" {
+		return fmt.Sprintf("%s/%s", strings.TrimSuffix(b.BuildLogBaseURL, "/"), key), nil
+	}
+	if b.StoragePublicHost == "" {
+		return "", nil
+	}
+
+	req, _ := newS3Client(b.StoragePublicHost).GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(b.ArtifactBucket),
+		Key:    aws.String(key),
+	})
+	u, err := req.Presign(buildLogPresignExpiry)
+	if err != nil {
+		return "", xerrors.Errorf(": %v", err)
+	}
+
+	return u, nil
+}
@@ -0,0 +1,41 @@
+package consumer
+
+import (
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestBazelBuild_buildLogURL(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	buildCtx := &eventContext{Owner: "f110", Repo: "bot"}
+	b := &BazelBuild{StorageHost: "storage.svc.cluster.local:9000", ArtifactBucket: "artifact"}
+	if u, err := b.buildLogURL(buildCtx, "1"); err != nil || u != "" {
+		t.Errorf("Expect no url because the storage is not public: %s %v", u, err)
+	}
+
+	b.StoragePublicHost = "https://s3.example.com"
+	u, err := b.buildLogURL(buildCtx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Scheme != "https" || parsed.Host != "s3.example.com" {
+		t.Errorf("Expect the url of the public endpoint: %s", u)
+	}
+	if v := parsed.Query().Get("X-Amz-Expires"); v != "3600" {
+		t.Errorf("Unexpected expiry: %s", v)
+	}
+
+	b.BuildLogBaseURL = "https://log.example.com/"
+	if u, err := b.buildLogURL(buildCtx, "1"); err != nil || u != "https://log.example.com/"+buildLogKey(buildCtx, "1") {
+		t.Errorf("Unexpected url: %s %v", u, err)
+	}
+}
@@ -4,43 +4,147 @@ import (
 	"fmt"
 
 	"golang.org/x/xerrors"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/registry"
 )
 
+// WaitForFinish watches the pod until the pod is succeeded or failed.
 func WaitForFinish(client *kubernetes.Clientset, namespace, name string) (bool, error) {
-	watchCh, err := client.CoreV1().Pods(namespace).Watch(metav1.ListOptions{
-		FieldSelector: fmt.Sprintf("metadata.name=%s", name),
-	})
-	if err != nil {
-		return false, xerrors.Errorf(": %v", err)
+	for {
+		pod, err := client.CoreV1().Pods(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return false, xerrors.Errorf(": %v", err)
+		}
+		if finished, failed := isPodFinished(pod); finished {
+			return failed, nil
+		}
+
+		watchCh, err := client.CoreV1().Pods(namespace).Watch(metav1.ListOptions{
+			FieldSelector:   fmt.Sprintf("metadata.name=%s", name),
+			ResourceVersion: pod.ResourceVersion,
+		})
+		if err != nil {
+			return false, xerrors.Errorf(": %v", err)
+		}
+		finished, failed, err := watchPod(watchCh)
+		watchCh.Stop()
+		if err != nil {
+			return false, xerrors.Errorf("%s: %v", name, err)
+		}
+		if finished {
+			return failed, nil
+		}
+		// The watch is closed by the API server (e.g. timeout). The pod is got again because the events may be missed.
 	}
-	defer watchCh.Stop()
+}
 
-	failed := false
-Watch:
-	for e := range watchCh.ResultChan() {
+// watchPod reads the events until the pod is finished or the watch is closed.
+func watchPod(w watch.Interface) (finished bool, failed bool, err error) {
+	for e := range w.ResultChan() {
 		switch e.Type {
 		case watch.Modified:
 			pod, ok := e.Object.(*corev1.Pod)
 			if !ok {
 				continue
 			}
-			switch pod.Status.Phase {
-			case corev1.PodSucceeded:
-				break Watch
-			case corev1.PodFailed:
-				failed = true
-				break Watch
+			if finished, failed := isPodFinished(pod); finished {
+				return true, failed, nil
 			}
+		case watch.Deleted:
+			return false, false, xerrors.New("the pod is deleted")
+		case watch.Error:
+			return false, false, xerrors.Errorf("failed to watch the pod: %v", apierrors.FromObject(e.Object))
 		}
 	}
 
-	return failed, nil
+	return false, false, nil
+}
+
+func isPodFinished(pod *corev1.Pod) (finished bool, failed bool) {
+	switch pod.Status.Phase {
+	case corev1.PodSucceeded:
+		return true, false
+	case corev1.PodFailed:
+		return true, true
+	}
+
+	return false, false
+}
+
+// WaitForJobFinish watches the job until the job is completed or failed.
+// The job is failed when all retries have been exhausted or the deadline has been exceeded.
+func WaitForJobFinish(client *kubernetes.Clientset, namespace, name string) (bool, error) {
+	for {
+		job, err := client.BatchV1().Jobs(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return false, xerrors.Errorf(": %v", err)
+		}
+		if finished, failed := isJobFinished(job); finished {
+			return failed, nil
+		}
+
+		watchCh, err := client.BatchV1().Jobs(namespace).Watch(metav1.ListOptions{
+			FieldSelector:   fmt.Sprintf("metadata.name=%s", name),
+			ResourceVersion: job.ResourceVersion,
+		})
+		if err != nil {
+			return false, xerrors.Errorf(": %v", err)
+		}
+		finished, failed, err := watchJob(watchCh)
+		watchCh.Stop()
+		if err != nil {
+			return false, xerrors.Errorf("%s: %v", name, err)
+		}
+		if finished {
+			return failed, nil
+		}
+		// The watch is closed by the API server (e.g. timeout). The job is got again because the events may be missed.
+	}
+}
+
+// watchJob reads the events until the job is finished or the watch is closed.
+func watchJob(w watch.Interface) (finished bool, failed bool, err error) {
+	for e := range w.ResultChan() {
+		switch e.Type {
+		case watch.Modified:
+			job, ok := e.Object.(*batchv1.Job)
+			if !ok {
+				continue
+			}
+			if finished, failed := isJobFinished(job); finished {
+				return true, failed, nil
+			}
+		case watch.Deleted:
+			return false, false, xerrors.New("the job is deleted")
+		}
+	}
+
+	return false, false, nil
+}
+
+func isJobFinished(job *batchv1.Job) (finished bool, failed bool) {
+	for _, v := range job.Status.Conditions {
+		if v.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch v.Type {
+		case batchv1.JobComplete:
+			return true, false
+		case batchv1.JobFailed:
+			return true, true
+		}
+	}
+
+	return false, false
 }
 
 func NewKubernetesClient() (*kubernetes.Clientset, error) {
@@ -60,3 +164,25 @@ func NewKubernetesClient() (*kubernetes.Clientset, error) {
 
 	return client, nil
 }
+
+// newRegistryClient returns the client of the registry with the credentials in the docker config secret.
+// If secretName is empty, the client accesses the registries anonymously.
+func newRegistryClient(namespace, secretName string, hostAliases []config.HostAlias, insecure []string) (*registry.Client, error) {
+	var credentials map[string]registry.Credential
+	if secretName != "" {
+		client, err := NewKubernetesClient()
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		secret, err := client.CoreV1().Secrets(namespace).Get(secretName, metav1.GetOptions{})
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		credentials, err = registry.ParseDockerConfig(secret.Data[corev1.DockerConfigJsonKey])
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+	}
+
+	return registry.NewClient(credentials, hostAliases, insecure), nil
+}
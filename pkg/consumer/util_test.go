@@ -0,0 +1,70 @@
+package consumer
+
+import (
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestWatchJob(t *testing.T) {
+	running := &batchv1.Job{}
+	failedJob := &batchv1.Job{Status: batchv1.JobStatus{Conditions: []batchv1.JobCondition{
+		{Type: batchv1.JobFailed, Status: corev1.ConditionTrue},
+	}}}
+
+	w := watch.NewFakeWithChanSize(2, false)
+	w.Modify(running)
+	w.Modify(failedJob)
+	if finished, failed, err := watchJob(w); err != nil || !finished || !failed {
+		t.Errorf("Expect the job is failed: %v %v %v", finished, failed, err)
+	}
+
+	// The watch is closed before the job is finished
+	w = watch.NewFakeWithChanSize(1, false)
+	w.Modify(running)
+	w.Stop()
+	if finished, _, err := watchJob(w); err != nil || finished {
+		t.Errorf("Expect the job is not finished: %v %v", finished, err)
+	}
+
+	w = watch.NewFakeWithChanSize(1, false)
+	w.Delete(running)
+	if _, _, err := watchJob(w); err == nil {
+		t.Error("Expect an error because the job is deleted")
+	}
+}
+
+func TestWatchPod(t *testing.T) {
+	running := &corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodRunning}}
+	succeeded := &corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodSucceeded}}
+
+	w := watch.NewFakeWithChanSize(2, false)
+	w.Modify(running)
+	w.Modify(succeeded)
+	if finished, failed, err := watchPod(w); err != nil || !finished || failed {
+		t.Errorf("Expect the pod is succeeded: %v %v %v", finished, failed, err)
+	}
+
+	// The watch is closed before the pod is finished
+	w = watch.NewFakeWithChanSize(1, false)
+	w.Modify(running)
+	w.Stop()
+	if finished, _, err := watchPod(w); err != nil || finished {
+		t.Errorf("Expect the pod is not finished: %v %v", finished, err)
+	}
+
+	w = watch.NewFakeWithChanSize(1, false)
+	w.Delete(running)
+	if _, _, err := watchPod(w); err == nil {
+		t.Error("Expect an error because the pod is deleted")
+	}
+
+	w = watch.NewFakeWithChanSize(1, false)
+	w.Error(&metav1.Status{Status: metav1.StatusFailure, Reason: metav1.StatusReasonExpired})
+	if _, _, err := watchPod(w); err == nil {
+		t.Error("Expect an error because the watch is failed")
+	}
+}
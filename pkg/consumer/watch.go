@@ -0,0 +1,276 @@
+package consumer
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradleyfalzon/ghinstallation"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/xerrors"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/githost"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/imagepolicy"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/updater"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/webhook"
+)
+
+const (
+	imageAutomationRuleFilePath = ".bot/image-automation.yaml"
+)
+
+// ImageWatcher polls the registries and opens the pull requests which update the images in the manifest repositories.
+// The policy of the images is read from the rule file of each manifest repository.
+type ImageWatcher struct {
+	Namespace          string
+	Repositories       []string
+	Interval           time.Duration
+	AuthorName         string
+	AuthorEmail        string
+	GitMirrorURL       string
+	InsecureRegistries []string
+
+	transport   *ghinstallation.Transport
+	host        *githost.Host
+	hostAliases []config.HostAlias
+	autoMerge   *AutoMergeConsumer
+	signKey     *openpgp.Entity
+
+	mu sync.Mutex
+	// applied is the reference of the image which is already applied. The key is the repository and the image.
+	applied map[string]string
+}
+
+func NewImageWatcher(namespace string, conf *config.Config) (*ImageWatcher, error) {
+	host, err := githost.FromConfig(conf)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	t, err := host.NewTransport(conf.GitHubAppId, conf.GitHubInstallationId, conf.GitHubAppPrivateKeyFile)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	botLogin, err := host.BotLogin(conf.GitHubAppId, conf.GitHubAppPrivateKeyFile)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	var signKey *openpgp.Entity
+	if conf.CommitSigningKeySecretName != "" {
+		signKey, err = loadSigningKey(namespace, conf.CommitSigningKeySecretName)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+	}
+
+	return &ImageWatcher{
+		Namespace:          namespace,
+		Repositories:       conf.ImageAutomation.Repositories,
+		Interval:           conf.ImageAutomation.IntervalDuration,
+		AuthorName:         conf.CommitAuthor,
+		AuthorEmail:        conf.CommitEmail,
+		GitMirrorURL:       conf.GitMirrorURL,
+		InsecureRegistries: conf.InsecureRegistries,
+		transport:          t,
+		host:               host,
+		hostAliases:        conf.HostAliases,
+		autoMerge:          newAutoMergeConsumer(host, t, botLogin),
+		signKey:            signKey,
+		applied:            make(map[string]string),
+	}, nil
+}
+
+// Run polls the registries at the interval. Run never returns.
+func (w *ImageWatcher) Run() {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		w.Poll()
+		<-ticker.C
+	}
+}
+
+// Poll checks the images of all manifest repositories once.
+func (w *ImageWatcher) Poll() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, v := range w.Repositories {
+		if err := w.poll(v); err != nil {
+			errorLog(err)
+		}
+	}
+}
+
+func (w *ImageWatcher) poll(repository string) error {
+	s := strings.SplitN(repository, "/", 2)
+	if len(s) != 2 {
+		return xerrors.Errorf("invalid repository name: %s", repository)
+	}
+	client := w.host.NewClient(&http.Client{Transport: w.transport})
+	defaultBranch, err := resolveBranch(client, s[0], s[1], "")
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	ctx := &eventContext{Owner: s[0], Repo: s[1], Commit: defaultBranch}
+	contents, err := ctx.FetchRuleFile(webhook.NewGitHubClient(client), imageAutomationRuleFilePath)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	rule, err := config.ParseImageAutomationRule(contents)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	var r *gitRepo
+	defer func() {
+		if r != nil {
+			r.Close()
+		}
+	}()
+	for _, img := range rule.Images {
+		image, err := w.latestImage(img)
+		if err != nil {
+			errorLog(err)
+			continue
+		}
+		key := fmt.Sprintf("%s:%s:%s", repository, img.Image, strings.Join(img.Paths, ","))
+		if w.applied[key] == imageRef(&image) {
+			continue
+		}
+
+		if r == nil {
+			r, err = newGitRepo(w.host, w.transport, s[0], s[1], img.Image, w.AuthorName, w.AuthorEmail, w.GitMirrorURL, w.signKey)
+			if err != nil {
+				return xerrors.Errorf(": %v", err)
+			}
+		}
+		if err := w.update(r, ctx, img, image); err != nil {
+			errorLog(err)
+			continue
+		}
+		w.applied[key] = imageRef(&image)
+	}
+
+	return nil
+}
+
+// update opens the pull request which updates the image. The repository is reused for all images of the rule.
+func (w *ImageWatcher) update(r *gitRepo, ctx *eventContext, img *config.WatchImage, image updater.Image) error {
+	baseBranch, err := resolveBranch(w.host.NewClient(&http.Client{Transport: w.transport}), r.owner, r.repoName, img.BaseBranch)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	r.image = img.Image
+	r.baseBranch = baseBranch
+	r.postProcess = &img.PostProcess
+
+	// The image is never downgraded even if the latest tag in the registry is older than the deployed tag.
+	// (e.g. the tag is deleted from the registry or the manifest is edited by hand)
+	if image.Tag != "" {
+		policy, err := imagePolicy(img)
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		current, err := r.currentImage(img.UpdateTargets(), image)
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		if current.Tag != "" && !isNewerTag(policy, current.Tag, image.Tag) {
+			log.Printf("Skip updating %s because %s is not newer than %s", img.Image, image.Tag, current.Tag)
+			return nil
+		}
+	}
+
+	pr, err := r.UpdateImage(ctx, image, img.UpdateTargets(), func(oldImage *updater.Image, editedFiles []string) *changelog {
+		return &changelog{
+			Host:        w.host,
+			Owner:       ctx.Owner,
+			Repo:        ctx.Repo,
+			OldImage:    oldImage,
+			NewImage:    image,
+			EditedFiles: editedFiles,
+		}
+	})
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	if pr != nil && img.AutoMerge != nil {
+		w.autoMerge.Schedule(r.owner, r.repoName, pr.GetNumber(), img.AutoMerge.DelayDuration)
+	}
+
+	return nil
+}
+
+// latestImage returns the image which is selected by the policy.
+// If the policy is Tag, the digest of the tag is returned. Otherwise the tag is returned.
+func (w *ImageWatcher) latestImage(img *config.WatchImage) (updater.Image, error) {
+	image := updater.Image{Name: img.Image, NewName: img.NewName}
+	c, err := newRegistryClient(w.Namespace, img.DockerConfigSecretName, w.hostAliases, w.InsecureRegistries)
+	if err != nil {
+		return image, xerrors.Errorf(": %v", err)
+	}
+
+	if img.Tag != "" {
+		d, err := c.Digest(fmt.Sprintf("%s:%s", img.Image, img.Tag))
+		if err != nil {
+			return image, xerrors.Errorf(": %v", err)
+		}
+		image.Digest = d
+		return image, nil
+	}
+
+	policy, err := imagePolicy(img)
+	if err != nil {
+		return image, xerrors.Errorf(": %v", err)
+	}
+	tags, err := c.Tags(img.Image)
+	if err != nil {
+		return image, xerrors.Errorf(": %v", err)
+	}
+	tag, ok := policy.Select(tags)
+	if !ok {
+		return image, xerrors.Errorf("%s doesn't have any tag which matches the policy", img.Image)
+	}
+	log.Printf("The latest tag of %s is %s", img.Image, tag)
+	image.Tag = tag
+
+	return image, nil
+}
+
+// imagePolicy returns the policy which selects the tag of the image. imagePolicy returns nil if the tag is fixed.
+func imagePolicy(img *config.WatchImage) (imagepolicy.Policy, error) {
+	switch {
+	case img.Tag != "":
+		return nil, nil
+	case img.Semver != "":
+		p, err := imagepolicy.NewSemver(img.Semver)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		return p, nil
+	default:
+		p, err := imagepolicy.NewRegex(img.Regex, img.Order)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		return p, nil
+	}
+}
+
+// isNewerTag reports whether tag is newer than current under the policy.
+// The tag is newer if current doesn't match the policy.
+func isNewerTag(policy imagepolicy.Policy, current, tag string) bool {
+	if current == tag {
+		return false
+	}
+	selected, _ := policy.Select([]string{current, tag})
+
+	return selected == tag
+}
@@ -0,0 +1,76 @@
+package consumer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/imagepolicy"
+)
+
+func TestImageWatcher_latestImage(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/example/app/tags/list", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, `{"name":"example/app","tags":["latest","v1.0.0","v1.1.0","v2.0.0"]}`)
+	})
+	mux.HandleFunc("/v2/example/app/manifests/latest", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Docker-Content-Digest", "sha256:abcd")
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	name := strings.TrimPrefix(s.URL, "http://") + "/example/app"
+
+	w := &ImageWatcher{}
+	image, err := w.latestImage(&config.WatchImage{Semver: "^1.0.0", PostProcess: config.PostProcess{Image: name}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Tag != "v1.1.0" || image.Digest != "" {
+		t.Errorf("unexpected image: %+v", image)
+	}
+
+	image, err = w.latestImage(&config.WatchImage{PostProcess: config.PostProcess{Image: name, Tag: "latest"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Digest != "sha256:abcd" {
+		t.Errorf("unexpected image: %+v", image)
+	}
+
+	if _, err := w.latestImage(&config.WatchImage{Regex: `^release-`, PostProcess: config.PostProcess{Image: name}}); err == nil {
+		t.Error("Expect to fail when no tag matches")
+	}
+}
+
+func TestIsNewerTag(t *testing.T) {
+	semver, err := imagepolicy.NewSemver(">=1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	regex, err := imagepolicy.NewRegex(`^build-(\d+)$`, imagepolicy.OrderNumerical)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		Policy  imagepolicy.Policy
+		Current string
+		Tag     string
+		Expect  bool
+	}{
+		{Policy: semver, Current: "v1.2.0", Tag: "v1.3.0", Expect: true},
+		{Policy: semver, Current: "v1.3.0", Tag: "v1.2.0", Expect: false},
+		{Policy: semver, Current: "v1.3.0", Tag: "v1.3.0", Expect: false},
+		{Policy: semver, Current: "latest", Tag: "v1.2.0", Expect: true},
+		{Policy: regex, Current: "build-10", Tag: "build-9", Expect: false},
+		{Policy: regex, Current: "build-9", Tag: "build-10", Expect: true},
+	}
+	for _, c := range cases {
+		if v := isNewerTag(c.Policy, c.Current, c.Tag); v != c.Expect {
+			t.Errorf("Expect %v for %s -> %s: %v", c.Expect, c.Current, c.Tag, v)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package githost
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bradleyfalzon/ghinstallation"
+	"github.com/google/go-github/v29/github"
+	"golang.org/x/xerrors"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+)
+
+const (
+	defaultAPIURL    = "https://api.github.com/"
+	defaultUploadURL = "https://uploads.github.com/"
+	defaultGitHost   = "github.com"
+)
+
+// Default is github.com
+var Default = &Host{
+	apiURL:    mustParse(defaultAPIURL),
+	uploadURL: mustParse(defaultUploadURL),
+	gitHost:   defaultGitHost,
+}
+
+// Host is the endpoints of GitHub or GitHub Enterprise Server.
+// The methods of nil Host use github.com.
+type Host struct {
+	apiURL    *url.URL
+	uploadURL *url.URL
+	// gitHost is the host of git and the web page (e.g. github.example.com)
+	gitHost string
+}
+
+// New returns the Host. apiURL is the base URL of the REST API (e.g. https://github.example.com/api/v3/).
+// If apiURL is empty, New returns Default.
+// If uploadURL or gitHost are empty, they are derived from apiURL in the same way as GitHub Enterprise Server.
+func New(apiURL, uploadURL, gitHost string) (*Host, error) {
+	if apiURL == "" {
+		if uploadURL != "" || gitHost != "" {
+			return nil, xerrors.New("githost: the api url is mandatory when the upload url or the git host is specified")
+		}
+		return Default, nil
+	}
+
+	api, err := parseBaseURL(apiURL)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	if uploadURL == "" {
+		uploadURL = fmt.Sprintf("%s://%s/api/uploads/", api.Scheme, api.Host)
+	}
+	upload, err := parseBaseURL(uploadURL)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	if gitHost == "" {
+		gitHost = api.Host
+	}
+
+	return &Host{apiURL: api, uploadURL: upload, gitHost: gitHost}, nil
+}
+
+// FromConfig returns the Host of the config.
+func FromConfig(conf *config.Config) (*Host, error) {
+	return New(conf.GitHubAPIURL, conf.GitHubUploadURL, conf.GitHost)
+}
+
+// NewClient returns the client of the REST API.
+func (h *Host) NewClient(hClient *http.Client) *github.Client {
+	h = h.orDefault()
+	client := github.NewClient(hClient)
+	if h == Default {
+		return client
+	}
+	apiURL, uploadURL := *h.apiURL, *h.uploadURL
+	client.BaseURL, client.UploadURL = &apiURL, &uploadURL
+
+	return client
+}
+
+// NewTransport returns the transport of the GitHub App installation.
+func (h *Host) NewTransport(appId, installationId int64, privateKeyFile string) (*ghinstallation.Transport, error) {
+	t, err := ghinstallation.NewKeyFromFile(http.DefaultTransport, appId, installationId, privateKeyFile)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	if h := h.orDefault(); h != Default {
+		t.BaseURL = strings.TrimSuffix(h.apiURL.String(), "/")
+	}
+
+	return t, nil
+}
+
+// BotLogin returns the login of the bot user of the GitHub App (e.g. my-app[bot]).
+// The pull requests and the comments which are created by the installation are authored by the bot user.
+func (h *Host) BotLogin(appId int64, privateKeyFile string) (string, error) {
+	t, err := ghinstallation.NewAppsTransportKeyFromFile(http.DefaultTransport, appId, privateKeyFile)
+	if err != nil {
+		return "", xerrors.Errorf(": %v", err)
+	}
+	if h := h.orDefault(); h != Default {
+		t.BaseURL = strings.TrimSuffix(h.apiURL.String(), "/")
+	}
+
+	app, _, err := h.NewClient(&http.Client{Transport: t}).Apps.Get(context.Background(), "")
+	if err != nil {
+		return "", xerrors.Errorf(": %v", err)
+	}
+
+	return app.GetSlug() + "[bot]", nil
+}
+
+// GitHost returns the host of git and the web page.
+func (h *Host) GitHost() string {
+	return h.orDefault().gitHost
+}
+
+// APIURL returns the base URL of the REST API. The empty string is returned for github.com.
+func (h *Host) APIURL() string {
+	if h = h.orDefault(); h == Default {
+		return ""
+	}
+
+	return h.apiURL.String()
+}
+
+// UploadURL returns the upload URL. The empty string is returned for github.com.
+func (h *Host) UploadURL() string {
+	if h = h.orDefault(); h == Default {
+		return ""
+	}
+
+	return h.uploadURL.String()
+}
+
+// CloneURL returns the URL of the repository for git.
+func (h *Host) CloneURL(owner, repo string) string {
+	return fmt.Sprintf("https://%s/%s/%s.git", h.GitHost(), owner, repo)
+}
+
+// CloneURLFormat returns the format of CloneURL. (e.g. https://github.com/%s/%s.git)
+func (h *Host) CloneURLFormat() string {
+	return fmt.Sprintf("https://%s/%%s/%%s.git", h.GitHost())
+}
+
+// RepositoryURL returns the URL of the web page of the repository.
+func (h *Host) RepositoryURL(owner, repo string) string {
+	return fmt.Sprintf("https://%s/%s/%s", h.GitHost(), owner, repo)
+}
+
+// Args returns the flags of the build sidecar. The flags are empty for github.com.
+func (h *Host) Args() []string {
+	if h = h.orDefault(); h == Default {
+		return nil
+	}
+
+	return []string{
+		fmt.Sprintf("--github-api-url=%s", h.APIURL()),
+		fmt.Sprintf("--github-upload-url=%s", h.UploadURL()),
+		fmt.Sprintf("--git-host=%s", h.GitHost()),
+	}
+}
+
+func (h *Host) orDefault() *Host {
+	if h == nil {
+		return Default
+	}
+
+	return h
+}
+
+func parseBaseURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, xerrors.Errorf("githost: %s is not an absolute url", s)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+
+	return u, nil
+}
+
+func mustParse(s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return u
+}
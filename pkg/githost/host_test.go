@@ -0,0 +1,132 @@
+package githost
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	h, err := New("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h != Default {
+		t.Error("Expect Default")
+	}
+	if h.CloneURL("octocat", "example") != "https://github.com/octocat/example.git" {
+		t.Errorf("Unexpected clone url: %s", h.CloneURL("octocat", "example"))
+	}
+	if h.Args() != nil {
+		t.Errorf("Expect no args: %v", h.Args())
+	}
+
+	h, err = New("https://github.example.com/api/v3", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.APIURL() != "https://github.example.com/api/v3/" {
+		t.Errorf("Unexpected api url: %s", h.APIURL())
+	}
+	if h.UploadURL() != "https://github.example.com/api/uploads/" {
+		t.Errorf("Unexpected upload url: %s", h.UploadURL())
+	}
+	if h.GitHost() != "github.example.com" {
+		t.Errorf("Unexpected git host: %s", h.GitHost())
+	}
+	if h.RepositoryURL("octocat", "example") != "https://github.example.com/octocat/example" {
+		t.Errorf("Unexpected repository url: %s", h.RepositoryURL("octocat", "example"))
+	}
+	expectArgs := []string{
+		"--github-api-url=https://github.example.com/api/v3/",
+		"--github-upload-url=https://github.example.com/api/uploads/",
+		"--git-host=github.example.com",
+	}
+	if !reflect.DeepEqual(h.Args(), expectArgs) {
+		t.Errorf("Unexpected args: %v", h.Args())
+	}
+
+	h, err = New("https://api.example.com/", "https://uploads.example.com/", "git.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.CloneURLFormat() != "https://git.example.com/%s/%s.git" {
+		t.Errorf("Unexpected format: %s", h.CloneURLFormat())
+	}
+
+	if _, err := New("", "", "git.example.com"); err == nil {
+		t.Error("Expect an error without the api url")
+	}
+	if _, err := New("/api/v3/", "", ""); err == nil {
+		t.Error("Expect an error with the relative url")
+	}
+
+	var nilHost *Host
+	if nilHost.GitHost() != "github.com" {
+		t.Errorf("Expect github.com for nil: %s", nilHost.GitHost())
+	}
+}
+
+func TestHost_FakeServer(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if err := pem.Encode(f, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	m := http.NewServeMux()
+	m.HandleFunc("/api/v3/app/installations/2/access_tokens", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":      "installation-token",
+			"expires_at": time.Now().Add(time.Hour),
+		})
+	})
+	m.HandleFunc("/api/v3/repos/octocat/example", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "token installation-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"full_name": "octocat/example", "default_branch": "main"})
+	})
+	s := httptest.NewServer(m)
+	defer s.Close()
+
+	h, err := New(s.URL+"/api/v3/", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := h.NewTransport(1, 2, f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := h.NewClient(&http.Client{Transport: tr})
+	repo, _, err := client.Repositories.Get(context.Background(), "octocat", "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.GetDefaultBranch() != "main" {
+		t.Errorf("Unexpected default branch: %s", repo.GetDefaultBranch())
+	}
+	if client.UploadURL.String() != s.URL+"/api/uploads/" {
+		t.Errorf("Unexpected upload url: %s", client.UploadURL.String())
+	}
+}
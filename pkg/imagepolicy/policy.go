@@ -0,0 +1,108 @@
+package imagepolicy
+
+import (
+	"math/big"
+	"regexp"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	OrderAlphabetical = "alphabetical"
+	OrderNumerical    = "numerical"
+)
+
+// Policy selects the latest tag from the tags of the image repository.
+type Policy interface {
+	// Select returns the latest tag. If no tag matches the policy, Select returns false.
+	Select(tags []string) (string, bool)
+}
+
+// Semver selects the highest version in the range.
+type Semver struct {
+	r *Range
+}
+
+func NewSemver(s string) (*Semver, error) {
+	r, err := ParseRange(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Semver{r: r}, nil
+}
+
+func (p *Semver) Select(tags []string) (string, bool) {
+	var latest *Version
+	latestTag := ""
+	for _, t := range tags {
+		v, err := ParseVersion(t)
+		if err != nil || !p.r.Match(v) {
+			continue
+		}
+		if latest == nil || v.Compare(latest) > 0 {
+			latest, latestTag = v, t
+		}
+	}
+
+	return latestTag, latest != nil
+}
+
+// Regex selects the greatest tag which matches the pattern.
+// If the pattern has the submatch, the tags are ordered by the first submatch instead of the whole tag.
+type Regex struct {
+	re    *regexp.Regexp
+	order string
+}
+
+func NewRegex(pattern, order string) (*Regex, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	switch order {
+	case "":
+		order = OrderAlphabetical
+	case OrderAlphabetical, OrderNumerical:
+	default:
+		return nil, xerrors.Errorf("imagepolicy: unknown order: %s", order)
+	}
+
+	return &Regex{re: re, order: order}, nil
+}
+
+func (p *Regex) Select(tags []string) (string, bool) {
+	latestTag, latestKey := "", ""
+	found := false
+	for _, t := range tags {
+		m := p.re.FindStringSubmatch(t)
+		if m == nil {
+			continue
+		}
+		key := t
+		if len(m) > 1 {
+			key = m[1]
+		}
+		if p.order == OrderNumerical {
+			if _, ok := new(big.Int).SetString(key, 10); !ok {
+				continue
+			}
+		}
+
+		if !found || p.less(latestKey, key) {
+			latestTag, latestKey, found = t, key, true
+		}
+	}
+
+	return latestTag, found
+}
+
+func (p *Regex) less(a, b string) bool {
+	if p.order == OrderNumerical {
+		x, _ := new(big.Int).SetString(a, 10)
+		y, _ := new(big.Int).SetString(b, 10)
+		return x.Cmp(y) < 0
+	}
+
+	return a < b
+}
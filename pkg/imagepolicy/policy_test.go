@@ -0,0 +1,79 @@
+package imagepolicy
+
+import (
+	"testing"
+)
+
+func TestSemver_Select(t *testing.T) {
+	tags := []string{"latest", "v1.0.0", "v1.2.0", "v1.10.1", "v2.0.0-rc.1", "v2.0.0", "1.11.0-beta.1", "v3"}
+
+	cases := []struct {
+		Range string
+		Tag   string
+	}{
+		{Range: ">=1.0.0 <2.0.0", Tag: "v1.10.1"},
+		{Range: "^1.2", Tag: "v1.10.1"},
+		{Range: "~1.2.0", Tag: "v1.2.0"},
+		{Range: ">=2.0.0-rc.0 <2.0.0", Tag: "v2.0.0-rc.1"},
+		{Range: "<1.0.0 || >=2.0.0", Tag: "v3"},
+		{Range: "=4.0.0", Tag: ""},
+	}
+
+	for _, c := range cases {
+		p, err := NewSemver(c.Range)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tag, ok := p.Select(tags)
+		if ok != (c.Tag != "") || tag != c.Tag {
+			t.Errorf("%s: unexpected tag: %s", c.Range, tag)
+		}
+	}
+
+	if _, err := NewSemver(">=a.b"); err == nil {
+		t.Error("Expect to fail parsing the invalid range")
+	}
+}
+
+func TestVersion_Compare(t *testing.T) {
+	versions := []string{"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0"}
+	for i := 1; i < len(versions); i++ {
+		a, err := ParseVersion(versions[i-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ParseVersion(versions[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Compare(b) != -1 || b.Compare(a) != 1 {
+			t.Errorf("Expect %s < %s", versions[i-1], versions[i])
+		}
+	}
+}
+
+func TestRegex_Select(t *testing.T) {
+	tags := []string{"main-9-abcdef", "main-10-123456", "feature-11-000000", "latest"}
+
+	p, err := NewRegex(`^main-(\d+)-[0-9a-f]+$`, OrderNumerical)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, ok := p.Select(tags)
+	if !ok || tag != "main-10-123456" {
+		t.Errorf("unexpected tag: %s", tag)
+	}
+
+	p, err = NewRegex(`^main-`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, ok = p.Select(tags)
+	if !ok || tag != "main-9-abcdef" {
+		t.Errorf("unexpected tag: %s", tag)
+	}
+
+	if _, err := NewRegex(`^main-`, "random"); err == nil {
+		t.Error("Expect to fail with the unknown order")
+	}
+}
@@ -0,0 +1,195 @@
+package imagepolicy
+
+import (
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// Version is the semantic version. The prefix "v" is allowed and the minor and the patch can be omitted.
+type Version struct {
+	Major      int64
+	Minor      int64
+	Patch      int64
+	Prerelease string
+}
+
+func ParseVersion(s string) (*Version, error) {
+	v := strings.TrimPrefix(s, "v")
+	if i := strings.Index(v, "+"); i != -1 {
+		v = v[:i]
+	}
+	ver := &Version{}
+	if i := strings.Index(v, "-"); i != -1 {
+		ver.Prerelease = v[i+1:]
+		v = v[:i]
+	}
+
+	parts := strings.Split(v, ".")
+	if len(parts) > 3 || parts[0] == "" {
+		return nil, xerrors.Errorf("imagepolicy: invalid version: %s", s)
+	}
+	nums := []*int64{&ver.Major, &ver.Minor, &ver.Patch}
+	for i, p := range parts {
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil || n < 0 {
+			return nil, xerrors.Errorf("imagepolicy: invalid version: %s", s)
+		}
+		*nums[i] = n
+	}
+
+	return ver, nil
+}
+
+// Compare returns -1, 0 or 1 if v is less than, equal to or greater than o.
+func (v *Version) Compare(o *Version) int {
+	for _, c := range [][2]int64{{v.Major, o.Major}, {v.Minor, o.Minor}, {v.Patch, o.Patch}} {
+		if c[0] < c[1] {
+			return -1
+		}
+		if c[0] > c[1] {
+			return 1
+		}
+	}
+
+	return comparePrerelease(v.Prerelease, o.Prerelease)
+}
+
+// comparePrerelease compares the pre-release versions by the rule of semver 2.0.0.
+func comparePrerelease(a, b string) int {
+	if a == b {
+		return 0
+	}
+	if a == "" {
+		return 1
+	}
+	if b == "" {
+		return -1
+	}
+
+	ap, bp := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(ap) && i < len(bp); i++ {
+		an, aErr := strconv.ParseInt(ap[i], 10, 64)
+		bn, bErr := strconv.ParseInt(bp[i], 10, 64)
+		switch {
+		case aErr == nil && bErr == nil:
+			if an != bn {
+				if an < bn {
+					return -1
+				}
+				return 1
+			}
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(ap[i], bp[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	if len(ap) < len(bp) {
+		return -1
+	}
+	if len(ap) > len(bp) {
+		return 1
+	}
+
+	return 0
+}
+
+type constraint struct {
+	op string
+	v  *Version
+}
+
+func (c constraint) match(v *Version) bool {
+	n := v.Compare(c.v)
+	switch c.op {
+	case ">":
+		return n > 0
+	case ">=":
+		return n >= 0
+	case "<":
+		return n < 0
+	case "<=":
+		return n <= 0
+	default:
+		return n == 0
+	}
+}
+
+// Range is the range of the versions. (e.g. ">=1.2.0 <2.0.0", "^1.2", "~1.2.3 || >=2.1.0")
+// The space-separated constraints are ANDed and "||" separates the alternatives.
+// The pre-release versions are matched only if the range has the pre-release version.
+type Range struct {
+	alternatives [][]constraint
+	prerelease   bool
+}
+
+func ParseRange(s string) (*Range, error) {
+	r := &Range{}
+	for _, alt := range strings.Split(s, "||") {
+		fields := strings.Fields(alt)
+		if len(fields) == 0 {
+			return nil, xerrors.Errorf("imagepolicy: invalid range: %s", s)
+		}
+
+		constraints := make([]constraint, 0, len(fields))
+		for _, f := range fields {
+			op := ""
+			for _, v := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+				if strings.HasPrefix(f, v) {
+					op = v
+					break
+				}
+			}
+			ver, err := ParseVersion(strings.TrimPrefix(f, op))
+			if err != nil {
+				return nil, err
+			}
+			if ver.Prerelease != "" {
+				r.prerelease = true
+			}
+
+			switch op {
+			case "^":
+				upper := &Version{Major: ver.Major + 1}
+				if ver.Major == 0 {
+					upper = &Version{Minor: ver.Minor + 1}
+				}
+				constraints = append(constraints, constraint{op: ">=", v: ver}, constraint{op: "<", v: upper})
+			case "~":
+				constraints = append(constraints, constraint{op: ">=", v: ver}, constraint{op: "<", v: &Version{Major: ver.Major, Minor: ver.Minor + 1}})
+			default:
+				constraints = append(constraints, constraint{op: op, v: ver})
+			}
+		}
+		r.alternatives = append(r.alternatives, constraints)
+	}
+
+	return r, nil
+}
+
+func (r *Range) Match(v *Version) bool {
+	if v.Prerelease != "" && !r.prerelease {
+		return false
+	}
+
+	for _, alt := range r.alternatives {
+		matched := true
+		for _, c := range alt {
+			if !c.match(v) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
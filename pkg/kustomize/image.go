@@ -0,0 +1,168 @@
+package kustomize
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/xerrors"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	ErrImageNotFound = xerrors.New("kustomize: image is not found")
+
+	imagesKeyRe = regexp.MustCompile(`^images:\s*(#.*)?$`)
+	keyValueRe  = regexp.MustCompile(`^(\s*)(-\s+)?([A-Za-z]+):(\s*)([^#]*?)(\s*#.*)?$`)
+)
+
+// Image is the entry of images field in kustomization.yaml.
+type Image struct {
+	Name    string `json:"name"`
+	NewName string `json:"newName,omitempty"`
+	NewTag  string `json:"newTag,omitempty"`
+	Digest  string `json:"digest,omitempty"`
+}
+
+type kustomization struct {
+	Images []Image `json:"images"`
+}
+
+type imageEntry struct {
+	start     int
+	end       int
+	keyIndent int
+	keys      map[string]int
+}
+
+// GetImage returns the entry of images whose name is the same as name.
+func GetImage(b []byte, name string) (*Image, error) {
+	k := &kustomization{}
+	if err := yaml.Unmarshal(b, k); err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	for _, v := range k.Images {
+		if v.Name == name {
+			return &v, nil
+		}
+	}
+
+	return nil, ErrImageNotFound
+}
+
+// SetImage updates the entry of images whose name is the same as image.Name.
+// Only NewName, NewTag and Digest which are not empty are written.
+// SetImage edits the lines of the entry in place, so the comments and the format of the other lines are preserved.
+func SetImage(b []byte, image Image) ([]byte, error) {
+	if _, err := GetImage(b, image.Name); err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(string(b), "\n")
+	entry, err := findImageEntry(lines, image.Name)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	fields := []struct {
+		Key   string
+		Value string
+	}{
+		{Key: "newName", Value: image.NewName},
+		{Key: "newTag", Value: image.NewTag},
+		{Key: "digest", Value: image.Digest},
+	}
+	for _, f := range fields {
+		if f.Value == "" {
+			continue
+		}
+
+		if i, ok := entry.keys[f.Key]; ok {
+			m := keyValueRe.FindStringSubmatch(lines[i])
+			sep := m[4]
+			if sep == "" {
+				sep = " "
+			}
+			lines[i] = m[1] + m[2] + m[3] + ":" + sep + quoteAs(m[5], f.Value) + m[6]
+			continue
+		}
+
+		line := strings.Repeat(" ", entry.keyIndent) + f.Key + ": " + f.Value
+		lines = append(lines[:entry.end], append([]string{line}, lines[entry.end:]...)...)
+		entry.end++
+	}
+
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// findImageEntry finds the lines of the entry which has the name in images field.
+// The flow style is not supported.
+func findImageEntry(lines []string, name string) (*imageEntry, error) {
+	start := -1
+	for i, v := range lines {
+		if imagesKeyRe.MatchString(v) {
+			start = i + 1
+			break
+		}
+	}
+	if start == -1 {
+		return nil, xerrors.New("kustomize: images field is not found or not block style")
+	}
+
+	entries := make([]*imageEntry, 0)
+	var current *imageEntry
+	for i := start; i < len(lines); i++ {
+		v := lines[i]
+		trimmed := strings.TrimSpace(v)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		indent := len(v) - len(strings.TrimLeft(v, " "))
+		if indent == 0 && !strings.HasPrefix(trimmed, "-") {
+			break
+		}
+
+		m := keyValueRe.FindStringSubmatch(v)
+		if m == nil {
+			continue
+		}
+		if m[2] != "" {
+			current = &imageEntry{start: i, keyIndent: len(m[1]) + len(m[2]), keys: make(map[string]int)}
+			entries = append(entries, current)
+		}
+		if current == nil {
+			continue
+		}
+		current.keys[m[3]] = i
+		current.end = i + 1
+	}
+
+	for _, v := range entries {
+		i, ok := v.keys["name"]
+		if !ok {
+			continue
+		}
+		m := keyValueRe.FindStringSubmatch(lines[i])
+		if unquote(m[5]) == name {
+			return v, nil
+		}
+	}
+
+	return nil, ErrImageNotFound
+}
+
+func unquote(v string) string {
+	if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+		return v[1 : len(v)-1]
+	}
+
+	return v
+}
+
+// quoteAs quotes the value with the same quote character as the original value.
+func quoteAs(original, v string) string {
+	if len(original) >= 2 && (original[0] == '"' || original[0] == '\'') {
+		return string(original[0]) + v + string(original[0])
+	}
+
+	return v
+}
@@ -0,0 +1,103 @@
+package kustomize
+
+import (
+	"testing"
+)
+
+const kustomizationFile = `namespace: bot
+
+# Images
+images:
+  - name: registry.f110.dev/discord-bot/bot
+    digest: sha256:oldhash # pinned by bot
+  - name: "registry.f110.dev/discord-bot/sidecar"
+    newTag: v1.0.0
+
+resources:
+  - deployment.yaml
+`
+
+func TestSetImage(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Image  Image
+		Expect string
+	}{
+		{
+			Name:  "Update digest",
+			Image: Image{Name: "registry.f110.dev/discord-bot/bot", Digest: "sha256:newhash"},
+			Expect: `namespace: bot
+
+# Images
+images:
+  - name: registry.f110.dev/discord-bot/bot
+    digest: sha256:newhash # pinned by bot
+  - name: "registry.f110.dev/discord-bot/sidecar"
+    newTag: v1.0.0
+
+resources:
+  - deployment.yaml
+`,
+		},
+		{
+			Name:  "Add new fields",
+			Image: Image{Name: "registry.f110.dev/discord-bot/sidecar", NewName: "registry.f110.dev/bot/sidecar", NewTag: "v1.1.0", Digest: "sha256:newhash"},
+			Expect: `namespace: bot
+
+# Images
+images:
+  - name: registry.f110.dev/discord-bot/bot
+    digest: sha256:oldhash # pinned by bot
+  - name: "registry.f110.dev/discord-bot/sidecar"
+    newTag: v1.1.0
+    newName: registry.f110.dev/bot/sidecar
+    digest: sha256:newhash
+
+resources:
+  - deployment.yaml
+`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			b, err := SetImage([]byte(kustomizationFile), c.Image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != c.Expect {
+				t.Log(string(b))
+				t.Fatal("unexpected file modification")
+			}
+		})
+	}
+}
+
+func TestSetImage_NotFound(t *testing.T) {
+	_, err := SetImage([]byte(kustomizationFile), Image{Name: "registry.f110.dev/unknown", Digest: "sha256:newhash"})
+	if err != ErrImageNotFound {
+		t.Fatalf("Expect ErrImageNotFound: %v", err)
+	}
+}
+
+func TestSetImage_NoIndent(t *testing.T) {
+	in := `images:
+- name: registry.f110.dev/discord-bot/bot
+  newTag: v1.0.0
+resources:
+- deployment.yaml`
+
+	b, err := SetImage([]byte(in), Image{Name: "registry.f110.dev/discord-bot/bot", NewTag: "v1.1.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `images:
+- name: registry.f110.dev/discord-bot/bot
+  newTag: v1.1.0
+resources:
+- deployment.yaml`
+	if string(b) != expect {
+		t.Log(string(b))
+		t.Fatal("unexpected file modification")
+	}
+}
@@ -0,0 +1,128 @@
+package kustomize
+
+// rewriteReferences rewrites the references to the objects which are renamed by namePrefix and nameSuffix.
+// The key of renamed is the kind and the old name. (e.g. ConfigMap/config)
+func rewriteReferences(objs []Object, renamed map[string]string) {
+	for _, o := range objs {
+		if spec := podSpec(o); spec != nil {
+			rewritePodSpec(spec, renamed)
+		}
+
+		switch o.Kind() {
+		case "RoleBinding", "ClusterRoleBinding":
+			if ref, ok := o["roleRef"].(map[string]interface{}); ok {
+				kind, _ := ref["kind"].(string)
+				rename(ref, "name", kind, renamed)
+			}
+			subjects, _ := o["subjects"].([]interface{})
+			for _, v := range eachMap(subjects) {
+				kind, _ := v["kind"].(string)
+				rename(v, "name", kind, renamed)
+			}
+		}
+	}
+}
+
+// podSpec returns the spec of the pod in the object. If the object doesn't have the pod, podSpec returns nil.
+func podSpec(o Object) map[string]interface{} {
+	var path []string
+	switch o.Kind() {
+	case "Pod":
+		path = []string{"spec"}
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "Job":
+		path = []string{"spec", "template", "spec"}
+	case "CronJob":
+		path = []string{"spec", "jobTemplate", "spec", "template", "spec"}
+	default:
+		return nil
+	}
+
+	cur := map[string]interface{}(o)
+	for _, p := range path {
+		next, ok := cur[p].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		cur = next
+	}
+
+	return cur
+}
+
+func rewritePodSpec(spec map[string]interface{}, renamed map[string]string) {
+	rename(spec, "serviceAccountName", "ServiceAccount", renamed)
+	imagePullSecrets, _ := spec["imagePullSecrets"].([]interface{})
+	for _, v := range eachMap(imagePullSecrets) {
+		rename(v, "name", "Secret", renamed)
+	}
+
+	volumes, _ := spec["volumes"].([]interface{})
+	for _, v := range eachMap(volumes) {
+		if m, ok := v["configMap"].(map[string]interface{}); ok {
+			rename(m, "name", "ConfigMap", renamed)
+		}
+		if m, ok := v["secret"].(map[string]interface{}); ok {
+			rename(m, "secretName", "Secret", renamed)
+		}
+		if m, ok := v["persistentVolumeClaim"].(map[string]interface{}); ok {
+			rename(m, "claimName", "PersistentVolumeClaim", renamed)
+		}
+		if projected, ok := v["projected"].(map[string]interface{}); ok {
+			sources, _ := projected["sources"].([]interface{})
+			for _, s := range eachMap(sources) {
+				if m, ok := s["configMap"].(map[string]interface{}); ok {
+					rename(m, "name", "ConfigMap", renamed)
+				}
+				if m, ok := s["secret"].(map[string]interface{}); ok {
+					rename(m, "name", "Secret", renamed)
+				}
+			}
+		}
+	}
+
+	walkContainers(spec, func(c map[string]interface{}) {
+		envFrom, _ := c["envFrom"].([]interface{})
+		for _, v := range eachMap(envFrom) {
+			if m, ok := v["configMapRef"].(map[string]interface{}); ok {
+				rename(m, "name", "ConfigMap", renamed)
+			}
+			if m, ok := v["secretRef"].(map[string]interface{}); ok {
+				rename(m, "name", "Secret", renamed)
+			}
+		}
+		env, _ := c["env"].([]interface{})
+		for _, v := range eachMap(env) {
+			valueFrom, ok := v["valueFrom"].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if m, ok := valueFrom["configMapKeyRef"].(map[string]interface{}); ok {
+				rename(m, "name", "ConfigMap", renamed)
+			}
+			if m, ok := valueFrom["secretKeyRef"].(map[string]interface{}); ok {
+				rename(m, "name", "Secret", renamed)
+			}
+		}
+	})
+}
+
+func rename(m map[string]interface{}, key, kind string, renamed map[string]string) {
+	name, ok := m[key].(string)
+	if !ok {
+		return
+	}
+	if newName, ok := renamed[kind+"/"+name]; ok {
+		m[key] = newName
+	}
+}
+
+func eachMap(list []interface{}) []map[string]interface{} {
+	maps := make([]map[string]interface{}, 0, len(list))
+	for _, v := range list {
+		if m, ok := v.(map[string]interface{}); ok {
+			maps = append(maps, m)
+		}
+	}
+
+	return maps
+}
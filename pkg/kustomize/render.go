@@ -0,0 +1,674 @@
+package kustomize
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/xerrors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/yaml"
+)
+
+// KustomizationFileNames are the names of the kustomization file in the order of precedence.
+var KustomizationFileNames = []string{"kustomization.yaml", "kustomization.yml", "Kustomization"}
+
+// supportedFields are the fields of kustomization which Render understands.
+var supportedFields = map[string]struct{}{
+	"apiVersion":            {},
+	"kind":                  {},
+	"resources":             {},
+	"bases":                 {},
+	"namespace":             {},
+	"namePrefix":            {},
+	"nameSuffix":            {},
+	"commonLabels":          {},
+	"commonAnnotations":     {},
+	"images":                {},
+	"replicas":              {},
+	"patchesStrategicMerge": {},
+}
+
+// clusterScopedKinds are the kinds which don't have the namespace.
+var clusterScopedKinds = map[string]struct{}{
+	"Namespace":                      {},
+	"ClusterRole":                    {},
+	"ClusterRoleBinding":             {},
+	"CustomResourceDefinition":       {},
+	"PersistentVolume":               {},
+	"StorageClass":                   {},
+	"PriorityClass":                  {},
+	"PodSecurityPolicy":              {},
+	"MutatingWebhookConfiguration":   {},
+	"ValidatingWebhookConfiguration": {},
+	"APIService":                     {},
+	"Node":                           {},
+}
+
+// UnsupportedError means that the kustomization uses the feature which Render doesn't support.
+// The kustomization should be built by kustomize itself.
+type UnsupportedError struct {
+	Path  string
+	Field string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("kustomize: %s uses unsupported feature: %s", e.Path, e.Field)
+}
+
+// Object is the rendered object.
+type Object map[string]interface{}
+
+func (o Object) Kind() string {
+	v, _ := o["kind"].(string)
+	return v
+}
+
+func (o Object) APIVersion() string {
+	v, _ := o["apiVersion"].(string)
+	return v
+}
+
+func (o Object) metadata() map[string]interface{} {
+	m, ok := o["metadata"].(map[string]interface{})
+	if !ok {
+		m = make(map[string]interface{})
+		o["metadata"] = m
+	}
+	return m
+}
+
+func (o Object) Name() string {
+	v, _ := o.metadata()["name"].(string)
+	return v
+}
+
+func (o Object) Namespace() string {
+	v, _ := o.metadata()["namespace"].(string)
+	return v
+}
+
+func (o Object) String() string {
+	if o.Namespace() != "" {
+		return fmt.Sprintf("%s/%s/%s", o.Kind(), o.Namespace(), o.Name())
+	}
+	return fmt.Sprintf("%s/%s", o.Kind(), o.Name())
+}
+
+// Result is the result of Render.
+type Result struct {
+	Objects []Object
+	// Files are the absolute paths of all files which are read for rendering.
+	Files []string
+}
+
+// YAML returns the rendered objects as the multi-document YAML.
+func (r *Result) YAML() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	for i, v := range r.Objects {
+		b, err := yaml.Marshal(v)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		if i > 0 {
+			buf.WriteString("---\n")
+		}
+		buf.Write(b)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// HasFile returns true if the file is read for rendering.
+func (r *Result) HasFile(path string) bool {
+	for _, v := range r.Files {
+		if v == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Render builds the kustomization in dir without kustomize.
+// Render supports the subset of kustomization. If the kustomization uses other features, Render returns *UnsupportedError.
+func Render(dir string) (*Result, error) {
+	r := &renderer{files: make(map[string]struct{})}
+	objs, err := r.render(dir, make(map[string]struct{}))
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(r.files))
+	for k := range r.files {
+		files = append(files, k)
+	}
+	sort.Strings(files)
+
+	return &Result{Objects: objs, Files: files}, nil
+}
+
+// FindKustomizationFile returns the path of the kustomization file in dir. If dir doesn't have it, FindKustomizationFile returns empty.
+func FindKustomizationFile(dir string) string {
+	for _, v := range KustomizationFileNames {
+		p := filepath.Join(dir, v)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+
+	return ""
+}
+
+type renderer struct {
+	files map[string]struct{}
+}
+
+func (r *renderer) readFile(path string) ([]byte, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	b, err := ioutil.ReadFile(abs)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	r.files[abs] = struct{}{}
+
+	return b, nil
+}
+
+func (r *renderer) render(dir string, visiting map[string]struct{}) ([]Object, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	if _, ok := visiting[abs]; ok {
+		return nil, xerrors.Errorf("kustomize: cycle is detected at %s", dir)
+	}
+	visiting[abs] = struct{}{}
+	defer delete(visiting, abs)
+
+	path := FindKustomizationFile(abs)
+	if path == "" {
+		return nil, xerrors.Errorf("kustomize: kustomization is not found in %s", dir)
+	}
+	b, err := r.readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string]interface{})
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return nil, xerrors.Errorf("%s: %v", path, err)
+	}
+	for k := range raw {
+		if _, ok := supportedFields[k]; !ok {
+			return nil, &UnsupportedError{Path: path, Field: k}
+		}
+	}
+	k := &kustomizationSpec{}
+	if err := yaml.Unmarshal(b, k); err != nil {
+		return nil, xerrors.Errorf("%s: %v", path, err)
+	}
+
+	objs := make([]Object, 0)
+	for _, res := range append(k.Bases, k.Resources...) {
+		if strings.Contains(res, "://") || strings.HasPrefix(res, "github.com/") {
+			return nil, &UnsupportedError{Path: path, Field: "remote resource " + res}
+		}
+		p := filepath.Join(abs, res)
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, xerrors.Errorf("%s: %v", path, err)
+		}
+		if fi.IsDir() {
+			o, err := r.render(p, visiting)
+			if err != nil {
+				return nil, err
+			}
+			objs = append(objs, o...)
+			continue
+		}
+
+		buf, err := r.readFile(p)
+		if err != nil {
+			return nil, err
+		}
+		o, err := decodeObjects(buf)
+		if err != nil {
+			return nil, xerrors.Errorf("%s: %v", p, err)
+		}
+		objs = append(objs, o...)
+	}
+
+	for _, v := range k.PatchesStrategicMerge {
+		var buf []byte
+		if strings.Contains(v, "\n") {
+			buf = []byte(v)
+		} else {
+			buf, err = r.readFile(filepath.Join(abs, v))
+			if err != nil {
+				return nil, err
+			}
+		}
+		patches, err := decodeObjects(buf)
+		if err != nil {
+			return nil, xerrors.Errorf("%s: %v", v, err)
+		}
+		for _, p := range patches {
+			objs, err = applyPatch(objs, p)
+			if err != nil {
+				return nil, xerrors.Errorf("%s: %v", v, err)
+			}
+		}
+	}
+
+	renamed := make(map[string]string)
+	for _, o := range objs {
+		name := o.Name()
+		k.transform(o)
+		if o.Name() != name {
+			renamed[o.Kind()+"/"+name] = o.Name()
+		}
+	}
+	if len(renamed) > 0 {
+		rewriteReferences(objs, renamed)
+	}
+
+	return objs, nil
+}
+
+// pathFields are the fields of kustomization which have the paths of the files or the directories.
+var pathFields = []string{"resources", "bases", "components", "crds", "patchesStrategicMerge", "configurations", "generators", "transformers"}
+
+// Dependencies returns the absolute paths of the files which the kustomization in dir reads.
+// Dependencies doesn't render the kustomization. Thus it returns the files of the kustomization which Render doesn't support.
+func Dependencies(dir string) ([]string, error) {
+	files := make(map[string]struct{})
+	if err := dependencies(dir, files, make(map[string]struct{})); err != nil {
+		return nil, err
+	}
+
+	deps := make([]string, 0, len(files))
+	for k := range files {
+		deps = append(deps, k)
+	}
+	sort.Strings(deps)
+
+	return deps, nil
+}
+
+func dependencies(dir string, files, visiting map[string]struct{}) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	if _, ok := visiting[abs]; ok {
+		return xerrors.Errorf("kustomize: cycle is detected at %s", dir)
+	}
+	visiting[abs] = struct{}{}
+	defer delete(visiting, abs)
+
+	path := FindKustomizationFile(abs)
+	if path == "" {
+		return xerrors.Errorf("kustomize: kustomization is not found in %s", dir)
+	}
+	files[path] = struct{}{}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	raw := make(map[string]interface{})
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return xerrors.Errorf("%s: %v", path, err)
+	}
+
+	paths := make([]string, 0)
+	for _, k := range pathFields {
+		list, _ := raw[k].([]interface{})
+		for _, v := range list {
+			if s, ok := v.(string); ok {
+				paths = append(paths, s)
+			}
+		}
+	}
+	for _, k := range []string{"patches", "patchesJson6902"} {
+		list, _ := raw[k].([]interface{})
+		for _, v := range eachMap(list) {
+			if s, ok := v["path"].(string); ok {
+				paths = append(paths, s)
+			}
+		}
+	}
+	for _, k := range []string{"configMapGenerator", "secretGenerator"} {
+		list, _ := raw[k].([]interface{})
+		for _, v := range eachMap(list) {
+			if s, ok := v["env"].(string); ok {
+				paths = append(paths, s)
+			}
+			for _, f := range []string{"envs", "files"} {
+				l, _ := v[f].([]interface{})
+				for _, e := range l {
+					s, ok := e.(string)
+					if !ok {
+						continue
+					}
+					// The entry of files may have the key. (e.g. key=path)
+					if i := strings.Index(s, "="); i != -1 {
+						s = s[i+1:]
+					}
+					paths = append(paths, s)
+				}
+			}
+		}
+	}
+
+	for _, v := range paths {
+		// The remote resources and the inline patches are not the files in the repository
+		if strings.Contains(v, "://") || strings.HasPrefix(v, "github.com/") || strings.Contains(v, "\n") {
+			continue
+		}
+		p := filepath.Join(abs, v)
+		fi, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		if fi.IsDir() {
+			if err := dependencies(p, files, visiting); err != nil {
+				return err
+			}
+			continue
+		}
+		files[p] = struct{}{}
+	}
+
+	return nil
+}
+
+type kustomizationSpec struct {
+	Resources         []string          `json:"resources"`
+	Bases             []string          `json:"bases"`
+	Namespace         string            `json:"namespace"`
+	NamePrefix        string            `json:"namePrefix"`
+	NameSuffix        string            `json:"nameSuffix"`
+	CommonLabels      map[string]string `json:"commonLabels"`
+	CommonAnnotations map[string]string `json:"commonAnnotations"`
+	Images            []Image           `json:"images"`
+	Replicas          []struct {
+		Name  string `json:"name"`
+		Count int64  `json:"count"`
+	} `json:"replicas"`
+	PatchesStrategicMerge []string `json:"patchesStrategicMerge"`
+}
+
+// transform applies the transformers of the kustomization to the object.
+func (k *kustomizationSpec) transform(o Object) {
+	meta := o.metadata()
+	for _, v := range k.Replicas {
+		if v.Name != o.Name() {
+			continue
+		}
+		switch o.Kind() {
+		case "Deployment", "StatefulSet", "ReplicaSet", "ReplicationController":
+			spec, ok := o["spec"].(map[string]interface{})
+			if ok {
+				spec["replicas"] = v.Count
+			}
+		}
+	}
+	if k.NamePrefix != "" || k.NameSuffix != "" {
+		if o.Kind() != "Namespace" && o.Kind() != "CustomResourceDefinition" {
+			meta["name"] = k.NamePrefix + o.Name() + k.NameSuffix
+		}
+	}
+	if k.Namespace != "" {
+		if _, ok := clusterScopedKinds[o.Kind()]; !ok {
+			meta["namespace"] = k.Namespace
+		}
+	}
+	if len(k.CommonLabels) > 0 {
+		setStringMap(meta, "labels", k.CommonLabels)
+		for _, p := range selectorPaths(o.Kind()) {
+			if m := lookupMap(o, p...); m != nil {
+				setStringMap(m, p[len(p)-1], k.CommonLabels)
+			}
+		}
+	}
+	if len(k.CommonAnnotations) > 0 {
+		setStringMap(meta, "annotations", k.CommonAnnotations)
+		if m := lookupMap(o, "spec", "template", "metadata"); m != nil {
+			setStringMap(m, "annotations", k.CommonAnnotations)
+		}
+	}
+	if len(k.Images) > 0 {
+		walkContainers(o, func(c map[string]interface{}) {
+			image, ok := c["image"].(string)
+			if !ok {
+				return
+			}
+			for _, v := range k.Images {
+				if newImage, ok := replaceImage(image, v); ok {
+					c["image"] = newImage
+					return
+				}
+			}
+		})
+	}
+}
+
+// selectorPaths returns the paths of the labels which commonLabels is added to besides metadata.labels.
+// The last element of the path is the key of the labels.
+func selectorPaths(kind string) [][]string {
+	switch kind {
+	case "Service":
+		return [][]string{{"spec", "selector"}}
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet":
+		return [][]string{{"spec", "selector", "matchLabels"}, {"spec", "template", "metadata", "labels"}}
+	case "Job":
+		return [][]string{{"spec", "template", "metadata", "labels"}}
+	case "CronJob":
+		return [][]string{{"spec", "jobTemplate", "spec", "template", "metadata", "labels"}}
+	}
+
+	return nil
+}
+
+// lookupMap returns the parent map of the last element of the path. The intermediate maps are created if the object has the first element.
+func lookupMap(o Object, path ...string) map[string]interface{} {
+	cur := map[string]interface{}(o)
+	for i, p := range path[:len(path)-1] {
+		next, ok := cur[p].(map[string]interface{})
+		if !ok {
+			if i == 0 {
+				return nil
+			}
+			next = make(map[string]interface{})
+			cur[p] = next
+		}
+		cur = next
+	}
+
+	return cur
+}
+
+func setStringMap(parent map[string]interface{}, key string, values map[string]string) {
+	m, ok := parent[key].(map[string]interface{})
+	if !ok {
+		m = make(map[string]interface{})
+		parent[key] = m
+	}
+	for k, v := range values {
+		m[k] = v
+	}
+}
+
+// walkContainers calls fn for every container and init container in the object.
+func walkContainers(v interface{}, fn func(c map[string]interface{})) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, child := range t {
+			if k == "containers" || k == "initContainers" {
+				if list, ok := child.([]interface{}); ok {
+					for _, c := range list {
+						if m, ok := c.(map[string]interface{}); ok {
+							fn(m)
+						}
+					}
+				}
+				continue
+			}
+			walkContainers(child, fn)
+		}
+	case Object:
+		walkContainers(map[string]interface{}(t), fn)
+	case []interface{}:
+		for _, child := range t {
+			walkContainers(child, fn)
+		}
+	}
+}
+
+// replaceImage returns the new image if the name of the image is the same as the entry.
+func replaceImage(image string, entry Image) (string, bool) {
+	name, tag, digest := image, "", ""
+	if i := strings.Index(name, "@"); i != -1 {
+		name, digest = name[:i], name[i:]
+	}
+	if i := strings.LastIndex(name, ":"); i != -1 && !strings.Contains(name[i:], "/") {
+		name, tag = name[:i], name[i:]
+	}
+	if name != entry.Name {
+		return "", false
+	}
+
+	if entry.NewName != "" {
+		name = entry.NewName
+	}
+	if entry.NewTag != "" {
+		tag, digest = ":"+entry.NewTag, ""
+	}
+	if entry.Digest != "" {
+		tag, digest = "", "@"+entry.Digest
+	}
+
+	return name + tag + digest, true
+}
+
+func decodeObjects(b []byte) ([]Object, error) {
+	objs := make([]Object, 0)
+	for _, doc := range splitDocuments(b) {
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+		o := make(Object)
+		if err := yaml.Unmarshal(doc, &o); err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		if len(o) == 0 {
+			continue
+		}
+		if o.Kind() == "List" {
+			items, _ := o["items"].([]interface{})
+			for _, v := range items {
+				if m, ok := v.(map[string]interface{}); ok {
+					objs = append(objs, Object(m))
+				}
+			}
+			continue
+		}
+		if o.Kind() == "" || o.Name() == "" {
+			return nil, xerrors.New("kustomize: the object doesn't have kind or name")
+		}
+		objs = append(objs, o)
+	}
+
+	return objs, nil
+}
+
+func splitDocuments(b []byte) [][]byte {
+	docs := make([][]byte, 0)
+	cur := new(bytes.Buffer)
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.TrimRight(line, " \t\r") == "---" {
+			docs = append(docs, cur.Bytes())
+			cur = new(bytes.Buffer)
+			continue
+		}
+		cur.WriteString(line)
+		cur.WriteString("\n")
+	}
+
+	return append(docs, cur.Bytes())
+}
+
+// applyPatch applies the strategic merge patch to the object which has the same kind and name.
+// If the kind is not a built-in type, the patch is applied as the JSON merge patch.
+func applyPatch(objs []Object, patch Object) ([]Object, error) {
+	for i, o := range objs {
+		if o.Kind() != patch.Kind() || o.Name() != patch.Name() {
+			continue
+		}
+		if patch.Namespace() != "" && o.Namespace() != patch.Namespace() {
+			continue
+		}
+
+		gv, err := schema.ParseGroupVersion(o.APIVersion())
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		typed, err := scheme.Scheme.New(gv.WithKind(o.Kind()))
+		if err != nil {
+			objs[i] = Object(mergePatch(map[string]interface{}(o), map[string]interface{}(patch)).(map[string]interface{}))
+			return objs, nil
+		}
+
+		original, err := json.Marshal(o)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		p, err := json.Marshal(patch)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		patched, err := strategicpatch.StrategicMergePatch(original, p, typed)
+		if err != nil {
+			return nil, xerrors.Errorf("%s: %v", o, err)
+		}
+		n := make(Object)
+		if err := json.Unmarshal(patched, &n); err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		objs[i] = n
+		return objs, nil
+	}
+
+	return nil, xerrors.Errorf("kustomize: the target of the patch is not found: %s", patch)
+}
+
+// mergePatch applies the patch by RFC 7386.
+func mergePatch(original, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	o, ok := original.(map[string]interface{})
+	if !ok {
+		o = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(o, k)
+			continue
+		}
+		o[k] = mergePatch(o[k], v)
+	}
+
+	return o
+}
@@ -0,0 +1,287 @@
+package kustomize
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for k, v := range files {
+		p := filepath.Join(dir, k)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(v), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"base/kustomization.yaml": `resources:
+  - deployment.yaml
+`,
+		"base/deployment.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: bot
+spec:
+  selector:
+    matchLabels:
+      app: bot
+  template:
+    metadata:
+      labels:
+        app: bot
+    spec:
+      containers:
+        - name: bot
+          image: registry.f110.dev/bot/bot:v1
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: bot
+spec:
+  selector:
+    app: bot
+`,
+		"overlay/kustomization.yaml": `namespace: bot
+namePrefix: prod-
+commonLabels:
+  env: prod
+images:
+  - name: registry.f110.dev/bot/bot
+    digest: sha256:newhash
+replicas:
+  - name: bot
+    count: 3
+bases:
+  - ../base
+patchesStrategicMerge:
+  - patch.yaml
+`,
+		"overlay/patch.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: bot
+spec:
+  template:
+    spec:
+      containers:
+        - name: bot
+          args: ["--debug"]
+`,
+	})
+
+	res, err := Render(filepath.Join(dir, "overlay"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Objects) != 2 {
+		t.Fatalf("unexpected number of objects: %d", len(res.Objects))
+	}
+	if !res.HasFile(filepath.Join(dir, "base", "deployment.yaml")) || !res.HasFile(filepath.Join(dir, "overlay", "patch.yaml")) {
+		t.Errorf("unexpected files: %v", res.Files)
+	}
+	if err := Validate(res.Objects); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := res.YAML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(b)
+	for _, v := range []string{
+		"image: registry.f110.dev/bot/bot@sha256:newhash",
+		"name: prod-bot",
+		"namespace: bot",
+		"replicas: 3",
+		"- --debug",
+		"env: prod",
+	} {
+		if !strings.Contains(out, v) {
+			t.Errorf("Expect the output contains %q", v)
+		}
+	}
+	if strings.Count(out, "env: prod") != 5 {
+		t.Errorf("Expect commonLabels is added to the selectors:\n%s", out)
+	}
+}
+
+func TestRender_NameReference(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"kustomization.yaml": `namePrefix: prod-
+resources:
+  - resources.yaml
+`,
+		"resources.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: bot
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: bot
+spec:
+  template:
+    spec:
+      serviceAccountName: bot
+      containers:
+        - name: bot
+          image: registry.f110.dev/bot/bot:v1
+          envFrom:
+            - configMapRef:
+                name: config
+            - secretRef:
+                name: external
+      volumes:
+        - name: config
+          configMap:
+            name: config
+`,
+	})
+
+	res, err := Render(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := res.YAML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(b)
+	for _, v := range []string{"serviceAccountName: prod-bot", "name: external"} {
+		if !strings.Contains(out, v) {
+			t.Errorf("Expect the output contains %q:\n%s", v, out)
+		}
+	}
+	if strings.Count(out, "name: prod-config") != 3 {
+		t.Errorf("Expect the references to the ConfigMap are rewritten:\n%s", out)
+	}
+}
+
+func TestDependencies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"base/kustomization.yaml": "resources:\n  - deployment.yaml\n",
+		"base/deployment.yaml":    "",
+		"overlay/kustomization.yaml": `resources:
+  - ../base
+patches:
+  - path: patch.yaml
+configMapGenerator:
+  - name: config
+    files:
+      - app.conf=config/app.conf
+`,
+		"overlay/patch.yaml":      "",
+		"overlay/config/app.conf": "",
+		"overlay/unused.yaml":     "",
+	})
+
+	deps, err := Dependencies(filepath.Join(dir, "overlay"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"base/deployment.yaml", "base/kustomization.yaml", "overlay/config/app.conf", "overlay/kustomization.yaml", "overlay/patch.yaml"}
+	if len(deps) != len(expect) {
+		t.Fatalf("Unexpected dependencies: %v", deps)
+	}
+	for i, v := range expect {
+		if deps[i] != filepath.Join(dir, v) {
+			t.Errorf("Expect %s: %s", v, deps[i])
+		}
+	}
+}
+
+func TestRender_Unsupported(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"kustomization.yaml": `configMapGenerator:
+  - name: config
+    literals:
+      - FOO=bar
+`,
+	})
+
+	_, err = Render(dir)
+	if _, ok := err.(*UnsupportedError); !ok {
+		t.Errorf("Expect UnsupportedError: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	objs, err := decodeObjects([]byte(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: bot
+spec:
+  template:
+    spec:
+      containers:
+        - name: bot
+          imagee: registry.f110.dev/bot/bot:v1
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: bot
+spec:
+  ports:
+    - port: "http"
+---
+apiVersion: example.com/v1
+kind: Unknown
+metadata:
+  name: bot
+spec:
+  anything: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Validate(objs)
+	if err == nil {
+		t.Fatal("Expect to fail validation")
+	}
+	if !strings.Contains(err.Error(), "spec.template.spec.containers[0].imagee") {
+		t.Errorf("Expect the unknown field is reported: %v", err)
+	}
+	if !strings.Contains(err.Error(), "Service/bot") {
+		t.Errorf("Expect the type error is reported: %v", err)
+	}
+	if strings.Contains(err.Error(), "Unknown/bot") {
+		t.Errorf("Expect the custom resource is not validated: %v", err)
+	}
+}
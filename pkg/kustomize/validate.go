@@ -0,0 +1,125 @@
+package kustomize
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/xerrors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// Validate decodes the objects into the built-in types of Kubernetes.
+// Validate reports the fields which the type doesn't have and the values which have the wrong type.
+// The objects whose kind is not a built-in type (e.g. custom resources) are not validated.
+func Validate(objs []Object) error {
+	errs := make([]string, 0)
+	for _, o := range objs {
+		if err := validateObject(o); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", o, err))
+		}
+	}
+	if len(errs) > 0 {
+		return xerrors.Errorf("kustomize: invalid object(s):\n%s", strings.Join(errs, "\n"))
+	}
+
+	return nil
+}
+
+func validateObject(o Object) error {
+	gv, err := schema.ParseGroupVersion(o.APIVersion())
+	if err != nil {
+		return err
+	}
+	typed, err := scheme.Scheme.New(gv.WithKind(o.Kind()))
+	if err != nil {
+		return nil
+	}
+
+	b, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, typed); err != nil {
+		return err
+	}
+	b, err = json.Marshal(typed)
+	if err != nil {
+		return err
+	}
+	decoded := make(map[string]interface{})
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return err
+	}
+
+	unknown := unknownFields("", map[string]interface{}(o), decoded)
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return xerrors.Errorf("unknown field(s): %s", strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
+
+// unknownFields returns the paths of the fields which exist in the original but not in the decoded object.
+// The fields which have the zero value are ignored because they may be omitted by encoding.
+func unknownFields(path string, original, decoded interface{}) []string {
+	fields := make([]string, 0)
+	switch o := original.(type) {
+	case map[string]interface{}:
+		d, ok := decoded.(map[string]interface{})
+		if !ok {
+			return fields
+		}
+		for k, v := range o {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			dv, ok := d[k]
+			if !ok {
+				if !isZero(v) {
+					fields = append(fields, p)
+				}
+				continue
+			}
+			fields = append(fields, unknownFields(p, v, dv)...)
+		}
+	case []interface{}:
+		d, ok := decoded.([]interface{})
+		if !ok {
+			return fields
+		}
+		for i, v := range o {
+			if i >= len(d) {
+				break
+			}
+			fields = append(fields, unknownFields(fmt.Sprintf("%s[%d]", path, i), v, d[i])...)
+		}
+	}
+
+	return fields
+}
+
+func isZero(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !t
+	case string:
+		return t == ""
+	case float64:
+		return t == 0
+	case int64:
+		return t == 0
+	case map[string]interface{}:
+		return len(t) == 0
+	case []interface{}:
+		return len(t) == 0
+	}
+
+	return false
+}
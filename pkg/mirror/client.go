@@ -0,0 +1,36 @@
+package mirror
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+type Client struct {
+	URL string
+}
+
+func NewClient(u string) *Client {
+	return &Client{URL: strings.TrimSuffix(u, "/")}
+}
+
+func (c *Client) RepositoryURL(owner, repo string) string {
+	return fmt.Sprintf("%s/%s/%s.git", c.URL, owner, repo)
+}
+
+// Update makes the mirror fetch the repository from upstream.
+func (c *Client) Update(owner, repo string) error {
+	res, err := http.Post(c.RepositoryURL(owner, repo)+"/update", "", nil)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		return xerrors.Errorf("mirror returns unexpected status: %d", res.StatusCode)
+	}
+
+	return nil
+}
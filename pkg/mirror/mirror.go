@@ -0,0 +1,306 @@
+package mirror
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/xerrors"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	"gopkg.in/src-d/go-git.v4"
+	gitConfig "gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/pktline"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/server"
+)
+
+const (
+	upstreamRemoteName = "origin"
+	uploadPackService  = "git-upload-pack"
+)
+
+type AuthFunc func() (transport.AuthMethod, error)
+
+// Server keeps bare mirrors of the repositories and serves them with the smart HTTP protocol.
+// The request path is /<owner>/<repo>.git. Shallow clone is not supported.
+type Server struct {
+	*http.Server
+
+	dir               string
+	upstreamURLFormat string
+	auth              AuthFunc
+	allowRepositories map[string]struct{}
+	transport         transport.Transport
+
+	mu    sync.Mutex
+	locks map[string]*sync.RWMutex
+}
+
+// NewServer returns the mirror server.
+// upstreamURLFormat is the format of the url of upstream. (e.g. https://github.com/%s/%s.git)
+func NewServer(addr, dir, upstreamURLFormat string, allowRepositories []string, auth AuthFunc) *Server {
+	allow := make(map[string]struct{})
+	for _, v := range allowRepositories {
+		allow[v] = struct{}{}
+	}
+
+	s := &Server{
+		dir:               dir,
+		upstreamURLFormat: upstreamURLFormat,
+		auth:              auth,
+		allowRepositories: allow,
+		transport:         server.NewServer(server.NewFilesystemLoader(osfs.New(dir))),
+		locks:             make(map[string]*sync.RWMutex),
+	}
+	s.Server = &http.Server{
+		Addr:    addr,
+		Handler: s,
+	}
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	owner, repo, action, err := parsePath(req.URL.Path)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if _, ok := s.allowRepositories[fmt.Sprintf("%s/%s", owner, repo)]; !ok {
+		log.Printf("%s/%s is not allowed", owner, repo)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	switch action {
+	case "info/refs":
+		if req.URL.Query().Get("service") != uploadPackService {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err := s.advertisedReferences(w, owner, repo); err != nil {
+			log.Printf("%+v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	case uploadPackService:
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := s.uploadPack(w, req, owner, repo); err != nil {
+			log.Printf("%+v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	case "update":
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := s.Update(owner, repo); err != nil {
+			log.Printf("%+v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// Update fetches the repository from upstream. If the mirror does not exist yet, Update creates it.
+func (s *Server) Update(owner, repo string) error {
+	l := s.lock(owner, repo)
+	l.Lock()
+	defer l.Unlock()
+
+	return s.fetch(owner, repo)
+}
+
+func (s *Server) advertisedReferences(w http.ResponseWriter, owner, repo string) error {
+	if err := s.ensureMirror(owner, repo); err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	l := s.lock(owner, repo)
+	l.RLock()
+	defer l.RUnlock()
+
+	sess, err := s.transport.NewUploadPackSession(s.endpoint(owner, repo), nil)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	defer sess.Close()
+
+	ar, err := sess.AdvertisedReferences()
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	ar.Prefix = [][]byte{[]byte(fmt.Sprintf("# service=%s", uploadPackService)), pktline.Flush}
+
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-advertisement", uploadPackService))
+	w.Header().Set("Cache-Control", "no-cache")
+	return ar.Encode(w)
+}
+
+func (s *Server) uploadPack(w http.ResponseWriter, req *http.Request, owner, repo string) error {
+	l := s.lock(owner, repo)
+	l.RLock()
+	defer l.RUnlock()
+
+	upReq := packp.NewUploadPackRequest()
+	if err := upReq.Decode(req.Body); err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	sess, err := s.transport.NewUploadPackSession(s.endpoint(owner, repo), nil)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	defer sess.Close()
+
+	res, err := sess.UploadPack(req.Context(), upReq)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-result", uploadPackService))
+	w.Header().Set("Cache-Control", "no-cache")
+	return res.Encode(w)
+}
+
+func (s *Server) ensureMirror(owner, repo string) error {
+	if _, err := os.Stat(filepath.Join(s.repositoryDir(owner, repo), "config")); err == nil {
+		return nil
+	}
+
+	return s.Update(owner, repo)
+}
+
+func (s *Server) fetch(owner, repo string) error {
+	dir := s.repositoryDir(owner, repo)
+	r, err := git.PlainOpen(dir)
+	if err == git.ErrRepositoryNotExists {
+		log.Printf("Create mirror: %s/%s", owner, repo)
+		r, err = git.PlainInit(dir, true)
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		_, err = r.CreateRemote(&gitConfig.RemoteConfig{
+			Name: upstreamRemoteName,
+			URLs: []string{fmt.Sprintf(s.upstreamURLFormat, owner, repo)},
+			Fetch: []gitConfig.RefSpec{
+				"+refs/heads/*:refs/heads/*",
+				"+refs/tags/*:refs/tags/*",
+			},
+		})
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+	} else if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	var auth transport.AuthMethod
+	if s.auth != nil {
+		a, err := s.auth()
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		auth = a
+	}
+
+	remote, err := r.Remote(upstreamRemoteName)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	log.Printf("Fetch %s/%s", owner, repo)
+	err = remote.Fetch(&git.FetchOptions{Auth: auth, Force: true})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	refs, err := remote.List(&git.ListOptions{Auth: auth})
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	if head := defaultBranch(refs); head != "" {
+		if err := r.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, head)); err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) lock(owner, repo string) *sync.RWMutex {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := fmt.Sprintf("%s/%s", owner, repo)
+	if _, ok := s.locks[key]; !ok {
+		s.locks[key] = &sync.RWMutex{}
+	}
+
+	return s.locks[key]
+}
+
+func (s *Server) repositoryDir(owner, repo string) string {
+	return filepath.Join(s.dir, owner, repo+".git")
+}
+
+func (s *Server) endpoint(owner, repo string) *transport.Endpoint {
+	return &transport.Endpoint{Path: fmt.Sprintf("/%s/%s.git", owner, repo)}
+}
+
+// defaultBranch finds the branch which is pointed by HEAD of upstream.
+func defaultBranch(refs []*plumbing.Reference) plumbing.ReferenceName {
+	var head *plumbing.Reference
+	branches := make(map[plumbing.ReferenceName]plumbing.Hash)
+	for _, v := range refs {
+		if v.Name() == plumbing.HEAD {
+			head = v
+			continue
+		}
+		if v.Name().IsBranch() {
+			branches[v.Name()] = v.Hash()
+		}
+	}
+	if head == nil {
+		return ""
+	}
+	if head.Type() == plumbing.SymbolicReference {
+		return head.Target()
+	}
+
+	for _, v := range []plumbing.ReferenceName{"refs/heads/master", "refs/heads/main"} {
+		if h, ok := branches[v]; ok && h == head.Hash() {
+			return v
+		}
+	}
+	for name, h := range branches {
+		if h == head.Hash() {
+			return name
+		}
+	}
+
+	return ""
+}
+
+func parsePath(p string) (owner, repo, action string, err error) {
+	i := strings.Index(p, ".git/")
+	if i == -1 {
+		return "", "", "", xerrors.New("invalid path")
+	}
+	s := strings.Split(strings.TrimPrefix(p[:i], "/"), "/")
+	if len(s) != 2 || s[0] == "" || s[1] == "" {
+		return "", "", "", xerrors.New("invalid path")
+	}
+
+	return s[0], s[1], p[i+len(".git/"):], nil
+}
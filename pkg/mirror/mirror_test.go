@@ -0,0 +1,104 @@
+package mirror
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream", "octocat", "example")
+	r, err := git.PlainInit(upstream, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, r, upstream, "README.md", "first")
+
+	s := NewServer("", filepath.Join(dir, "mirror"), filepath.Join(dir, "upstream", "%s", "%s"), []string{"octocat/example"}, nil)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	c := NewClient(ts.URL)
+
+	cloned := filepath.Join(dir, "clone1")
+	_, err = git.PlainClone(cloned, false, &git.CloneOptions{URL: c.RepositoryURL("octocat", "example")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(cloned, "README.md")); err != nil || string(b) != "first" {
+		t.Fatalf("unexpected contents: %s %v", string(b), err)
+	}
+
+	head := commitFile(t, r, upstream, "README.md", "second")
+	if err := c.Update("octocat", "example"); err != nil {
+		t.Fatal(err)
+	}
+	cloned = filepath.Join(dir, "clone2")
+	cr, err := git.PlainClone(cloned, false, &git.CloneOptions{URL: c.RepositoryURL("octocat", "example")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := cr.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Hash().String() != head {
+		t.Errorf("Expect %s: %s", head, ref.Hash().String())
+	}
+
+	res, err := http.Get(ts.URL + "/octocat/not-allowed.git/info/refs?service=git-upload-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Expect forbidden: %d", res.StatusCode)
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	owner, repo, action, err := parsePath("/octocat/example.git/info/refs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner != "octocat" || repo != "example" || action != "info/refs" {
+		t.Errorf("unexpected result: %s %s %s", owner, repo, action)
+	}
+
+	if _, _, _, err := parsePath("/example.git/info/refs"); err == nil {
+		t.Error("Expect error")
+	}
+}
+
+func commitFile(t *testing.T, r *git.Repository, dir, name, contents string) string {
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tree, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.Add(name); err != nil {
+		t.Fatal(err)
+	}
+	h, err := tree.Commit(contents, &git.CommitOptions{
+		Author: &object.Signature{Name: "octocat", Email: "octocat@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return h.String()
+}
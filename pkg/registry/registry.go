@@ -0,0 +1,421 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+)
+
+const (
+	defaultRegistry = "registry-1.docker.io"
+)
+
+var linkNextRe = regexp.MustCompile(`<([^>]+)>;\s*rel="?next"?`)
+
+// manifestMediaTypes are the media types which the client accepts. The index and the list are preferred
+// because the digest of the multi-arch image is the digest of the index.
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// Credential is the credential of the registry.
+type Credential struct {
+	Username string
+	Password string
+}
+
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+}
+
+// ParseDockerConfig parses the content of .dockerconfigjson and returns the credentials for each registry.
+func ParseDockerConfig(b []byte) (map[string]Credential, error) {
+	conf := &dockerConfig{}
+	if err := json.Unmarshal(b, conf); err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	credentials := make(map[string]Credential)
+	for k, v := range conf.Auths {
+		cred := Credential{Username: v.Username, Password: v.Password}
+		if v.Auth != "" {
+			buf, err := base64.StdEncoding.DecodeString(v.Auth)
+			if err != nil {
+				return nil, xerrors.Errorf(": %v", err)
+			}
+			s := strings.SplitN(string(buf), ":", 2)
+			if len(s) != 2 {
+				return nil, xerrors.Errorf("registry: malformed auth of %s", k)
+			}
+			cred = Credential{Username: s[0], Password: s[1]}
+		}
+
+		host := strings.TrimPrefix(strings.TrimPrefix(k, "https://"), "http://")
+		host = strings.SplitN(host, "/", 2)[0]
+		if host == "index.docker.io" || host == "docker.io" {
+			host = defaultRegistry
+		}
+		credentials[host] = cred
+	}
+
+	return credentials, nil
+}
+
+// Reference is the parsed reference of the image. (e.g. registry.f110.dev/bot/bot:latest)
+type Reference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseReference parses the reference of the image. If the tag and the digest are omitted, the tag is latest.
+func ParseReference(s string) (*Reference, error) {
+	if s == "" {
+		return nil, xerrors.New("registry: reference is empty")
+	}
+
+	ref := &Reference{}
+	if i := strings.Index(s, "@"); i != -1 {
+		ref.Digest = s[i+1:]
+		s = s[:i]
+	}
+	if i := strings.LastIndex(s, ":"); i != -1 && !strings.Contains(s[i:], "/") {
+		ref.Tag = s[i+1:]
+		s = s[:i]
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+
+	p := strings.SplitN(s, "/", 2)
+	if len(p) == 2 && (strings.ContainsAny(p[0], ".:") || p[0] == "localhost") {
+		ref.Registry, ref.Repository = p[0], p[1]
+	} else {
+		ref.Registry, ref.Repository = defaultRegistry, s
+	}
+	if ref.Registry == "docker.io" || ref.Registry == "index.docker.io" {
+		ref.Registry = defaultRegistry
+	}
+	if ref.Registry == defaultRegistry && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = "library/" + ref.Repository
+	}
+
+	return ref, nil
+}
+
+// Client is the client of the OCI distribution API.
+type Client struct {
+	httpClient  *http.Client
+	credentials map[string]Credential
+	insecure    map[string]struct{}
+}
+
+// NewClient returns the client. The hostnames of hostAliases are resolved to the addresses without DNS.
+// insecure is the list of the registries which are accessed via plain HTTP.
+func NewClient(credentials map[string]Credential, hostAliases []config.HostAlias, insecure []string) *Client {
+	aliases := make(map[string]string)
+	for _, v := range hostAliases {
+		for _, h := range v.Hostnames {
+			aliases[h] = v.IP
+		}
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if ip, ok := aliases[host]; ok {
+			addr = net.JoinHostPort(ip, port)
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	if credentials == nil {
+		credentials = make(map[string]Credential)
+	}
+	insecureRegistries := make(map[string]struct{})
+	for _, v := range insecure {
+		insecureRegistries[v] = struct{}{}
+	}
+
+	return &Client{
+		httpClient:  &http.Client{Transport: transport, Timeout: time.Minute},
+		credentials: credentials,
+		insecure:    insecureRegistries,
+	}
+}
+
+// Digest resolves the reference to the digest of the manifest.
+// If the reference already has the digest, Digest returns it without accessing the registry.
+func (c *Client) Digest(image string) (string, error) {
+	ref, err := ParseReference(image)
+	if err != nil {
+		return "", err
+	}
+	if ref.Digest != "" {
+		return ref.Digest, nil
+	}
+
+	res, err := c.do(http.MethodHead, ref, c.url(ref, fmt.Sprintf("/v2/%s/manifests/%s", ref.Repository, ref.Tag)), map[string]string{
+		"Accept": strings.Join(manifestMediaTypes, ", "),
+	})
+	if err != nil {
+		return "", xerrors.Errorf(": %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", xerrors.Errorf("registry: %s returned %s", image, res.Status)
+	}
+	if d := res.Header.Get("Docker-Content-Digest"); d != "" {
+		return d, nil
+	}
+
+	// The registry is not required to return the digest. The digest is calculated from the manifest.
+	res, err = c.do(http.MethodGet, ref, c.url(ref, fmt.Sprintf("/v2/%s/manifests/%s", ref.Repository, ref.Tag)), map[string]string{
+		"Accept": strings.Join(manifestMediaTypes, ", "),
+	})
+	if err != nil {
+		return "", xerrors.Errorf(": %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", xerrors.Errorf("registry: %s returned %s", image, res.Status)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, res.Body); err != nil {
+		return "", xerrors.Errorf(": %v", err)
+	}
+
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
+
+// Tags returns all tags of the repository. (e.g. registry.f110.dev/bot/bot)
+func (c *Client) Tags(repository string) ([]string, error) {
+	ref, err := ParseReference(repository)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]string, 0)
+	u := c.url(ref, fmt.Sprintf("/v2/%s/tags/list?n=1000", ref.Repository))
+	for u != "" {
+		res, err := c.do(http.MethodGet, ref, u, nil)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		buf, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		if res.StatusCode != http.StatusOK {
+			return nil, xerrors.Errorf("registry: %s returned %s", repository, res.Status)
+		}
+		list := &struct {
+			Tags []string `json:"tags"`
+		}{}
+		if err := json.Unmarshal(buf, list); err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		tags = append(tags, list.Tags...)
+
+		u = ""
+		if m := linkNextRe.FindStringSubmatch(res.Header.Get("Link")); m != nil {
+			next, err := res.Request.URL.Parse(m[1])
+			if err != nil {
+				return nil, xerrors.Errorf(": %v", err)
+			}
+			u = next.String()
+		}
+	}
+
+	return tags, nil
+}
+
+func (c *Client) url(ref *Reference, path string) string {
+	scheme := "https"
+	if c.isInsecure(ref.Registry) {
+		scheme = "http"
+	}
+
+	return fmt.Sprintf("%s://%s%s", scheme, ref.Registry, path)
+}
+
+func (c *Client) isInsecure(registry string) bool {
+	if _, ok := c.insecure[registry]; ok {
+		return true
+	}
+	host := registry
+	if h, _, err := net.SplitHostPort(registry); err == nil {
+		host = h
+	}
+
+	return host == "localhost" || host == "127.0.0.1"
+}
+
+// do sends the request. If the registry requires the authentication, do retries the request with the credential.
+func (c *Client) do(method string, ref *Reference, u string, header map[string]string) (*http.Response, error) {
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequest(method, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		return req, nil
+	}
+
+	req, err := newRequest()
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	if res.StatusCode != http.StatusUnauthorized {
+		return res, nil
+	}
+	res.Body.Close()
+
+	scheme, params := parseChallenge(res.Header.Get("WWW-Authenticate"))
+	cred, hasCred := c.credentials[ref.Registry]
+	req, err = newRequest()
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if !hasCred {
+			return nil, xerrors.Errorf("registry: %s requires the credential", ref.Registry)
+		}
+		req.SetBasicAuth(cred.Username, cred.Password)
+	case "bearer":
+		scope := params["scope"]
+		if scope == "" {
+			scope = fmt.Sprintf("repository:%s:pull", ref.Repository)
+		}
+		token, err := c.token(params["realm"], params["service"], scope, cred, hasCred)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	default:
+		return nil, xerrors.Errorf("registry: unsupported authentication scheme: %s", scheme)
+	}
+
+	res, err = c.httpClient.Do(req)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	return res, nil
+}
+
+// token fetches the bearer token from the authorization server.
+func (c *Client) token(realm, service, scope string, cred Credential, hasCred bool) (string, error) {
+	if realm == "" {
+		return "", xerrors.New("registry: realm is not found in the challenge")
+	}
+	req, err := http.NewRequest(http.MethodGet, realm, nil)
+	if err != nil {
+		return "", xerrors.Errorf(": %v", err)
+	}
+	q := req.URL.Query()
+	if service != "" {
+		q.Set("service", service)
+	}
+	q.Set("scope", scope)
+	req.URL.RawQuery = q.Encode()
+	if hasCred {
+		req.SetBasicAuth(cred.Username, cred.Password)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", xerrors.Errorf(": %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", xerrors.Errorf("registry: authorization server returned %s", res.Status)
+	}
+	buf, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", xerrors.Errorf(": %v", err)
+	}
+	t := &struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.Unmarshal(buf, t); err != nil {
+		return "", xerrors.Errorf(": %v", err)
+	}
+	if t.Token != "" {
+		return t.Token, nil
+	}
+
+	return t.AccessToken, nil
+}
+
+// parseChallenge parses WWW-Authenticate header. (e.g. Bearer realm="https://auth.docker.io/token",service="registry.docker.io")
+func parseChallenge(v string) (string, map[string]string) {
+	params := make(map[string]string)
+	s := strings.SplitN(strings.TrimSpace(v), " ", 2)
+	if len(s) != 2 {
+		return s[0], params
+	}
+
+	for _, p := range splitParams(s[1]) {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+	}
+
+	return s[0], params
+}
+
+// splitParams splits the parameters by comma. The comma in the quoted string is not a separator.
+func splitParams(v string) []string {
+	params := make([]string, 0)
+	quoted := false
+	start := 0
+	for i, c := range v {
+		switch c {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				params = append(params, v[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(params, v[start:])
+}
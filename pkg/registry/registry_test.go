@@ -0,0 +1,140 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+)
+
+func TestParseReference(t *testing.T) {
+	cases := []struct {
+		Image string
+		Ref   Reference
+	}{
+		{Image: "registry.f110.dev/bot/bot:v1", Ref: Reference{Registry: "registry.f110.dev", Repository: "bot/bot", Tag: "v1"}},
+		{Image: "localhost:5000/bot", Ref: Reference{Registry: "localhost:5000", Repository: "bot", Tag: "latest"}},
+		{Image: "nginx", Ref: Reference{Registry: defaultRegistry, Repository: "library/nginx", Tag: "latest"}},
+		{Image: "f110/bot@sha256:abcd", Ref: Reference{Registry: defaultRegistry, Repository: "f110/bot", Digest: "sha256:abcd"}},
+	}
+
+	for _, c := range cases {
+		ref, err := ParseReference(c.Image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *ref != c.Ref {
+			t.Errorf("%s: unexpected reference: %+v", c.Image, ref)
+		}
+	}
+}
+
+func TestParseDockerConfig(t *testing.T) {
+	auth := base64.StdEncoding.EncodeToString([]byte("octocat:password"))
+	credentials, err := ParseDockerConfig([]byte(fmt.Sprintf(`{"auths":{"https://registry.f110.dev":{"auth":"%s"},"https://index.docker.io/v1/":{"username":"f110","password":"secret"}}}`, auth)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if credentials["registry.f110.dev"] != (Credential{Username: "octocat", Password: "password"}) {
+		t.Errorf("unexpected credential: %+v", credentials["registry.f110.dev"])
+	}
+	if credentials[defaultRegistry] != (Credential{Username: "f110", Password: "secret"}) {
+		t.Errorf("unexpected credential: %+v", credentials[defaultRegistry])
+	}
+}
+
+func TestClient_Digest(t *testing.T) {
+	manifest := `{"schemaVersion":2}`
+	mux := http.NewServeMux()
+	var s *httptest.Server
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		if u, p, ok := req.BasicAuth(); !ok || u != "octocat" || p != "password" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.URL.Query().Get("scope") != "repository:bot/bot:pull" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"token":"token"}`)
+	})
+	mux.HandleFunc("/v2/bot/bot/manifests/v1", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry",scope="repository:bot/bot:pull"`, s.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !strings.Contains(req.Header.Get("Accept"), "application/vnd.oci.image.index.v1+json") {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", "sha256:abcd")
+	})
+	mux.HandleFunc("/v2/bot/basic/manifests/v1", func(w http.ResponseWriter, req *http.Request) {
+		if _, _, ok := req.BasicAuth(); !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, manifest)
+	})
+	s = httptest.NewServer(mux)
+	defer s.Close()
+
+	port := s.URL[strings.LastIndex(s.URL, ":")+1:]
+	host := "registry.test:" + port
+	c := NewClient(
+		map[string]Credential{host: {Username: "octocat", Password: "password"}},
+		[]config.HostAlias{{Hostnames: []string{"registry.test"}, IP: "127.0.0.1"}},
+		[]string{host},
+	)
+
+	d, err := c.Digest(host + "/bot/bot:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != "sha256:abcd" {
+		t.Errorf("unexpected digest: %s", d)
+	}
+
+	d, err = c.Digest(host + "/bot/basic:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(manifest))) {
+		t.Errorf("unexpected digest: %s", d)
+	}
+
+	if _, err := c.Digest(host + "/bot/unknown:v1"); err == nil {
+		t.Error("Expect to fail resolving the unknown image")
+	}
+}
+
+func TestClient_Tags(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/bot/bot/tags/list", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("last") == "" {
+			w.Header().Set("Link", `</v2/bot/bot/tags/list?last=v2&n=2>; rel="next"`)
+			fmt.Fprint(w, `{"name":"bot/bot","tags":["v1","v2"]}`)
+			return
+		}
+		fmt.Fprint(w, `{"name":"bot/bot","tags":["v3"]}`)
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	c := NewClient(nil, nil, nil)
+	tags, err := c.Tags(strings.TrimPrefix(s.URL, "http://") + "/bot/bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(tags, ",") != "v1,v2,v3" {
+		t.Errorf("unexpected tags: %v", tags)
+	}
+}
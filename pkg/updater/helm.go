@@ -0,0 +1,167 @@
+package updater
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultHelmLocator = "image"
+)
+
+var yamlKeyValueRe = regexp.MustCompile(`^(\s*)([A-Za-z0-9_.-]+|"[^"]*"|'[^']*'):(\s*)([^#]*?)(\s*#.*)?$`)
+
+// Helm updates the image in values.yaml of the chart.
+// The locator is the dotted path to the map of the image. (e.g. server.image) The default is "image".
+// repository, tag and digest of the map are updated. The key which doesn't exist is added.
+type Helm struct{}
+
+func (*Helm) Current(b []byte, locator string, image Image) (*Image, error) {
+	if locator == "" {
+		locator = defaultHelmLocator
+	}
+	path := strings.Split(locator, ".")
+
+	lines := strings.Split(string(b), "\n")
+	if locateYAMLKey(lines, path) == -1 {
+		return nil, ErrNotFound
+	}
+	value := func(key string) string {
+		i := locateYAMLKey(lines, append(path, key))
+		if i == -1 {
+			return ""
+		}
+		return unquote(yamlKeyValueRe.FindStringSubmatch(lines[i])[4])
+	}
+
+	name := value("repository")
+	if name == "" {
+		name = image.Name
+	}
+	return &Image{Name: name, Tag: value("tag"), Digest: value("digest")}, nil
+}
+
+func (*Helm) Update(b []byte, locator string, image Image) ([]byte, error) {
+	if locator == "" {
+		locator = defaultHelmLocator
+	}
+	path := strings.Split(locator, ".")
+
+	lines := strings.Split(string(b), "\n")
+	i := locateYAMLKey(lines, path)
+	if i == -1 {
+		return nil, ErrNotFound
+	}
+
+	fields := []struct {
+		Key   string
+		Value string
+	}{
+		{Key: "repository", Value: image.NewName},
+		{Key: "tag", Value: image.Tag},
+		{Key: "digest", Value: image.Digest},
+	}
+	for _, f := range fields {
+		if f.Value == "" {
+			continue
+		}
+
+		if j := locateYAMLKey(lines, append(path, f.Key)); j != -1 {
+			m := yamlKeyValueRe.FindStringSubmatch(lines[j])
+			sep := m[3]
+			if sep == "" {
+				sep = " "
+			}
+			lines[j] = m[1] + m[2] + ":" + sep + quoteAs(m[4], f.Value) + m[5]
+			continue
+		}
+
+		end, indent := yamlChildren(lines, i)
+		line := strings.Repeat(" ", indent) + f.Key + ": " + f.Value
+		lines = append(lines[:end], append([]string{line}, lines[end:]...)...)
+	}
+
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// locateYAMLKey returns the index of the line which has the key of path.
+// If the key is not found, locateYAMLKey returns -1.
+func locateYAMLKey(lines []string, path []string) int {
+	type key struct {
+		Indent int
+		Name   string
+	}
+	stack := make([]key, 0)
+	for i, v := range lines {
+		trimmed := strings.TrimSpace(v)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		indent := len(v) - len(strings.TrimLeft(v, " "))
+		for len(stack) > 0 && stack[len(stack)-1].Indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+
+		m := yamlKeyValueRe.FindStringSubmatch(v)
+		if m == nil {
+			continue
+		}
+		stack = append(stack, key{Indent: indent, Name: unquote(m[2])})
+		if len(stack) != len(path) {
+			continue
+		}
+		matched := true
+		for j := range path {
+			if stack[j].Name != path[j] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// yamlChildren returns the index of the next line of the last child and the indent of children.
+func yamlChildren(lines []string, i int) (int, int) {
+	parentIndent := len(lines[i]) - len(strings.TrimLeft(lines[i], " "))
+	end, indent := i+1, parentIndent+2
+	first := true
+	for j := i + 1; j < len(lines); j++ {
+		trimmed := strings.TrimSpace(lines[j])
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		ind := len(lines[j]) - len(strings.TrimLeft(lines[j], " "))
+		if ind <= parentIndent {
+			break
+		}
+		if first {
+			indent = ind
+			first = false
+		}
+		end = j + 1
+	}
+
+	return end, indent
+}
+
+func unquote(v string) string {
+	if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+		return v[1 : len(v)-1]
+	}
+
+	return v
+}
+
+// quoteAs quotes the value with the same quote character as the original value.
+func quoteAs(original, v string) string {
+	if len(original) >= 2 && (original[0] == '"' || original[0] == '\'') {
+		return string(original[0]) + v + string(original[0])
+	}
+
+	return v
+}
@@ -0,0 +1,54 @@
+package updater
+
+import (
+	"fmt"
+	"regexp"
+
+	"golang.org/x/xerrors"
+)
+
+// Jsonnet updates the string constant in jsonnet or libsonnet.
+// The locator is the name of the local variable or the field. (e.g. "botImage" matches `local botImage = '...';` and `botImage: '...'`)
+// The constant is replaced with the reference of the image.
+type Jsonnet struct{}
+
+func (*Jsonnet) Current(b []byte, locator string, _ Image) (*Image, error) {
+	re, err := jsonnetConstantRe(locator)
+	if err != nil {
+		return nil, err
+	}
+	m := re.FindSubmatch(b)
+	if m == nil {
+		return nil, ErrNotFound
+	}
+
+	return parseImage(string(m[3])), nil
+}
+
+func (*Jsonnet) Update(b []byte, locator string, image Image) ([]byte, error) {
+	re, err := jsonnetConstantRe(locator)
+	if err != nil {
+		return nil, err
+	}
+	if !re.Match(b) {
+		return nil, ErrNotFound
+	}
+
+	return re.ReplaceAllFunc(b, func(v []byte) []byte {
+		m := re.FindSubmatch(v)
+		return []byte(string(m[1]) + string(m[2]) + image.Ref() + string(m[4]))
+	}), nil
+}
+
+func jsonnetConstantRe(locator string) (*regexp.Regexp, error) {
+	if locator == "" {
+		return nil, xerrors.New("updater: jsonnet needs the locator")
+	}
+
+	re, err := regexp.Compile(fmt.Sprintf(`(?m)^(\s*(?:local\s+)?%s\s*(?:=|:{1,3})\s*)(['"])([^'"\n]*)(['"])`, regexp.QuoteMeta(locator)))
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	return re, nil
+}
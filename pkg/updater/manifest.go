@@ -0,0 +1,57 @@
+package updater
+
+import (
+	"regexp"
+	"strings"
+)
+
+var manifestImageRe = regexp.MustCompile(`^(\s*(?:-\s+)?image:\s*)(["']?)([^"'\s#]+)(["']?)(.*)$`)
+
+// Manifest updates the image field of the containers in the raw manifests. (e.g. Deployment, StatefulSet and CronJob)
+// The locator is the repository of the image which is replaced. The default is the name of the image which is built.
+// All containers which use the repository are updated.
+type Manifest struct{}
+
+func (*Manifest) Current(b []byte, locator string, image Image) (*Image, error) {
+	if locator == "" {
+		locator = image.Name
+	}
+
+	for _, v := range strings.Split(string(b), "\n") {
+		m := manifestImageRe.FindStringSubmatch(v)
+		if m == nil {
+			continue
+		}
+		if repo, _ := splitImage(m[3]); repo == locator {
+			return parseImage(m[3]), nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (*Manifest) Update(b []byte, locator string, image Image) ([]byte, error) {
+	if locator == "" {
+		locator = image.Name
+	}
+
+	found := false
+	lines := strings.Split(string(b), "\n")
+	for i, v := range lines {
+		m := manifestImageRe.FindStringSubmatch(v)
+		if m == nil {
+			continue
+		}
+		if repo, _ := splitImage(m[3]); repo != locator {
+			continue
+		}
+
+		found = true
+		lines[i] = m[1] + m[2] + image.Ref() + m[4] + m[5]
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+
+	return []byte(strings.Join(lines, "\n")), nil
+}
@@ -0,0 +1,136 @@
+package updater
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/xerrors"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/kustomize"
+)
+
+const (
+	TypeKustomize = "kustomize"
+	TypeHelm      = "helm"
+	TypeManifest  = "manifest"
+	TypeJsonnet   = "jsonnet"
+)
+
+var (
+	ErrNotFound = xerrors.New("updater: the locator is not found")
+)
+
+// Image is the new image which is written to the file.
+// Either Digest or Tag is set.
+type Image struct {
+	// Name is the name of the image which is built. (e.g. registry.f110.dev/bot/bot)
+	Name string
+	// NewName replaces Name if not empty
+	NewName string
+	Tag     string
+	Digest  string
+}
+
+// Repository returns the repository of the image which is written to the file.
+func (i Image) Repository() string {
+	if i.NewName != "" {
+		return i.NewName
+	}
+
+	return i.Name
+}
+
+// Ref returns the reference of the image. (e.g. registry.f110.dev/bot/bot@sha256:xxx)
+func (i Image) Ref() string {
+	if i.Digest != "" {
+		return fmt.Sprintf("%s@%s", i.Repository(), i.Digest)
+	}
+
+	return fmt.Sprintf("%s:%s", i.Repository(), i.Tag)
+}
+
+// Updater rewrites the image in the file.
+// The syntax of locator is different for each updater. If locator is empty, the updater uses the default.
+type Updater interface {
+	// Current returns the image which is written in the file. Either Tag or Digest of the image is set.
+	Current(b []byte, locator string, image Image) (*Image, error)
+	Update(b []byte, locator string, image Image) ([]byte, error)
+}
+
+var updaters = map[string]Updater{
+	TypeKustomize: &Kustomize{},
+	TypeHelm:      &Helm{},
+	TypeManifest:  &Manifest{},
+	TypeJsonnet:   &Jsonnet{},
+}
+
+func Get(typ string) (Updater, error) {
+	if typ == "" {
+		typ = TypeKustomize
+	}
+	u, ok := updaters[typ]
+	if !ok {
+		return nil, xerrors.Errorf("updater: unknown type: %s", typ)
+	}
+
+	return u, nil
+}
+
+// Kustomize updates the entry of images in kustomization.yaml.
+// The locator is the name of the image. The default is the name of the image which is built.
+type Kustomize struct{}
+
+func (*Kustomize) Current(b []byte, locator string, image Image) (*Image, error) {
+	if locator == "" {
+		locator = image.Name
+	}
+
+	i, err := kustomize.GetImage(b, locator)
+	if err != nil {
+		return nil, err
+	}
+	name := i.Name
+	if i.NewName != "" {
+		name = i.NewName
+	}
+
+	return &Image{Name: name, Tag: i.NewTag, Digest: i.Digest}, nil
+}
+
+func (*Kustomize) Update(b []byte, locator string, image Image) ([]byte, error) {
+	if locator == "" {
+		locator = image.Name
+	}
+
+	return kustomize.SetImage(b, kustomize.Image{
+		Name:    locator,
+		NewName: image.NewName,
+		NewTag:  image.Tag,
+		Digest:  image.Digest,
+	})
+}
+
+// parseImage parses the reference of the image.
+func parseImage(v string) *Image {
+	repo, rest := splitImage(v)
+	switch {
+	case strings.HasPrefix(rest, "@"):
+		return &Image{Name: repo, Digest: rest[1:]}
+	case strings.HasPrefix(rest, ":"):
+		return &Image{Name: repo, Tag: rest[1:]}
+	}
+
+	return &Image{Name: repo}
+}
+
+// splitImage splits the reference of the image into the repository and the rest. (e.g. ":tag" or "@sha256:xxx")
+func splitImage(v string) (string, string) {
+	if i := strings.Index(v, "@"); i != -1 {
+		return v[:i], v[i:]
+	}
+	if i := strings.LastIndex(v, ":"); i != -1 && !strings.Contains(v[i:], "/") {
+		return v[:i], v[i:]
+	}
+
+	return v, ""
+}
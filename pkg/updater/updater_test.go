@@ -0,0 +1,148 @@
+package updater
+
+import (
+	"testing"
+)
+
+func TestHelm_Update(t *testing.T) {
+	in := `replicaCount: 1
+server:
+  image:
+    repository: registry.f110.dev/bot/bot # the image
+    tag: "v1.0.0"
+  service:
+    port: 80
+`
+
+	h := &Helm{}
+	b, err := h.Update([]byte(in), "server.image", Image{Name: "registry.f110.dev/bot/bot", Tag: "v1.1.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `replicaCount: 1
+server:
+  image:
+    repository: registry.f110.dev/bot/bot # the image
+    tag: "v1.1.0"
+  service:
+    port: 80
+`
+	if string(b) != expect {
+		t.Log(string(b))
+		t.Error("unexpected file modification")
+	}
+
+	b, err = h.Update([]byte(in), "server.image", Image{Name: "registry.f110.dev/bot/bot", Digest: "sha256:newhash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = `replicaCount: 1
+server:
+  image:
+    repository: registry.f110.dev/bot/bot # the image
+    tag: "v1.0.0"
+    digest: sha256:newhash
+  service:
+    port: 80
+`
+	if string(b) != expect {
+		t.Log(string(b))
+		t.Error("unexpected file modification")
+	}
+
+	if _, err := h.Update([]byte(in), "", Image{Name: "registry.f110.dev/bot/bot", Tag: "v1.1.0"}); err != ErrNotFound {
+		t.Errorf("Expect ErrNotFound: %v", err)
+	}
+}
+
+func TestManifest_Update(t *testing.T) {
+	in := `apiVersion: apps/v1
+kind: Deployment
+spec:
+  template:
+    spec:
+      containers:
+        - name: bot
+          image: registry.f110.dev/bot/bot:v1.0.0
+        - name: sidecar
+          image: "registry.f110.dev/bot/sidecar@sha256:oldhash"
+---
+apiVersion: batch/v1beta1
+kind: CronJob
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+            - image: registry.f110.dev/bot/bot@sha256:oldhash
+              name: cron
+`
+
+	m := &Manifest{}
+	b, err := m.Update([]byte(in), "", Image{Name: "registry.f110.dev/bot/bot", Digest: "sha256:newhash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `apiVersion: apps/v1
+kind: Deployment
+spec:
+  template:
+    spec:
+      containers:
+        - name: bot
+          image: registry.f110.dev/bot/bot@sha256:newhash
+        - name: sidecar
+          image: "registry.f110.dev/bot/sidecar@sha256:oldhash"
+---
+apiVersion: batch/v1beta1
+kind: CronJob
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+            - image: registry.f110.dev/bot/bot@sha256:newhash
+              name: cron
+`
+	if string(b) != expect {
+		t.Log(string(b))
+		t.Error("unexpected file modification")
+	}
+
+	if _, err := m.Update([]byte(in), "registry.f110.dev/unknown", Image{Name: "registry.f110.dev/bot/bot", Tag: "v1.1.0"}); err != ErrNotFound {
+		t.Errorf("Expect ErrNotFound: %v", err)
+	}
+}
+
+func TestJsonnet_Update(t *testing.T) {
+	in := `local botImage = 'registry.f110.dev/bot/bot:v1.0.0';
+{
+  images:: {
+    sidecar: "registry.f110.dev/bot/sidecar:v1.0.0",
+  },
+}
+`
+
+	j := &Jsonnet{}
+	b, err := j.Update([]byte(in), "botImage", Image{Name: "registry.f110.dev/bot/bot", Digest: "sha256:newhash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = j.Update(b, "sidecar", Image{Name: "registry.f110.dev/bot/sidecar", Tag: "v1.1.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `local botImage = 'registry.f110.dev/bot/bot@sha256:newhash';
+{
+  images:: {
+    sidecar: "registry.f110.dev/bot/sidecar:v1.1.0",
+  },
+}
+`
+	if string(b) != expect {
+		t.Log(string(b))
+		t.Error("unexpected file modification")
+	}
+}
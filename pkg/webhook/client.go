@@ -0,0 +1,235 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-github/v29/github"
+	"github.com/sourcegraph/go-diff/diff"
+	"golang.org/x/xerrors"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+)
+
+// The states of the commit status. The states are converted to the states of each provider.
+const (
+	StatePending = "pending"
+	StateSuccess = "success"
+	StateFailure = "failure"
+	StateError   = "error"
+)
+
+// maxCompareFiles is the maximum number of the files which the compare API of GitHub returns.
+const maxCompareFiles = 300
+
+// Client is the API of the provider which the consumers use for any provider.
+type Client interface {
+	// SetStatus reports the commit status.
+	SetStatus(repo *Repository, commit, context, state, description string) error
+	// CreateComment comments on the pull request.
+	CreateComment(repo *Repository, number int, body string) error
+	// FetchFile returns the contents of the file at ref.
+	FetchFile(repo *Repository, ref, path string) ([]byte, error)
+	// PullRequestFiles returns the files which are changed by the pull request.
+	PullRequestFiles(repo *Repository, number int) ([]string, error)
+	// CompareFiles returns the files which are changed between base and head.
+	// CompareFiles returns nil if the provider can't return all files.
+	CompareFiles(repo *Repository, base, head string) ([]string, error)
+}
+
+// Clients are the clients of the providers. The key is the provider.
+type Clients map[string]Client
+
+// NewClients returns the clients of GitHub and the providers which are configured.
+func NewClients(conf *config.Config, ghClient *github.Client) Clients {
+	clients := Clients{ProviderGitHub: NewGitHubClient(ghClient)}
+	if conf.Gitea != nil {
+		clients[ProviderGitea] = NewGiteaClient(conf.Gitea.URL, conf.Gitea.Token)
+	}
+	if conf.GitLab != nil {
+		clients[ProviderGitLab] = NewGitLabClient(conf.GitLab.URL, conf.GitLab.Token)
+	}
+
+	return clients
+}
+
+// Get returns the client of the provider. The empty provider is GitHub.
+func (c Clients) Get(provider string) (Client, error) {
+	if provider == "" {
+		provider = ProviderGitHub
+	}
+	client, ok := c[provider]
+	if !ok {
+		return nil, xerrors.Errorf("%s is not configured", provider)
+	}
+
+	return client, nil
+}
+
+type gitHubClient struct {
+	client *github.Client
+}
+
+var _ Client = &gitHubClient{}
+
+func NewGitHubClient(client *github.Client) Client {
+	return &gitHubClient{client: client}
+}
+
+func (c *gitHubClient) SetStatus(repo *Repository, commit, statusContext, state, description string) error {
+	_, _, err := c.client.Repositories.CreateStatus(context.Background(), repo.Owner, repo.Name, commit, &github.RepoStatus{
+		Context:     github.String(statusContext),
+		State:       github.String(state),
+		Description: github.String(description),
+	})
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	return nil
+}
+
+func (c *gitHubClient) CreateComment(repo *Repository, number int, body string) error {
+	_, _, err := c.client.Issues.CreateComment(context.Background(), repo.Owner, repo.Name, number, &github.IssueComment{Body: github.String(body)})
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	return nil
+}
+
+// FetchFile finds the file from the tree because the contents API can't return the large file.
+func (c *gitHubClient) FetchFile(repo *Repository, ref, path string) ([]byte, error) {
+	t, _, err := c.client.Git.GetTree(context.Background(), repo.Owner, repo.Name, ref, true)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	fileSHA := ""
+	for _, v := range t.Entries {
+		if v.GetPath() != path {
+			continue
+		}
+		fileSHA = v.GetSHA()
+		break
+	}
+	if fileSHA == "" {
+		return nil, xerrors.Errorf("%s is not found", path)
+	}
+
+	b, _, err := c.client.Git.GetBlob(context.Background(), repo.Owner, repo.Name, fileSHA)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	buf, err := base64.StdEncoding.DecodeString(b.GetContent())
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	return buf, nil
+}
+
+func (c *gitHubClient) PullRequestFiles(repo *Repository, number int) ([]string, error) {
+	d, _, err := c.client.PullRequests.GetRaw(context.Background(), repo.Owner, repo.Name, number, github.RawOptions{Type: github.Diff})
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	return filesFromDiff(d)
+}
+
+func (c *gitHubClient) CompareFiles(repo *Repository, base, head string) ([]string, error) {
+	compare, _, err := c.client.Repositories.CompareCommits(context.Background(), repo.Owner, repo.Name, base, head)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	if len(compare.Files) >= maxCompareFiles {
+		return nil, nil
+	}
+	files := make([]string, 0, len(compare.Files))
+	for _, v := range compare.Files {
+		files = append(files, v.GetFilename())
+		if v.GetPreviousFilename() != "" {
+			files = append(files, v.GetPreviousFilename())
+		}
+	}
+
+	return changedFiles(files), nil
+}
+
+// filesFromDiff returns the files in the unified diff.
+func filesFromDiff(v string) ([]string, error) {
+	diffs, err := diff.ParseMultiFileDiff([]byte(v))
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	names := make([]string, 0, len(diffs))
+	for _, v := range diffs {
+		name := v.NewName
+		if name == "/dev/null" {
+			name = v.OrigName
+		}
+		s := strings.SplitN(name, "/", 2)
+		if len(s) == 2 {
+			name = s[1]
+		}
+		names = append(names, name)
+	}
+
+	return changedFiles(names), nil
+}
+
+// apiClient is the client of the REST API which is authenticated by the header.
+type apiClient struct {
+	baseURL    string
+	authHeader string
+	authValue  string
+	client     *http.Client
+}
+
+func (c *apiClient) do(method, path string, body interface{}) ([]byte, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, r)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.authValue != "" {
+		req.Header.Set(c.authHeader, c.authValue)
+	}
+
+	client := c.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	defer res.Body.Close()
+	buf, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, xerrors.Errorf("%s %s: %d %s", method, path, res.StatusCode, strings.TrimSpace(string(buf)))
+	}
+
+	return buf, nil
+}
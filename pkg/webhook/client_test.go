@@ -0,0 +1,48 @@
+package webhook
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFilesFromDiff(t *testing.T) {
+	d := `diff --git a/README.md b/README.md
+index 8b30266..c7dd277 100644
+--- a/README.md
++++ b/README.md
+@@ -1 +1,5 @@
+-# bot-staging
+\ No newline at end of file
++# bot-staging
++
++# Author
++
++Fumihiro Ito
+diff --git a/zones/example.com.js b/zones/example.com.js
+deleted file mode 100644
+index 8b30266..0000000
+--- a/zones/example.com.js
++++ /dev/null
+@@ -1 +0,0 @@
+-D("example.com", REG_NONE)
+`
+
+	files, err := filesFromDiff(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(files, []string{"README.md", "zones/example.com.js"}) {
+		t.Errorf("Unexpected files: %v", files)
+	}
+}
+
+func TestClients_Get(t *testing.T) {
+	clients := Clients{ProviderGitHub: NewGitHubClient(nil)}
+
+	if _, err := clients.Get(""); err != nil {
+		t.Errorf("Expect GitHub: %v", err)
+	}
+	if _, err := clients.Get(ProviderGitea); err == nil {
+		t.Error("Expect an error because Gitea is not configured")
+	}
+}
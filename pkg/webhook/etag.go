@@ -0,0 +1,78 @@
+package webhook
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+type cachedResponse struct {
+	ETag   string
+	Header http.Header
+	Body   []byte
+}
+
+// etagTransport sends the conditional request with the ETag of the previous response.
+// The conditional request which returns 304 Not Modified doesn't count against the rate limit of GitHub.
+// The cached response is returned as 200 OK so that the client doesn't have to care about 304.
+type etagTransport struct {
+	base http.RoundTripper
+
+	mu    sync.Mutex
+	cache map[string]*cachedResponse
+}
+
+func newETagTransport(base http.RoundTripper) *etagTransport {
+	return &etagTransport{base: base, cache: make(map[string]*cachedResponse)}
+}
+
+func (t *etagTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return t.base.RoundTrip(req)
+	}
+
+	key := req.URL.String()
+	t.mu.Lock()
+	cached := t.cache[key]
+	t.mu.Unlock()
+	if cached != nil {
+		req = req.Clone(req.Context())
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case res.StatusCode == http.StatusNotModified && cached != nil:
+		res.Body.Close()
+		// The headers of the rate limit are taken from the new response
+		header := res.Header.Clone()
+		for _, k := range []string{"Content-Type", "Link"} {
+			if v := cached.Header.Get(k); v != "" {
+				header.Set(k, v)
+			}
+		}
+		res.StatusCode = http.StatusOK
+		res.Status = "200 OK"
+		res.Header = header
+		res.Body = ioutil.NopCloser(bytes.NewReader(cached.Body))
+		res.ContentLength = int64(len(cached.Body))
+	case res.StatusCode == http.StatusOK && res.Header.Get("ETag") != "":
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		t.mu.Lock()
+		t.cache[key] = &cachedResponse{ETag: res.Header.Get("ETag"), Header: res.Header.Clone(), Body: body}
+		t.mu.Unlock()
+	}
+
+	return res, nil
+}
@@ -0,0 +1,51 @@
+package webhook
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestETagTransport(t *testing.T) {
+	requests := 0
+	notModified := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Link", `<https://api.github.com/next?page=2>; rel="next"`)
+		w.Write([]byte("body"))
+	}))
+	defer s.Close()
+
+	client := &http.Client{Transport: newETagTransport(http.DefaultTransport)}
+	for i := 0; i < 2; i++ {
+		res, err := client.Get(s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("Expect 200: %d", res.StatusCode)
+		}
+		if string(b) != "body" {
+			t.Errorf("Unexpected body: %s", string(b))
+		}
+		if res.Header.Get("Link") == "" {
+			t.Error("Expect Link header")
+		}
+	}
+
+	if requests != 2 || notModified != 1 {
+		t.Errorf("Expect the second request is conditional: requests=%d not modified=%d", requests, notModified)
+	}
+}
@@ -0,0 +1,166 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v29/github"
+)
+
+const (
+	ProviderGitHub = "github"
+	ProviderGitea  = "gitea"
+	ProviderGitLab = "gitlab"
+)
+
+// The actions of PullRequestEvent. The actions of all providers are normalized to them.
+const (
+	ActionOpened      = "opened"
+	ActionSynchronize = "synchronize"
+	ActionClosed      = "closed"
+	ActionReopened    = "reopened"
+)
+
+// Repository is the repository of the event which doesn't depend on the provider.
+type Repository struct {
+	Provider string
+	// Owner is the owner of the repository. It is the namespace of the project for GitLab (e.g. group/subgroup).
+	Owner string
+	Name  string
+	// CloneURL is the URL of git over HTTPS.
+	CloneURL string
+	// DefaultBranch may be empty if the payload doesn't have it.
+	DefaultBranch string
+}
+
+func (r *Repository) FullName() string {
+	return r.Owner + "/" + r.Name
+}
+
+// QualifiedName returns the name which is used in AllowRepositories.
+// The name of the repository of the provider other than GitHub has the prefix of the provider. (e.g. gitea:infra/dns)
+func (r *Repository) QualifiedName() string {
+	if r.Provider == "" || r.Provider == ProviderGitHub {
+		return r.FullName()
+	}
+
+	return r.Provider + ":" + r.FullName()
+}
+
+// PushEvent is the push of a branch or a tag.
+type PushEvent struct {
+	Repo   *Repository
+	Ref    string
+	Before string
+	After  string
+	// HeadCommit is the commit of After. It is the commit which the tag refers if the annotated tag is pushed.
+	HeadCommit        string
+	HeadCommitMessage string
+	Deleted           bool
+	// Changed are the files which are changed by the push.
+	// If the payload doesn't have all files (e.g. GitHub, the force push or the truncated commits), Changed is nil.
+	Changed []string
+}
+
+// PullRequestEvent is the change of a pull request (a merge request of GitLab).
+type PullRequestEvent struct {
+	Repo   *Repository
+	Action string
+	Number int
+	// Head is the head commit of the pull request.
+	Head     string
+	HeadRef  string
+	BaseRef  string
+	Body     string
+	Merged   bool
+	MergedAt time.Time
+}
+
+// NewPushEventFromGitHub converts the push event of GitHub.
+func NewPushEventFromGitHub(event *github.PushEvent) *PushEvent {
+	return &PushEvent{
+		Repo: &Repository{
+			Provider:      ProviderGitHub,
+			Owner:         ownerOf(event.GetRepo().GetFullName()),
+			Name:          nameOf(event.GetRepo().GetFullName()),
+			CloneURL:      event.GetRepo().GetCloneURL(),
+			DefaultBranch: event.GetRepo().GetDefaultBranch(),
+		},
+		Ref:               event.GetRef(),
+		Before:            event.GetBefore(),
+		After:             event.GetAfter(),
+		HeadCommit:        event.GetHeadCommit().GetID(),
+		HeadCommitMessage: event.GetHeadCommit().GetMessage(),
+		Deleted:           event.GetDeleted(),
+	}
+}
+
+// NewPullRequestEventFromGitHub converts the pull request event of GitHub.
+func NewPullRequestEventFromGitHub(event *github.PullRequestEvent) *PullRequestEvent {
+	pr := event.GetPullRequest()
+	return &PullRequestEvent{
+		Repo: &Repository{
+			Provider:      ProviderGitHub,
+			Owner:         ownerOf(event.GetRepo().GetFullName()),
+			Name:          nameOf(event.GetRepo().GetFullName()),
+			CloneURL:      event.GetRepo().GetCloneURL(),
+			DefaultBranch: event.GetRepo().GetDefaultBranch(),
+		},
+		Action:   event.GetAction(),
+		Number:   pr.GetNumber(),
+		Head:     pr.GetHead().GetSHA(),
+		HeadRef:  pr.GetHead().GetRef(),
+		BaseRef:  pr.GetBase().GetRef(),
+		Body:     pr.GetBody(),
+		Merged:   pr.GetMerged(),
+		MergedAt: pr.GetMergedAt(),
+	}
+}
+
+// providerCloneURL returns the URL of git over HTTPS on the configured provider.
+// The URL in the payload is not used because the payload decides what is built.
+func providerCloneURL(baseURL, fullName string) string {
+	return fmt.Sprintf("%s/%s.git", strings.TrimSuffix(baseURL, "/"), fullName)
+}
+
+// ownerOf returns the owner of the full name. The last element is the name of the repository.
+func ownerOf(fullName string) string {
+	i := strings.LastIndex(fullName, "/")
+	if i == -1 {
+		return ""
+	}
+
+	return fullName[:i]
+}
+
+func nameOf(fullName string) string {
+	return fullName[strings.LastIndex(fullName, "/")+1:]
+}
+
+// isCompletePush returns true if the commits in the payload cover the push.
+// The provider truncates the commits, and the commits are empty on the force push.
+func isCompletePush(before string, commits, totalCommits int) bool {
+	if before == emptyCommit || commits == 0 {
+		return false
+	}
+
+	return totalCommits <= commits
+}
+
+// changedFiles returns the files which are added, removed or modified by the commits without duplication.
+func changedFiles(files ...[]string) []string {
+	seen := make(map[string]struct{})
+	changed := make([]string, 0)
+	for _, v := range files {
+		for _, f := range v {
+			if _, ok := seen[f]; ok {
+				continue
+			}
+			seen[f] = struct{}{}
+			changed = append(changed, f)
+		}
+	}
+
+	return changed
+}
@@ -0,0 +1,229 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+)
+
+const (
+	giteaEventHeader     = "X-Gitea-Event"
+	giteaSignatureHeader = "X-Gitea-Signature"
+)
+
+type giteaRepository struct {
+	FullName      string `json:"full_name"`
+	DefaultBranch string `json:"default_branch"`
+}
+
+func (r *giteaRepository) Repository(baseURL string) *Repository {
+	return &Repository{
+		Provider:      ProviderGitea,
+		Owner:         ownerOf(r.FullName),
+		Name:          nameOf(r.FullName),
+		CloneURL:      providerCloneURL(baseURL, r.FullName),
+		DefaultBranch: r.DefaultBranch,
+	}
+}
+
+type giteaCommit struct {
+	ID       string   `json:"id"`
+	Message  string   `json:"message"`
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	Modified []string `json:"modified"`
+}
+
+type giteaPushEvent struct {
+	Ref          string          `json:"ref"`
+	Before       string          `json:"before"`
+	After        string          `json:"after"`
+	Commits      []giteaCommit   `json:"commits"`
+	TotalCommits int             `json:"total_commits"`
+	HeadCommit   *giteaCommit    `json:"head_commit"`
+	Repository   giteaRepository `json:"repository"`
+}
+
+type giteaPullRequestEvent struct {
+	Action      string `json:"action"`
+	Number      int    `json:"number"`
+	PullRequest struct {
+		Body     string     `json:"body"`
+		Merged   bool       `json:"merged"`
+		MergedAt *time.Time `json:"merged_at"`
+		Head     struct {
+			Ref string `json:"ref"`
+			SHA string `json:"sha"`
+		} `json:"head"`
+		Base struct {
+			Ref string `json:"ref"`
+		} `json:"base"`
+	} `json:"pull_request"`
+	Repository giteaRepository `json:"repository"`
+}
+
+// ParseGiteaWebhook verifies the signature and parses the webhook of Gitea.
+// ParseGiteaWebhook returns nil if the event is not the push or the pull request.
+func ParseGiteaWebhook(req *http.Request, body []byte, conf *config.ProviderConfig) (interface{}, error) {
+	if conf.WebhookSecret == "" {
+		return nil, xerrors.New("gitea: the secret of the webhook is not configured")
+	}
+	mac := hmac.New(sha256.New, []byte(conf.WebhookSecret))
+	mac.Write(body)
+	if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(req.Header.Get(giteaSignatureHeader))) {
+		return nil, xerrors.New("gitea: signature mismatch")
+	}
+
+	switch req.Header.Get(giteaEventHeader) {
+	case "push":
+		event := &giteaPushEvent{}
+		if err := json.Unmarshal(body, event); err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		e := &PushEvent{
+			Repo:    event.Repository.Repository(conf.URL),
+			Ref:     event.Ref,
+			Before:  event.Before,
+			After:   event.After,
+			Deleted: event.After == emptyCommit,
+		}
+		if isCompletePush(event.Before, len(event.Commits), event.TotalCommits) {
+			files := make([][]string, 0)
+			for _, v := range event.Commits {
+				files = append(files, v.Added, v.Removed, v.Modified)
+			}
+			e.Changed = changedFiles(files...)
+		}
+		if event.HeadCommit != nil {
+			e.HeadCommit, e.HeadCommitMessage = event.HeadCommit.ID, event.HeadCommit.Message
+		}
+		return e, nil
+	case "pull_request":
+		event := &giteaPullRequestEvent{}
+		if err := json.Unmarshal(body, event); err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		action := event.Action
+		if action == "synchronized" {
+			action = ActionSynchronize
+		}
+		e := &PullRequestEvent{
+			Repo:    event.Repository.Repository(conf.URL),
+			Action:  action,
+			Number:  event.Number,
+			Head:    event.PullRequest.Head.SHA,
+			HeadRef: event.PullRequest.Head.Ref,
+			BaseRef: event.PullRequest.Base.Ref,
+			Body:    event.PullRequest.Body,
+			Merged:  event.PullRequest.Merged,
+		}
+		if event.PullRequest.MergedAt != nil {
+			e.MergedAt = *event.PullRequest.MergedAt
+		}
+		return e, nil
+	}
+
+	return nil, nil
+}
+
+// giteaClient is the client of the API of Gitea. (e.g. https://gitea.example.com/api/v1)
+type giteaClient struct {
+	*apiClient
+}
+
+var _ Client = &giteaClient{}
+
+// NewGiteaClient returns the client of Gitea. baseURL is the URL of Gitea (e.g. https://gitea.example.com).
+func NewGiteaClient(baseURL, token string) Client {
+	return &giteaClient{apiClient: &apiClient{
+		baseURL:    strings.TrimSuffix(baseURL, "/") + "/api/v1",
+		authHeader: "Authorization",
+		authValue:  "token " + token,
+	}}
+}
+
+func (c *giteaClient) SetStatus(repo *Repository, commit, statusContext, state, description string) error {
+	_, err := c.do(http.MethodPost, fmt.Sprintf("/repos/%s/%s/statuses/%s", repo.Owner, repo.Name, commit), map[string]string{
+		"context":     statusContext,
+		"state":       state,
+		"description": description,
+	})
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	return nil
+}
+
+func (c *giteaClient) CreateComment(repo *Repository, number int, body string) error {
+	_, err := c.do(http.MethodPost, fmt.Sprintf("/repos/%s/%s/issues/%d/comments", repo.Owner, repo.Name, number), map[string]string{"body": body})
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	return nil
+}
+
+func (c *giteaClient) FetchFile(repo *Repository, ref, path string) ([]byte, error) {
+	b, err := c.do(http.MethodGet, fmt.Sprintf("/repos/%s/%s/raw/%s?ref=%s", repo.Owner, repo.Name, escapePath(path), url.QueryEscape(ref)), nil)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	return b, nil
+}
+
+func (c *giteaClient) PullRequestFiles(repo *Repository, number int) ([]string, error) {
+	b, err := c.do(http.MethodGet, fmt.Sprintf("/repos/%s/%s/pulls/%d.diff", repo.Owner, repo.Name, number), nil)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	return filesFromDiff(string(b))
+}
+
+func (c *giteaClient) CompareFiles(repo *Repository, base, head string) ([]string, error) {
+	b, err := c.do(http.MethodGet, fmt.Sprintf("/repos/%s/%s/compare/%s...%s", repo.Owner, repo.Name, url.PathEscape(base), url.PathEscape(head)), nil)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	res := struct {
+		Commits []struct {
+			Files []struct {
+				Filename string `json:"filename"`
+			} `json:"files"`
+		} `json:"commits"`
+	}{}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	files := make([]string, 0)
+	for _, v := range res.Commits {
+		for _, f := range v.Files {
+			files = append(files, f.Filename)
+		}
+	}
+
+	return changedFiles(files), nil
+}
+
+// escapePath escapes each element of the path.
+func escapePath(p string) string {
+	s := strings.Split(p, "/")
+	for i := range s {
+		s[i] = url.PathEscape(s[i])
+	}
+
+	return strings.Join(s, "/")
+}
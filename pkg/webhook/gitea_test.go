@@ -0,0 +1,201 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+)
+
+const giteaPushPayload = `{
+  "ref": "refs/heads/master",
+  "before": "a1",
+  "after": "a2",
+  "commits": [
+    {"id": "a2", "message": "Update records", "added": ["zones/example.net.js"], "removed": [], "modified": ["zones/example.com.js"]},
+    {"id": "a3", "message": "Fix typo", "added": [], "removed": [], "modified": ["zones/example.com.js"]}
+  ],
+  "head_commit": {"id": "a2", "message": "Update records"},
+  "repository": {"full_name": "infra/dns", "clone_url": "https://attacker.example.com/dns.git", "default_branch": "master"}
+}`
+
+var giteaConfig = &config.ProviderConfig{URL: "https://gitea.example.com/", WebhookSecret: "secret"}
+
+func newGiteaRequest(event, payload string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/gitea", strings.NewReader(payload))
+	req.Header.Set(giteaEventHeader, event)
+	mac := hmac.New(sha256.New, []byte(giteaConfig.WebhookSecret))
+	mac.Write([]byte(payload))
+	req.Header.Set(giteaSignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+
+	return req
+}
+
+func TestParseGiteaWebhook(t *testing.T) {
+	req := newGiteaRequest("push", giteaPushPayload)
+	e, err := ParseGiteaWebhook(req, []byte(giteaPushPayload), giteaConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, ok := e.(*PushEvent)
+	if !ok {
+		t.Fatalf("Expect PushEvent: %T", e)
+	}
+	if event.Repo.Provider != ProviderGitea || event.Repo.FullName() != "infra/dns" || event.Repo.DefaultBranch != "master" {
+		t.Errorf("Unexpected repository: %v", event.Repo)
+	}
+	if event.Repo.CloneURL != "https://gitea.example.com/infra/dns.git" {
+		t.Errorf("Expect the clone url of the configured host: %s", event.Repo.CloneURL)
+	}
+	if event.HeadCommit != "a2" || event.HeadCommitMessage != "Update records" {
+		t.Errorf("Unexpected head commit: %s %s", event.HeadCommit, event.HeadCommitMessage)
+	}
+	if !reflect.DeepEqual(event.Changed, []string{"zones/example.net.js", "zones/example.com.js"}) {
+		t.Errorf("Unexpected changed files: %v", event.Changed)
+	}
+
+	// The force push doesn't have the commits
+	forcePush := `{"ref": "refs/heads/master", "before": "a1", "after": "a0", "commits": [], "total_commits": 0, "repository": {"full_name": "infra/dns"}}`
+	e, err = ParseGiteaWebhook(newGiteaRequest("push", forcePush), []byte(forcePush), giteaConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed := e.(*PushEvent).Changed; changed != nil {
+		t.Errorf("Expect unknown changed files: %v", changed)
+	}
+
+	if _, err := ParseGiteaWebhook(req, []byte(giteaPushPayload), &config.ProviderConfig{URL: giteaConfig.URL, WebhookSecret: "other"}); err == nil {
+		t.Error("Expect an error of the signature")
+	}
+	req.Header.Del(giteaSignatureHeader)
+	if _, err := ParseGiteaWebhook(req, []byte(giteaPushPayload), giteaConfig); err == nil {
+		t.Error("Expect an error of the unsigned payload")
+	}
+
+	payload := `{
+  "action": "synchronized",
+  "number": 3,
+  "pull_request": {"body": "Add a record", "merged": false, "head": {"ref": "feature", "sha": "b2"}, "base": {"ref": "master"}},
+  "repository": {"full_name": "infra/dns", "clone_url": "https://gitea.example.com/infra/dns.git"}
+}`
+	e, err = ParseGiteaWebhook(newGiteaRequest("pull_request", payload), []byte(payload), giteaConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, ok := e.(*PullRequestEvent)
+	if !ok {
+		t.Fatalf("Expect PullRequestEvent: %T", e)
+	}
+	if pr.Action != ActionSynchronize || pr.Number != 3 || pr.Head != "b2" || pr.BaseRef != "master" {
+		t.Errorf("Unexpected pull request: %v", pr)
+	}
+
+	if e, err := ParseGiteaWebhook(newGiteaRequest("issues", `{}`), []byte(`{}`), giteaConfig); err != nil || e != nil {
+		t.Errorf("Expect to ignore the event: %v %v", e, err)
+	}
+}
+
+func TestGiteaClient(t *testing.T) {
+	var status map[string]string
+	m := http.NewServeMux()
+	m.HandleFunc("/api/v1/repos/infra/dns/statuses/a2", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "token gitea-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewDecoder(req.Body).Decode(&status)
+		w.WriteHeader(http.StatusCreated)
+	})
+	m.HandleFunc("/api/v1/repos/infra/dns/raw/.bot/build.yaml", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("ref") != "a2" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("target: //:image"))
+	})
+	m.HandleFunc("/api/v1/repos/infra/dns/pulls/3.diff", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("diff --git a/zones/example.com.js b/zones/example.com.js\n--- a/zones/example.com.js\n+++ b/zones/example.com.js\n@@ -1 +1 @@\n-a\n+b\n"))
+	})
+	m.HandleFunc("/api/v1/repos/infra/dns/compare/a1...a2", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"commits": [{"files": [{"filename": "zones/example.com.js"}]}, {"files": [{"filename": "zones/example.com.js"}, {"filename": "README.md"}]}]}`))
+	})
+	s := httptest.NewServer(m)
+	defer s.Close()
+
+	repo := &Repository{Provider: ProviderGitea, Owner: "infra", Name: "dns"}
+	client := NewGiteaClient(s.URL+"/", "gitea-token")
+	if err := client.SetStatus(repo, "a2", "build", StateSuccess, "Build succeeded"); err != nil {
+		t.Fatal(err)
+	}
+	if status["context"] != "build" || status["state"] != StateSuccess {
+		t.Errorf("Unexpected status: %v", status)
+	}
+
+	b, err := client.FetchFile(repo, "a2", ".bot/build.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "target: //:image" {
+		t.Errorf("Unexpected contents: %s", string(b))
+	}
+	if _, err := client.FetchFile(repo, "a1", ".bot/build.yaml"); err == nil {
+		t.Error("Expect an error of not found")
+	}
+
+	files, err := client.PullRequestFiles(repo, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(files, []string{"zones/example.com.js"}) {
+		t.Errorf("Unexpected files: %v", files)
+	}
+
+	files, err = client.CompareFiles(repo, "a1", "a2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(files, []string{"zones/example.com.js", "README.md"}) {
+		t.Errorf("Unexpected files: %v", files)
+	}
+}
+
+func TestListener_Gitea(t *testing.T) {
+	l := &Listener{eventHandler: newEventHandler([]string{"gitea:infra/dns"})}
+	received := make(chan interface{}, 1)
+	l.SubscribePushEvent(func(event interface{}) { received <- event })
+
+	w := httptest.NewRecorder()
+	l.providerHandler(ParseGiteaWebhook, giteaConfig)(w, newGiteaRequest("push", giteaPushPayload))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status: %d", w.Code)
+	}
+	if _, ok := (<-received).(*PushEvent); !ok {
+		t.Error("Expect PushEvent")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/gitea", strings.NewReader(giteaPushPayload))
+	req.Header.Set(giteaEventHeader, "push")
+	w = httptest.NewRecorder()
+	l.providerHandler(ParseGiteaWebhook, giteaConfig)(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expect to reject the unsigned payload: %d", w.Code)
+	}
+
+	// The repository of GitHub which has the same name is not allowed for Gitea
+	l = &Listener{eventHandler: newEventHandler([]string{"infra/dns"})}
+	l.SubscribePushEvent(func(event interface{}) { received <- event })
+	l.providerHandler(ParseGiteaWebhook, giteaConfig)(httptest.NewRecorder(), newGiteaRequest("push", giteaPushPayload))
+	select {
+	case e := <-received:
+		t.Errorf("Expect not to deliver the event: %v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -6,13 +6,17 @@ import (
 	"net/http"
 
 	"github.com/google/go-github/v29/github"
+	"golang.org/x/xerrors"
 
 	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
 )
 
 const (
-	EventTypePush        = "push"
-	EventTypePullRequest = "pull_request"
+	EventTypePush         = "push"
+	EventTypePullRequest  = "pull_request"
+	EventTypeCheckSuite   = "check_suite"
+	EventTypeStatus       = "status"
+	EventTypeIssueComment = "issue_comment"
 )
 
 type subscriber struct {
@@ -23,6 +27,31 @@ type subscriber struct {
 
 type ConsumeFunc func(event interface{})
 
+// EventSource delivers the events of the allowed repositories to the subscribers.
+type EventSource interface {
+	SubscribePushEvent(consume ConsumeFunc)
+	SubscribePullRequest(consume ConsumeFunc)
+	SubscribeCheckSuite(consume ConsumeFunc)
+	SubscribeStatus(consume ConsumeFunc)
+	SubscribeIssueComment(consume ConsumeFunc)
+	// Run blocks until the source is stopped.
+	Run() error
+}
+
+// NewEventSource returns the listener of the webhook or the poller according to the config.
+func NewEventSource(conf *config.Config) (EventSource, error) {
+	switch conf.EventSource {
+	case config.EventSourcePolling:
+		p, err := NewPoller(conf)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		return p, nil
+	default:
+		return NewListener(conf), nil
+	}
+}
+
 type eventHandler struct {
 	allowRepositories map[string]struct{}
 	subscribers       map[string][]*subscriber
@@ -56,25 +85,83 @@ func (e *eventHandler) SubscribePullRequest(consume ConsumeFunc) {
 	e.subscribers[EventTypePullRequest] = append(e.subscribers[EventTypePullRequest], &subscriber{ConsumeFunc: consume})
 }
 
+func (e *eventHandler) SubscribeCheckSuite(consume ConsumeFunc) {
+	if _, ok := e.subscribers[EventTypeCheckSuite]; !ok {
+		e.subscribers[EventTypeCheckSuite] = make([]*subscriber, 0)
+	}
+
+	e.subscribers[EventTypeCheckSuite] = append(e.subscribers[EventTypeCheckSuite], &subscriber{ConsumeFunc: consume})
+}
+
+func (e *eventHandler) SubscribeStatus(consume ConsumeFunc) {
+	if _, ok := e.subscribers[EventTypeStatus]; !ok {
+		e.subscribers[EventTypeStatus] = make([]*subscriber, 0)
+	}
+
+	e.subscribers[EventTypeStatus] = append(e.subscribers[EventTypeStatus], &subscriber{ConsumeFunc: consume})
+}
+
+func (e *eventHandler) SubscribeIssueComment(consume ConsumeFunc) {
+	if _, ok := e.subscribers[EventTypeIssueComment]; !ok {
+		e.subscribers[EventTypeIssueComment] = make([]*subscriber, 0)
+	}
+
+	e.subscribers[EventTypeIssueComment] = append(e.subscribers[EventTypeIssueComment], &subscriber{ConsumeFunc: consume})
+}
+
 func (e *eventHandler) Handle(msg interface{}) {
 	switch event := msg.(type) {
 	case *github.PushEvent:
+		e.Handle(NewPushEventFromGitHub(event))
+	case *github.PullRequestEvent:
+		e.Handle(NewPullRequestEventFromGitHub(event))
+	case *PushEvent:
 		subscribers, ok := e.subscribers[EventTypePush]
 		if !ok {
 			return
 		}
+		if !e.checkWhiteListed(event.Repo.QualifiedName()) {
+			log.Printf("%s is not allowed", event.Repo.QualifiedName())
+			return
+		}
+
+		log.Printf("Push Event: %s (%s)", event.Repo.FullName(), event.Repo.Provider)
+		for _, s := range subscribers {
+			log.Print("Trigger subscriber")
+			go s.ConsumeFunc(event)
+		}
+	case *PullRequestEvent:
+		subscribers, ok := e.subscribers[EventTypePullRequest]
+		if !ok {
+			return
+		}
+		if !e.checkWhiteListed(event.Repo.QualifiedName()) {
+			log.Printf("%s is not allowed", event.Repo.QualifiedName())
+			return
+		}
+
+		log.Printf("PullRequest: %s (%s)", event.Repo.FullName(), event.Repo.Provider)
+		for _, s := range subscribers {
+			log.Print("Trigger subscriber")
+			go s.ConsumeFunc(event)
+		}
+	case *github.CheckSuiteEvent:
+		subscribers, ok := e.subscribers[EventTypeCheckSuite]
+		if !ok {
+			return
+		}
 		if !e.checkWhiteListed(event.GetRepo().GetFullName()) {
 			log.Printf("%s is not allowed", event.GetRepo().GetFullName())
 			return
 		}
 
-		log.Printf("Push Event: %s", event.GetRepo().GetFullName())
+		log.Printf("CheckSuite: %s", event.GetRepo().GetFullName())
 		for _, s := range subscribers {
 			log.Print("Trigger subscriber")
 			go s.ConsumeFunc(event)
 		}
-	case *github.PullRequestEvent:
-		subscribers, ok := e.subscribers[EventTypePullRequest]
+	case *github.StatusEvent:
+		subscribers, ok := e.subscribers[EventTypeStatus]
 		if !ok {
 			return
 		}
@@ -83,7 +170,22 @@ func (e *eventHandler) Handle(msg interface{}) {
 			return
 		}
 
-		log.Printf("PullRequest: %s", event.GetRepo().GetFullName())
+		log.Printf("Status: %s", event.GetRepo().GetFullName())
+		for _, s := range subscribers {
+			log.Print("Trigger subscriber")
+			go s.ConsumeFunc(event)
+		}
+	case *github.IssueCommentEvent:
+		subscribers, ok := e.subscribers[EventTypeIssueComment]
+		if !ok {
+			return
+		}
+		if !e.checkWhiteListed(event.GetRepo().GetFullName()) {
+			log.Printf("%s is not allowed", event.GetRepo().GetFullName())
+			return
+		}
+
+		log.Printf("IssueComment: %s", event.GetRepo().GetFullName())
 		for _, s := range subscribers {
 			log.Print("Trigger subscriber")
 			go s.ConsumeFunc(event)
@@ -99,6 +201,8 @@ func (e *eventHandler) checkWhiteListed(fullName string) bool {
 	return false
 }
 
+// Listener receives the webhooks of GitHub at /github, and Gitea and GitLab at /gitea and /gitlab if they are configured.
+// The push and the pull request of all providers are delivered as PushEvent and PullRequestEvent.
 type Listener struct {
 	*http.Server
 	*eventHandler
@@ -129,6 +233,13 @@ func NewListener(conf *config.Config) *Listener {
 		l.Handle(messageBody)
 	})
 
+	if conf.Gitea != nil {
+		m.HandleFunc("/gitea", l.providerHandler(ParseGiteaWebhook, conf.Gitea))
+	}
+	if conf.GitLab != nil {
+		m.HandleFunc("/gitlab", l.providerHandler(ParseGitLabWebhook, conf.GitLab))
+	}
+
 	s := &http.Server{
 		Addr:    conf.WebhookListener,
 		Handler: m,
@@ -138,3 +249,42 @@ func NewListener(conf *config.Config) *Listener {
 
 	return l
 }
+
+// providerHandler returns the handler of the webhook of the provider except GitHub.
+// The payload which is not signed by the secret of conf is rejected.
+func (l *Listener) providerHandler(parse func(req *http.Request, body []byte, conf *config.ProviderConfig) (interface{}, error), conf *config.ProviderConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		buf, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		req.Body.Close()
+
+		event, err := parse(req, buf, conf)
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if event == nil {
+			return
+		}
+
+		log.Printf("Get event: %s %v", req.URL.Path, event)
+		l.Handle(event)
+	}
+}
+
+func (l *Listener) Run() error {
+	if err := l.ListenAndServe(); err != nil {
+		if err == http.ErrServerClosed {
+			return nil
+		}
+
+		return xerrors.Errorf(": %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,254 @@
+package webhook
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+)
+
+const (
+	gitLabEventHeader = "X-Gitlab-Event"
+	gitLabTokenHeader = "X-Gitlab-Token"
+)
+
+type gitLabProject struct {
+	PathWithNamespace string `json:"path_with_namespace"`
+	DefaultBranch     string `json:"default_branch"`
+}
+
+func (p *gitLabProject) Repository(baseURL string) *Repository {
+	return &Repository{
+		Provider:      ProviderGitLab,
+		Owner:         ownerOf(p.PathWithNamespace),
+		Name:          nameOf(p.PathWithNamespace),
+		CloneURL:      providerCloneURL(baseURL, p.PathWithNamespace),
+		DefaultBranch: p.DefaultBranch,
+	}
+}
+
+type gitLabCommit struct {
+	ID       string   `json:"id"`
+	Message  string   `json:"message"`
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	Modified []string `json:"modified"`
+}
+
+type gitLabPushEvent struct {
+	Ref               string         `json:"ref"`
+	Before            string         `json:"before"`
+	After             string         `json:"after"`
+	CheckoutSHA       string         `json:"checkout_sha"`
+	Commits           []gitLabCommit `json:"commits"`
+	TotalCommitsCount int            `json:"total_commits_count"`
+	Project           gitLabProject  `json:"project"`
+}
+
+type gitLabMergeRequestEvent struct {
+	Project          gitLabProject `json:"project"`
+	ObjectAttributes struct {
+		IID          int    `json:"iid"`
+		Action       string `json:"action"`
+		State        string `json:"state"`
+		Description  string `json:"description"`
+		SourceBranch string `json:"source_branch"`
+		TargetBranch string `json:"target_branch"`
+		OldRev       string `json:"oldrev"`
+		UpdatedAt    string `json:"updated_at"`
+		LastCommit   struct {
+			ID string `json:"id"`
+		} `json:"last_commit"`
+	} `json:"object_attributes"`
+}
+
+// gitLabTimeLayout is the layout of the time in the payload of the webhook.
+const gitLabTimeLayout = "2006-01-02 15:04:05 MST"
+
+// ParseGitLabWebhook verifies the secret token and parses the webhook of GitLab.
+// ParseGitLabWebhook returns nil if the event is not the push or the merge request.
+func ParseGitLabWebhook(req *http.Request, body []byte, conf *config.ProviderConfig) (interface{}, error) {
+	if conf.WebhookSecret == "" {
+		return nil, xerrors.New("gitlab: the secret of the webhook is not configured")
+	}
+	if subtle.ConstantTimeCompare([]byte(conf.WebhookSecret), []byte(req.Header.Get(gitLabTokenHeader))) != 1 {
+		return nil, xerrors.New("gitlab: token mismatch")
+	}
+
+	switch req.Header.Get(gitLabEventHeader) {
+	case "Push Hook", "Tag Push Hook":
+		event := &gitLabPushEvent{}
+		if err := json.Unmarshal(body, event); err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		e := &PushEvent{
+			Repo:       event.Project.Repository(conf.URL),
+			Ref:        event.Ref,
+			Before:     event.Before,
+			After:      event.After,
+			HeadCommit: event.CheckoutSHA,
+			Deleted:    event.After == emptyCommit,
+		}
+		if isCompletePush(event.Before, len(event.Commits), event.TotalCommitsCount) {
+			files := make([][]string, 0)
+			for _, v := range event.Commits {
+				files = append(files, v.Added, v.Removed, v.Modified)
+			}
+			e.Changed = changedFiles(files...)
+		}
+		for _, v := range event.Commits {
+			if v.ID == e.HeadCommit {
+				e.HeadCommitMessage = v.Message
+			}
+		}
+		return e, nil
+	case "Merge Request Hook":
+		event := &gitLabMergeRequestEvent{}
+		if err := json.Unmarshal(body, event); err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		attr := event.ObjectAttributes
+		e := &PullRequestEvent{
+			Repo:    event.Project.Repository(conf.URL),
+			Number:  attr.IID,
+			Head:    attr.LastCommit.ID,
+			HeadRef: attr.SourceBranch,
+			BaseRef: attr.TargetBranch,
+			Body:    attr.Description,
+		}
+		switch attr.Action {
+		case "open":
+			e.Action = ActionOpened
+		case "reopen":
+			e.Action = ActionReopened
+		case "update":
+			// The update without oldrev is the change of the title, the labels, etc.
+			if attr.OldRev == "" {
+				return nil, nil
+			}
+			e.Action = ActionSynchronize
+		case "close":
+			e.Action = ActionClosed
+		case "merge":
+			e.Action = ActionClosed
+			e.Merged = true
+			if t, err := time.Parse(gitLabTimeLayout, attr.UpdatedAt); err == nil {
+				e.MergedAt = t
+			}
+		default:
+			return nil, nil
+		}
+		return e, nil
+	}
+
+	return nil, nil
+}
+
+// gitLabClient is the client of the API of GitLab. (e.g. https://gitlab.example.com/api/v4)
+type gitLabClient struct {
+	*apiClient
+}
+
+var _ Client = &gitLabClient{}
+
+// NewGitLabClient returns the client of GitLab. baseURL is the URL of GitLab (e.g. https://gitlab.example.com).
+func NewGitLabClient(baseURL, token string) Client {
+	return &gitLabClient{apiClient: &apiClient{
+		baseURL:    strings.TrimSuffix(baseURL, "/") + "/api/v4",
+		authHeader: "PRIVATE-TOKEN",
+		authValue:  token,
+	}}
+}
+
+func (c *gitLabClient) SetStatus(repo *Repository, commit, statusContext, state, description string) error {
+	switch state {
+	case StateFailure, StateError:
+		state = "failed"
+	}
+	_, err := c.do(http.MethodPost, fmt.Sprintf("/projects/%s/statuses/%s", projectID(repo), commit), map[string]string{
+		"name":        statusContext,
+		"state":       state,
+		"description": description,
+	})
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	return nil
+}
+
+func (c *gitLabClient) CreateComment(repo *Repository, number int, body string) error {
+	_, err := c.do(http.MethodPost, fmt.Sprintf("/projects/%s/merge_requests/%d/notes", projectID(repo), number), map[string]string{"body": body})
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	return nil
+}
+
+func (c *gitLabClient) FetchFile(repo *Repository, ref, path string) ([]byte, error) {
+	b, err := c.do(http.MethodGet, fmt.Sprintf("/projects/%s/repository/files/%s/raw?ref=%s", projectID(repo), url.PathEscape(path), url.QueryEscape(ref)), nil)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	return b, nil
+}
+
+func (c *gitLabClient) PullRequestFiles(repo *Repository, number int) ([]string, error) {
+	b, err := c.do(http.MethodGet, fmt.Sprintf("/projects/%s/merge_requests/%d/changes", projectID(repo), number), nil)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	res := struct {
+		Changes []struct {
+			OldPath string `json:"old_path"`
+			NewPath string `json:"new_path"`
+		} `json:"changes"`
+	}{}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	files := make([]string, 0, len(res.Changes)*2)
+	for _, v := range res.Changes {
+		files = append(files, v.NewPath, v.OldPath)
+	}
+
+	return changedFiles(files), nil
+}
+
+func (c *gitLabClient) CompareFiles(repo *Repository, base, head string) ([]string, error) {
+	b, err := c.do(http.MethodGet, fmt.Sprintf("/projects/%s/repository/compare?from=%s&to=%s", projectID(repo), url.QueryEscape(base), url.QueryEscape(head)), nil)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	res := struct {
+		Diffs []struct {
+			OldPath string `json:"old_path"`
+			NewPath string `json:"new_path"`
+		} `json:"diffs"`
+	}{}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	files := make([]string, 0, len(res.Diffs)*2)
+	for _, v := range res.Diffs {
+		files = append(files, v.NewPath, v.OldPath)
+	}
+
+	return changedFiles(files), nil
+}
+
+// projectID returns the URL-encoded path of the project which the API accepts as the id.
+func projectID(repo *Repository) string {
+	return url.PathEscape(repo.FullName())
+}
@@ -0,0 +1,188 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+)
+
+func TestParseGitLabWebhook(t *testing.T) {
+	payload := `{
+  "ref": "refs/tags/v1.0.0",
+  "before": "0000000000000000000000000000000000000000",
+  "after": "t1",
+  "checkout_sha": "a2",
+  "commits": [{"id": "a2", "message": "Release v1.0.0", "added": [], "removed": [], "modified": ["main.go"]}],
+  "project": {"path_with_namespace": "infra/tools/app", "git_http_url": "https://attacker.example.com/app.git", "default_branch": "main"}
+}`
+	conf := &config.ProviderConfig{URL: "https://gitlab.example.com", WebhookSecret: "secret"}
+	req := httptest.NewRequest(http.MethodPost, "/gitlab", nil)
+	req.Header.Set(gitLabEventHeader, "Tag Push Hook")
+	req.Header.Set(gitLabTokenHeader, "secret")
+
+	e, err := ParseGitLabWebhook(req, []byte(payload), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, ok := e.(*PushEvent)
+	if !ok {
+		t.Fatalf("Expect PushEvent: %T", e)
+	}
+	if event.Repo.Owner != "infra/tools" || event.Repo.Name != "app" || event.Repo.Provider != ProviderGitLab {
+		t.Errorf("Unexpected repository: %v", event.Repo)
+	}
+	if event.Repo.CloneURL != "https://gitlab.example.com/infra/tools/app.git" {
+		t.Errorf("Expect the clone url of the configured host: %s", event.Repo.CloneURL)
+	}
+	if event.HeadCommit != "a2" || event.HeadCommitMessage != "Release v1.0.0" {
+		t.Errorf("Unexpected head commit: %s %s", event.HeadCommit, event.HeadCommitMessage)
+	}
+	// The commits of the new tag are not the changes of the tag
+	if event.Changed != nil {
+		t.Errorf("Expect unknown changed files: %v", event.Changed)
+	}
+
+	push := func(totalCommits string) string {
+		return `{
+  "ref": "refs/heads/main", "before": "a1", "after": "a2", "checkout_sha": "a2", "total_commits_count": ` + totalCommits + `,
+  "commits": [{"id": "a2", "message": "Fix", "added": [], "removed": [], "modified": ["main.go"]}],
+  "project": {"path_with_namespace": "infra/tools/app", "default_branch": "main"}
+}`
+	}
+	req.Header.Set(gitLabEventHeader, "Push Hook")
+	e, err = ParseGitLabWebhook(req, []byte(push("1")), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed := e.(*PushEvent).Changed; !reflect.DeepEqual(changed, []string{"main.go"}) {
+		t.Errorf("Unexpected changed files: %v", changed)
+	}
+	// The commits are truncated
+	e, err = ParseGitLabWebhook(req, []byte(push("25")), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed := e.(*PushEvent).Changed; changed != nil {
+		t.Errorf("Expect unknown changed files: %v", changed)
+	}
+
+	req.Header.Set(gitLabTokenHeader, "other")
+	if _, err := ParseGitLabWebhook(req, []byte(payload), conf); err == nil {
+		t.Error("Expect an error of the token")
+	}
+
+	mergeRequest := func(action, oldRev string) string {
+		return `{
+  "project": {"path_with_namespace": "infra/dns", "git_http_url": "https://gitlab.example.com/infra/dns.git"},
+  "object_attributes": {"iid": 5, "action": "` + action + `", "oldrev": "` + oldRev + `", "source_branch": "feature", "target_branch": "main",
+    "updated_at": "2020-03-01 10:00:00 UTC", "last_commit": {"id": "b2"}}
+}`
+	}
+	req = httptest.NewRequest(http.MethodPost, "/gitlab", nil)
+	req.Header.Set(gitLabEventHeader, "Merge Request Hook")
+	req.Header.Set(gitLabTokenHeader, "secret")
+
+	e, err = ParseGitLabWebhook(req, []byte(mergeRequest("merge", "")), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, ok := e.(*PullRequestEvent)
+	if !ok {
+		t.Fatalf("Expect PullRequestEvent: %T", e)
+	}
+	if pr.Action != ActionClosed || !pr.Merged || pr.MergedAt.IsZero() || pr.Number != 5 || pr.Head != "b2" {
+		t.Errorf("Unexpected merge request: %v", pr)
+	}
+
+	e, err = ParseGitLabWebhook(req, []byte(mergeRequest("update", "b1")), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr, ok := e.(*PullRequestEvent); !ok || pr.Action != ActionSynchronize {
+		t.Errorf("Expect synchronize: %v", e)
+	}
+
+	// The update of the title doesn't have oldrev
+	e, err = ParseGitLabWebhook(req, []byte(mergeRequest("update", "")), conf)
+	if err != nil || e != nil {
+		t.Errorf("Expect to ignore the event: %v %v", e, err)
+	}
+}
+
+func TestGitLabClient(t *testing.T) {
+	var status, note map[string]string
+	m := http.NewServeMux()
+	m.HandleFunc("/api/v4/projects/", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("PRIVATE-TOKEN") != "gitlab-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch req.URL.EscapedPath() {
+		case "/api/v4/projects/infra%2Fdns/statuses/a2":
+			json.NewDecoder(req.Body).Decode(&status)
+			w.WriteHeader(http.StatusCreated)
+		case "/api/v4/projects/infra%2Fdns/merge_requests/5/notes":
+			json.NewDecoder(req.Body).Decode(&note)
+			w.WriteHeader(http.StatusCreated)
+		case "/api/v4/projects/infra%2Fdns/repository/files/.bot%2Fdnscontrol.yaml/raw":
+			w.Write([]byte("dir: /zones"))
+		case "/api/v4/projects/infra%2Fdns/merge_requests/5/changes":
+			w.Write([]byte(`{"changes": [{"old_path": "zones/old.js", "new_path": "zones/new.js"}, {"old_path": "README.md", "new_path": "README.md"}]}`))
+		case "/api/v4/projects/infra%2Fdns/repository/compare":
+			if req.URL.Query().Get("from") != "a1" || req.URL.Query().Get("to") != "a2" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"diffs": [{"old_path": "zones/example.com.js", "new_path": "zones/example.com.js"}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	s := httptest.NewServer(m)
+	defer s.Close()
+
+	repo := &Repository{Provider: ProviderGitLab, Owner: "infra", Name: "dns"}
+	client := NewGitLabClient(s.URL, "gitlab-token")
+	if err := client.SetStatus(repo, "a2", "preview", StateFailure, "Run dry-run"); err != nil {
+		t.Fatal(err)
+	}
+	if status["name"] != "preview" || status["state"] != "failed" {
+		t.Errorf("Unexpected status: %v", status)
+	}
+
+	if err := client.CreateComment(repo, 5, "Preview"); err != nil {
+		t.Fatal(err)
+	}
+	if note["body"] != "Preview" {
+		t.Errorf("Unexpected note: %v", note)
+	}
+
+	b, err := client.FetchFile(repo, "a2", ".bot/dnscontrol.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "dir: /zones" {
+		t.Errorf("Unexpected contents: %s", string(b))
+	}
+
+	files, err := client.PullRequestFiles(repo, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(files, []string{"zones/new.js", "zones/old.js", "README.md"}) {
+		t.Errorf("Unexpected files: %v", files)
+	}
+
+	files, err = client.CompareFiles(repo, "a1", "a2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(files, []string{"zones/example.com.js"}) {
+		t.Errorf("Unexpected files: %v", files)
+	}
+}
@@ -0,0 +1,491 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v29/github"
+	"golang.org/x/xerrors"
+
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/config"
+	"github.com/f110/k8s-cluster-maintenance-bot/pkg/githost"
+)
+
+const (
+	branchRefPrefix = "refs/heads/"
+	tagRefPrefix    = "refs/tags/"
+	emptyCommit     = "0000000000000000000000000000000000000000"
+)
+
+// repositoryState is the snapshot of the repository at the previous poll.
+type repositoryState struct {
+	Branches map[string]string
+	Tags     map[string]string
+	// PullRequests are the head commits of the open pull requests. The closed pull request has empty.
+	PullRequests map[int]string
+	// PullRequestsSince is the latest updated time of the pull requests which are read.
+	PullRequestsSince time.Time
+	// CommentsSince is the time of the latest issue comment which is delivered.
+	CommentsSince time.Time
+	LastComment   int64
+	// Checks are the states of the checks of the head commits of the open pull requests.
+	Checks map[string]string
+}
+
+type refUpdate struct {
+	Ref    string
+	Before string
+	After  string
+}
+
+// Poller polls the API of GitHub instead of receiving the webhook.
+// Poller delivers the push, the pull request and the issue comment.
+// The status event and the check suite event are delivered when the checks of the head of the open pull request are changed.
+// The first poll of each repository is the baseline. The changes before the baseline are not delivered.
+type Poller struct {
+	*eventHandler
+	Repositories []string
+	Interval     time.Duration
+
+	// client sends the conditional requests
+	client *github.Client
+	// commitClient fetches the commits without the cache because the commits are never changed
+	commitClient *github.Client
+
+	mu     sync.Mutex
+	states map[string]*repositoryState
+	// baseline is the time of the first poll. The pull request which is closed before baseline is ignored.
+	baseline time.Time
+}
+
+func NewPoller(conf *config.Config) (*Poller, error) {
+	host, err := githost.FromConfig(conf)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	t, err := host.NewTransport(conf.GitHubAppId, conf.GitHubInstallationId, conf.GitHubAppPrivateKeyFile)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+
+	return &Poller{
+		eventHandler: newEventHandler(conf.AllowRepositories),
+		Repositories: conf.GitHubRepositories(),
+		Interval:     conf.PollingIntervalDuration,
+		client:       host.NewClient(&http.Client{Transport: newETagTransport(t)}),
+		commitClient: host.NewClient(&http.Client{Transport: t}),
+		states:       make(map[string]*repositoryState),
+	}, nil
+}
+
+// Run polls the repositories at the interval. Run never returns.
+func (p *Poller) Run() error {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	for {
+		p.Poll()
+		<-ticker.C
+	}
+}
+
+// Poll checks all repositories once.
+func (p *Poller) Poll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.baseline.IsZero() {
+		p.baseline = time.Now()
+	}
+	for _, v := range p.Repositories {
+		if err := p.poll(v); err != nil {
+			log.Printf("%+v", err)
+		}
+	}
+}
+
+func (p *Poller) poll(repository string) error {
+	s := strings.SplitN(repository, "/", 2)
+	if len(s) != 2 {
+		return xerrors.Errorf("invalid repository name: %s", repository)
+	}
+	owner, repo := s[0], s[1]
+
+	branches, err := p.listBranches(owner, repo)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	tags, err := p.listTags(owner, repo)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	state, ok := p.states[repository]
+	if !ok {
+		state = &repositoryState{PullRequests: make(map[int]string)}
+	}
+	if state.PullRequestsSince.IsZero() {
+		state.PullRequestsSince = p.baseline
+	}
+	pulls, err := p.listPullRequests(owner, repo, state.PullRequestsSince)
+	if err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+	p.states[repository] = state
+
+	var updates []refUpdate
+	if ok {
+		updates = append(diffRefs(state.Branches, branches, branchRefPrefix), diffRefs(state.Tags, tags, tagRefPrefix)...)
+	}
+	for _, v := range updates {
+		event, err := p.newPushEvent(owner, repo, v)
+		if err != nil {
+			// The ref is kept as the previous poll so that the update is delivered at the next poll
+			log.Printf("%+v", xerrors.Errorf(": %v", err))
+			if strings.HasPrefix(v.Ref, tagRefPrefix) {
+				restoreRef(tags, state.Tags, strings.TrimPrefix(v.Ref, tagRefPrefix))
+			} else {
+				restoreRef(branches, state.Branches, strings.TrimPrefix(v.Ref, branchRefPrefix))
+			}
+			continue
+		}
+		p.Handle(event)
+	}
+	state.Branches, state.Tags = branches, tags
+
+	for _, v := range pulls {
+		if v.GetUpdatedAt().After(state.PullRequestsSince) {
+			state.PullRequestsSince = v.GetUpdatedAt()
+		}
+	}
+	events := pullRequestEvents(state.PullRequests, pulls, p.baseline)
+	if ok {
+		for _, v := range events {
+			v.Repo = repositoryOf(owner, repo)
+			p.Handle(v)
+		}
+	}
+
+	p.pollChecks(owner, repo, state, pulls, ok)
+	if err := p.pollComments(owner, repo, state); err != nil {
+		return xerrors.Errorf(": %v", err)
+	}
+
+	return nil
+}
+
+// listPullRequests returns all open pull requests and the pull requests which are updated since the time.
+// The closed pull requests are read until the pull request which is older than since.
+func (p *Poller) listPullRequests(owner, repo string, since time.Time) ([]*github.PullRequest, error) {
+	pulls := make(map[int]*github.PullRequest)
+	openOpt := &github.PullRequestListOptions{State: "open", ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		list, res, err := p.client.PullRequests.List(context.Background(), owner, repo, openOpt)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		for _, v := range list {
+			pulls[v.GetNumber()] = v
+		}
+		if res.NextPage == 0 {
+			break
+		}
+		openOpt.Page = res.NextPage
+	}
+
+	opt := &github.PullRequestListOptions{
+		State:       "all",
+		Sort:        "updated",
+		Direction:   "desc",
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+Pages:
+	for {
+		list, res, err := p.client.PullRequests.List(context.Background(), owner, repo, opt)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		for _, v := range list {
+			if v.GetUpdatedAt().Before(since) {
+				break Pages
+			}
+			pulls[v.GetNumber()] = v
+		}
+		if res.NextPage == 0 {
+			break
+		}
+		opt.Page = res.NextPage
+	}
+
+	result := make([]*github.PullRequest, 0, len(pulls))
+	for _, v := range pulls {
+		result = append(result, v)
+	}
+
+	return result, nil
+}
+
+// pollComments delivers the issue comments which are created since the previous poll.
+func (p *Poller) pollComments(owner, repo string, state *repositoryState) error {
+	if state.CommentsSince.IsZero() {
+		state.CommentsSince = p.baseline
+	}
+	since := state.CommentsSince
+	opt := &github.IssueListCommentsOptions{
+		Sort:        github.String("created"),
+		Direction:   github.String("asc"),
+		Since:       &since,
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	comments := make([]*github.IssueComment, 0)
+	for {
+		c, res, err := p.client.Issues.ListComments(context.Background(), owner, repo, 0, opt)
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+		comments = append(comments, c...)
+		if res.NextPage == 0 {
+			break
+		}
+		opt.Page = res.NextPage
+	}
+	sort.Slice(comments, func(i, j int) bool { return comments[i].GetID() < comments[j].GetID() })
+
+	for _, v := range comments {
+		// since is compared with the updated time. The edited comments are also listed.
+		if v.GetID() <= state.LastComment {
+			continue
+		}
+		number, err := strconv.Atoi(path.Base(v.GetIssueURL()))
+		if err != nil {
+			return xerrors.Errorf("invalid issue url: %s", v.GetIssueURL())
+		}
+		issue, _, err := p.commitClient.Issues.Get(context.Background(), owner, repo, number)
+		if err != nil {
+			return xerrors.Errorf(": %v", err)
+		}
+
+		p.Handle(&github.IssueCommentEvent{
+			Action:  github.String("created"),
+			Issue:   issue,
+			Comment: v,
+			Repo:    repositoryOf(owner, repo),
+		})
+		state.LastComment, state.CommentsSince = v.GetID(), v.GetCreatedAt()
+	}
+
+	return nil
+}
+
+// pollChecks delivers the event when the checks of the head of the open pull request are changed.
+// The event is the trigger of AutoMergeConsumer which reads the statuses and the check runs by itself.
+// If deliver is false, pollChecks only records the current checks.
+func (p *Poller) pollChecks(owner, repo string, state *repositoryState, pulls []*github.PullRequest, deliver bool) {
+	checks := make(map[string]string)
+	for _, v := range pulls {
+		if v.GetState() != "open" {
+			continue
+		}
+		sha := v.GetHead().GetSHA()
+
+		status, _, err := p.client.Repositories.GetCombinedStatus(context.Background(), owner, repo, sha, nil)
+		if err != nil {
+			log.Printf("%+v", xerrors.Errorf(": %v", err))
+			if prev, ok := state.Checks[sha]; ok {
+				checks[sha] = prev
+			}
+			continue
+		}
+		suites, _, err := p.client.Checks.ListCheckSuitesForRef(context.Background(), owner, repo, sha, nil)
+		if err != nil {
+			log.Printf("%+v", xerrors.Errorf(": %v", err))
+			if prev, ok := state.Checks[sha]; ok {
+				checks[sha] = prev
+			}
+			continue
+		}
+		completed := len(suites.CheckSuites) > 0
+		for _, s := range suites.CheckSuites {
+			if s.GetStatus() != "completed" {
+				completed = false
+			}
+		}
+		checks[sha] = fmt.Sprintf("%s:%t", status.GetState(), completed)
+		if !deliver || state.Checks[sha] == checks[sha] {
+			continue
+		}
+
+		switch {
+		case completed:
+			p.Handle(&github.CheckSuiteEvent{
+				Action:     github.String("completed"),
+				CheckSuite: &github.CheckSuite{HeadSHA: github.String(sha)},
+				Repo:       repositoryOf(owner, repo),
+			})
+		case status.GetState() == "success":
+			p.Handle(&github.StatusEvent{
+				SHA:   github.String(sha),
+				State: github.String("success"),
+				Repo:  repositoryOf(owner, repo),
+			})
+		}
+	}
+	state.Checks = checks
+}
+
+func repositoryOf(owner, repo string) *github.Repository {
+	return &github.Repository{
+		Owner:    &github.User{Login: github.String(owner)},
+		Name:     github.String(repo),
+		FullName: github.String(fmt.Sprintf("%s/%s", owner, repo)),
+	}
+}
+
+func (p *Poller) newPushEvent(owner, repo string, update refUpdate) (*github.PushEvent, error) {
+	event := &github.PushEvent{
+		Ref:     github.String(update.Ref),
+		Before:  github.String(update.Before),
+		After:   github.String(update.After),
+		Created: github.Bool(update.Before == emptyCommit),
+		Deleted: github.Bool(update.After == emptyCommit),
+		Repo: &github.PushEventRepository{
+			Owner:    &github.User{Name: github.String(owner), Login: github.String(owner)},
+			Name:     github.String(repo),
+			FullName: github.String(fmt.Sprintf("%s/%s", owner, repo)),
+		},
+	}
+	if update.After == emptyCommit {
+		return event, nil
+	}
+
+	commit, _, err := p.commitClient.Git.GetCommit(context.Background(), owner, repo, update.After)
+	if err != nil {
+		return nil, xerrors.Errorf(": %v", err)
+	}
+	event.HeadCommit = &github.PushEventCommit{ID: github.String(update.After), Message: github.String(commit.GetMessage())}
+
+	return event, nil
+}
+
+func (p *Poller) listBranches(owner, repo string) (map[string]string, error) {
+	branches := make(map[string]string)
+	opt := &github.BranchListOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		b, res, err := p.client.Repositories.ListBranches(context.Background(), owner, repo, opt)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		for _, v := range b {
+			branches[v.GetName()] = v.GetCommit().GetSHA()
+		}
+		if res.NextPage == 0 {
+			break
+		}
+		opt.Page = res.NextPage
+	}
+
+	return branches, nil
+}
+
+func (p *Poller) listTags(owner, repo string) (map[string]string, error) {
+	tags := make(map[string]string)
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		t, res, err := p.client.Repositories.ListTags(context.Background(), owner, repo, opt)
+		if err != nil {
+			return nil, xerrors.Errorf(": %v", err)
+		}
+		for _, v := range t {
+			tags[v.GetName()] = v.GetCommit().GetSHA()
+		}
+		if res.NextPage == 0 {
+			break
+		}
+		opt.Page = res.NextPage
+	}
+
+	return tags, nil
+}
+
+// diffRefs returns the refs which are created, updated or deleted. The result is sorted by the ref.
+func diffRefs(before, after map[string]string, prefix string) []refUpdate {
+	updates := make([]refUpdate, 0)
+	for name, sha := range after {
+		if before[name] == sha {
+			continue
+		}
+		old := before[name]
+		if old == "" {
+			old = emptyCommit
+		}
+		updates = append(updates, refUpdate{Ref: prefix + name, Before: old, After: sha})
+	}
+	for name, sha := range before {
+		if _, ok := after[name]; !ok {
+			updates = append(updates, refUpdate{Ref: prefix + name, Before: sha, After: emptyCommit})
+		}
+	}
+	sort.Slice(updates, func(i, j int) bool { return updates[i].Ref < updates[j].Ref })
+
+	return updates
+}
+
+// restoreRef sets the ref of current back to previous.
+func restoreRef(current, previous map[string]string, name string) {
+	if sha, ok := previous[name]; ok {
+		current[name] = sha
+		return
+	}
+	delete(current, name)
+}
+
+// pullRequestEvents returns the events of the pull requests which are changed since the previous poll, and updates known.
+// known is the head commit of the open pull requests and empty for the closed pull requests.
+func pullRequestEvents(known map[int]string, pulls []*github.PullRequest, baseline time.Time) []*github.PullRequestEvent {
+	sort.Slice(pulls, func(i, j int) bool { return pulls[i].GetNumber() < pulls[j].GetNumber() })
+
+	events := make([]*github.PullRequestEvent, 0)
+	for _, v := range pulls {
+		head := ""
+		if v.GetState() == "open" {
+			head = v.GetHead().GetSHA()
+		}
+		prev, ok := known[v.GetNumber()]
+		known[v.GetNumber()] = head
+
+		action := ""
+		switch {
+		case !ok && head != "":
+			action = "opened"
+		case !ok && v.GetClosedAt().After(baseline):
+			action = "closed"
+		case ok && prev == head:
+		case ok && prev != "" && head == "":
+			action = "closed"
+		case ok && prev == "":
+			action = "reopened"
+		case ok:
+			action = "synchronize"
+		}
+		if action == "" {
+			continue
+		}
+
+		// The list API doesn't have merged
+		v.Merged = github.Bool(v.MergedAt != nil)
+		events = append(events, &github.PullRequestEvent{
+			Action:      github.String(action),
+			Number:      v.Number,
+			PullRequest: v,
+		})
+	}
+
+	return events
+}
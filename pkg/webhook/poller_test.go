@@ -0,0 +1,208 @@
+package webhook
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v29/github"
+)
+
+func TestDiffRefs(t *testing.T) {
+	before := map[string]string{"master": "a1", "feature": "b1", "old": "c1"}
+	after := map[string]string{"master": "a2", "feature": "b1", "new": "d1"}
+
+	got := diffRefs(before, after, branchRefPrefix)
+	expect := []refUpdate{
+		{Ref: "refs/heads/master", Before: "a1", After: "a2"},
+		{Ref: "refs/heads/new", Before: emptyCommit, After: "d1"},
+		{Ref: "refs/heads/old", Before: "c1", After: emptyCommit},
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Unexpected updates: %v", got)
+	}
+}
+
+func TestPullRequestEvents(t *testing.T) {
+	baseline := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	pullRequest := func(number int, state, head string, closedAt, mergedAt *time.Time) *github.PullRequest {
+		return &github.PullRequest{
+			Number:   github.Int(number),
+			State:    github.String(state),
+			Head:     &github.PullRequestBranch{SHA: github.String(head)},
+			ClosedAt: closedAt,
+			MergedAt: mergedAt,
+		}
+	}
+	before := baseline.Add(-time.Hour)
+	after := baseline.Add(time.Hour)
+
+	known := map[int]string{1: "a1", 2: "b1", 3: "", 4: "d1", 5: ""}
+	pulls := []*github.PullRequest{
+		pullRequest(1, "open", "a1", nil, nil),
+		pullRequest(2, "open", "b2", nil, nil),
+		pullRequest(3, "open", "c1", nil, nil),
+		pullRequest(4, "closed", "d1", &after, &after),
+		pullRequest(5, "closed", "e1", &before, nil),
+		pullRequest(6, "open", "f1", nil, nil),
+		pullRequest(7, "closed", "g1", &after, nil),
+		pullRequest(8, "closed", "h1", &before, &before),
+	}
+
+	events := pullRequestEvents(known, pulls, baseline)
+	got := make(map[int]string)
+	for _, v := range events {
+		got[v.GetPullRequest().GetNumber()] = v.GetAction()
+	}
+	expect := map[int]string{2: "synchronize", 3: "reopened", 4: "closed", 6: "opened", 7: "closed"}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Unexpected actions: %v", got)
+	}
+	for _, v := range events {
+		if v.GetPullRequest().GetNumber() == 4 && !v.GetPullRequest().GetMerged() {
+			t.Error("Expect #4 is merged")
+		}
+	}
+	if known[2] != "b2" || known[4] != "" || known[8] != "" {
+		t.Errorf("Unexpected known: %v", known)
+	}
+
+	if events := pullRequestEvents(known, pulls, baseline); len(events) != 0 {
+		t.Errorf("Expect no events for the same pull requests: %d", len(events))
+	}
+}
+
+func TestPoller_Poll(t *testing.T) {
+	branches := `[{"name": "master", "commit": {"sha": "a1"}}, {"name": "feature", "commit": {"sha": "b1"}}]`
+	missing := ""
+	m := http.NewServeMux()
+	m.HandleFunc("/repos/f110/bot/branches", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(branches))
+	})
+	m.HandleFunc("/repos/f110/bot/tags", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`[]`))
+	})
+	m.HandleFunc("/repos/f110/bot/pulls", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`[{"number": 3, "state": "open", "head": {"sha": "c1"}}]`))
+	})
+	checkSuite := "in_progress"
+	m.HandleFunc("/repos/f110/bot/commits/c1/status", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"state": "pending"}`))
+	})
+	m.HandleFunc("/repos/f110/bot/commits/c1/check-suites", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"total_count": 1, "check_suites": [{"status": "` + checkSuite + `"}]}`))
+	})
+	comments := `[]`
+	m.HandleFunc("/repos/f110/bot/issues/comments", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(comments))
+	})
+	m.HandleFunc("/repos/f110/bot/issues/3", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"number": 3, "pull_request": {"url": "https://api.github.com/repos/f110/bot/pulls/3"}}`))
+	})
+	m.HandleFunc("/repos/f110/bot/git/commits/", func(w http.ResponseWriter, req *http.Request) {
+		sha := path.Base(req.URL.Path)
+		if sha == missing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"sha": "` + sha + `", "message": "Update"}`))
+	})
+	s := httptest.NewServer(m)
+	defer s.Close()
+
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(s.URL + "/")
+	p := &Poller{
+		eventHandler: newEventHandler([]string{"f110/bot"}),
+		Repositories: []string{"f110/bot"},
+		client:       client,
+		commitClient: client,
+		states:       make(map[string]*repositoryState),
+	}
+	received := make(chan *PushEvent, 2)
+	p.SubscribePushEvent(func(event interface{}) { received <- event.(*PushEvent) })
+	commented := make(chan *github.IssueCommentEvent, 2)
+	p.SubscribeIssueComment(func(event interface{}) { commented <- event.(*github.IssueCommentEvent) })
+	checked := make(chan *github.CheckSuiteEvent, 2)
+	p.SubscribeCheckSuite(func(event interface{}) { checked <- event.(*github.CheckSuiteEvent) })
+
+	p.Poll()
+	branches = `[{"name": "master", "commit": {"sha": "a2"}}, {"name": "feature", "commit": {"sha": "b2"}}]`
+	missing = "b2"
+	p.Poll()
+	if e := <-received; e.Ref != "refs/heads/master" || e.After != "a2" {
+		t.Errorf("Unexpected event: %v", e)
+	}
+	if sha := p.states["f110/bot"].Branches["feature"]; sha != "b1" {
+		t.Fatalf("Expect the branch which is not delivered is kept: %s", sha)
+	}
+
+	missing = ""
+	checkSuite = "completed"
+	comments = `[{"id": 10, "body": "/promote", "issue_url": "https://api.github.com/repos/f110/bot/issues/3", "created_at": "2020-03-01T00:00:00Z"}]`
+	p.Poll()
+	if e := <-received; e.Ref != "refs/heads/feature" || e.Before != "b1" || e.After != "b2" {
+		t.Errorf("Expect the update is delivered at the next poll: %v", e)
+	}
+	if e := <-checked; e.GetCheckSuite().GetHeadSHA() != "c1" {
+		t.Errorf("Unexpected check suite event: %v", e)
+	}
+	if e := <-commented; e.GetComment().GetBody() != "/promote" || !e.GetIssue().IsPullRequest() || e.GetIssue().GetNumber() != 3 {
+		t.Errorf("Unexpected issue comment event: %v", e)
+	}
+
+	// The comment and the checks which are delivered are not delivered again
+	p.Poll()
+	select {
+	case e := <-commented:
+		t.Errorf("Expect not to deliver the comment again: %v", e)
+	case e := <-checked:
+		t.Errorf("Expect not to deliver the check suite again: %v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPoller_listPullRequests(t *testing.T) {
+	m := http.NewServeMux()
+	m.HandleFunc("/repos/f110/bot/pulls", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("state") == "open" {
+			w.Write([]byte(`[{"number": 1, "state": "open", "updated_at": "2020-03-01T00:00:00Z"}]`))
+			return
+		}
+		switch req.URL.Query().Get("page") {
+		case "", "1":
+			w.Header().Set("Link", `<`+req.URL.Path+`?page=2>; rel="next"`)
+			w.Write([]byte(`[{"number": 5, "state": "closed", "updated_at": "2020-03-02T10:00:00Z"}, {"number": 4, "state": "open", "updated_at": "2020-03-02T09:00:00Z"}]`))
+		case "2":
+			w.Header().Set("Link", `<`+req.URL.Path+`?page=3>; rel="next"`)
+			w.Write([]byte(`[{"number": 3, "state": "closed", "updated_at": "2020-03-02T08:00:00Z"}, {"number": 2, "state": "closed", "updated_at": "2020-03-02T07:00:00Z"}]`))
+		default:
+			t.Errorf("Expect not to read the page which is older than the previous poll: %s", req.URL.String())
+			w.Write([]byte(`[]`))
+		}
+	})
+	s := httptest.NewServer(m)
+	defer s.Close()
+
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(s.URL + "/")
+	p := &Poller{client: client}
+
+	pulls, err := p.listPullRequests("f110", "bot", time.Date(2020, 3, 2, 8, 30, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	numbers := make([]int, 0)
+	for _, v := range pulls {
+		numbers = append(numbers, v.GetNumber())
+	}
+	sort.Ints(numbers)
+	if !reflect.DeepEqual(numbers, []int{1, 4, 5}) {
+		t.Errorf("Unexpected pull requests: %v", numbers)
+	}
+}